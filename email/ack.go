@@ -0,0 +1,74 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// ackToken returns the signature of the alert key with the secret.
+func ackToken(secret, alert string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(alert))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyAckToken reports whether the token of an ack link is the signature
+// of the alert key with the secret (ack_secret).
+func VerifyAckToken(secret, alert, token string) bool {
+	return hmac.Equal([]byte(ackToken(secret, alert)), []byte(token))
+}
+
+// AckHandler is the companion handler of the ack links: it calls ack with
+// the alert key of the links (GET, or RFC 8058 one-click POST) having
+// a valid token, and answers 403 Forbidden to the others.
+func AckHandler(secret string, ack func(alert string) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alert, token := r.FormValue("alert"), r.FormValue("token")
+		if alert == "" || !VerifyAckToken(secret, alert, token) {
+			http.Error(w, "bad ack token", http.StatusForbidden)
+			return
+		}
+		if err := ack(alert); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("acknowledged\n"))
+	})
+}
+
+// ackLink returns the signed ack link of the message's alert
+// (see conditionKey), or "" if ack links are off.
+func (o *EmailOutput) ackLink(msg *message.Message) string {
+	if o.ackBaseURL == "" {
+		return ""
+	}
+	alert := conditionKey(msg)
+	sep := "?"
+	if strings.Contains(o.ackBaseURL, "?") {
+		sep = "&"
+	}
+	return o.ackBaseURL + sep + "alert=" + url.QueryEscape(alert) +
+		"&token=" + ackToken(o.ackSecret, alert)
+}
+
+// ackHeaders returns the one-click List-Unsubscribe headers of the ack link.
+func ackHeaders(link string) []string {
+	return []string{"List-Unsubscribe: <" + link + ">", "List-Unsubscribe-Post: List-Unsubscribe=One-Click"}
+}
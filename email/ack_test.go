@@ -0,0 +1,93 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAckLink(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.AckBaseURL, conf.AckSecret = "https://ack.example.com/ack", "s3cret"
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	email, err := mail.ReadMessage(bytes.NewReader(o.formatMessage(newTestMessage(2, "db-01", "down"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := email.Header.Get("List-Unsubscribe")
+	if !strings.HasPrefix(header, "<https://ack.example.com/ack?alert=") || !strings.HasSuffix(header, ">") {
+		t.Fatalf("got List-Unsubscribe %q", header)
+	}
+	if got := email.Header.Get("List-Unsubscribe-Post"); got != "List-Unsubscribe=One-Click" {
+		t.Errorf("got List-Unsubscribe-Post %q", got)
+	}
+	link := strings.Trim(header, "<>")
+	var body bytes.Buffer
+	body.ReadFrom(email.Body)
+	if !strings.Contains(body.String(), "Acknowledge: "+link) {
+		t.Errorf("the link is missing from the body %q", body.String())
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alert, token := u.Query().Get("alert"), u.Query().Get("token")
+	if alert != "logger:test" {
+		t.Errorf("got alert %q", alert)
+	}
+	if !VerifyAckToken("s3cret", alert, token) {
+		t.Error("the token does not verify")
+	}
+	tampered := []byte(token)
+	tampered[0] ^= 1
+	if VerifyAckToken("s3cret", "logger:other", token) || VerifyAckToken("other", alert, token) ||
+		VerifyAckToken("s3cret", alert, string(tampered)) {
+		t.Error("tampered token verifies")
+	}
+
+	var acked []string
+	h := AckHandler("s3cret", func(alert string) error { acked = append(acked, alert); return nil })
+	for _, tc := range []struct {
+		query string
+		code  int
+	}{
+		{u.RawQuery, http.StatusOK},
+		{"alert=logger:other&token=" + token, http.StatusForbidden},
+		{"alert=" + url.QueryEscape(alert), http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/ack?"+tc.query, strings.NewReader("List-Unsubscribe=One-Click")))
+		if w.Code != tc.code {
+			t.Errorf("%s: got %d, wanted %d", tc.query, w.Code, tc.code)
+		}
+	}
+	if len(acked) != 1 || acked[0] != alert {
+		t.Errorf("got acks %q", acked)
+	}
+
+	conf.AckSecret = ""
+	if err := new(EmailOutput).Init(conf); err == nil {
+		t.Error("wanted error for ack_base_url without ack_secret")
+	}
+}
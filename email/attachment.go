@@ -0,0 +1,202 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+const (
+	// defaultAttachmentName is used when there is no usable name
+	defaultAttachmentName = "payload"
+	// defaultAttachmentExt is appended to the names without an extension
+	defaultAttachmentExt = ".txt"
+	// maxFilenameLen is the maximal length of an attachment's name, in bytes
+	maxFilenameLen = 100
+)
+
+// attachmentName returns the filename of the payload attachment,
+// from the field (or the logger, if field is "Logger") of the message,
+// or payload.txt.
+func attachmentName(msg *message.Message, field string) string {
+	var name string
+	switch field {
+	case "":
+	case "Logger":
+		name = msg.GetLogger()
+	default:
+		if v, ok := msg.GetFieldValue(field); ok {
+			name = fmt.Sprint(v)
+		}
+	}
+	return sanitizeFilename(name)
+}
+
+// sanitizeFilename returns the name usable as an attachment's filename:
+// without the directories, control and reserved characters, leading dots,
+// at most maxFilenameLen bytes long and with an extension.
+func sanitizeFilename(name string) string {
+	name = path.Base(strings.Replace(name, `\`, "/", -1))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(strings.TrimLeft(name, ". "))
+	if name == "" {
+		name = defaultAttachmentName
+	}
+	ext := path.Ext(name)
+	if ext == "" || ext == "." || len(ext) > 10 {
+		ext = defaultAttachmentExt
+		name = strings.TrimRight(name, ".") + ext
+	}
+	if len(name) > maxFilenameLen {
+		base := name[:maxFilenameLen-len(ext)]
+		for !utf8.ValidString(base) {
+			base = base[:len(base)-1]
+		}
+		name = base + ext
+	}
+	return name
+}
+
+// payloadFile returns the payload of the message to be attached: gzipped if
+// it is longer than gzip_threshold, as is with attach_payload; nil if it
+// is to be inline.
+func (o *EmailOutput) payloadFile(msg *message.Message) *attachment {
+	gzipped := o.gzipThreshold > 0 && len(o.payload(msg)) > o.gzipThreshold
+	if !o.attachPayload && !gzipped {
+		return nil
+	}
+	a := o.payloadAttachment(msg)
+	if gzipped {
+		data, err := gzipFile(a.name, a.data)
+		if err != nil {
+			o.logError(fmt.Errorf("compressing the payload: %s", err))
+			return &a
+		}
+		name := defaultAttachmentName + ".gz"
+		if o.attachName != nil {
+			name = a.name + ".gz"
+		}
+		a = attachment{name: name, contentType: "application/gzip", data: data}
+	}
+	return &a
+}
+
+// gzipFile returns the data gzipped, as the file name.
+func gzipFile(name string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Name = name
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// payloadAttachment returns the payload of the message as an attachment,
+// named by attachment_filename.
+func (o *EmailOutput) payloadAttachment(msg *message.Message) attachment {
+	var name string
+	if o.attachName != nil {
+		var buf bytes.Buffer
+		if err := o.attachName.Execute(&buf, o.templateData(msg)); err != nil {
+			o.logError(fmt.Errorf("executing the attachment_filename template: %s", err))
+		} else {
+			name = buf.String()
+		}
+	}
+	a := attachment{name: sanitizeFilename(name), contentType: o.attachType, data: []byte(o.payload(msg))}
+	if a.contentType == "" {
+		a.contentType = attachmentContentType(a.name)
+	}
+	return a
+}
+
+// attachmentSummary returns the text of the email of the message whose
+// payload is attached as name: the body template, or the subject.
+func (o *EmailOutput) attachmentSummary(msg *message.Message, name string) string {
+	if o.bodyTmpl != nil {
+		text, err := o.executeBody(msg)
+		if err == nil {
+			return text
+		}
+		o.logError(fmt.Errorf("executing the body template: %s", err))
+	}
+	return o.subject(msg) + "\r\n\r\nThe payload is attached as " + name + ".\r\n"
+}
+
+// attachment is a file attached to an email.
+type attachment struct {
+	name, contentType string
+	data              []byte
+}
+
+// withAttachments returns the multipart/mixed text of the email with the
+// text inline, then the attachments base64 encoded, and its MIME headers.
+func withAttachments(text string, attachments ...attachment) (string, []string, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	part.Write([]byte(text))
+	for _, a := range attachments {
+		contentType := a.contentType
+		if mediaType, params, err := mime.ParseMediaType(contentType); err == nil {
+			params["name"] = a.name
+			contentType = mime.FormatMediaType(mediaType, params)
+		}
+		if part, err = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.name})},
+		}); err != nil {
+			return "", nil, err
+		}
+		part.Write([]byte(base64Lines(a.data) + "\r\n"))
+	}
+	if err = mw.Close(); err != nil {
+		return "", nil, err
+	}
+	return buf.String(), []string{"MIME-Version: 1.0",
+		fmt.Sprintf("Content-Type: multipart/mixed; boundary=%q", mw.Boundary())}, nil
+}
+
+// attachmentContentType returns the content type of the attachment by its
+// name's extension, application/octet-stream if unknown.
+func attachmentContentType(name string) string {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,182 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	for i, tc := range []struct {
+		in, want string
+	}{
+		{"", "payload.txt"},
+		{"../../etc/passwd", "passwd.txt"},
+		{`..\..\windows\win.ini`, "win.ini"},
+		{"..", "payload.txt"},
+		{".hidden", "hidden.txt"},
+		{"disk\x00full\r\n.log", "diskfull.log"},
+		{`a<b>c:d"e|f?g*h.csv`, "abcdefgh.csv"},
+		{"report.", "report.txt"},
+		{strings.Repeat("é", 80) + ".log", strings.Repeat("é", 48) + ".log"},
+	} {
+		if got := sanitizeFilename(tc.in); got != tc.want {
+			t.Errorf("%d. %q: got %q, wanted %q", i, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestAttachmentName(t *testing.T) {
+	msg := newTestMessage(3, "db-01", "disk full")
+	msg.SetLogger("../cron/backup")
+	f, _ := message.NewField("file", "/var/log/app\x1b[31m.log", "")
+	msg.AddField(f)
+	for field, want := range map[string]string{
+		"":        "payload.txt",
+		"Logger":  "backup.txt",
+		"file":    "app[31m.log",
+		"missing": "payload.txt",
+	} {
+		if got := attachmentName(msg, field); got != want {
+			t.Errorf("%q: got %q, wanted %q", field, got, want)
+		}
+	}
+}
+
+func TestAttachPayload(t *testing.T) {
+	const payload = `{"disk": "/var", "used": "99%"}`
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.AttachPayload, conf.AttachmentFilename = true, "{{.Logger}}-{{.Hostname}}.json"
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(o.formatMessage(newTestMessage(3, "db-01", payload))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, _ := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if mediaType != "multipart/mixed" {
+		t.Fatalf("got Content-Type %q", m.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	p, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, _ := ioutil.ReadAll(p)
+	if want := "2013-11-12T13:14:15Z [3] test@db-01: " + payload + "\r\n\r\nThe payload is attached as test-db-01.json.\r\n"; string(summary) != want {
+		t.Errorf("got summary %q, wanted %q", summary, want)
+	}
+	if p, err = mr.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+	if p.FileName() != "test-db-01.json" || !strings.HasPrefix(p.Header.Get("Content-Type"), "application/json") {
+		t.Errorf("got attachment %q of %q", p.FileName(), p.Header.Get("Content-Type"))
+	}
+	data, _ := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, p))
+	if string(data) != payload {
+		t.Errorf("got attached %q", data)
+	}
+
+	// the body template is the summary, the content type is configurable
+	conf.BodyTemplate, conf.AttachmentFilename, conf.AttachmentContentType = "disk full on {{.Hostname}}", "", "text/x-log"
+	if err = o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	email := string(o.formatMessage(newTestMessage(3, "db-01", payload)))
+	for _, want := range []string{"\r\n\r\ndisk full on db-01\r\n", "Content-Type: text/x-log; name=payload.txt\r\n",
+		"Content-Disposition: attachment; filename=payload.txt\r\n"} {
+		if !strings.Contains(email, want) {
+			t.Errorf("no %q in\n%s", want, email)
+		}
+	}
+
+	conf.AttachmentFilename = "{{.Logger"
+	if err = new(EmailOutput).Init(conf); err == nil || !strings.Contains(err.Error(), "attachment_filename") {
+		t.Errorf("got %v, wanted the attachment_filename error", err)
+	}
+	conf.AttachmentFilename, conf.BodyTemplate, conf.BodyFormat = "", "", "json"
+	if err = new(EmailOutput).Init(conf); err == nil {
+		t.Error("both body_format and attach_payload accepted")
+	}
+}
+
+func TestGzipThreshold(t *testing.T) {
+	long := strings.Repeat("disk full on /var ", 100)
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.GzipThreshold = 100
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	// attachment returns the name and the (decoded) data of the attachment of the email
+	attachment := func(email []byte) (string, string, []byte) {
+		m, err := mail.ReadMessage(bytes.NewReader(email))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, params, _ := mime.ParseMediaType(m.Header.Get("Content-Type"))
+		mr := multipart.NewReader(m.Body, params["boundary"])
+		if _, err = mr.NextPart(); err != nil {
+			t.Fatalf("not multipart: %v\n%s", err, email)
+		}
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, p))
+		return p.FileName(), p.Header.Get("Content-Type"), data
+	}
+
+	if email := o.formatMessage(newTestMessage(3, "db-01", "disk full")); !bytes.HasSuffix(email, []byte("\r\n\r\ndisk full")) {
+		t.Errorf("a short payload is not inline:\n%s", email)
+	}
+	name, contentType, data := attachment(o.formatMessage(newTestMessage(3, "db-01", long)))
+	if name != "payload.gz" || contentType != "application/gzip; name=payload.gz" {
+		t.Errorf("got %q of %q", name, contentType)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unzipped, _ := ioutil.ReadAll(zr); string(unzipped) != long || zr.Name != "payload.txt" {
+		t.Errorf("got %q (%d bytes) gzipped", zr.Name, len(unzipped))
+	}
+
+	// with attach_payload, the short payloads are attached as is
+	conf.AttachPayload, conf.AttachmentFilename = true, "{{.Hostname}}.log"
+	if err = o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	if name, _, data = attachment(o.formatMessage(newTestMessage(3, "db-01", "disk full"))); name != "db-01.log" || string(data) != "disk full" {
+		t.Errorf("got %q: %q", name, data)
+	}
+	if name, _, _ = attachment(o.formatMessage(newTestMessage(3, "db-01", long))); name != "db-01.log.gz" {
+		t.Errorf("got %q", name)
+	}
+
+	conf.GzipThreshold = -1
+	if err = new(EmailOutput).Init(conf); err == nil || !strings.Contains(err.Error(), "gzip_threshold") {
+		t.Errorf("got %v, wanted the gzip_threshold error", err)
+	}
+}
@@ -0,0 +1,172 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// newAuth returns the smtp.Auth of the mechanism ("plain", "login", "cram-md5"
+// or "xoauth2", case-insensitively) with the credentials, for the server at host.
+// The password of xoauth2 is the OAuth2 access token.
+func newAuth(mechanism, username, password, host string) (smtp.Auth, error) {
+	switch strings.ToLower(mechanism) {
+	case "", "plain":
+		return smtp.PlainAuth("", username, password, host), nil
+	case "login":
+		return &loginAuth{username: username, password: password, host: host}, nil
+	case "cram-md5":
+		return smtp.CRAMMD5Auth(username, password), nil
+	case "xoauth2":
+		return &xoauth2Auth{username: username, token: password, host: host}, nil
+	}
+	return nil, fmt.Errorf("unsupported auth mechanism %q", mechanism)
+}
+
+// xoauth2Auth implements the XOAUTH2 mechanism (of Gmail and Office 365)
+// with an OAuth2 bearer token. Like smtp.PlainAuth, it sends the token
+// only over TLS or to localhost.
+type xoauth2Auth struct {
+	username, token, host string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// Next aborts the exchange on the (JSON) error challenge of the server.
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return nil, fmt.Errorf("XOAUTH2 rejected: %s", fromServer)
+	}
+	return nil, nil
+}
+
+// loginAuth implements the LOGIN mechanism (of older Exchange servers
+// not offering PLAIN). It sends the credentials only over TLS, even to localhost.
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch prompt := strings.ToLower(string(fromServer)); {
+	case strings.HasPrefix(prompt, "username"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "password"):
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+// bannerAuth selects the auth mechanism by the greeting and EHLO response
+// of the server, for relay pools mixing different servers behind one address.
+type bannerAuth struct {
+	rules              []bannerRule
+	username, password string
+}
+
+type bannerRule struct {
+	re        *regexp.Regexp
+	mechanism string
+}
+
+// newBannerAuth returns the bannerAuth of the regexp -> mechanism map,
+// trying the patterns in lexical order.
+func newBannerAuth(byBanner map[string]string, username, password string) (*bannerAuth, error) {
+	patterns := make([]string, 0, len(byBanner))
+	for pattern := range byBanner {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	ba := &bannerAuth{rules: make([]bannerRule, len(patterns)), username: username, password: password}
+	for i, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad auth_by_banner pattern %q: %s", pattern, err)
+		}
+		if _, err = newAuth(byBanner[pattern], username, password, ""); err != nil {
+			return nil, err
+		}
+		ba.rules[i] = bannerRule{re: re, mechanism: byBanner[pattern]}
+	}
+	return ba, nil
+}
+
+// Auth returns the auth for the server at host with the banner,
+// or nil if no pattern matches it.
+func (ba *bannerAuth) Auth(banner, host string) smtp.Auth {
+	for _, rule := range ba.rules {
+		if rule.re.MatchString(banner) {
+			auth, _ := newAuth(rule.mechanism, ba.username, ba.password, host)
+			return auth
+		}
+	}
+	return nil
+}
+
+// bannerConn records what is read from the connection till Banner is called,
+// to catch the greeting and the EHLO response of the server.
+type bannerConn struct {
+	net.Conn
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	done bool
+}
+
+func (c *bannerConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	if !c.done && c.buf.Len() < 4096 {
+		c.buf.Write(p[:n])
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+// Banner stops the recording, and returns what has been recorded.
+func (c *bannerConn) Banner() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done = true
+	return c.buf.String()
+}
@@ -0,0 +1,201 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tgulacsi/heka-plugins/email/testutil"
+)
+
+func TestAuthByBanner(t *testing.T) {
+	for _, tc := range []struct {
+		greeting, ext, want string
+	}{
+		{"mail.example.com Microsoft ESMTP MAIL Service ready", "AUTH LOGIN", "AUTH LOGIN"},
+		{"mail.example.com ESMTP Postfix", "AUTH PLAIN LOGIN", "AUTH PLAIN"},
+		{"mail.example.com ESMTP Exim", "AUTH PLAIN LOGIN", "AUTH PLAIN"},
+	} {
+		srv := testutil.NewFakeSMTP("STARTTLS", tc.ext)
+		srv.Greeting = tc.greeting
+		srv.Users = map[string]string{"heka": "s3cret"}
+		if err := srv.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+
+		o := new(EmailOutput)
+		conf := o.ConfigStruct().(*EmailOutputConfig)
+		conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+		conf.Username, conf.Password, conf.NoCertCheck = "heka", "s3cret", true
+		conf.AuthByBanner = map[string]string{"Microsoft ESMTP": "login", "(?i)postfix": "plain"}
+		if err := o.Init(conf); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err != nil {
+			t.Errorf("%s: %v", tc.greeting, err)
+			continue
+		}
+		if got := findCommand(srv.Commands(), "AUTH "); len(got) < len(tc.want) || got[:len(tc.want)] != tc.want {
+			t.Errorf("%s: got %q, wanted %s", tc.greeting, got, tc.want)
+		}
+		if msgs := srv.Messages(); len(msgs) != 1 || msgs[0].User != "heka" {
+			t.Errorf("%s: wanted a message sent by heka, got %+v", tc.greeting, msgs)
+		}
+	}
+
+	conf := &EmailOutputConfig{Address: "localhost", AuthByBanner: map[string]string{"Exchange": "ntlm"}}
+	if err := new(EmailOutput).Init(conf); err == nil {
+		t.Error("wanted error for an unsupported mechanism")
+	}
+}
+
+func TestAuthRequiredAtMail(t *testing.T) {
+	srv := testutil.NewFakeSMTP() // not advertising AUTH
+	srv.Users = map[string]string{"heka": "s3cret"}
+	const required = "530 5.7.0 Authentication required"
+	srv.Reply("MAIL FROM", required, testutil.Pass, required, testutil.Pass, required)
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.Username, conf.Password = "heka", "s3cret"
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err != nil {
+		t.Fatal(err)
+	}
+	var verbs []string
+	for _, cmd := range srv.Commands() {
+		if verb := strings.Fields(cmd)[0]; verb == "MAIL" || verb == "AUTH" {
+			verbs = append(verbs, verb)
+		}
+	}
+	if got, want := strings.Join(verbs, " "), "MAIL AUTH MAIL MAIL AUTH MAIL"; got != want {
+		t.Errorf("got %s, wanted %s", got, want)
+	}
+	if msgs := srv.Messages(); len(msgs) != 1 || msgs[0].User != "heka" {
+		t.Errorf("wanted a message sent by heka, got %+v", msgs)
+	}
+
+	// without credentials, the 530 is the result
+	conf.Username, conf.Password = "", ""
+	if err := o.Init(conf); err == nil || !strings.HasPrefix(err.Error(), "530") {
+		t.Errorf("got %v, wanted the 530 error", err)
+	}
+}
+
+func TestXOAuth2(t *testing.T) {
+	srv := testutil.NewFakeSMTP("AUTH XOAUTH2")
+	srv.Users = map[string]string{"heka@example.com": "ya29.token"}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("ya29.token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.AuthMechanism, conf.Username, conf.TokenFile = "xoauth2", "heka@example.com", tokenFile
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := srv.Messages(); len(msgs) != 1 || msgs[0].User != "heka@example.com" {
+		t.Errorf("wanted a message sent by heka@example.com, got %+v", msgs)
+	}
+
+	// the error challenge of a bad token aborts the exchange
+	conf.TokenFile, conf.Token = "", "expired"
+	if err := o.Init(conf); err == nil || !strings.Contains(err.Error(), "XOAUTH2 rejected") {
+		t.Errorf("got %v, wanted the rejection", err)
+	}
+	if cmds := srv.Commands(); !strings.HasPrefix(cmds[len(cmds)-2], "AUTH XOAUTH2") || cmds[len(cmds)-1] != "QUIT" {
+		t.Errorf("the exchange is not aborted: %q", cmds)
+	}
+
+	conf.Token = ""
+	if err := o.Init(conf); err == nil {
+		t.Error("wanted error without a token")
+	}
+	conf.AuthMechanism, conf.Token = "ntlm", "x"
+	if err := o.Init(conf); err == nil {
+		t.Error("wanted error for an unsupported mechanism")
+	}
+}
+
+func TestAuthMechanism(t *testing.T) {
+	srv := testutil.NewFakeSMTP("STARTTLS", "AUTH PLAIN LOGIN CRAM-MD5")
+	srv.Users = map[string]string{"heka": "s3cret"}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	for _, mechanism := range []string{"plain", "LOGIN", "cram-md5"} {
+		o := new(EmailOutput)
+		conf := o.ConfigStruct().(*EmailOutputConfig)
+		conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+		conf.AuthMechanism, conf.Username, conf.Password = mechanism, "heka", "s3cret"
+		conf.NoCertCheck = true
+		if err := o.Init(conf); err != nil {
+			t.Fatalf("%s: %v", mechanism, err)
+		}
+		if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err != nil {
+			t.Errorf("%s: %v", mechanism, err)
+			continue
+		}
+		cmds := srv.Commands() // the last session is EHLO STARTTLS EHLO AUTH MAIL RCPT DATA QUIT
+		if got, want := findCommand(cmds[len(cmds)-8:], "AUTH "), "AUTH "+strings.ToUpper(mechanism); !strings.HasPrefix(got, want) {
+			t.Errorf("got %q, wanted %s", got, want)
+		}
+	}
+	if msgs := srv.Messages(); len(msgs) != 3 || msgs[2].User != "heka" {
+		t.Errorf("wanted 3 messages sent by heka, got %+v", msgs)
+	}
+
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.AuthMechanism, conf.Username, conf.Password = "cram-md5", "heka", "wrong"
+	conf.NoCertCheck = true
+	if err := o.Init(conf); err == nil || !strings.HasPrefix(err.Error(), "535") {
+		t.Errorf("got %v, wanted the 535 error for the wrong password", err)
+	}
+	// LOGIN sends the password only over TLS, even to localhost
+	plain := startFakeSMTP(t, "AUTH LOGIN")
+	conf.Address, conf.AuthMechanism, conf.Password = plain.Addr(), "login", "s3cret"
+	if err := o.Init(conf); err == nil || !strings.Contains(err.Error(), "unencrypted connection") {
+		t.Errorf("got %v, wanted the unencrypted connection error", err)
+	}
+	if cmd := findCommand(plain.Commands(), "AUTH"); cmd != "" {
+		t.Errorf("got %q over plain text", cmd)
+	}
+	conf.AuthMechanism = "digest-md5"
+	if err := o.Init(conf); err == nil || !strings.Contains(err.Error(), "auth_mechanism") {
+		t.Errorf("got %v, wanted the auth_mechanism error", err)
+	}
+}
@@ -0,0 +1,199 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// batchDelimiter separates the messages in a batched email.
+const batchDelimiter = "----------------------------------------"
+
+// BatchConfig configures the batching of messages into one email:
+// the batch is sent when any of the limits is reached.
+type BatchConfig struct {
+	// MaxCount is the maximal number of messages in one email.
+	MaxCount int `toml:"max_count"`
+	// MaxBytes is the maximal size of the payloads in one email.
+	MaxBytes int `toml:"max_bytes"`
+	// FlushInterval is the maximal time (e.g. "1m") a message waits in the batch.
+	FlushInterval string `toml:"flush_interval"`
+	// SeparateMessages sends the messages of the batch as separate emails
+	// (MX mode only, without coalesce_recipients), over one connection
+	// per recipient domain.
+	SeparateMessages bool `toml:"separate_messages"`
+}
+
+// batchLimits are the parsed BatchConfig.
+type batchLimits struct {
+	maxCount, maxBytes int
+	flushInterval      time.Duration
+	separate           bool
+}
+
+func (bl batchLimits) enabled() bool {
+	return bl.maxCount > 0 || bl.maxBytes > 0 || bl.flushInterval > 0
+}
+
+// full reports whether a batch of count messages with size bytes of payload must be sent.
+func (bl batchLimits) full(count, size int) bool {
+	return bl.maxCount > 0 && count >= bl.maxCount ||
+		bl.maxBytes > 0 && size >= bl.maxBytes
+}
+
+// messageSize returns the (approximate) memory size of the message:
+// the size of its strings, byte slices and field values.
+func messageSize(msg *message.Message) int {
+	n := len(msg.GetUuid()) + len(msg.GetType()) + len(msg.GetLogger()) +
+		len(msg.GetPayload()) + len(msg.GetEnvVersion()) + len(msg.GetHostname()) +
+		16 // the timestamp, severity and pid
+	for _, f := range msg.GetFields() {
+		n += len(f.GetName()) + len(f.GetRepresentation())
+		for _, v := range f.GetValueString() {
+			n += len(v)
+		}
+		for _, v := range f.GetValueBytes() {
+			n += len(v)
+		}
+		n += 8*(len(f.GetValueInteger())+len(f.GetValueDouble())) + len(f.GetValueBool())
+	}
+	return n
+}
+
+// severityNames are the short names of the syslog severities.
+var severityNames = [...]string{"emerg", "alert", "crit", "err", "warn", "notice", "info", "debug"}
+
+// severityName returns the short name of the syslog severity.
+func severityName(severity int32) string {
+	if severity >= 0 && int(severity) < len(severityNames) {
+		return severityNames[severity]
+	}
+	return fmt.Sprintf("severity%d", severity)
+}
+
+// batchSummaryLine returns a one-line summary of the batch, such as
+// "5 messages: 2 crit, 3 warn from web-01,web-02".
+func (o *EmailOutput) batchSummaryLine(msgs []*message.Message) string {
+	counts := make(map[int32]int, len(severityNames))
+	hosts := make(map[string]struct{}, len(msgs))
+	for _, msg := range msgs {
+		counts[o.severity(msg)]++
+		hosts[msg.GetHostname()] = struct{}{}
+	}
+	severities := make([]int, 0, len(counts))
+	for sev := range counts {
+		severities = append(severities, int(sev))
+	}
+	sort.Ints(severities)
+	parts := make([]string, len(severities))
+	for i, sev := range severities {
+		parts[i] = fmt.Sprintf("%d %s", counts[int32(sev)], severityName(int32(sev)))
+	}
+	hostNames := make([]string, 0, len(hosts))
+	for host := range hosts {
+		hostNames = append(hostNames, host)
+	}
+	sort.Strings(hostNames)
+	noun := "messages"
+	if len(msgs) == 1 {
+		noun = "message"
+	}
+	return fmt.Sprintf("%d %s: %s from %s", len(msgs), noun,
+		strings.Join(parts, ", "), strings.Join(hostNames, ","))
+}
+
+// formatBatch returns the email for the batch of messages: the subject is
+// that of the first message, and each message gets its own header line.
+func (o *EmailOutput) formatBatch(msgs []*message.Message) []byte {
+	suppressed := suppressedBefore(msgs...)
+	if len(msgs) == 1 {
+		if suppressed > 0 {
+			return withSubjectSuffix(o.formatMessage(msgs[0]), duplicatesNote(suppressed))
+		}
+		return o.formatMessage(msgs[0])
+	}
+	subject := fmt.Sprintf("%s (+%d more)%s", o.subject(msgs[0]), len(msgs)-1, duplicatesNote(suppressed))
+	text := bytes.NewBuffer(make([]byte, 0, 1024))
+	if o.batchSummary {
+		text.WriteString(o.batchSummaryLine(msgs))
+		text.WriteString("\r\n\r\n")
+	}
+	for _, msg := range msgs {
+		text.WriteString(batchDelimiter + "\r\n")
+		text.WriteString(strings.TrimSuffix(o.messageHeader(msg), ": "))
+		text.WriteString(duplicatesNote(suppressedBefore(msg)))
+		text.WriteString("\r\n")
+		text.WriteString(o.payload(msg))
+		text.WriteString("\r\n")
+		text.WriteString(o.runbookText(msg.GetPayload()))
+	}
+	if o.compressDigest {
+		body, headers, err := compressedDigest(o.digestOverview(msgs), text.Bytes())
+		if err == nil {
+			return o.email(subject, body, append(headers, o.priorityHeaders(o.mostSevere(msgs))...)...)
+		}
+		o.logError(fmt.Errorf("compressing the digest: %s", err))
+	}
+	return o.email(subject, text.String(), o.priorityHeaders(o.mostSevere(msgs))...)
+}
+
+// deliverSeparately sends the messages of the batch as separate emails,
+// each as if it came alone, streamed over the pooled connection of each
+// recipient domain (with RSET between the transactions). The connections
+// are quit after the batch, unless reuse_connections.
+func (o *EmailOutput) deliverSeparately(msgs []*message.Message, msgLoopCount uint) {
+	for _, msg := range msgs {
+		for _, e := range o.messageEmails(msg) {
+			if suppressed := suppressedBefore(msg); suppressed > 0 {
+				e.body = withSubjectSuffix(e.body, duplicatesNote(suppressed))
+			}
+			o.deliverLogged(e.body, e.env, msgLoopCount)
+		}
+	}
+	if o.batchPool {
+		o.pool.Close()
+	}
+}
+
+// digestOverview returns the inline summary of the compressed digest:
+// the batch summary, and one line per message.
+func (o *EmailOutput) digestOverview(msgs []*message.Message) string {
+	var buf bytes.Buffer
+	buf.WriteString(o.batchSummaryLine(msgs))
+	buf.WriteString("\r\n\r\n")
+	for _, msg := range msgs {
+		buf.WriteString(o.messageHeader(msg))
+		buf.WriteString(o.subjectPayload(o.payload(msg)))
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("\r\nThe full digest is attached as " + digestFilename + ".\r\n")
+	return buf.String()
+}
+
+// digestFilename is the name of the compressed digest attachment.
+const digestFilename = "digest.txt.gz"
+
+// compressedDigest returns the multipart/mixed text of the email with the
+// overview inline and the gzipped digest attached, and its MIME headers.
+func compressedDigest(overview string, digest []byte) (string, []string, error) {
+	gz, err := gzipFile(strings.TrimSuffix(digestFilename, ".gz"), digest)
+	if err != nil {
+		return "", nil, err
+	}
+	return withAttachments(overview, attachment{name: digestFilename, contentType: "application/gzip", data: gz})
+}
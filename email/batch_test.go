@@ -0,0 +1,482 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/tgulacsi/heka-plugins/email/testutil"
+)
+
+func TestBatchSummary(t *testing.T) {
+	msgs := []*message.Message{
+		newTestMessage(4, "web-02", "slow"),
+		newTestMessage(2, "web-01", "down"),
+		newTestMessage(4, "web-01", "slow"),
+		newTestMessage(2, "web-02", "down"),
+		newTestMessage(4, "web-01", "slow"),
+	}
+	want := "5 messages: 2 crit, 3 warn from web-01,web-02"
+	o := new(EmailOutput)
+	if got := o.batchSummaryLine(msgs); got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+	if got, want := o.batchSummaryLine(msgs[:1]), "1 message: 1 warn from web-02"; got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+func TestRunBatchSummary(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"},
+		hostport: srv.Addr(), batch: batchLimits{maxCount: 3}, batchSummary: true}
+	runner := newTestRunner()
+	for _, msg := range []*message.Message{
+		newTestMessage(2, "db-01", "replication broken"),
+		newTestMessage(3, "web-01", "500 on /"),
+		newTestMessage(3, "web-01", "500 on /login"),
+		newTestMessage(6, "web-02", "restarted"),
+	} {
+		runner.send(msg)
+	}
+	close(runner.inChan)
+	if err := o.Run(runner, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := srv.Messages()
+	if len(msgs) != 2 {
+		t.Fatalf("got %d emails, wanted 2 (a full batch and the rest at close)", len(msgs))
+	}
+	data := string(msgs[0].Data)
+	if !strings.Contains(data, "\r\n\r\n3 messages: 1 crit, 2 err from db-01,web-01\r\n") {
+		t.Errorf("summary is missing from\n%s", data)
+	}
+	if n := strings.Count(data, batchDelimiter); n != 3 {
+		t.Errorf("got %d messages in the batch, wanted 3", n)
+	}
+	if i, j := strings.Index(data, "messages:"), strings.Index(data, batchDelimiter); i > j {
+		t.Error("the summary is not before the messages")
+	}
+	if data = string(msgs[1].Data); strings.Contains(data, "messages:") || !strings.Contains(data, "restarted") {
+		t.Errorf("a single message should be sent as is, got\n%s", data)
+	}
+}
+
+func TestImmediateSeverity(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"},
+		hostport: srv.Addr(), batch: batchLimits{maxCount: 10},
+		immediate: true, immediateSeverity: 2, emitReceipt: true}
+	runner := newTestRunner()
+	runner.sendLooped(newTestMessage(4, "web-01", "slow response"), 3)
+	runner.sendLooped(newTestMessage(2, "db-01", "replication broken"), 0)
+	runner.sendLooped(newTestMessage(6, "web-02", "restarted"), 1)
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+	// the receipts of the crit and of the batch, with the greatest loop count of the batch
+	runner.mu.Lock()
+	if lc := runner.loopCounts; len(lc) != 2 || lc[0] != 0 || lc[1] != 3 {
+		t.Errorf("got loop counts %v, wanted [0 3]", lc)
+	}
+	runner.mu.Unlock()
+
+	msgs := srv.Messages()
+	if len(msgs) != 2 {
+		t.Fatalf("got %d emails, wanted 2 (the crit and the batch at close)", len(msgs))
+	}
+	if data := string(msgs[0].Data); !strings.Contains(data, "replication broken") ||
+		strings.Contains(data, batchDelimiter) {
+		t.Errorf("the crit should be sent at once, alone, got\n%s", data)
+	}
+	data := string(msgs[1].Data)
+	if n := strings.Count(data, batchDelimiter); n != 2 {
+		t.Errorf("got %d messages in the batch, wanted 2", n)
+	}
+	if strings.Contains(data, "replication broken") {
+		t.Errorf("the crit is in the batch:\n%s", data)
+	}
+}
+
+func TestSeverityField(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"},
+		hostport: srv.Addr(), batch: batchLimits{maxCount: 10},
+		immediate: true, immediateSeverity: 2,
+		severityField: "priority", severityMap: map[string]int32{"P1": 2, "P3": 5}, batchSummary: true}
+	prioritized := func(severity int32, payload, priority string) *message.Message {
+		msg := newTestMessage(severity, "shop-01", payload)
+		f, _ := message.NewField("priority", priority, "")
+		msg.AddField(f)
+		return msg
+	}
+	runner := newTestRunner()
+	for _, msg := range []*message.Message{
+		prioritized(6, "checkout is failing", "P1"),      // info by Heka, P1 by business
+		prioritized(2, "cache miss rate high", "P3"),     // crit by Heka, P3 by business
+		prioritized(4, "slow search", "P9"),              // unmapped: stays warning
+		newTestMessage(2, "db-01", "replication broken"), // no field: stays crit
+	} {
+		runner.send(msg)
+	}
+	close(runner.inChan)
+	if err := o.Run(runner, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := srv.Messages()
+	if len(msgs) != 3 {
+		t.Fatalf("got %d emails, wanted 3 (2 immediate and the batch)", len(msgs))
+	}
+	if subject := subjectOf(msgs[0].Data); !strings.Contains(subject, "[2] test@shop-01: checkout is failing") {
+		t.Errorf("the P1 message was not sent immediately as crit: %q", subject)
+	}
+	if subject := subjectOf(msgs[1].Data); !strings.Contains(subject, "replication broken") {
+		t.Errorf("the crit message was not sent immediately: %q", subject)
+	}
+	data := string(msgs[2].Data)
+	if n := strings.Count(data, batchDelimiter); n != 2 ||
+		!strings.Contains(data, "[5] test@shop-01") || !strings.Contains(data, "[4] test@shop-01") ||
+		!strings.Contains(data, "2 messages: 1 warn, 1 notice from shop-01") {
+		t.Errorf("got batch\n%s", data)
+	}
+
+	// the rollup and the thread keys go by the field, too
+	o.rollup = new(rollup)
+	a, b := prioritized(6, "checkout is failing", "P1"), prioritized(2, "checkout is failing", "P1")
+	if ka, kb := o.rollupKey(a), o.rollupKey(b); ka != kb {
+		t.Errorf("got rollup keys %q and %q for the same P1", ka, kb)
+	}
+	if ka, kb := o.incidentKey(a), o.incidentKey(b); ka != kb {
+		t.Errorf("got thread keys %q and %q for the same P1", ka, kb)
+	}
+}
+
+func TestCoalesceRecipients(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.Batch.MaxCount, conf.ToField, conf.CoalesceRecipients = 10, "to", true
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	withTo := func(msg *message.Message, to ...string) *message.Message {
+		f, _ := message.NewField("to", to[0], "")
+		for _, addr := range to[1:] {
+			f.AddValue(addr)
+		}
+		msg.AddField(f)
+		return msg
+	}
+	runner := newTestRunner()
+	for _, msg := range []*message.Message{
+		withTo(newTestMessage(3, "db-01", "db1 down"), "alice@example.com, bob@example.com"),
+		withTo(newTestMessage(3, "db-02", "db2 down"), "bob@example.com", "Alice@example.com"),
+		withTo(newTestMessage(3, "web-01", "web1 down"), "carol@example.com"),
+		newTestMessage(3, "web-02", "web2 down"),
+		withTo(newTestMessage(3, "db-03", "db3 down"), "bob@example.com"),
+	} {
+		runner.send(msg)
+	}
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		"alice@example.com": {"db1 down", "db2 down"},
+		"bob@example.com":   {"db1 down", "db2 down", "db3 down"},
+		"carol@example.com": {"web1 down"},
+		"ops@example.com":   {"web2 down"},
+	}
+	all := []string{"db1 down", "db2 down", "db3 down", "web1 down", "web2 down"}
+	got := make(map[string]int)
+	for _, m := range srv.Messages() {
+		body := string(m.Data[strings.Index(string(m.Data), "\r\n\r\n"):])
+		for _, to := range m.To {
+			got[to]++
+			for _, payload := range all {
+				in, wanted := strings.Count(body, payload), 0
+				for _, p := range want[to] {
+					if p == payload {
+						wanted = 1
+					}
+				}
+				if in != wanted {
+					t.Errorf("%s got %q %d times, wanted %d", to, payload, in, wanted)
+				}
+			}
+		}
+	}
+	for to := range want {
+		if got[to] != 1 {
+			t.Errorf("%s got %d emails, wanted 1", to, got[to])
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("got emails to %v", got)
+	}
+}
+
+func TestCompressDigest(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"},
+		hostport: srv.Addr(), batch: batchLimits{maxCount: 3}, compressDigest: true}
+	msgs := []*message.Message{
+		newTestMessage(2, "db-01", "replication broken"),
+		newTestMessage(3, "web-01", strings.Repeat("500 on /login ", 1000)),
+		newTestMessage(3, "web-02", "500 on /"),
+	}
+	runner := newTestRunner()
+	for _, msg := range msgs {
+		runner.send(msg)
+	}
+	close(runner.inChan)
+	if err := o.Run(runner, nil); err != nil {
+		t.Fatal(err)
+	}
+	sent := srv.Messages()
+	if len(sent) != 1 {
+		t.Fatalf("got %d emails, wanted 1", len(sent))
+	}
+
+	email, err := mail.ReadMessage(bytes.NewReader(sent[0].Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(email.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("got Content-Type %q (%v)", email.Header.Get("Content-Type"), err)
+	}
+	mr := multipart.NewReader(email.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	overview, _ := ioutil.ReadAll(part)
+	if !strings.HasPrefix(string(overview), "3 messages: 1 crit, 2 err from db-01,web-01,web-02\r\n") {
+		t.Errorf("got overview %q", overview)
+	}
+	if part, err = mr.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+	if part.FileName() != "digest.txt.gz" {
+		t.Errorf("got attachment %q", part.FileName())
+	}
+	zr, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, part))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	for _, msg := range msgs {
+		want.WriteString(batchDelimiter + "\r\n" + strings.TrimSuffix(o.messageHeader(msg), ": ") +
+			"\r\n" + msg.GetPayload() + "\r\n")
+	}
+	if string(digest) != want.String() {
+		t.Errorf("got digest\n%q\nwanted\n%q", digest, want.String())
+	}
+	if len(sent[0].Data) > want.Len()/2 {
+		t.Errorf("the email is %d bytes for a %d bytes digest", len(sent[0].Data), want.Len())
+	}
+}
+
+func TestBatchSeparateMessages(t *testing.T) {
+	srv := startFakeSMTP(t)
+	useFakeMX(t, "localhost.", srv.Port())
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.From, conf.To = "heka@example.com", []string{"ops@example.com", "dev@example.com"}
+	conf.Batch.MaxCount, conf.Batch.SeparateMessages = 10, true
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	prepared := srv.Connections()
+	runner := newTestRunner()
+	for _, payload := range []string{"db1 down", "db2 down", "db3 down"} {
+		runner.send(newTestMessage(3, "db-01", payload))
+	}
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := srv.Connections() - prepared; n != 1 {
+		t.Errorf("got %d connections, wanted 1", n)
+	}
+	msgs := srv.Messages()
+	if len(msgs) != 3 {
+		t.Fatalf("got %d emails, wanted 3", len(msgs))
+	}
+	for i, payload := range []string{"db1 down", "db2 down", "db3 down"} {
+		if !strings.Contains(string(msgs[i].Data), payload) {
+			t.Errorf("%d. email misses %q:\n%s", i+1, payload, msgs[i].Data)
+		}
+		if got := strings.Join(msgs[i].To, ","); got != "ops@example.com,dev@example.com" {
+			t.Errorf("%d. email went to %s", i+1, got)
+		}
+	}
+	// one RSET between each two transactions of the sending
+	var resets []int
+	for i, cmd := range srv.Commands() {
+		if strings.EqualFold(cmd, "RSET") {
+			resets = append(resets, i)
+		}
+	}
+	if len(resets) != 2 {
+		t.Fatalf("got %d RSETs, wanted 2: %q", len(resets), srv.Commands())
+	}
+	cmds := srv.Commands()
+	for _, i := range resets {
+		if prev, next := cmds[i-1], cmds[i+1]; prev != "." && !strings.HasPrefix(prev, "DATA") ||
+			!strings.HasPrefix(strings.ToUpper(next), "MAIL FROM") {
+			t.Errorf("RSET between %q and %q", prev, next)
+		}
+	}
+	if quit := findCommand(cmds, "QUIT"); quit == "" {
+		t.Error("the connection is not quit after the batch")
+	}
+
+	// the emails go the way of the single ones: with the headers, requeued
+	// on failure, over a new connection if the streamed one broke
+	conf.Cc = []string{"boss@example.com"}
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	sent, conns := len(srv.Messages()), srv.Connections()
+	srv.Reply("MAIL FROM", testutil.Pass, "451 try again later", testutil.Pass)
+	srv.Reply("RSET", testutil.Pass, testutil.Drop, testutil.Pass)
+	runner = newTestRunner()
+	for _, payload := range []string{"db1 down", "db2 down", "db3 down"} {
+		runner.send(newTestMessage(3, "db-01", payload))
+	}
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+	if errs := runner.Errors(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "451") {
+		t.Errorf("got errors %v, wanted the 451", errs)
+	}
+	var got []string
+	for _, m := range srv.Messages()[sent:] {
+		if !bytes.Contains(m.Data, []byte("\r\nCc: boss@example.com\r\n")) {
+			t.Errorf("no Cc header in\n%s", m.Data)
+		}
+		subject := subjectOf(m.Data)
+		got = append(got, subject[len(subject)-len("db1 down"):])
+	}
+	// the failed db2 is resent before db3
+	if s := strings.Join(got, ","); s != "db1 down,db2 down,db3 down" {
+		t.Errorf("sent %s", s)
+	}
+	// one for db1 and db2, one for the resent db2, one after the dropped RSET
+	if n := srv.Connections() - conns; n != 3 {
+		t.Errorf("got %d connections, wanted 3", n)
+	}
+
+	conf.CoalesceRecipients = true
+	if err := o.Init(conf); err == nil {
+		t.Error("Init accepted separate_messages with coalesce_recipients")
+	}
+	conf.CoalesceRecipients = false
+	conf.Address = srv.Addr()
+	if err := o.Init(conf); err == nil {
+		t.Error("Init accepted separate_messages with an address")
+	}
+}
+
+func TestMaxBatchMemory(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.Batch.MaxCount = 100
+	conf.MaxBatchMemory = 2*messageSize(newTestMessage(3, "db-01", "db down 1")) + 1
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	runner := newTestRunner()
+	for i := 1; i <= 5; i++ {
+		runner.send(newTestMessage(3, "db-01", fmt.Sprintf("db down %d", i)))
+	}
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the third message exceeds the limit, the rest is sent at the end
+	msgs := srv.Messages()
+	if len(msgs) != 2 {
+		t.Fatalf("got %d emails, wanted 2", len(msgs))
+	}
+	for i, want := range []string{"(+2 more)", "(+1 more)"} {
+		if subject := subjectOf(msgs[i].Data); !strings.HasSuffix(subject, want) {
+			t.Errorf("%d. email has subject %q, wanted the suffix %q", i+1, subject, want)
+		}
+	}
+	report := new(message.Message)
+	o.ReportMsg(report)
+	if v, _ := report.GetFieldValue("Batch.MemoryFlushes"); v != int64(1) {
+		t.Errorf("got %v memory flushes, wanted 1", v)
+	}
+}
+
+func TestSeverityRange(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.MinSeverity, conf.MaxSeverity = 4, 1 // warn, err, crit and alert, but no emerg
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	prepared := len(srv.Messages())
+	runner := newTestRunner()
+	for severity := int32(0); severity <= 7; severity++ {
+		runner.send(newTestMessage(severity, "db-01", fmt.Sprintf("severity %d", severity)))
+	}
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range srv.Messages()[prepared:] {
+		subject := subjectOf(m.Data)
+		got = append(got, subject[len(subject)-1:])
+	}
+	if s := strings.Join(got, ","); s != "1,2,3,4" {
+		t.Errorf("sent the severities %s, wanted 1,2,3,4", s)
+	}
+
+	for _, bounds := range [][2]int32{{3, 4}, {8, 0}, {7, -1}} {
+		conf.MinSeverity, conf.MaxSeverity = bounds[0], bounds[1]
+		if err := new(EmailOutput).Init(conf); err == nil {
+			t.Errorf("accepted min_severity %d and max_severity %d", bounds[0], bounds[1])
+		}
+	}
+}
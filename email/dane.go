@@ -0,0 +1,284 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ErrDANEMismatch is returned when the certificate of the server
+// does not match any of its TLSA records.
+var ErrDANEMismatch = errors.New("certificate does not match the TLSA records")
+
+// tlsaTTL is how long the TLSA records of a host are cached.
+var tlsaTTL = time.Hour
+
+// tlsaRecord is a TLSA (RFC 6698) resource record.
+type tlsaRecord struct {
+	Usage, Selector, MatchingType uint8
+	Data                          []byte
+}
+
+// lookupTLSA returns the DNSSEC validated TLSA records of name, asking the
+// resolvers, nil if there are none or they are not validated. Replaceable for tests.
+var lookupTLSA = dnsLookupTLSA
+
+// lookupSecureMX reports whether the MX records of domain are DNSSEC
+// validated, asking the resolvers. Replaceable for tests.
+var lookupSecureMX = dnsSecureMX
+
+type cachedTLSA struct {
+	records []tlsaRecord
+	expires time.Time
+}
+
+type cachedSecureMX struct {
+	secure  bool
+	expires time.Time
+}
+
+var (
+	tlsaCacheMu   sync.Mutex
+	tlsaCache     = make(map[string]cachedTLSA)
+	secureMXCache = make(map[string]cachedSecureMX)
+)
+
+// daneRecords returns the usable (DANE-TA and DANE-EE, RFC 7672 3.1.3)
+// TLSA records of the SMTP server at addr (host:port), an MX host of domain,
+// cached. There are none if the MX records of domain are not DNSSEC validated
+// (RFC 7672 2.2.1): the MX hosts of an insecure MX RRset are not trusted.
+func daneRecords(resolvers []string, domain, addr string) ([]tlsaRecord, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if secure, err := secureMX(resolvers, domain); err != nil || !secure {
+		return nil, err
+	}
+	name := "_" + port + "._tcp." + strings.TrimSuffix(host, ".") + "."
+	tlsaCacheMu.Lock()
+	cached, ok := tlsaCache[name]
+	tlsaCacheMu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.records, nil
+	}
+	records, err := lookupTLSA(resolvers, name)
+	if err != nil {
+		return nil, fmt.Errorf("TLSA lookup of %s: %s", name, err)
+	}
+	usable := records[:0:0]
+	for _, r := range records {
+		if r.Usage == 2 || r.Usage == 3 {
+			usable = append(usable, r)
+		}
+	}
+	tlsaCacheMu.Lock()
+	tlsaCache[name] = cachedTLSA{records: usable, expires: time.Now().Add(tlsaTTL)}
+	tlsaCacheMu.Unlock()
+	return usable, nil
+}
+
+// secureMX reports whether the MX records of domain are DNSSEC validated, cached.
+func secureMX(resolvers []string, domain string) (bool, error) {
+	tlsaCacheMu.Lock()
+	cached, ok := secureMXCache[domain]
+	tlsaCacheMu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.secure, nil
+	}
+	secure, err := lookupSecureMX(resolvers, domain)
+	if err != nil {
+		return false, fmt.Errorf("MX lookup of %s: %s", domain, err)
+	}
+	tlsaCacheMu.Lock()
+	secureMXCache[domain] = cachedSecureMX{secure: secure, expires: time.Now().Add(tlsaTTL)}
+	tlsaCacheMu.Unlock()
+	return secure, nil
+}
+
+// daneTLSConfig returns the TLS config verifying the server's certificate
+// against the TLSA records, instead of the CAs.
+func daneTLSConfig(tlsConfig *tls.Config, host string, records []tlsaRecord) *tls.Config {
+	cfg := tlsConfig.Clone()
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(state tls.ConnectionState) error {
+		return verifyDANE(state.PeerCertificates, host, records)
+	}
+	return cfg
+}
+
+// verifyDANE verifies the certificate chain against the TLSA records:
+// a DANE-EE record must match the leaf certificate, a DANE-TA record
+// a certificate of the chain, which must be a valid chain for host.
+func verifyDANE(certs []*x509.Certificate, host string, records []tlsaRecord) error {
+	if len(certs) == 0 {
+		return ErrDANEMismatch
+	}
+	for _, r := range records {
+		if r.Usage == 3 {
+			if r.matches(certs[0]) {
+				return nil
+			}
+			continue
+		}
+		for _, cert := range certs {
+			if !r.matches(cert) {
+				continue
+			}
+			roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+			roots.AddCert(cert)
+			for _, c := range certs[1:] {
+				intermediates.AddCert(c)
+			}
+			if _, err := certs[0].Verify(x509.VerifyOptions{
+				DNSName:       strings.TrimSuffix(host, "."),
+				Roots:         roots,
+				Intermediates: intermediates,
+			}); err == nil {
+				return nil
+			}
+		}
+	}
+	return ErrDANEMismatch
+}
+
+// matches reports whether the certificate matches the record.
+func (r tlsaRecord) matches(cert *x509.Certificate) bool {
+	var data []byte
+	switch r.Selector {
+	case 0:
+		data = cert.Raw
+	case 1:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+	switch r.MatchingType {
+	case 0:
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	default:
+		return false
+	}
+	return bytes.Equal(data, r.Data)
+}
+
+// dnsClient and dnsTCPClient query the validating resolvers of DANE:
+// over UDP, over TCP if the UDP response is truncated.
+var (
+	dnsClient    = &dns.Client{Net: "udp", Timeout: 5 * time.Second}
+	dnsTCPClient = &dns.Client{Net: "tcp", Timeout: 5 * time.Second}
+)
+
+// defaultDANEResolver is the validating resolver of DANE if dane_resolvers is not set.
+const defaultDANEResolver = "127.0.0.1:53"
+
+// parseDANEResolvers returns the addresses (host:port) of the validating
+// resolvers, which must be on the loopback interface: the AD bit of their
+// responses is trusted, and it is worth no more than the path it came on.
+func parseDANEResolvers(resolvers []string) ([]string, error) {
+	if len(resolvers) == 0 {
+		return []string{defaultDANEResolver}, nil
+	}
+	addrs := make([]string, len(resolvers))
+	for i, resolver := range resolvers {
+		host, port, err := net.SplitHostPort(resolver)
+		if err != nil {
+			host, port = resolver, "53"
+		}
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("dane resolver %s is not a loopback address", resolver)
+		}
+		addrs[i] = net.JoinHostPort(host, port)
+	}
+	return addrs, nil
+}
+
+// dnsExchange asks the resolvers in turn for the records of name of type qtype,
+// with the DNSSEC validation (AD and DO bits) requested, until one of them answers.
+func dnsExchange(resolvers []string, name string, qtype uint16) (*dns.Msg, error) {
+	name = dns.Fqdn(name)
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(1232, true)
+	m.AuthenticatedData = true
+	err := errors.New("no DANE resolvers")
+	for _, resolver := range resolvers {
+		m.Id = dns.Id()
+		var r *dns.Msg
+		if r, _, err = dnsClient.Exchange(m, resolver); err == nil && r.Truncated {
+			r, _, err = dnsTCPClient.Exchange(m, resolver)
+		}
+		if err != nil {
+			continue
+		}
+		if len(r.Question) != 1 || !strings.EqualFold(r.Question[0].Name, name) || r.Question[0].Qtype != qtype {
+			err = fmt.Errorf("DNS response of %s to another question", resolver)
+			continue
+		}
+		if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+			err = fmt.Errorf("DNS error %s from %s", dns.RcodeToString[r.Rcode], resolver)
+			continue
+		}
+		return r, nil
+	}
+	return nil, err
+}
+
+// dnsLookupTLSA asks the resolvers for the TLSA records of name, which must
+// be validated by them (AD bit) to be used.
+func dnsLookupTLSA(resolvers []string, name string) ([]tlsaRecord, error) {
+	r, err := dnsExchange(resolvers, name, dns.TypeTLSA)
+	if err != nil || !r.AuthenticatedData {
+		return nil, err
+	}
+	var records []tlsaRecord
+	for _, rr := range r.Answer {
+		t, ok := rr.(*dns.TLSA)
+		if !ok {
+			continue
+		}
+		data, err := hex.DecodeString(t.Certificate)
+		if err != nil {
+			return nil, fmt.Errorf("bad TLSA record %s: %s", t, err)
+		}
+		records = append(records, tlsaRecord{Usage: t.Usage, Selector: t.Selector,
+			MatchingType: t.MatchingType, Data: data})
+	}
+	return records, nil
+}
+
+// dnsSecureMX asks the resolvers whether the MX records of domain are DNSSEC validated.
+func dnsSecureMX(resolvers []string, domain string) (bool, error) {
+	r, err := dnsExchange(resolvers, domain, dns.TypeMX)
+	if err != nil {
+		return false, err
+	}
+	return r.AuthenticatedData, nil
+}
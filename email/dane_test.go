@@ -0,0 +1,236 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// useFakeTLSA makes lookupTLSA return the records for name, the MX records
+// validated, and empties the caches.
+func useFakeTLSA(t *testing.T, name string, records ...tlsaRecord) {
+	old, oldMX := lookupTLSA, lookupSecureMX
+	lookupTLSA = func(_ []string, n string) ([]tlsaRecord, error) {
+		if n != name {
+			return nil, nil
+		}
+		return records, nil
+	}
+	lookupSecureMX = func([]string, string) (bool, error) { return true, nil }
+	tlsaCacheMu.Lock()
+	tlsaCache = make(map[string]cachedTLSA)
+	secureMXCache = make(map[string]cachedSecureMX)
+	tlsaCacheMu.Unlock()
+	t.Cleanup(func() { lookupTLSA, lookupSecureMX = old, oldMX })
+}
+
+func TestDANE(t *testing.T) {
+	srv := startFakeSMTP(t, "STARTTLS")
+	useFakeMX(t, "localhost.", srv.Port())
+	mxAddrsLock.Lock()
+	mxAddrs["example.com"] = cachedMX{mxs: []*net.MX{{Host: "localhost.", Pref: 10}}, fetched: time.Now()}
+	mxAddrsLock.Unlock()
+	leaf := srv.TLSConfig.Certificates[0].Leaf
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	name := "_" + srv.Port() + "._tcp.localhost."
+
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"},
+		byHost: map[string][]string{"example.com": {"ops@example.com"}}, dane: true}
+	// for the CA verification without usable TLSA records
+	o.opts.tlsConfig = &tls.Config{RootCAs: srv.CertPool()}
+	body := []byte("Subject: test\r\n\r\nbody")
+	for i, records := range [][]tlsaRecord{
+		{{Usage: 3, Selector: 1, MatchingType: 1, Data: spki[:]}},          // DANE-EE SPKI SHA-256
+		{{Usage: 2, Selector: 0, MatchingType: 0, Data: leaf.Raw}},         // DANE-TA full certificate
+		{{Usage: 1, Selector: 1, MatchingType: 1, Data: make([]byte, 32)}}, // PKIX-EE is unusable
+	} {
+		useFakeTLSA(t, name, records...)
+		if err := o.sendMail(body, envelope{}); err != nil {
+			t.Fatalf("%d. %v", i, err)
+		}
+		msgs := srv.Messages()
+		if !msgs[len(msgs)-1].TLS {
+			t.Errorf("%d. sent without TLS", i)
+		}
+	}
+
+	useFakeTLSA(t, name, tlsaRecord{Usage: 3, Selector: 1, MatchingType: 1, Data: make([]byte, 32)})
+	err := o.sendMail(body, envelope{})
+	if err == nil || !strings.Contains(err.Error(), ErrDANEMismatch.Error()) {
+		t.Errorf("got %v, wanted %v", err, ErrDANEMismatch)
+	}
+
+	// the TLSA records of the MX hosts are not used if the MX records are not validated
+	lookupSecureMX = func([]string, string) (bool, error) { return false, nil }
+	tlsaCacheMu.Lock()
+	secureMXCache = make(map[string]cachedSecureMX)
+	tlsaCacheMu.Unlock()
+	if err = o.sendMail(body, envelope{}); err != nil {
+		t.Errorf("insecure MX: %v", err)
+	}
+
+	// STARTTLS is required with TLSA records
+	plain := startFakeSMTP(t)
+	useFakeMX(t, "localhost.", plain.Port())
+	mxAddrsLock.Lock()
+	mxAddrs["example.com"] = cachedMX{mxs: []*net.MX{{Host: "localhost.", Pref: 10}}, fetched: time.Now()}
+	mxAddrsLock.Unlock()
+	useFakeTLSA(t, "_"+plain.Port()+"._tcp.localhost.", tlsaRecord{Usage: 3, Selector: 1, MatchingType: 1, Data: spki[:]})
+	if err = o.sendMail(body, envelope{}); err == nil {
+		t.Error("sent without STARTTLS to a host with TLSA records")
+	}
+	if n := len(plain.Messages()); n != 0 {
+		t.Errorf("got %d messages over plaintext", n)
+	}
+}
+
+// startFakeResolver starts a DNS server answering the TLSA and MX queries
+// on the same UDP and TCP port, with the AD bit if validated is set.
+// If truncate is set, the UDP responses are truncated.
+func startFakeResolver(t *testing.T, data []byte, validated, truncate *atomic.Bool) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Skip(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.AuthenticatedData = validated.Load()
+		q := req.Question[0]
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp && truncate.Load() {
+			resp.Truncated = true
+		} else if q.Qtype == dns.TypeTLSA {
+			resp.Answer = append(resp.Answer, &dns.TLSA{
+				Hdr:   dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTLSA, Class: dns.ClassINET, Ttl: 3600},
+				Usage: 3, Selector: 1, MatchingType: 1, Certificate: hex.EncodeToString(data)})
+		} else if q.Qtype == dns.TypeMX {
+			resp.Answer = append(resp.Answer, &dns.MX{
+				Hdr:        dns.RR_Header{Name: q.Name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: 3600},
+				Preference: 10, Mx: "mx." + q.Name})
+		}
+		w.WriteMsg(resp)
+	})
+	udp, tcp := &dns.Server{PacketConn: pc, Handler: handler}, &dns.Server{Listener: ln, Handler: handler}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	t.Cleanup(func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	})
+	return pc.LocalAddr().String()
+}
+
+func TestDNSLookupTLSA(t *testing.T) {
+	var validated, truncate atomic.Bool
+	data := []byte{0xde, 0xad, 0xbe, 0xef}
+	resolver := startFakeResolver(t, data, &validated, &truncate)
+	// a dead resolver is skipped
+	resolvers := []string{"127.0.0.1:1", resolver}
+
+	validated.Store(true)
+	for _, trunc := range []bool{false, true} {
+		truncate.Store(trunc)
+		records, err := dnsLookupTLSA(resolvers, "_25._tcp.mx.example.com.")
+		if err != nil {
+			t.Fatalf("truncated=%t: %v", trunc, err)
+		}
+		if len(records) != 1 || records[0].Usage != 3 || records[0].Selector != 1 ||
+			records[0].MatchingType != 1 || !bytes.Equal(records[0].Data, data) {
+			t.Errorf("truncated=%t: got %+v", trunc, records)
+		}
+	}
+	if secure, err := dnsSecureMX(resolvers, "example.com"); err != nil || !secure {
+		t.Errorf("got %t, %v for validated MX records", secure, err)
+	}
+
+	// not validated by DNSSEC
+	validated.Store(false)
+	if records, err := dnsLookupTLSA(resolvers, "_25._tcp.mx.example.com."); err != nil || records != nil {
+		t.Errorf("got %+v, %v for an unvalidated response", records, err)
+	}
+	if secure, err := dnsSecureMX(resolvers, "example.com"); err != nil || secure {
+		t.Errorf("got %t, %v for unvalidated MX records", secure, err)
+	}
+
+	if _, err := dnsLookupTLSA(resolvers[:1], "_25._tcp.mx.example.com."); err == nil {
+		t.Error("no error without a live resolver")
+	}
+}
+
+func TestParseDANEResolvers(t *testing.T) {
+	for _, tc := range []struct {
+		in   []string
+		want []string
+	}{
+		{nil, []string{"127.0.0.1:53"}},
+		{[]string{"127.0.0.53", "[::1]:5353"}, []string{"127.0.0.53:53", "[::1]:5353"}},
+		{[]string{"127.0.0.1", "8.8.8.8"}, nil},
+		{[]string{"localhost:53"}, nil},
+	} {
+		got, err := parseDANEResolvers(tc.in)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("%q: got %q, wanted an error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%q: got %q, %v, wanted %q", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestTLSACache(t *testing.T) {
+	n := 0
+	old := lookupTLSA
+	lookupTLSA = func([]string, string) ([]tlsaRecord, error) {
+		n++
+		return []tlsaRecord{{Usage: 3, Selector: 1, MatchingType: 1}}, nil
+	}
+	oldMX := lookupSecureMX
+	lookupSecureMX = func([]string, string) (bool, error) { return true, nil }
+	defer func() { lookupTLSA, lookupSecureMX = old, oldMX }()
+	tlsaCacheMu.Lock()
+	tlsaCache = make(map[string]cachedTLSA)
+	secureMXCache = make(map[string]cachedSecureMX)
+	tlsaCacheMu.Unlock()
+	for i := 0; i < 3; i++ {
+		if records, err := daneRecords(nil, "example.com", "mx.example.com:25"); err != nil || len(records) != 1 {
+			t.Fatalf("%d. got %v, %v", i, records, err)
+		}
+	}
+	if n != 1 {
+		t.Errorf("looked up %d times, wanted once", n)
+	}
+	defer func(ttl time.Duration) { tlsaTTL = ttl }(tlsaTTL)
+	tlsaTTL = 0
+	daneRecords(nil, "example.com", "mx2.example.com:25")
+	daneRecords(nil, "example.com", "mx2.example.com:25")
+	if n != 3 {
+		t.Errorf("looked up %d times, wanted 3 (expired)", n)
+	}
+}
@@ -0,0 +1,147 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// dedup suppresses the duplicates of the messages sent within the window,
+// counting them per key.
+type dedup struct {
+	window    time.Duration
+	field     string // the field of the key, the subject if empty
+	sent      map[string]*dedupEntry
+	lastPrune time.Time
+}
+
+// dedupEntry is the state of a key.
+type dedupEntry struct {
+	sent       time.Time // when the last message was sent
+	suppressed int       // number of the duplicates suppressed since then
+}
+
+func newDedup(window time.Duration, field string) *dedup {
+	return &dedup{window: window, field: field, sent: make(map[string]*dedupEntry)}
+}
+
+// Check reports whether the message with the key arriving at now is to be
+// sent, with the number of its duplicates suppressed before it.
+func (d *dedup) Check(key string, now time.Time) (send bool, suppressed int) {
+	if now.Sub(d.lastPrune) >= d.window {
+		// forget the expired keys without suppressed duplicates to report
+		for k, e := range d.sent {
+			if e.suppressed == 0 && now.Sub(e.sent) >= d.window {
+				delete(d.sent, k)
+			}
+		}
+		d.lastPrune = now
+	}
+	e := d.sent[key]
+	if e == nil {
+		d.sent[key] = &dedupEntry{sent: now}
+		return true, 0
+	}
+	if now.Sub(e.sent) < d.window {
+		e.suppressed++
+		return false, 0
+	}
+	suppressed = e.suppressed
+	e.sent, e.suppressed = now, 0
+	return true, suppressed
+}
+
+// dedupKey returns the key of the message: the value of the dedup key
+// field, or (without one) the subject, without the timestamp.
+func (o *EmailOutput) dedupKey(msg *message.Message) string {
+	if o.dedup.field != "" {
+		if v, ok := msg.GetFieldValue(o.dedup.field); ok {
+			return fmt.Sprintf("field:%v", v)
+		}
+	}
+	return fmt.Sprintf("%d %s@%s %s", o.severity(msg), msg.GetLogger(), msg.GetHostname(),
+		o.subjectPayload(o.payload(msg)))
+}
+
+// suppressedField is the field of the batched (or rolled up) copy of
+// a message with the number of its duplicates suppressed before it.
+const suppressedField = "duplicates_suppressed"
+
+// withSuppressed returns the copy of the message to be batched, noting
+// the number of its duplicates suppressed before it, if any.
+func withSuppressed(msg *message.Message, suppressed int) *message.Message {
+	msg = message.CopyMessage(msg)
+	if suppressed > 0 {
+		addField(msg, suppressedField, int64(suppressed), "count")
+	}
+	return msg
+}
+
+// suppressedBefore returns the number of the duplicates suppressed
+// before the (batched) messages.
+func suppressedBefore(msgs ...*message.Message) int {
+	var n int
+	for _, msg := range msgs {
+		if v, ok := msg.GetFieldValue(suppressedField); ok {
+			if i, ok := v.(int64); ok {
+				n += int(i)
+			}
+		}
+	}
+	return n
+}
+
+// duplicatesNote returns the note of the suppressed duplicates,
+// " (N duplicates suppressed)", or "" if there are none.
+func duplicatesNote(suppressed int) string {
+	if suppressed <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%d duplicates suppressed)", suppressed)
+}
+
+// withSubjectSuffix returns the email with the suffix appended to its subject.
+func withSubjectSuffix(body []byte, suffix string) []byte {
+	headerEnd := bytes.Index(body, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		headerEnd = len(body)
+	}
+	start := 0
+	if !bytes.HasPrefix(body, []byte("Subject: ")) {
+		if start = bytes.Index(body[:headerEnd], []byte("\r\nSubject: ")); start < 0 {
+			return body
+		}
+		start += 2
+	}
+	// the end of the (maybe folded) subject
+	end := start
+	for {
+		i := bytes.Index(body[end:headerEnd], []byte("\r\n"))
+		if i < 0 {
+			end = headerEnd
+			break
+		}
+		end += i
+		if end+2 >= headerEnd || (body[end+2] != ' ' && body[end+2] != '\t') {
+			break
+		}
+		end += 2
+	}
+	b := make([]byte, 0, len(body)+len(suffix))
+	b = append(b, body[:end]...)
+	b = append(b, suffix...)
+	return append(b, body[end:]...)
+}
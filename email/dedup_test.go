@@ -0,0 +1,141 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+func TestDedupCheck(t *testing.T) {
+	d := newDedup(time.Minute, "")
+	t0 := time.Date(2013, 11, 12, 13, 14, 15, 0, time.UTC)
+	for i, tc := range []struct {
+		key        string
+		after      time.Duration
+		send       bool
+		suppressed int
+	}{
+		{"a", 0, true, 0},
+		{"a", 10 * time.Second, false, 0},
+		{"b", 15 * time.Second, true, 0},
+		{"a", 20 * time.Second, false, 0},
+		{"a", 61 * time.Second, true, 2},
+		{"a", 62 * time.Second, false, 0},
+		{"b", 80 * time.Second, true, 0},
+	} {
+		if send, suppressed := d.Check(tc.key, t0.Add(tc.after)); send != tc.send || suppressed != tc.suppressed {
+			t.Errorf("%d. got %t, %d, wanted %t, %d", i+1, send, suppressed, tc.send, tc.suppressed)
+		}
+	}
+	// the expired keys without suppressed duplicates are forgotten
+	d.Check("c", t0.Add(3*time.Minute))
+	if _, ok := d.sent["b"]; ok || len(d.sent) != 2 {
+		t.Errorf("got keys %v, wanted a (with a suppressed duplicate) and c", d.sent)
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"}, hostport: srv.Addr(),
+		dedup: newDedup(50*time.Millisecond, "")}
+	runner := newTestRunner()
+	done := make(chan error, 1)
+	go func() { done <- o.Run(runner, testHelper{}) }()
+	for i := 0; i < 3; i++ {
+		runner.send(newTestMessage(3, "web-01", "disk full"))
+	}
+	runner.send(newTestMessage(3, "web-02", "disk full"))
+	time.Sleep(100 * time.Millisecond)
+	runner.send(newTestMessage(3, "web-01", "disk full"))
+	close(runner.inChan)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	msgs := srv.Messages()
+	if len(msgs) != 3 {
+		t.Fatalf("got %d emails, wanted 3", len(msgs))
+	}
+	for i, want := range []string{
+		"2013-11-12T13:14:15Z [3] test@web-01: disk full",
+		"2013-11-12T13:14:15Z [3] test@web-02: disk full",
+		"2013-11-12T13:14:15Z [3] test@web-01: disk full (2 duplicates suppressed)",
+	} {
+		if subject := subjectOf(msgs[i].Data); subject != want {
+			t.Errorf("%d. got subject %q, wanted %q", i+1, subject, want)
+		}
+	}
+	msg := new(message.Message)
+	o.ReportMsg(msg)
+	if v, _ := msg.GetFieldValue("Dedup.Suppressed"); v != int64(2) {
+		t.Errorf("got %v suppressed, wanted 2", v)
+	}
+}
+
+func TestDedupBatch(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"}, hostport: srv.Addr(),
+		dedup: newDedup(50*time.Millisecond, ""), batch: batchLimits{maxCount: 2}}
+	runner := newTestRunner()
+	done := make(chan error, 1)
+	go func() { done <- o.Run(runner, testHelper{}) }()
+	for i := 0; i < 3; i++ {
+		runner.send(newTestMessage(3, "web-01", "disk full"))
+	}
+	time.Sleep(100 * time.Millisecond)
+	runner.send(newTestMessage(3, "web-01", "disk full"))
+	runner.send(newTestMessage(3, "web-02", "disk full"))
+	close(runner.inChan)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	msgs := srv.Messages()
+	if len(msgs) != 2 {
+		t.Fatalf("got %d emails, wanted 2", len(msgs))
+	}
+	// the batch notes the duplicates in its subject, and at the message
+	if want := "2013-11-12T13:14:15Z [3] test@web-01: disk full (+1 more) (2 duplicates suppressed)"; subjectOf(msgs[0].Data) != want {
+		t.Errorf("got subject %q, wanted %q", subjectOf(msgs[0].Data), want)
+	}
+	if n := strings.Count(string(msgs[0].Data), "(2 duplicates suppressed)\r\n"); n != 2 {
+		t.Errorf("the duplicates are noted %d times, wanted in the subject and at the message:\n%s", n, msgs[0].Data)
+	}
+	if subject := subjectOf(msgs[1].Data); strings.Contains(subject, "suppressed") {
+		t.Errorf("got subject %q without duplicates", subject)
+	}
+}
+
+func TestDedupKeyField(t *testing.T) {
+	o := &EmailOutput{dedup: newDedup(time.Minute, "fingerprint")}
+	a, b := newTestMessage(3, "web-01", "disk full on /"), newTestMessage(3, "web-02", "disk full on /var")
+	addField(a, "fingerprint", "disk-full", "")
+	addField(b, "fingerprint", "disk-full", "")
+	if ka, kb := o.dedupKey(a), o.dedupKey(b); ka != kb {
+		t.Errorf("the keys of the same fingerprint differ: %q, %q", ka, kb)
+	}
+	if o.dedupKey(a) == o.dedupKey(newTestMessage(3, "web-01", "disk full on /")) {
+		t.Error("a message without the field got the key of the field")
+	}
+
+	body := withSubjectSuffix([]byte("Message-Id: <1@x>\r\nSubject: disk full\r\n\r\nSubject: body"), " (x)")
+	if got := string(body); got != "Message-Id: <1@x>\r\nSubject: disk full (x)\r\n\r\nSubject: body" {
+		t.Errorf("got %q", got)
+	}
+
+	conf := &EmailOutputConfig{Address: "localhost", DedupWindow: "0s"}
+	if err := new(EmailOutput).Init(conf); err == nil || !strings.Contains(err.Error(), "dedup_window") {
+		t.Errorf("got %v, wanted the dedup_window error", err)
+	}
+}
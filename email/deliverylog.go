@@ -0,0 +1,129 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// deliveryEntry is a line of the delivery log.
+type deliveryEntry struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Relay      string    `json:"relay"`
+	Recipients []string  `json:"recipients"`
+	Bytes      int       `json:"bytes"`
+	Result     string    `json:"result"`  // "sent" or "failed"
+	Latency    float64   `json:"latency"` // in seconds
+	Error      string    `json:"error,omitempty"`
+}
+
+// rotatingFile is an append-only file, rotated when it reaches maxSize:
+// path is renamed to path.1 (path.1 to path.2 and so on), keeping
+// backups old files at most.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	fh   *os.File
+	size int64
+}
+
+// openRotatingFile opens (or creates) the file at path for appending.
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	fh, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	rf.fh, rf.size = fh, fi.Size()
+	return nil
+}
+
+// rotate shifts the backups, and starts a new file.
+func (rf *rotatingFile) rotate() error {
+	rf.fh.Close()
+	if rf.backups < 1 {
+		os.Remove(rf.path)
+	} else {
+		for i := rf.backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		}
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+			return err
+		}
+	}
+	return rf.open()
+}
+
+// Write writes p in whole, rotating the file before if p does not fit into it.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.fh == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.fh.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Close closes the file.
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.fh == nil {
+		return nil
+	}
+	err := rf.fh.Close()
+	rf.fh = nil
+	return err
+}
+
+// logDelivery writes the entry of the sending attempt via relay
+// into the delivery log, if there is one.
+func (o *EmailOutput) logDelivery(relay string, to []string, body []byte, start time.Time, err error) {
+	if o.deliveryLog == nil {
+		return
+	}
+	entry := deliveryEntry{Timestamp: start.UTC(), Relay: relay, Recipients: to,
+		Bytes: len(body), Result: "sent", Latency: time.Since(start).Seconds()}
+	if err != nil {
+		entry.Result, entry.Error = "failed", err.Error()
+	}
+	line, _ := json.Marshal(entry)
+	if _, err = o.deliveryLog.Write(append(line, '\n')); err != nil {
+		o.logError(fmt.Errorf("cannot write the delivery log %s: %s", o.deliveryLog.path, err))
+	}
+}
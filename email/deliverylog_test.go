@@ -0,0 +1,87 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeliveryLog(t *testing.T) {
+	srv := startFakeSMTP(t)
+	path := filepath.Join(t.TempDir(), "delivery.log")
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.DeliveryLog = path
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	body := []byte("Subject: test\r\n\r\nbody")
+	if err := o.sendMail(body, envelope{}); err != nil {
+		t.Fatal(err)
+	}
+	srv.Reply("RCPT TO", "550 no such user")
+	if err := o.sendMail(body, envelope{}); err == nil {
+		t.Fatal("sending succeeded with a rejected recipient")
+	}
+	o.deliveryLog.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, wanted 2:\n%s", len(lines), data)
+	}
+	for i, want := range []struct{ result, err string }{{"sent", ""}, {"failed", `550 "no such user"`}} {
+		var entry deliveryEntry
+		if err := json.Unmarshal(lines[i], &entry); err != nil {
+			t.Fatalf("%d. %v: %s", i+1, err, lines[i])
+		}
+		if entry.Relay != srv.Addr() || strings.Join(entry.Recipients, ",") != "ops@example.com" ||
+			entry.Bytes != len(body) || entry.Timestamp.IsZero() || entry.Latency < 0 {
+			t.Errorf("%d. got %+v", i+1, entry)
+		}
+		if entry.Result != want.result || entry.Error != want.err {
+			t.Errorf("%d. got result %q error %q, wanted %q and %q", i+1, entry.Result, entry.Error, want.result, want.err)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "delivery.log")
+	rf, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err = rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rf.Close()
+	for name, want := range map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"} {
+		if data, err := ioutil.ReadFile(name); err != nil || string(data) != want {
+			t.Errorf("%s: got %q (%v), wanted %q", name, data, err, want)
+		}
+	}
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more backups than wanted: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Dialer makes the connections to the SMTP servers, such as *net.Dialer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// defaultDialer is the dialer used if none is set with SetDialer.
+var defaultDialer = &net.Dialer{Timeout: DefaultTimeout, KeepAlive: 30 * time.Second}
+
+var (
+	dialerMu     sync.RWMutex
+	sharedDialer Dialer = defaultDialer
+)
+
+// SetDialer sets the dialer of all the SMTP connections (e.g. a *net.Dialer
+// with a LocalAddr to bind the source address), nil restores the default.
+func SetDialer(d Dialer) {
+	if d == nil {
+		d = defaultDialer
+	}
+	dialerMu.Lock()
+	sharedDialer = d
+	dialerMu.Unlock()
+}
+
+// dialTCP connects to addr with the shared dialer (or via, if not nil),
+// within timeout (if positive).
+func dialTCP(addr string, timeout time.Duration, via Dialer) (net.Conn, error) {
+	d := via
+	if d == nil {
+		d = currentDialer()
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+func currentDialer() Dialer {
+	dialerMu.RLock()
+	defer dialerMu.RUnlock()
+	return sharedDialer
+}
+
+// sharedForward connects to the proxy with the shared dialer.
+type sharedForward struct{}
+
+func (sharedForward) Dial(network, addr string) (net.Conn, error) {
+	return currentDialer().DialContext(context.Background(), network, addr)
+}
+
+func (sharedForward) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return currentDialer().DialContext(ctx, network, addr)
+}
+
+// newSOCKS5Dialer returns the dialer connecting through the SOCKS5 proxy
+// at addr, authenticating with username and password if username is set.
+func newSOCKS5Dialer(addr, username, password string) (Dialer, error) {
+	var auth *proxy.Auth
+	if username != "" {
+		auth = &proxy.Auth{User: username, Password: password}
+	}
+	d, err := proxy.SOCKS5("tcp", addr, auth, sharedForward{})
+	if err != nil {
+		return nil, err
+	}
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return nil, errors.New("the SOCKS5 dialer does not support timeouts")
+	}
+	return cd, nil
+}
@@ -0,0 +1,226 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// countingDialer counts the connections made through it.
+type countingDialer struct {
+	net.Dialer
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.addrs = append(d.addrs, addr)
+	d.mu.Unlock()
+	return d.Dialer.DialContext(ctx, network, addr)
+}
+
+func TestSetDialer(t *testing.T) {
+	srv := startFakeSMTP(t)
+	d := new(countingDialer)
+	SetDialer(d)
+	defer SetDialer(nil)
+
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"}, hostport: srv.Addr()}
+	for i := 0; i < 2; i++ {
+		if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(d.addrs) != 2 || d.addrs[0] != srv.Addr() {
+		t.Errorf("the dialer got %v, wanted 2 connections to %s", d.addrs, srv.Addr())
+	}
+
+	SetDialer(nil)
+	if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.addrs) != 2 {
+		t.Error("the dialer is used after resetting")
+	}
+}
+
+// fakeSOCKS5 is a SOCKS5 proxy (CONNECT only), requiring username and
+// password authentication if user is set, and recording the targets.
+type fakeSOCKS5 struct {
+	ln         net.Listener
+	user, pass string
+	mu         sync.Mutex
+	targets    []string
+}
+
+func startFakeSOCKS5(t *testing.T, user, pass string) *fakeSOCKS5 {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeSOCKS5{ln: ln, user: user, pass: pass}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return p
+}
+
+func (p *fakeSOCKS5) Addr() string { return p.ln.Addr().String() }
+
+func (p *fakeSOCKS5) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+func (p *fakeSOCKS5) serve(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 256)
+	// the greeting: version, the methods
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil || buf[0] != 5 {
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return
+	}
+	method := byte(0)
+	if p.user != "" {
+		method = 2
+	}
+	if bytes.IndexByte(buf[:buf[1]], method) < 0 {
+		conn.Write([]byte{5, 0xff})
+		return
+	}
+	conn.Write([]byte{5, method})
+	if method == 2 {
+		// the subnegotiation: version, username, password
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		user := make([]byte, buf[1])
+		if _, err := io.ReadFull(conn, user); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return
+		}
+		pass := make([]byte, buf[0])
+		if _, err := io.ReadFull(conn, pass); err != nil {
+			return
+		}
+		if string(user) != p.user || string(pass) != p.pass {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+	// the request: version, CONNECT, reserved, the address type
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil || buf[1] != 1 {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1, 4:
+		ip := make(net.IP, 4)
+		if buf[3] == 4 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, buf[:buf[0]]); err != nil {
+			return
+		}
+		host = string(buf[:buf[0]])
+	default:
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2]))))
+	p.mu.Lock()
+	p.targets = append(p.targets, target)
+	p.mu.Unlock()
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func TestProxyAddress(t *testing.T) {
+	srv := startFakeSMTP(t, "STARTTLS")
+	proxy := startFakeSOCKS5(t, "heka", "s3cret")
+	d := new(countingDialer)
+	SetDialer(d)
+	defer SetDialer(nil)
+
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.NoCertCheck = true
+	conf.TLSPolicy = map[string]string{"example.com": "required"}
+	conf.ProxyAddress, conf.ProxyUsername, conf.ProxyPassword = proxy.Addr(), "heka", "s3cret"
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := srv.Messages(); len(msgs) == 0 || !msgs[len(msgs)-1].TLS {
+		t.Errorf("got %+v, wanted the email over STARTTLS", msgs)
+	}
+	if targets := proxy.Targets(); len(targets) == 0 || targets[len(targets)-1] != srv.Addr() {
+		t.Errorf("the proxy got %v, wanted connections to %s", targets, srv.Addr())
+	}
+	// the proxy is reached with the shared dialer
+	for _, addr := range d.addrs {
+		if addr != proxy.Addr() {
+			t.Errorf("dialed %s directly", addr)
+		}
+	}
+
+	conf.ProxyPassword = "wrong"
+	if err := new(EmailOutput).Init(conf); err == nil {
+		t.Error("Init succeeded with a wrong proxy password")
+	}
+	conf.ProxyAddress = ""
+	if err := new(EmailOutput).Init(conf); err == nil || !strings.Contains(err.Error(), "proxy_address") {
+		t.Errorf("got %v, wanted the proxy_address error", err)
+	}
+}
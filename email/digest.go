@@ -0,0 +1,54 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import "time"
+
+// autoDigest switches to digest (batching) mode when the message rate
+// exceeds the threshold, and back when it drops to the half of it.
+type autoDigest struct {
+	threshold float64       // messages per minute
+	window    time.Duration // of the rate measurement
+	arrivals  []time.Time   // within the window
+	on        bool
+}
+
+func newAutoDigest(threshold float64, window time.Duration) *autoDigest {
+	if window <= 0 {
+		window = time.Minute
+	}
+	return &autoDigest{threshold: threshold, window: window}
+}
+
+// Observe records a message arrival at now, and returns whether digest mode is on.
+func (d *autoDigest) Observe(now time.Time) bool {
+	d.arrivals = append(d.arrivals, now)
+	return d.Active(now)
+}
+
+// Active returns whether digest mode is on at now: it is switched on when
+// the rate is above the threshold, and switched off when it is at most the
+// half of the threshold, to avoid flapping.
+func (d *autoDigest) Active(now time.Time) bool {
+	i := 0
+	for i < len(d.arrivals) && now.Sub(d.arrivals[i]) >= d.window {
+		i++
+	}
+	d.arrivals = d.arrivals[i:]
+	rate := float64(len(d.arrivals)) / d.window.Minutes()
+	if !d.on && rate > d.threshold {
+		d.on = true
+	} else if d.on && rate <= d.threshold/2 {
+		d.on = false
+	}
+	return d.on
+}
@@ -0,0 +1,70 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutoDigestTransitions(t *testing.T) {
+	d := newAutoDigest(10, time.Minute) // 10 messages per minute
+	now := time.Date(2013, 11, 12, 13, 0, 0, 0, time.UTC)
+	observe := func(n int, every time.Duration) bool {
+		var on bool
+		for i := 0; i < n; i++ {
+			now = now.Add(every)
+			on = d.Observe(now)
+		}
+		return on
+	}
+	if observe(5, 6*time.Second) {
+		t.Error("digest mode at 5/min")
+	}
+	if !observe(10, time.Second) {
+		t.Error("no digest mode at 15/min")
+	}
+	// 8/min is below the threshold, but above its half: stay in digest mode
+	if !observe(8, 7500*time.Millisecond) {
+		t.Error("digest mode left at 8/min")
+	}
+	// a quiet minute
+	now = now.Add(time.Minute)
+	if d.Active(now) {
+		t.Error("digest mode kept without messages")
+	}
+	if observe(1, time.Second) {
+		t.Error("digest mode after a quiet minute")
+	}
+}
+
+func TestAutoDigestRun(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"}, hostport: srv.Addr(),
+		digest: newAutoDigest(2, time.Minute)}
+	runner := newTestRunner()
+	for _, host := range []string{"web-01", "web-02", "web-03", "web-04", "web-05"} {
+		runner.send(newTestMessage(3, host, "disk full"))
+	}
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+	// two individual emails, then one digest of three messages
+	msgs := srv.Messages()
+	if len(msgs) != 3 {
+		t.Fatalf("got %d emails, wanted 3", len(msgs))
+	}
+	if subject := subjectOf(msgs[2].Data); subject != "2013-11-12T13:14:15Z [3] test@web-03: disk full (+2 more)" {
+		t.Errorf("got digest subject %q", subject)
+	}
+}
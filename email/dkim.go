@@ -0,0 +1,210 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dkimHeaders are the headers signed, if present (From always is).
+var dkimHeaders = []string{"From", "Sender", "Reply-To", "To", "Cc", "Subject", "Date",
+	"Message-Id", "In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding"}
+
+// dkimSigner signs the emails with DKIM (RFC 6376), rsa-sha256 with the
+// relaxed/relaxed canonicalization.
+type dkimSigner struct {
+	domain, selector string
+	key              *rsa.PrivateKey
+	now              func() time.Time
+}
+
+// newDKIMSigner returns the signer with the RSA private key read from
+// the PEM file keyFile (PKCS #1 or PKCS #8).
+func newDKIMSigner(domain, selector, keyFile string) (*dkimSigner, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", keyFile)
+	}
+	var key *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var k interface{}
+		if k, err = x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+			var ok bool
+			if key, ok = k.(*rsa.PrivateKey); !ok {
+				err = fmt.Errorf("%T is not an RSA key", k)
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bad key in %s: %s", keyFile, err)
+	}
+	return &dkimSigner{domain: domain, selector: selector, key: key, now: time.Now}, nil
+}
+
+// Sign returns the email with the DKIM-Signature header prepended.
+// The bare LFs of the email are turned into CRLFs first.
+func (s *dkimSigner) Sign(msg []byte) ([]byte, error) {
+	msg = toCRLF(msg)
+	header, body := msg, []byte(nil)
+	if i := bytes.Index(msg, []byte("\r\n\r\n")); i >= 0 {
+		header, body = msg[:i+2], msg[i+4:]
+	}
+	fields := headerFields(header)
+	bh := sha256.Sum256(relaxedBody(body))
+
+	h := sha256.New()
+	var names []string
+	for _, name := range dkimHeaders {
+		// the repeated headers are signed from the bottom up
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.EqualFold(fieldName(fields[i]), name) {
+				h.Write(relaxedHeader(fields[i]))
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == 0 || !strings.EqualFold(names[0], "From") {
+		return nil, errors.New("DKIM signing needs a From header")
+	}
+	sig := "DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=" + s.domain +
+		"; s=" + s.selector + ";\r\n\tt=" + strconv.FormatInt(s.now().Unix(), 10) +
+		"; h=" + strings.Join(names, ":") +
+		";\r\n\tbh=" + base64.StdEncoding.EncodeToString(bh[:]) + ";\r\n\tb="
+	h.Write(bytes.TrimSuffix(relaxedHeader([]byte(sig)), []byte("\r\n")))
+	b, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	signed := bytes.NewBuffer(make([]byte, 0, len(sig)+len(b)*2+len(msg)))
+	signed.WriteString(sig)
+	b64 := base64.StdEncoding.EncodeToString(b)
+	for len(b64) > 72 {
+		signed.WriteString(b64[:72])
+		signed.WriteString("\r\n\t")
+		b64 = b64[72:]
+	}
+	signed.WriteString(b64)
+	signed.WriteString("\r\n")
+	signed.Write(msg)
+	return signed.Bytes(), nil
+}
+
+// toCRLF returns msg with its bare LFs turned into CRLFs.
+func toCRLF(msg []byte) []byte {
+	if bytes.Count(msg, []byte("\n")) == bytes.Count(msg, []byte("\r\n")) {
+		return msg
+	}
+	b := make([]byte, 0, len(msg)+len(msg)/32)
+	for i, c := range msg {
+		if c == '\n' && (i == 0 || msg[i-1] != '\r') {
+			b = append(b, '\r')
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// headerFields splits the header into its fields, with their continuation
+// lines and the ending CRLFs.
+func headerFields(header []byte) [][]byte {
+	var fields [][]byte
+	for len(header) > 0 {
+		end := 0
+		for {
+			i := bytes.Index(header[end:], []byte("\r\n"))
+			if i < 0 {
+				end = len(header)
+				break
+			}
+			end += i + 2
+			if end == len(header) || (header[end] != ' ' && header[end] != '\t') {
+				break
+			}
+		}
+		fields = append(fields, header[:end])
+		header = header[end:]
+	}
+	return fields
+}
+
+// fieldName returns the name of the header field.
+func fieldName(field []byte) string {
+	if i := bytes.IndexByte(field, ':'); i >= 0 {
+		return strings.TrimSpace(string(field[:i]))
+	}
+	return ""
+}
+
+// relaxedHeader returns the header field in the relaxed canonical form:
+// lowercase name, unfolded value with the whitespace runs compressed.
+func relaxedHeader(field []byte) []byte {
+	i := bytes.IndexByte(field, ':')
+	if i < 0 {
+		return nil
+	}
+	value := bytes.Replace(field[i+1:], []byte("\r\n"), nil, -1)
+	return []byte(strings.ToLower(strings.TrimRight(string(field[:i]), " \t")) + ":" +
+		string(bytes.TrimSpace(compressWSP(value))) + "\r\n")
+}
+
+// relaxedBody returns the body in the relaxed canonical form: whitespace
+// runs compressed, without trailing whitespace and empty lines.
+func relaxedBody(body []byte) []byte {
+	lines := bytes.Split(toCRLF(body), []byte("\r\n"))
+	for len(lines) > 0 && len(bytes.TrimRight(lines[len(lines)-1], " \t")) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	var b bytes.Buffer
+	for _, line := range lines {
+		b.Write(bytes.TrimRight(compressWSP(line), " "))
+		b.WriteString("\r\n")
+	}
+	return b.Bytes()
+}
+
+// compressWSP replaces the runs of spaces and tabs with a single space.
+func compressWSP(p []byte) []byte {
+	b := make([]byte, 0, len(p))
+	for i, c := range p {
+		if c == ' ' || c == '\t' {
+			if i > 0 && (p[i-1] == ' ' || p[i-1] == '\t') {
+				continue
+			}
+			c = ' '
+		}
+		b = append(b, c)
+	}
+	return b
+}
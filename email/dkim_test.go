@@ -0,0 +1,158 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDKIMCanonicalization(t *testing.T) {
+	// the example of RFC 6376 3.4.5
+	var got []byte
+	for _, field := range headerFields([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n")) {
+		got = append(got, relaxedHeader(field)...)
+	}
+	if want := "a:X\r\nb:Y Z\r\n"; string(got) != want {
+		t.Errorf("got headers %q, wanted %q", got, want)
+	}
+	if got, want := relaxedBody([]byte(" C \r\nD \t E\r\n\r\n\r\n")), " C\r\nD E\r\n"; string(got) != want {
+		t.Errorf("got body %q, wanted %q", got, want)
+	}
+	if got := relaxedBody([]byte("\r\n\r\n")); len(got) != 0 {
+		t.Errorf("got %q for an empty body", got)
+	}
+}
+
+func TestDKIMSign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "heka-email-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, keyFile := writeDKIMKey(t, dir)
+
+	srv := startFakeSMTP(t, "8BITMIME")
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.DKIMDomain, conf.DKIMSelector, conf.DKIMKeyFile = "example.com", "heka", keyFile
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	o.opts.dkim.now = func() time.Time { return time.Unix(1384262055, 0) }
+	body := "From: heka@example.com\r\nTo: ops@example.com\r\nSubject:  disk\r\n\tfull\r\n" +
+		"X-Unsigned: 1\r\n\r\nthe disk  is full \r\n\r\n"
+	if err := o.sendMail([]byte(body), envelope{}); err != nil {
+		t.Fatal(err)
+	}
+	msgs := srv.Messages()
+	data := msgs[len(msgs)-1].Data
+	if !bytes.HasPrefix(data, []byte("DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=heka;\r\n\tt=1384262055; h=From:To:Subject;")) {
+		t.Fatalf("got %q", data)
+	}
+	if err := verifyDKIM(data, &key.PublicKey); err != nil {
+		t.Error(err)
+	}
+	// a changed body fails the verification
+	changed := bytes.Replace(data, []byte("full \r\n"), []byte("empty\r\n"), 1)
+	if err := verifyDKIM(changed, &key.PublicKey); err == nil {
+		t.Error("the changed email is verified")
+	}
+
+	for _, c := range []EmailOutputConfig{
+		{Address: "localhost", DKIMDomain: "example.com", DKIMKeyFile: keyFile},
+		{Address: "localhost", DKIMDomain: "example.com", DKIMSelector: "heka",
+			DKIMKeyFile: filepath.Join(dir, "missing.pem")},
+		{Address: "localhost", DKIMDomain: "example.com", DKIMSelector: "heka", DKIMKeyFile: dkimTestFile(t, dir, "junk")},
+	} {
+		if err := new(EmailOutput).Init(&c); err == nil || !strings.Contains(err.Error(), "dkim_") {
+			t.Errorf("%+v: got %v, wanted a dkim error", c, err)
+		}
+	}
+}
+
+// verifyDKIM verifies the DKIM-Signature of the email, the first header.
+func verifyDKIM(data []byte, pub *rsa.PublicKey) error {
+	fields := headerFields(data[:bytes.Index(data, []byte("\r\n\r\n"))+2])
+	sigField := fields[0]
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(string(sigField[len("DKIM-Signature:"):]), ";") {
+		if i := strings.IndexByte(tag, '='); i >= 0 {
+			tags[strings.TrimSpace(tag[:i])] = strings.Join(strings.Fields(tag[i+1:]), "")
+		}
+	}
+	bh := sha256.Sum256(relaxedBody(data[bytes.Index(data, []byte("\r\n\r\n"))+4:]))
+	if got := base64.StdEncoding.EncodeToString(bh[:]); got != tags["bh"] {
+		return errors.New("body hash mismatch")
+	}
+	h := sha256.New()
+	used := make(map[string]int)
+	for _, name := range strings.Split(tags["h"], ":") {
+		// the repeated headers are taken from the bottom up
+		seen := 0
+		for i := len(fields) - 1; i > 0; i-- {
+			if strings.EqualFold(fieldName(fields[i]), name) {
+				if seen == used[name] {
+					h.Write(relaxedHeader(fields[i]))
+					break
+				}
+				seen++
+			}
+		}
+		used[name]++
+	}
+	// the signature itself, with an empty b=
+	unsigned := sigField[:bytes.LastIndex(sigField, []byte("b="))+2]
+	h.Write(bytes.TrimSuffix(relaxedHeader(unsigned), []byte("\r\n")))
+	b, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	return rsa.VerifyPKCS1v15(pub, crypto.SHA256, h.Sum(nil), b)
+}
+
+// writeDKIMKey writes a new RSA private key into dir, returning it and its file.
+func writeDKIMKey(t *testing.T, dir string) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return key, dkimTestFile(t, dir, string(data))
+}
+
+// dkimTestFile writes the content into a new file in dir, returning its name.
+func dkimTestFile(t *testing.T, dir, content string) string {
+	fh, err := ioutil.TempFile(dir, "dkim-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	if _, err := fh.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return fh.Name()
+}
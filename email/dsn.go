@@ -0,0 +1,58 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// dsnDefaultNotify is the NOTIFY parameter when DSN is requested with "true".
+const dsnDefaultNotify = "SUCCESS,FAILURE"
+
+// dsnNotify returns the RFC 3461 NOTIFY parameter requested by the message's
+// request_dsn field, or "" if the message does not request DSN.
+//
+// The field may be a boolean, or a string: "true" (the same as true),
+// or the NOTIFY list itself, e.g. "SUCCESS,FAILURE,DELAY" or "NEVER".
+func dsnNotify(msg *message.Message) string {
+	v, ok := msg.GetFieldValue("request_dsn")
+	if !ok {
+		return ""
+	}
+	switch x := v.(type) {
+	case bool:
+		if x {
+			return dsnDefaultNotify
+		}
+	case string:
+		x = strings.ToUpper(strings.TrimSpace(x))
+		switch x {
+		case "", "FALSE", "NO", "0":
+			return ""
+		case "TRUE", "YES", "1":
+			return dsnDefaultNotify
+		case "NEVER":
+			return x
+		}
+		for _, kw := range strings.Split(x, ",") {
+			switch kw {
+			case "SUCCESS", "FAILURE", "DELAY":
+			default:
+				return ""
+			}
+		}
+		return x
+	}
+	return ""
+}
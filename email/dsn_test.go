@@ -0,0 +1,89 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/tgulacsi/heka-plugins/email/testutil"
+)
+
+func TestDSNNotify(t *testing.T) {
+	for i, tc := range []struct {
+		value interface{}
+		want  string
+	}{
+		{nil, ""},
+		{true, "SUCCESS,FAILURE"},
+		{false, ""},
+		{"yes", "SUCCESS,FAILURE"},
+		{"no", ""},
+		{"never", "NEVER"},
+		{"success,delay", "SUCCESS,DELAY"},
+		{"NEVER,SUCCESS", ""},
+		{"SUCCESS,SOMETIMES", ""},
+	} {
+		msg := newTestMessage(3, "web-01", "disk full")
+		if tc.value != nil {
+			addField(msg, "request_dsn", tc.value, "")
+		}
+		if got := dsnNotify(msg); got != tc.want {
+			t.Errorf("%d. %v: got %q, wanted %q", i, tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestDSN(t *testing.T) {
+	send := func(srv *testutil.FakeSMTP, msg *message.Message) {
+		o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"}, hostport: srv.Addr()}
+		runner := newTestRunner()
+		runner.send(msg)
+		close(runner.inChan)
+		if err := o.Run(runner, testHelper{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	requesting := newTestMessage(3, "web-01", "disk full")
+	addField(requesting, "request_dsn", true, "")
+
+	srv := startFakeSMTP(t, "DSN")
+	send(srv, requesting)
+	if mail := findCommand(srv.Commands(), "MAIL FROM"); mail != "MAIL FROM:<heka@example.com> RET=HDRS" {
+		t.Errorf("got %q, wanted RET=HDRS", mail)
+	}
+	if rcpt := findCommand(srv.Commands(), "RCPT TO"); rcpt != "RCPT TO:<ops@example.com> NOTIFY=SUCCESS,FAILURE" {
+		t.Errorf("got %q, wanted NOTIFY=SUCCESS,FAILURE", rcpt)
+	}
+
+	// not requested
+	srv = startFakeSMTP(t, "DSN")
+	send(srv, newTestMessage(3, "web-01", "disk full"))
+	for _, cmd := range srv.Commands() {
+		if strings.Contains(cmd, "RET=") || strings.Contains(cmd, "NOTIFY=") {
+			t.Errorf("DSN parameter without request: %q", cmd)
+		}
+	}
+
+	// requested, but the server does not support DSN
+	srv = startFakeSMTP(t)
+	send(srv, requesting)
+	for _, cmd := range srv.Commands() {
+		if strings.Contains(cmd, "RET=") || strings.Contains(cmd, "NOTIFY=") {
+			t.Errorf("DSN parameter without the extension: %q", cmd)
+		}
+	}
+	if len(srv.Messages()) != 1 {
+		t.Error("message not sent without DSN support")
+	}
+}
@@ -0,0 +1,459 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// InboundType is the type of the messages injected by EmailInput.
+const InboundType = "email_received"
+
+// ErrPlaintextAuth is returned instead of sending the credentials over
+// an unencrypted connection, unless allow_plaintext_auth is set.
+var ErrPlaintextAuth = errors.New("refusing to log in over an unencrypted connection")
+
+// EmailInput polls an IMAP folder (or a POP3 mailbox), injecting the new
+// emails into the pipeline.
+type EmailInput struct {
+	addr               string
+	username, password string
+	folder             string
+	interval           time.Duration
+	delete             bool // delete the ingested emails, instead of marking them seen
+	implicitTLS        bool
+	requireTLS         bool // fail without STARTTLS
+	plaintextAuth      bool // log in without TLS, too
+	tlsConfig          *tls.Config
+	pop3               bool
+	// hwm is the UIDL of the last ingested POP3 message (the high-water
+	// mark), kept in uidlFile if set
+	hwm, uidlFile string
+
+	runner   pipeline.InputRunner
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// EmailInputConfig is the config of EmailInput.
+type EmailInputConfig struct {
+	// Protocol is "imap" (the default) or "pop3".
+	Protocol string `toml:"protocol"`
+	// Address is the host:port of the IMAP (or POP3) server.
+	Address string `toml:"address"`
+	// Username and Password are used for LOGIN, if Username is set.
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	// Folder is the polled IMAP folder, INBOX by default.
+	Folder string `toml:"folder"`
+	// PollInterval is the time between the polls, 1m by default.
+	PollInterval string `toml:"poll_interval"`
+	// AfterIngest says what to do with the ingested emails: mark them
+	// "seen" (the default, polling the unseen ones), or "delete" them
+	// (polling all of them). With POP3, the seen emails are left on the
+	// server, and the ones after the last ingested one (by UIDL) are new.
+	AfterIngest string `toml:"after_ingest"`
+	// UIDLFile keeps the UIDL of the last ingested POP3 email across the
+	// restarts, so the emails left on the server are not ingested again.
+	UIDLFile string `toml:"uidl_file"`
+	// ImplicitTLS connects with TLS from the start (IMAPS, usually port 993),
+	// instead of upgrading the connection with STARTTLS if possible.
+	ImplicitTLS bool `toml:"implicit_tls"`
+	// RequireTLS fails the polls if the server does not support STARTTLS
+	// (STLS with POP3).
+	RequireTLS bool `toml:"require_tls"`
+	// AllowPlaintextAuth allows the LOGIN (USER and PASS with POP3) over an
+	// unencrypted connection (without TLS or STARTTLS), sending the password
+	// in the clear.
+	AllowPlaintextAuth bool `toml:"allow_plaintext_auth"`
+	NoCertCheck        bool `toml:"no_cert_check"`
+	// ClientCertFile and ClientKeyFile are the PEM files of the client
+	// certificate presented to the server, if it asks for one.
+	ClientCertFile string `toml:"client_cert_file"`
+	ClientKeyFile  string `toml:"client_key_file"`
+}
+
+// ConfigStruct returns the default config.
+func (in *EmailInput) ConfigStruct() interface{} {
+	return &EmailInputConfig{Protocol: "imap", Folder: "INBOX", PollInterval: "1m", AfterIngest: "seen"}
+}
+
+// Init checks the config.
+func (in *EmailInput) Init(config interface{}) error {
+	conf := config.(*EmailInputConfig)
+	if conf.Address == "" {
+		return errors.New("address is needed")
+	}
+	switch conf.Protocol {
+	case "", "imap":
+		in.pop3 = false
+	case "pop3":
+		in.pop3 = true
+	default:
+		return fmt.Errorf("unknown protocol %q (should be imap or pop3)", conf.Protocol)
+	}
+	in.addr, in.username, in.password = conf.Address, conf.Username, conf.Password
+	if in.folder = conf.Folder; in.folder == "" {
+		in.folder = "INBOX"
+	}
+	d, err := time.ParseDuration(conf.PollInterval)
+	if err == nil && d <= 0 {
+		err = errors.New("not positive")
+	}
+	if err != nil {
+		return fmt.Errorf("bad poll_interval %q: %s", conf.PollInterval, err)
+	}
+	in.interval = d
+	switch conf.AfterIngest {
+	case "", "seen":
+		in.delete = false
+	case "delete":
+		in.delete = true
+	default:
+		return fmt.Errorf("unknown after_ingest %q (should be seen or delete)", conf.AfterIngest)
+	}
+	in.implicitTLS, in.requireTLS, in.plaintextAuth = conf.ImplicitTLS, conf.RequireTLS, conf.AllowPlaintextAuth
+	in.tlsConfig = nil
+	if conf.NoCertCheck {
+		in.tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if in.tlsConfig, err = withClientCert(in.tlsConfig, conf.ClientCertFile, conf.ClientKeyFile); err != nil {
+		return err
+	}
+	in.hwm, in.uidlFile = "", conf.UIDLFile
+	if in.uidlFile != "" {
+		b, err := ioutil.ReadFile(in.uidlFile)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("bad uidl_file: %s", err)
+		}
+		in.hwm = strings.TrimSpace(string(b))
+	}
+	in.stop, in.stopOnce = make(chan struct{}), sync.Once{}
+	return nil
+}
+
+// Run polls the folder till Stop.
+func (in *EmailInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) error {
+	in.runner = ir
+	ticker := time.NewTicker(in.interval)
+	defer ticker.Stop()
+	for {
+		if err := in.poll(); err != nil {
+			ir.LogError(fmt.Errorf("polling %s of %s: %s", in.folder, in.addr, err))
+		}
+		select {
+		case <-in.stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops Run.
+func (in *EmailInput) Stop() {
+	in.stopOnce.Do(func() { close(in.stop) })
+}
+
+// poll injects the new emails, marking them seen or deleting them.
+func (in *EmailInput) poll() error {
+	if in.pop3 {
+		return in.pollPOP3()
+	}
+	return in.pollIMAP()
+}
+
+// pollIMAP injects the new emails of the folder.
+func (in *EmailInput) pollIMAP() error {
+	c, err := dialIMAP(in.addr, in.tlsConfig, in.implicitTLS, DefaultTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if !c.isTLS {
+		caps, err := c.Capabilities()
+		if err != nil {
+			return err
+		}
+		if caps["STARTTLS"] {
+			if err = c.StartTLS(in.tlsConfig); err != nil {
+				return err
+			}
+		} else if in.requireTLS {
+			return ErrStartTLSUnsupported
+		}
+	}
+	if in.username != "" {
+		if !c.isTLS && !in.plaintextAuth {
+			return ErrPlaintextAuth
+		}
+		if err = c.Login(in.username, in.password); err != nil {
+			return err
+		}
+	}
+	if err = c.Select(in.folder); err != nil {
+		return err
+	}
+	criteria, flag := "UNSEEN", `\Seen`
+	if in.delete {
+		criteria, flag = "UNDELETED", `\Deleted`
+	}
+	uids, err := c.Search(criteria)
+	if err != nil {
+		return err
+	}
+	var ingested int
+	for _, uid := range uids {
+		data, err := c.Fetch(uid)
+		if err != nil {
+			return err
+		}
+		if !in.inject(data) {
+			break
+		}
+		if err = c.AddFlag(uid, flag); err != nil {
+			return err
+		}
+		ingested++
+	}
+	if in.delete && ingested > 0 {
+		if err = c.Expunge(); err != nil {
+			return err
+		}
+	}
+	return c.Logout()
+}
+
+// pollPOP3 injects the emails after the high-water mark (all of them, if it
+// is not on the server anymore), deleting them or moving the mark after them.
+func (in *EmailInput) pollPOP3() error {
+	c, err := dialPOP3(in.addr, in.tlsConfig, in.implicitTLS, DefaultTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if !c.isTLS {
+		caps, err := c.Capabilities()
+		if err != nil {
+			return err
+		}
+		if caps["STLS"] {
+			if err = c.StartTLS(in.tlsConfig); err != nil {
+				return err
+			}
+		} else if in.requireTLS {
+			return ErrStartTLSUnsupported
+		}
+	}
+	if in.username != "" {
+		if !c.isTLS && !in.plaintextAuth {
+			return ErrPlaintextAuth
+		}
+		if err = c.Login(in.username, in.password); err != nil {
+			return err
+		}
+	}
+	msgs, err := c.List()
+	if err != nil {
+		return err
+	}
+	if in.hwm != "" {
+		found := false
+		for i, m := range msgs {
+			if found = m.uidl == in.hwm; found {
+				msgs = msgs[i+1:]
+				break
+			}
+		}
+		if !found && !in.delete {
+			in.runner.LogMessage(fmt.Sprintf("the last ingested email (UIDL %s) is gone from %s, ingesting all the %d emails",
+				in.hwm, in.addr, len(msgs)))
+		}
+	}
+	hwm := in.hwm
+	for _, m := range msgs {
+		data, err := c.Retr(m.num)
+		if err != nil {
+			return err
+		}
+		if !in.inject(data) {
+			break
+		}
+		if in.delete {
+			if err = c.Dele(m.num); err != nil {
+				return err
+			}
+		}
+		in.hwm = m.uidl
+	}
+	if in.hwm != hwm && in.uidlFile != "" {
+		if err = saveUIDL(in.uidlFile, in.hwm); err != nil {
+			return fmt.Errorf("error saving the UIDL: %s", err)
+		}
+	}
+	return c.Quit()
+}
+
+// saveUIDL replaces the content of the file with the UIDL.
+func saveUIDL(path, uidl string) error {
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(uidl+"\n"), 0600)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// inject injects the email, reporting false if stopped meanwhile.
+func (in *EmailInput) inject(data []byte) bool {
+	var pack *pipeline.PipelinePack
+	select {
+	case pack = <-in.runner.InChan():
+	case <-in.stop:
+		return false
+	}
+	pack.Message = inboundMessage(data)
+	pack.Message.SetLogger(in.runner.Name())
+	pack.Decoded = true
+	in.runner.Inject(pack)
+	return true
+}
+
+// inboundMessage returns the message of the email: its text as the payload,
+// its subject, from, to and Message-ID as fields, and its date as the timestamp.
+func inboundMessage(data []byte) *message.Message {
+	msg := new(message.Message)
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetType(InboundType)
+	msg.SetSeverity(6)
+	msg.SetPid(int32(os.Getpid()))
+	if hostname, err := os.Hostname(); err == nil {
+		msg.SetHostname(hostname)
+	}
+	ts := time.Now()
+	email, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		msg.SetTimestamp(ts.UnixNano())
+		msg.SetPayload(string(data))
+		return msg
+	}
+	if date, err := email.Header.Date(); err == nil {
+		ts = date
+	}
+	msg.SetTimestamp(ts.UnixNano())
+	dec := new(mime.WordDecoder)
+	for _, h := range []struct{ name, field string }{
+		{"Subject", "subject"}, {"From", "from"}, {"To", "to"}, {"Message-Id", "message_id"},
+	} {
+		if v := email.Header.Get(h.name); v != "" {
+			if decoded, err := dec.DecodeHeader(v); err == nil {
+				v = decoded
+			}
+			addField(msg, h.field, v, "")
+		}
+	}
+	text, err := textOf(email.Header.Get("Content-Type"), email.Header.Get("Content-Transfer-Encoding"), email.Body)
+	if err != nil {
+		text = string(rawBody(data))
+	}
+	msg.SetPayload(text)
+	return msg
+}
+
+// rawBody returns the body of the email, as is.
+func rawBody(data []byte) []byte {
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		return data[i+4:]
+	}
+	if i := bytes.Index(data, []byte("\n\n")); i >= 0 {
+		return data[i+2:]
+	}
+	return nil
+}
+
+// textOf returns the text of the body with the content type and transfer
+// encoding: the decoded body of a text, or the text of the first
+// text/plain (or else text) part of a multipart.
+func textOf(contentType, encoding string, body io.Reader) (string, error) {
+	mediaType, params := "text/plain", map[string]string(nil)
+	if contentType != "" {
+		var err error
+		if mediaType, params, err = mime.ParseMediaType(contentType); err != nil {
+			return "", err
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		if !strings.HasPrefix(mediaType, "text/") {
+			return "", fmt.Errorf("no text in %s", mediaType)
+		}
+		b, err := ioutil.ReadAll(body)
+		return string(b), err
+	}
+	mr := multipart.NewReader(body, params["boundary"])
+	var fallback string
+	var found bool
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		// multipart decodes the quoted-printable parts itself
+		text, err := textOf(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+		if err != nil {
+			continue
+		}
+		ct := strings.ToLower(part.Header.Get("Content-Type"))
+		if ct == "" || strings.HasPrefix(ct, "text/plain") || strings.HasPrefix(ct, "multipart/") {
+			return text, nil
+		}
+		if !found {
+			fallback, found = text, true
+		}
+	}
+	if !found {
+		return "", errors.New("no text part")
+	}
+	return fallback, nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("EmailInput", func() interface{} { return new(EmailInput) })
+}
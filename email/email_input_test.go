@@ -0,0 +1,429 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/tgulacsi/heka-plugins/email/testutil"
+)
+
+// testInputRunner is an InputRunner supplying packs, and collecting
+// the injected messages and the errors.
+// The methods not overridden here panic if called.
+type testInputRunner struct {
+	pipeline.InputRunner
+	packs chan *pipeline.PipelinePack
+
+	mu       sync.Mutex
+	injected []*message.Message
+	errors   []error
+	logged   []string
+}
+
+func newTestInputRunner() *testInputRunner {
+	r := &testInputRunner{packs: make(chan *pipeline.PipelinePack, 100)}
+	for i := 0; i < cap(r.packs); i++ {
+		r.packs <- pipeline.NewPipelinePack(r.packs)
+	}
+	return r
+}
+
+func (r *testInputRunner) Name() string                        { return "EmailInput" }
+func (r *testInputRunner) InChan() chan *pipeline.PipelinePack { return r.packs }
+
+func (r *testInputRunner) Inject(pack *pipeline.PipelinePack) {
+	r.mu.Lock()
+	r.injected = append(r.injected, pack.Message)
+	r.mu.Unlock()
+}
+
+func (r *testInputRunner) LogError(err error) {
+	r.mu.Lock()
+	r.errors = append(r.errors, err)
+	r.mu.Unlock()
+}
+
+func (r *testInputRunner) LogMessage(msg string) {
+	r.mu.Lock()
+	r.logged = append(r.logged, msg)
+	r.mu.Unlock()
+}
+
+// Logged returns the messages logged so far.
+func (r *testInputRunner) Logged() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.logged...)
+}
+
+// Injected returns the messages injected so far.
+func (r *testInputRunner) Injected() []*message.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*message.Message(nil), r.injected...)
+}
+
+// Errors returns the errors logged so far.
+func (r *testInputRunner) Errors() []error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]error(nil), r.errors...)
+}
+
+// runInput runs the input till it has injected n messages (or logged an
+// error, or timed out), then stops it.
+func runInput(t *testing.T, in interface {
+	Run(pipeline.InputRunner, pipeline.PluginHelper) error
+	Stop()
+}, n int) *testInputRunner {
+	runner := newTestInputRunner()
+	done := make(chan error, 1)
+	go func() { done <- in.Run(runner, testHelper{}) }()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if len(runner.Injected()) >= n || len(runner.Errors()) > 0 {
+			break
+		}
+	}
+	in.Stop()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return runner
+}
+
+const (
+	testPlainEmail = "From: Alerts <alerts@example.com>\r\nTo: heka@example.com\r\n" +
+		"Subject: disk full\r\nMessage-Id: <1@example.com>\r\nDate: Tue, 12 Nov 2013 13:14:15 +0000\r\n" +
+		"\r\nthe disk of web-01 is full\r\n"
+	testMultipartEmail = "From: mailer-daemon@example.com\r\nTo: heka@example.com\r\n" +
+		"Subject: =?utf-8?q?k=C3=A9zbes=C3=ADt=C3=A9s?= failed\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b1\r\n\r\n" +
+		"--b1\r\nContent-Type: multipart/alternative; boundary=b2\r\n\r\n" +
+		"--b2\r\nContent-Type: text/html\r\n\r\n<p>html</p>\r\n" +
+		"--b2\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" +
+		"k=C3=A9zbes=C3=ADt=C3=A9s failed: =\r\nno such user\r\n" +
+		"--b2--\r\n" +
+		"--b1\r\nContent-Type: message/delivery-status\r\n\r\nStatus: 5.1.1\r\n" +
+		"--b1--\r\n"
+)
+
+func TestEmailInputIMAP(t *testing.T) {
+	srv := testutil.NewFakeIMAP()
+	srv.StartTLS = true
+	srv.Users = map[string]string{"heka": "secret"}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Add("INBOX", []byte(testPlainEmail))
+	srv.Add("INBOX", []byte(testMultipartEmail))
+
+	in := new(EmailInput)
+	conf := in.ConfigStruct().(*EmailInputConfig)
+	conf.Address, conf.Username, conf.Password = srv.Addr(), "heka", "secret"
+	conf.NoCertCheck, conf.RequireTLS = true, true
+	if err := in.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	runner := runInput(t, in, 2)
+	if errs := runner.Errors(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	msgs := runner.Injected()
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages, wanted 2", len(msgs))
+	}
+	for i, want := range []struct {
+		subject, from, payload string
+	}{
+		{"disk full", "Alerts <alerts@example.com>", "the disk of web-01 is full\r\n"},
+		{"kézbesítés failed", "mailer-daemon@example.com", "kézbesítés failed: no such user"},
+	} {
+		msg := msgs[i]
+		if msg.GetType() != InboundType || msg.GetLogger() != "EmailInput" {
+			t.Errorf("%d. got type %q, logger %q", i+1, msg.GetType(), msg.GetLogger())
+		}
+		if v, _ := msg.GetFieldValue("subject"); v != want.subject {
+			t.Errorf("%d. got subject %q, wanted %q", i+1, v, want.subject)
+		}
+		if v, _ := msg.GetFieldValue("from"); v != want.from {
+			t.Errorf("%d. got from %q, wanted %q", i+1, v, want.from)
+		}
+		if msg.GetPayload() != want.payload {
+			t.Errorf("%d. got payload %q, wanted %q", i+1, msg.GetPayload(), want.payload)
+		}
+	}
+	if ts := time.Unix(0, msgs[0].GetTimestamp()).UTC(); !ts.Equal(time.Date(2013, 11, 12, 13, 14, 15, 0, time.UTC)) {
+		t.Errorf("got timestamp %s", ts)
+	}
+	if v, _ := msgs[0].GetFieldValue("message_id"); v != "<1@example.com>" {
+		t.Errorf("got message_id %q", v)
+	}
+	for _, m := range srv.Mailbox("INBOX") {
+		if !m.Seen || m.Deleted {
+			t.Errorf("got %+v, wanted it seen", m)
+		}
+	}
+
+	// the seen emails are not ingested again
+	srv.Add("INBOX", []byte(testPlainEmail))
+	if err := in.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := runInput(t, in, 1).Injected(); len(msgs) != 1 {
+		t.Errorf("got %d messages, wanted only the new one", len(msgs))
+	}
+}
+
+func TestEmailInputDelete(t *testing.T) {
+	srv := testutil.NewFakeIMAP()
+	srv.ImplicitTLS = true
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Add("Alerts", []byte(testPlainEmail))
+	srv.Add("Alerts", []byte(testPlainEmail))
+
+	in := new(EmailInput)
+	conf := in.ConfigStruct().(*EmailInputConfig)
+	conf.Address, conf.Username, conf.Folder, conf.AfterIngest = srv.Addr(), "heka", "Alerts", "delete"
+	conf.ImplicitTLS, conf.NoCertCheck = true, true
+	if err := in.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	runner := runInput(t, in, 2)
+	if msgs := runner.Injected(); len(msgs) != 2 {
+		t.Errorf("got %d messages, wanted 2 (errors: %v)", len(msgs), runner.Errors())
+	}
+	if msgs := srv.Mailbox("Alerts"); len(msgs) != 0 {
+		t.Errorf("%d emails remained", len(msgs))
+	}
+}
+
+func TestEmailInputRequireTLS(t *testing.T) {
+	srv := testutil.NewFakeIMAP()
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Add("INBOX", []byte(testPlainEmail))
+
+	in := new(EmailInput)
+	conf := in.ConfigStruct().(*EmailInputConfig)
+	conf.Address, conf.RequireTLS = srv.Addr(), true
+	if err := in.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	runner := runInput(t, in, 1)
+	if errs := runner.Errors(); len(errs) != 1 || !strings.Contains(errs[0].Error(), ErrStartTLSUnsupported.Error()) {
+		t.Errorf("got %v, wanted %v", errs, ErrStartTLSUnsupported)
+	}
+	if msgs := runner.Injected(); len(msgs) != 0 {
+		t.Errorf("got %d messages over plaintext", len(msgs))
+	}
+
+	for _, c := range []EmailInputConfig{
+		{},
+		{Address: srv.Addr(), PollInterval: "0s"},
+		{Address: srv.Addr(), PollInterval: "1m", AfterIngest: "archive"},
+		{Address: srv.Addr(), PollInterval: "1m", ClientCertFile: "client.crt"},
+	} {
+		if err := new(EmailInput).Init(&c); err == nil {
+			t.Errorf("%+v accepted", c)
+		}
+	}
+}
+
+func TestEmailInputPlaintextAuth(t *testing.T) {
+	srv := testutil.NewFakeIMAP()
+	srv.Users = map[string]string{"heka": "secret"}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Add("INBOX", []byte(testPlainEmail))
+
+	in := new(EmailInput)
+	conf := in.ConfigStruct().(*EmailInputConfig)
+	conf.Address, conf.Username, conf.Password = srv.Addr(), "heka", "secret"
+	if err := in.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	runner := runInput(t, in, 1)
+	if errs := runner.Errors(); len(errs) != 1 || !strings.Contains(errs[0].Error(), ErrPlaintextAuth.Error()) {
+		t.Errorf("got %v, wanted %v", errs, ErrPlaintextAuth)
+	}
+	if msgs := runner.Injected(); len(msgs) != 0 {
+		t.Errorf("got %d messages without logging in", len(msgs))
+	}
+
+	conf.AllowPlaintextAuth = true
+	if err := in.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	runner = runInput(t, in, 1)
+	if msgs := runner.Injected(); len(msgs) != 1 {
+		t.Errorf("got %d messages, wanted 1 (errors: %v)", len(msgs), runner.Errors())
+	}
+
+	pop := testutil.NewFakePOP3()
+	pop.Users = map[string]string{"heka": "secret"}
+	if err := pop.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pop.Close()
+	pop.Add([]byte(testPlainEmail))
+	conf.Protocol, conf.Address, conf.AllowPlaintextAuth = "pop3", pop.Addr(), false
+	if err := in.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	runner = runInput(t, in, 1)
+	if errs := runner.Errors(); len(errs) != 1 || !strings.Contains(errs[0].Error(), ErrPlaintextAuth.Error()) {
+		t.Errorf("got %v, wanted %v", errs, ErrPlaintextAuth)
+	}
+	for _, cmd := range pop.Commands() {
+		if strings.HasPrefix(cmd, "USER") || strings.HasPrefix(cmd, "PASS") {
+			t.Errorf("sent %q over plaintext", cmd)
+		}
+	}
+
+	conf.AllowPlaintextAuth = true
+	if err := in.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	runner = runInput(t, in, 1)
+	if msgs := runner.Injected(); len(msgs) != 1 {
+		t.Errorf("got %d messages, wanted 1 (errors: %v)", len(msgs), runner.Errors())
+	}
+}
+
+func TestEmailInputPOP3(t *testing.T) {
+	srv := testutil.NewFakePOP3()
+	srv.StartTLS = true
+	srv.Users = map[string]string{"heka": "secret"}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Add([]byte(testPlainEmail))
+	second := srv.Add([]byte(testMultipartEmail))
+
+	dir, err := ioutil.TempDir("", "heka-pop3-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	in := new(EmailInput)
+	conf := in.ConfigStruct().(*EmailInputConfig)
+	conf.Protocol, conf.Address, conf.Username, conf.Password = "pop3", srv.Addr(), "heka", "secret"
+	conf.NoCertCheck, conf.RequireTLS = true, true
+	conf.UIDLFile = filepath.Join(dir, "uidl")
+	if err = in.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	runner := runInput(t, in, 2)
+	if errs := runner.Errors(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	msgs := runner.Injected()
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages, wanted 2", len(msgs))
+	}
+	if v, _ := msgs[1].GetFieldValue("subject"); v != "kézbesítés failed" || msgs[1].GetPayload() != "kézbesítés failed: no such user" {
+		t.Errorf("got subject %q, payload %q", v, msgs[1].GetPayload())
+	}
+	if b, _ := ioutil.ReadFile(conf.UIDLFile); string(b) != second+"\n" {
+		t.Errorf("got UIDL file %q, wanted %q", b, second)
+	}
+	if msgs := srv.Mailbox(); len(msgs) != 2 {
+		t.Errorf("got %d emails on the server, wanted them kept", len(msgs))
+	}
+
+	// after a restart, only the emails after the last ingested one are new
+	third := srv.Add([]byte(testPlainEmail))
+	in = new(EmailInput)
+	if err = in.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := runInput(t, in, 1).Injected(); len(msgs) != 1 {
+		t.Errorf("got %d messages, wanted only the new one", len(msgs))
+	}
+
+	// all are ingested if the last ingested one is gone
+	srv.Remove(third)
+	if err = in.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	runner = runInput(t, in, 2)
+	if msgs := runner.Injected(); len(msgs) != 2 {
+		t.Errorf("got %d messages, wanted 2", len(msgs))
+	}
+	if logged := runner.Logged(); len(logged) != 1 || !strings.Contains(logged[0], third) {
+		t.Errorf("got logged %q", logged)
+	}
+}
+
+func TestEmailInputPOP3Delete(t *testing.T) {
+	srv := testutil.NewFakePOP3()
+	srv.ImplicitTLS = true
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Add([]byte(testPlainEmail))
+	srv.Add([]byte(testPlainEmail))
+
+	in := new(EmailInput)
+	conf := in.ConfigStruct().(*EmailInputConfig)
+	conf.Protocol, conf.Address, conf.Username, conf.AfterIngest = "pop3", srv.Addr(), "heka", "delete"
+	conf.ImplicitTLS, conf.NoCertCheck = true, true
+	if err := in.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	runner := runInput(t, in, 2)
+	if msgs := runner.Injected(); len(msgs) != 2 {
+		t.Errorf("got %d messages, wanted 2 (errors: %v)", len(msgs), runner.Errors())
+	}
+	// the deletions take effect at QUIT, after the injection
+	for deadline := time.Now().Add(time.Second); len(srv.Mailbox()) != 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if msgs := srv.Mailbox(); len(msgs) != 0 {
+		t.Errorf("%d emails remained", len(msgs))
+	}
+
+	srv = testutil.NewFakePOP3()
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	conf.Address, conf.ImplicitTLS, conf.RequireTLS = srv.Addr(), false, true
+	if err := in.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	if errs := runInput(t, in, 1).Errors(); len(errs) != 1 || !strings.Contains(errs[0].Error(), ErrStartTLSUnsupported.Error()) {
+		t.Errorf("got %v, wanted %v", errs, ErrStartTLSUnsupported)
+	}
+	if err := in.Init(&EmailInputConfig{Protocol: "smtp", Address: srv.Addr(), PollInterval: "1m"}); err == nil {
+		t.Error("protocol smtp accepted")
+	}
+}
@@ -12,210 +12,2345 @@
 package email
 
 import (
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
 	"github.com/tgulacsi/heka-plugins/utils"
 
 	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"math/rand"
+	"mime"
 	"net"
+	"net/mail"
 	"net/smtp"
+	"net/textproto"
+	"os"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
+	"unicode/utf8"
 )
 
 // DefaultTimeout is the default timeout
 var DefaultTimeout = 30 * time.Second
 
+// ErrRequireTLSUnsupported is returned when require_tls_chain is set,
+// but the server does not offer REQUIRETLS (RFC 8689) over a TLS session.
+var ErrRequireTLSUnsupported = errors.New("server does not support REQUIRETLS")
+
+// ErrStartTLSUnsupported is returned when the TLS policy requires TLS,
+// but the server does not offer STARTTLS.
+var ErrStartTLSUnsupported = errors.New("server does not support STARTTLS")
+
 // EmailOutput holds the config values for the Email Output plugin
 type EmailOutput struct {
-	From      string
-	To        []string
-	hostport  string
-	auth      smtp.Auth
-	byHost    map[string][]string
-	tlsConfig *tls.Config
+	From     string
+	To       []string
+	Cc       []string
+	Bcc      []string
+	hostport string
+	byHost   map[string][]string
+	opts     smtpOptions
+	// mxCacheTTL is how long the cached MX records are used (forever if not positive)
+	mxCacheTTL time.Duration
+	// tlsPolicy is the STARTTLS policy per recipient domain
+	tlsPolicy map[string]tlsPolicy
+	// requireStartTLS requires TLS with every server (see policyFor)
+	requireStartTLS bool
+	// dane verifies the MX hosts by their TLSA records
+	dane bool
+	// daneResolvers are the validating resolvers of the DANE lookups
+	daneResolvers []string
+	// sts is the MTA-STS policy cache, nil if MTA-STS is not enforced
+	sts *mtaSTS
+	// tlsrpt accumulates the TLS outcomes per domain, if enabled
+	tlsrpt *tlsReporter
+	// batch holds the limits of batching, batching is off if zero
+	batch        batchLimits
+	batchSummary bool
+	// immediate sends the messages of immediateSeverity or more severe
+	// right away, bypassing the batch
+	immediate         bool
+	immediateSeverity int32
+	// severityField is the field overriding the severity of the messages,
+	// by severityMap for the non-numeric values
+	severityField string
+	severityMap   map[string]int32
+	// digest switches to batching at high message rates, if set
+	digest *autoDigest
+	// verifier skips the invalid recipients, if set
+	verifier *recipientVerifier
+	// pending holds back the messages of new conditions, if set
+	pending *pendingAlerts
+	// incidents caps the emails per incident, if set
+	incidents *incidentCap
+	// rollup collects the identical messages, nil if rolling up is off
+	rollup *rollup
+	// summary collects the messages of the digest interval, if set
+	summary *summary
+	// dedup suppresses the duplicate messages, if set
+	dedup *dedup
+	// fallbackRelay is used when all the MX hosts of a domain fail
+	fallbackRelay string
+	// relays are the relays of the addresses config, selected by relayRR
+	// (with relay_weights), or starting with the last good one (lastGoodRelay)
+	relays        []relay
+	relayRR       *weightedRR
+	lastGoodRelay int32
+	// throttles pace the deliveries to the throttled domains
+	throttles map[string]*throttle
+	// pool holds the open connections, nil if they are not reused
+	pool *connPool
+	// batchPool says the pool is only for the emails of a batch with
+	// separate_messages, its connections are quit after the batch
+	batchPool bool
+	// pgpKeys are the recipients' public keys, pgpSkip skips the others
+	pgpKeys map[string]*openpgp.Entity
+	pgpSkip bool
+	// vault holds the client and the secret of the credentials, if read from Vault
+	vault       *vaultClient
+	vaultSecret *vaultSecret
+	emitReceipt bool
+	selfAlert   bool
+	// failures is the number of consecutive failed deliveries
+	failures int
+	// truncMarker is appended to the truncated subjects, with " [truncated]" if truncTag
+	truncMarker string
+	truncTag    bool
+	// locales are the templates per locale, recipientLocales the locale
+	// per (lowercase) recipient address
+	locales          map[string]*localeTemplates
+	recipientLocales map[string]string
+	// stripPrefix matches the prefix removed from the payloads, if set
+	stripPrefix *regexp.Regexp
+	// collapseWS collapses the whitespace of the payloads in the subjects
+	collapseWS bool
+	// tsLayout is the layout of the timestamps of the subjects, time.RFC3339 if empty
+	tsLayout    string
+	contentHash bool
+	// bodyFormatter formats the body of the single message emails, if set
+	bodyFormatter BodyFormatter
+	// bodyTmpl is the template of the body of the single message emails, if set
+	bodyTmpl *template.Template
+	// attachPayload attaches the payloads of the single message emails,
+	// named by attachName (if set), with the content type attachType (if set)
+	attachPayload bool
+	attachName    *template.Template
+	attachType    string
+	// gzipThreshold is the payload size above which it is attached gzipped, if positive
+	gzipThreshold int
+	// threads computes the Thread-Index headers, nil if Outlook threading is off
+	threads *outlookThreads
+	// throughput is the assumed minimal sending speed in bytes per second
+	throughput int
+
+	// tracer exports the spans of the sendings, if tracing is on
+	tracer SpanExporter
+
+	// partialPrepare skips the unreachable recipient domains in Prepare,
+	// listed in unreachable with their errors
+	partialPrepare bool
+	unreachable    map[string]string
+	// prepareJitter is the maximal random delay before Prepare
+	prepareJitter time.Duration
+	// sourceHeaders adds the X-Heka-Pid and X-Heka-EnvVersion headers
+	sourceHeaders bool
+	// headers are the configured header lines (from_name, reply_to and headers)
+	headers []string
+	// priorities are the priorities (high, normal or low) of the severities
+	// 0-7 in the priority headers, nil without add_priority_header
+	priorities []string
+	// subjectLen is the maximal length of the payload in the subject:
+	// subjectPayloadLen if zero, none if negative
+	subjectLen int
+	// minSeverity and maxSeverity are the least and the most severe
+	// severity sent (the greatest and the least number), if filterSeverity
+	filterSeverity           bool
+	minSeverity, maxSeverity int32
+	// loggerWhitelist and loggerBlacklist are the sets of the loggers whose
+	// messages are sent only, and never; nil if not configured
+	loggerWhitelist, loggerBlacklist map[string]bool
+
+	// maildir gets a copy of the sent emails, if set
+	maildir *maildir
+
+	// toField is the message field holding the recipients of the message,
+	// coalesceTo sends each recipient only the messages of a batch addressed to it
+	toField    string
+	coalesceTo bool
+	// allowedDomains are the domains the recipients must be in, if set
+	allowedDomains map[string]bool
+
+	// htmlTmpl renders the HTML alternative of the emails, if set
+	htmlTmpl *htmltemplate.Template
+
+	// runbooks are included in the emails of the matching payloads
+	runbooks []runbook
+
+	// subjectTmpl renders the subjects, if set
+	subjectTmpl *template.Template
+
+	// compressDigest attaches the batches gzipped, with an overview inline
+	compressDigest bool
+
+	// ackBaseURL is the base of the signed ack links, ackSecret is their key
+	ackBaseURL, ackSecret string
+
+	// metrics are served in the Prometheus format at metricsAddr, metricsPath
+	metrics                  sendMetrics
+	metricsAddr, metricsPath string
+
+	// retry retries the transient failures of the sendings
+	retry retryPolicy
+
+	// primary is the recipient listed first in the To header, if set
+	primary string
+
+	// deliveryLog is the JSON log of the sending attempts, if set
+	deliveryLog *rotatingFile
+
+	// requeued are the failed emails to be resent, unless dropOnError
+	requeued    []failedEmail
+	dropOnError bool
+
+	// maxBatchMemory caps the size of the buffered messages,
+	// memoryFlushes counts the flushes forced by it
+	maxBatchMemory int
+	memoryFlushes  int64
+
+	// limiter limits the rate of the emails (with dropOverLimit, rateLimited
+	// counts the emails dropped by it)
+	limiter       *tokenBucket
+	dropOverLimit bool
+	rateLimited   int64
+
+	// retries counts the retries of the failed sendings, dropped the messages
+	// (out of the severity range, or of a filtered logger) and emails (over the rate limit or failed)
+	// not sent, for ReportMsg
+	retries, dropped int64
+	// duplicates counts the messages suppressed by dedup, for ReportMsg
+	duplicates int64
+
+	// runner and helper are set by Run
+	runner pipeline.OutputRunner
+	helper pipeline.PluginHelper
+
+	statusMu sync.Mutex
+	status   map[string]RecipientStatus
+}
+
+// RecipientStatus is the delivery status of one recipient address.
+type RecipientStatus struct {
+	LastAttempt         time.Time // time of the last sending attempt
+	LastError           error     // result of the last attempt, nil on success
+	ConsecutiveFailures int       // number of failed attempts since the last success
+}
+
+// EmailOutputConfig is for reading the configuration file
+type EmailOutputConfig struct {
+	Address     string   `toml:"address"`
+	Username    string   `toml:"username"`
+	Password    string   `toml:"password"`
+	From        string   `toml:"from"`
+	To          []string `toml:"to"`
+	NoCertCheck bool     `toml:"no_cert_check"`
+	// AuthMechanism is the SMTP AUTH mechanism used with the username:
+	// "plain" (the default), "login" (over TLS only), "cram-md5" or "xoauth2".
+	AuthMechanism string `toml:"auth_mechanism"`
+	// Token is the OAuth2 access token of xoauth2 (instead of the password),
+	// or TokenFile is the file holding it, read by Init.
+	Token     string `toml:"token"`
+	TokenFile string `toml:"token_file"`
+	// Addresses are several relays (instead of address), tried in order till
+	// one accepts the email; the last good relay is tried first next time.
+	// With relay_weights, the emails are spread over them by the weights,
+	// failing over to the others in order.
+	Addresses []string `toml:"addresses"`
+	// RelayWeights are the weights of the addresses (1 each by default):
+	// a relay with weight 2 gets twice as many emails as one with weight 1.
+	RelayWeights []int `toml:"relay_weights"`
+	// AuthByBanner selects the auth mechanism ("plain", "login" or "cram-md5")
+	// by regexps matched against the greeting and EHLO response of the relay,
+	// for relays behind one address needing different mechanisms.
+	// The patterns are tried in lexical order, PLAIN is used if none matches.
+	AuthByBanner map[string]string `toml:"auth_by_banner"`
+	// RequireTLS asks the server to relay the message over TLS only
+	// (RFC 8689 REQUIRETLS), if the server supports it.
+	RequireTLS bool `toml:"requiretls"`
+	// RequireTLSChain implies RequireTLS, and aborts the sending
+	// if the server does not support REQUIRETLS.
+	RequireTLSChain bool `toml:"require_tls_chain"`
+	// TLSPolicy is the STARTTLS policy per recipient domain:
+	// "required", "opportunistic" (the default) or "none".
+	TLSPolicy map[string]string `toml:"tls_policy"`
+	// MTASTS enforces the recipient domains' MTA-STS (RFC 8461) policies
+	// when sending directly to the MX hosts.
+	MTASTS bool `toml:"mta_sts"`
+	// EnableDANE verifies the certificates of the MX hosts having DNSSEC
+	// validated TLSA records against them (DANE, RFC 7672) when sending
+	// directly to the MX hosts: STARTTLS is required with them, and the
+	// sending fails if the certificate does not match. The TLSA records of
+	// the MX hosts are used only if the MX records of the domain are DNSSEC
+	// validated too.
+	EnableDANE bool `toml:"enable_dane"`
+	// DANEResolvers are the addresses (host or host:port) of the DNSSEC
+	// validating resolvers asked for the TLSA and MX records of DANE, in turn,
+	// "127.0.0.1:53" by default. Their validation (the AD bit) is trusted, so
+	// they must be on the loopback interface.
+	DANEResolvers []string `toml:"dane_resolvers"`
+	// TLSRPT collects the TLS outcomes of the deliveries to the MX hosts
+	// of the recipient domains publishing TLSRPT (RFC 8460) records.
+	// See ReportMsg and TLSReports.
+	TLSRPT bool `toml:"tlsrpt"`
+	// Batch configures the batching of several messages into one email.
+	Batch BatchConfig `toml:"batch"`
+	// BatchSummary prepends a line with the counts of the messages
+	// per severity and the hosts to the batched emails.
+	BatchSummary bool `toml:"batch_summary"`
+	// ImmediateSeverity sends the messages of this severity or more severe
+	// (e.g. 2 for crit, alert and emerg) at once, each in its own email,
+	// while the less severe ones are batched.
+	// The default, -1, batches every message.
+	ImmediateSeverity int32 `toml:"immediate_severity"`
+	// SeverityField is the message field (e.g. "priority") overriding the
+	// severity of the message in the subject and for immediate_severity.
+	// A numeric value is used as is, the others are mapped by severity_map.
+	SeverityField string `toml:"severity_field"`
+	// SeverityMap maps the values of severity_field to severities
+	// (e.g. P1 = 2, P2 = 3); the unmapped values leave the severity as is.
+	SeverityMap map[string]int32 `toml:"severity_map"`
+	// VaultPath is the path of the HashiCorp Vault secret (e.g. "secret/data/heka/smtp")
+	// holding the "username" and "password", instead of the config.
+	VaultPath string `toml:"vault_path"`
+	// VaultAddr and VaultToken default to the VAULT_ADDR and VAULT_TOKEN environment variables.
+	VaultAddr  string `toml:"vault_addr"`
+	VaultToken string `toml:"vault_token"`
+	// VaultRenew keeps renewing the secret's lease and the token while running.
+	VaultRenew bool `toml:"vault_renew"`
+	// EmitReceipt injects an "email_sent" message with the recipients,
+	// subject and latency into the pipeline after each successful sending.
+	EmitReceipt bool `toml:"emit_receipt"`
+	// SelfAlert injects an "email_delivery_failure" message with severity 2
+	// into the pipeline when sending an email fails, so another output
+	// can escalate the failure of the alerting.
+	SelfAlert bool `toml:"self_alert"`
+	// MaxTotalConns caps the number of concurrent SMTP conversations
+	// (dial to QUIT, or a transaction over a pooled connection; the idle
+	// pooled connections are not counted) of the whole process, all the
+	// email outputs. The limit is set by the last output initialized with
+	// it, so the outputs setting it should agree; 0 leaves it as it is
+	// (no limit if no output sets it).
+	MaxTotalConns int `toml:"max_total_conns"`
+	// SubjectTruncationMarker is appended to the subject when the payload
+	// is truncated in it; defaults to "…".
+	SubjectTruncationMarker string `toml:"subject_truncation_marker"`
+	// SubjectTruncatedTag appends " [truncated]" to the truncated subjects, too.
+	SubjectTruncatedTag bool `toml:"subject_truncated_tag"`
+	// ContentHash adds an "X-Content-Hash: sha256=<hex>" header to the
+	// emails of single messages, with the SHA-256 hash of the payload
+	// (without strip_payload_prefix's match).
+	ContentHash bool `toml:"content_hash"`
+	// Locales are the subject and body templates per locale (e.g. "de").
+	Locales map[string]LocaleConfig `toml:"locales"`
+	// RecipientLocales maps the recipient addresses to their locales:
+	// each locale's recipients get a separate email rendered by its templates,
+	// the others the default one. Only the single message emails are localized.
+	RecipientLocales map[string]string `toml:"recipient_locales"`
+	// StripPayloadPrefix is a regular expression matching the prefix
+	// (e.g. a timestamp and a PID) removed from the payloads in the emails.
+	StripPayloadPrefix string `toml:"strip_payload_prefix"`
+	// CollapseWhitespace collapses the runs of whitespace (tabs, newlines)
+	// of the payload to single spaces in the subject; the body is untouched.
+	CollapseWhitespace bool `toml:"collapse_whitespace"`
+	// TimestampLayout is the Go time layout of the timestamp in the subjects
+	// (e.g. "15:04:05" or "2006.01.02 15:04"), time.RFC3339 by default.
+	TimestampLayout string `toml:"timestamp_layout"`
+	// OutlookThreading adds a Thread-Index header, so the emails of the same
+	// incident (by the fingerprint field, or the subject) are grouped in
+	// Outlook's conversation view.
+	OutlookThreading bool `toml:"outlook_threading"`
+	// BodyFormat is the name of the body formatter of the single message
+	// emails: "text" (the payload), "json" (the whole message),
+	// "markdown-to-html" (the payload rendered as HTML), or one registered
+	// with RegisterBodyFormatter. The batches and rollups are plain text.
+	BodyFormat string `toml:"body_format"`
+	// PendingDuration (e.g. "5m") holds back the first message of a condition
+	// (per fingerprint field, or logger) for this long, and sends it only
+	// if the condition is not resolved (by a message with a true "resolved"
+	// field) in the meantime. Then the condition is firing, and its messages
+	// are sent as usual till resolved.
+	PendingDuration string `toml:"pending_duration"`
+	// MaxEmailsPerIncident caps the number of emails of an incident (per
+	// fingerprint field, or logger): its further messages are suppressed
+	// till it is resolved (by a message with a true "resolved" field).
+	MaxEmailsPerIncident int `toml:"max_emails_per_incident"`
+	// IncidentReminderInterval (e.g. "4h") sends a "still ongoing" reminder
+	// of a capped incident at most this often, when its messages keep arriving.
+	IncidentReminderInterval string `toml:"incident_reminder_interval"`
+	// EscalatingDigest sends the reminders of the capped incidents at
+	// growing intervals instead of incident_reminder_interval, e.g. after
+	// 1m, 3m, 9m... (with max_emails_per_incident 1 by default).
+	EscalatingDigest EscalatingDigestConfig `toml:"escalating_digest"`
+	// RollupWindow (e.g. "5m") rolls up the identical messages arriving
+	// within the window into one email with the count in the subject,
+	// listing the timestamps and hosts of the occurrences.
+	RollupWindow string `toml:"rollup_window"`
+	// RollupBy says which messages are identical: the ones with the same
+	// "subject" (without the timestamp and host; the default), or the
+	// same "fingerprint" field.
+	RollupBy string `toml:"rollup_by"`
+	// TimeoutThroughputBps lengthens the timeout of the SMTP conversation
+	// (30s by default) by the time needed to send the email at this
+	// speed (bytes per second).
+	TimeoutThroughputBps int `toml:"timeout_throughput_bps"`
+	// FallbackRelay is the address (host:port) of the relay used when
+	// none of the MX hosts of a recipient domain accepts the email.
+	// The username and password are used with it.
+	FallbackRelay string `toml:"fallback_relay"`
+	// DomainThrottles limits the number of recipients per minute of the
+	// domains (e.g. gmail.com = 100), pacing the deliveries to them
+	// while the other domains are not delayed.
+	DomainThrottles map[string]int `toml:"domain_throttles"`
+	// ReuseConnections keeps the connection of the last successful sending
+	// open per recipient domain (or relay), and reuses it for the next email,
+	// whether it was made to an MX host or to the fallback relay.
+	ReuseConnections bool `toml:"reuse_connections"`
+	// PoolSize is the maximal number of idle connections kept per recipient
+	// domain (or relay) with reuse_connections, 1 by default. When full, the
+	// least recently used one is closed. See ReportMsg for the pool's counters.
+	PoolSize int `toml:"pool_size"`
+	// PoolIdleTimeout closes the pooled connections idle for longer
+	// (before the server would), "1m" by default.
+	PoolIdleTimeout string `toml:"pool_idle_timeout"`
+	// PGPKeys maps the recipient addresses to their armored public key files:
+	// the emails to them are encrypted (PGP/MIME, RFC 3156).
+	PGPKeys map[string]string `toml:"pgp_keys"`
+	// PGPMissingKey says what to do with the recipients without a key,
+	// when pgp_keys is set: send them "plaintext" (the default), or "skip" them.
+	PGPMissingKey string `toml:"pgp_missing_key"`
+	// DigestRateThreshold switches to batching the messages (digest mode)
+	// when more than this many messages arrive per minute, and back to
+	// individual emails when the rate drops to the half of it.
+	// The digests are sent per the batch limits, or every digest_rate_window.
+	DigestRateThreshold float64 `toml:"digest_rate_threshold"`
+	// DigestRateWindow is the window of the rate measurement, "1m" by default.
+	DigestRateWindow string `toml:"digest_rate_window"`
+	// Tracing records an OpenTelemetry span ("email.send") of each sending,
+	// in the trace of the message's W3C "traceparent" field (if any),
+	// and exports it to tracing_endpoint.
+	Tracing bool `toml:"tracing"`
+	// TracingEndpoint is the OTLP/HTTP (JSON) traces endpoint,
+	// "http://localhost:4318/v1/traces" by default.
+	TracingEndpoint string `toml:"tracing_endpoint"`
+	// PartialPrepare does not fail Init if some of the recipient domains
+	// are unreachable when sending directly to the MX hosts: it logs them
+	// (see also ReportMsg), and sends to the reachable ones only.
+	PartialPrepare bool `toml:"partial_prepare"`
+	// Maildir is a maildir directory where a copy of every sent email is
+	// written, for local inspection or archiving.
+	Maildir string `toml:"maildir"`
+	// PhaseTimeouts override the timeout of the phases of the SMTP
+	// conversation: "greeting", "ehlo", "starttls", "auth", "mail", "rcpt"
+	// and "data" (the upload and its acceptance), e.g. {data = "5m"}.
+	PhaseTimeouts map[string]string `toml:"phase_timeouts"`
+	// StartTLSFallback are the trusted networks (CIDR, e.g. "10.0.0.0/8"):
+	// if the STARTTLS handshake with a server in them fails (e.g. broken by
+	// a middlebox), the email is sent in plaintext (with a warning) instead.
+	// The sending is aborted with the servers outside of them, and when
+	// TLS is required (by tls_policy or DANE).
+	StartTLSFallback []string `toml:"starttls_fallback"`
+	// ToField is the message field holding the recipients of the message
+	// (comma-separated or repeated), instead of to. The messages without it
+	// are sent to the recipients in to.
+	ToField string `toml:"to_field"`
+	// AllowedRecipientDomains are the only domains the emails may be sent to:
+	// Init fails with recipients in other domains, and such recipients
+	// from to_field are dropped (and logged).
+	AllowedRecipientDomains []string `toml:"allowed_recipient_domains"`
+	// CoalesceRecipients sends the recipients of a batch (per to_field) only
+	// the messages addressed to them, in one email per recipient.
+	CoalesceRecipients bool `toml:"coalesce_recipients"`
+	// HTMLTemplate is the html/template of the HTML alternative of the
+	// emails of single messages (multipart/alternative, with the plain text),
+	// executed with the data of the subject template, and the Subject.
+	HTMLTemplate string `toml:"html_template"`
+	// Runbooks map regexps to remediation snippets (or URLs): the emails
+	// of the payloads matching a pattern include its snippet.
+	Runbooks map[string]string `toml:"runbooks"`
+	// Subject is the text/template of the subjects, executed with the
+	// message's Timestamp, Severity, Logger, Hostname, Payload and Fields
+	// (by name), e.g. "[{{.Severity}}] {{.Hostname}}: {{.Payload}}".
+	// The batches get the subject of their first message, with the count.
+	// By default, it is the "timestamp [severity] logger@hostname: " header
+	// with the beginning of the payload.
+	Subject string `toml:"subject"`
+	// CompressDigest sends the batches (digests) as a gzipped attachment,
+	// with a summary and one line per message inline, to spare bandwidth.
+	CompressDigest bool `toml:"compress_digest"`
+	// AckBaseURL is the base URL of the ack links appended to the emails
+	// of single alerts (and sent as a one-click List-Unsubscribe header),
+	// signed with ack_secret (see AckHandler).
+	AckBaseURL string `toml:"ack_base_url"`
+	AckSecret  string `toml:"ack_secret"`
+	// MetricsAddr is the address (e.g. ":9125") of the HTTP server exposing
+	// the statistics (see ReportMsg) and the sending latencies in the
+	// Prometheus text format, while the plugin runs.
+	MetricsAddr string `toml:"metrics_addr"`
+	// MetricsPath is the path of the metrics, "/metrics" by default.
+	MetricsPath string `toml:"metrics_path"`
+	// VerifyRecipients verifies the recipients with SMTP callouts to their
+	// MX hosts (RCPT without DATA), and skips the ones rejected permanently.
+	VerifyRecipients bool `toml:"verify_recipients"`
+	// VerifyCacheTTL is how long the results are cached, "24h" by default.
+	VerifyCacheTTL string `toml:"verify_cache_ttl"`
+	// VerifyInterval is the minimal time between two callouts, "1s" by default.
+	VerifyInterval string `toml:"verify_interval"`
+	// RetryCount is the number of retries of a failed sending, with
+	// exponential backoff. The permanent (5xx) failures are not retried.
+	RetryCount int `toml:"retry_count"`
+	// RetryBaseDelay is the delay before the first retry, doubled by each
+	// further one (plus random jitter), "1s" by default.
+	RetryBaseDelay string `toml:"retry_base_delay"`
+	// MaxBatchMemory is the maximal size (in bytes) of the messages held in
+	// the batch and the rollups: exceeding it, they are sent at once, to
+	// protect the host. See ReportMsg for the count of such flushes.
+	MaxBatchMemory int `toml:"max_batch_memory"`
+	// MailParams are extra MAIL FROM parameters (e.g. "ENVID=alert-1"),
+	// sent only if the server advertises their extensions. The messages
+	// may add their own in the mail_params field (space-separated).
+	MailParams []string `toml:"mail_params"`
+	// PrimaryRecipient is the primary (e.g. on-call) contact: the emails get
+	// a To header listing their recipients, with this one first.
+	PrimaryRecipient string `toml:"primary_recipient"`
+	// ImplicitTLS connects to the relay with TLS from the start (SMTPS,
+	// usually port 465), instead of upgrading the connection with STARTTLS.
+	ImplicitTLS bool `toml:"implicit_tls"`
+	// DeliveryLog is the file of the delivery log: a JSON line of each
+	// sending attempt, with its timestamp, relay, recipients, bytes,
+	// result ("sent" or "failed"), latency (in seconds) and error.
+	DeliveryLog string `toml:"delivery_log"`
+	// DeliveryLogMaxSize is the size (in bytes) the delivery log is rotated
+	// at (to delivery_log.1, .2...), 100MiB by default.
+	DeliveryLogMaxSize int64 `toml:"delivery_log_max_size"`
+	// DeliveryLogBackups is the number of rotated delivery logs kept, 5 by default.
+	DeliveryLogBackups int `toml:"delivery_log_backups"`
+	// Disable8BitMIME sends the 8-bit (e.g. UTF-8) text quoted-printable
+	// encoded even to the servers supporting 8BITMIME, which get it
+	// as is (with BODY=8BITMIME) by default. See transfer_encoding, too.
+	Disable8BitMIME bool `toml:"disable_8bitmime"`
+	// MaxPerInterval limits the number of emails sent per interval
+	// (e.g. 100 per "1h"), with bursts up to the limit.
+	MaxPerInterval int    `toml:"max_per_interval"`
+	Interval       string `toml:"interval"`
+	// OnLimit says what to do with the emails over max_per_interval:
+	// wait till they may be sent ("block", the default), or "drop" them.
+	// See ReportMsg for the count of the dropped ones.
+	OnLimit string `toml:"on_limit"`
+	// DropOnError drops the emails failed to be sent (after the retries).
+	// By default, they are queued (at most 100), and resent before the next email.
+	// The failures are logged, and do not stop the plugin either way.
+	DropOnError bool `toml:"drop_on_error"`
+	// PrepareJitter is the maximal random delay (e.g. "30s") before the MX lookups
+	// and test sends of Prepare, not to hit DNS and the relays with the
+	// Prepares of many Heka instances starting at the same time.
+	PrepareJitter string `toml:"prepare_jitter"`
+	// SourceHeaders adds the X-Heka-Pid and X-Heka-EnvVersion headers
+	// of the message (if set) to its email, to help finding its source.
+	SourceHeaders bool `toml:"source_headers"`
+	// HeloHostname is the name sent in EHLO/HELO, the hostname of the
+	// machine by default. Strict relays reject "localhost", and many check
+	// it against the connecting IP for SPF and reputation.
+	HeloHostname string `toml:"helo_hostname"`
+	// Cc are the recipients copied in the Cc header, Bcc the ones copied
+	// blindly (in no header). They get every email, to_field's, too.
+	Cc  []string `toml:"cc"`
+	Bcc []string `toml:"bcc"`
+	// ReplyTo is the address of the Reply-To header.
+	ReplyTo string `toml:"reply_to"`
+	// Headers are added to every email (e.g. X-Alert-Source = "heka").
+	Headers map[string]string `toml:"headers"`
+	// FromName is the display name of the From header ("Heka Alerts"
+	// <from>), RFC 2047 encoded if needed. The envelope sender is from as is.
+	FromName string `toml:"from_name"`
+	// MinSeverity and MaxSeverity bound the severities (per severity_field)
+	// of the messages sent, the others are dropped. Lower numbers are more
+	// severe (0 is emerg, 7 is debug), so min_severity = 4 sends the warnings
+	// and the more severe ones, max_severity = 1 drops the emergencies.
+	// By default (7 and 0) every message is sent.
+	MinSeverity int32 `toml:"min_severity"`
+	MaxSeverity int32 `toml:"max_severity"`
+	// MXCacheTTL is how long the MX records of the recipient domains are
+	// used from the (process-wide) cache before being looked up again,
+	// "1h" by default. Each output uses its own TTL with the shared records.
+	MXCacheTTL string `toml:"mx_cache_ttl"`
+	// SubjectPayloadLen is the maximal length (in bytes, cut at a character
+	// boundary) of the payload in the subject, 100 by default; 0 leaves it out.
+	SubjectPayloadLen int `toml:"subject_payload_len"`
+	// TransferEncoding is the encoding of the non-ASCII (e.g. UTF-8) text:
+	// "quoted-printable", "base64", or "7bit" to never send 8-bit text, not
+	// even to the servers supporting 8BITMIME (it is quoted-printable then).
+	// By default it goes as is (8bit) to the servers supporting 8BITMIME,
+	// quoted-printable to the others.
+	TransferEncoding string `toml:"transfer_encoding"`
+	// RequireStartTLS never sends in plaintext: the sending fails (before
+	// AUTH and MAIL) if the server does not offer STARTTLS, unless it speaks
+	// TLS already (implicit_tls). Unlike requiretls, it is about the
+	// connection to the server only. By default TLS is opportunistic.
+	RequireStartTLS bool `toml:"require_starttls"`
+	// DigestInterval (e.g. "15m") sends one summary email per interval
+	// instead of the messages: their counts per logger and severity, with
+	// the first and last timestamps and a few sample payloads. The digest
+	// goes to the recipients in to (and cc, bcc).
+	DigestInterval string `toml:"digest_interval"`
+	// DigestSendEmpty sends the digest of the intervals without messages, too.
+	DigestSendEmpty bool `toml:"digest_send_empty"`
+	// DedupWindow (e.g. "10m") suppresses the duplicates of a message sent
+	// within the window, counting them. The first message after the window
+	// notes the count in its subject, "(N duplicates suppressed)", and in
+	// the batch, rollup or digest it is sent in.
+	DedupWindow string `toml:"dedup_window"`
+	// DedupKeyField is the field of the messages which are duplicates if
+	// they have the same value in it; by default (or without the field)
+	// the messages with the same subject (but timestamp) are duplicates.
+	DedupKeyField string `toml:"dedup_key_field"`
+	// BodyTemplate is the text/template of the body of the single message
+	// emails, executed with the data of the subject template (and Subject,
+	// Type, Uuid, Pid and EnvVersion), but with the Fields as strings: the
+	// missing ones are empty, e.g. "{{.Payload}}\n\nservice: {{.Fields.service}}".
+	// It cannot be used with body_format.
+	BodyTemplate string `toml:"body_template"`
+	// AttachPayload attaches the payload of the single message emails as a
+	// file (multipart/mixed), their text being a summary only: the body
+	// template, or the subject. It cannot be used with body_format.
+	AttachPayload bool `toml:"attach_payload"`
+	// AttachmentFilename is the text/template of the attachment's name,
+	// executed with the data of the subject template, e.g.
+	// "{{.Logger}}-{{.Timestamp.Unix}}.json". It is sanitized, and
+	// payload.txt by default.
+	AttachmentFilename string `toml:"attachment_filename"`
+	// AttachmentContentType is the content type of the attachment,
+	// by the extension of its name by default.
+	AttachmentContentType string `toml:"attachment_content_type"`
+	// GzipThreshold attaches the payloads longer than this many bytes
+	// gzipped, as payload.gz (or the attachment_filename with .gz), with
+	// the summary inline; the shorter ones stay inline (or attached as is,
+	// with attach_payload). 0 turns it off.
+	GzipThreshold int `toml:"gzip_threshold"`
+	// ClientCertFile and ClientKeyFile are the PEM files of the client
+	// certificate presented to the servers asking for one (mutual TLS),
+	// both with STARTTLS and implicit_tls.
+	ClientCertFile string `toml:"client_cert_file"`
+	ClientKeyFile  string `toml:"client_key_file"`
+	// ProxyAddress is the host:port of the SOCKS5 proxy to connect to the
+	// servers through, authenticating with ProxyUsername and ProxyPassword
+	// if ProxyUsername is set.
+	ProxyAddress  string `toml:"proxy_address"`
+	ProxyUsername string `toml:"proxy_username"`
+	ProxyPassword string `toml:"proxy_password"`
+	// DKIMDomain, DKIMSelector and DKIMKeyFile (an RSA private key PEM file)
+	// make the emails DKIM signed (relaxed/relaxed), with the public key
+	// published at <dkim_selector>._domainkey.<dkim_domain>.
+	DKIMDomain   string `toml:"dkim_domain"`
+	DKIMSelector string `toml:"dkim_selector"`
+	DKIMKeyFile  string `toml:"dkim_key_file"`
+	// AddPriorityHeader adds the X-Priority, X-MSMail-Priority and Importance
+	// headers, by the severity (per severity_field) of the message: high for
+	// crit and the more severe ones, normal for warn, low for the others.
+	// PriorityMap overrides these, mapping severities (as "4") to priorities.
+	AddPriorityHeader bool              `toml:"add_priority_header"`
+	PriorityMap       map[string]string `toml:"priority_map"`
+	// LoggerWhitelist are the loggers whose messages are sent, the others
+	// are dropped. LoggerBlacklist are the loggers whose messages are
+	// dropped; it is ignored if logger_whitelist is set.
+	LoggerWhitelist []string `toml:"logger_whitelist"`
+	LoggerBlacklist []string `toml:"logger_blacklist"`
+}
+
+// tlsPolicy says whether STARTTLS is used.
+type tlsPolicy int
+
+const (
+	// tlsOpportunistic uses STARTTLS if the server offers it
+	tlsOpportunistic = tlsPolicy(iota)
+	// tlsRequired fails if the server does not offer STARTTLS
+	tlsRequired
+	// tlsNone never uses STARTTLS
+	tlsNone
+)
+
+func parseTLSPolicy(s string) (tlsPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "opportunistic":
+		return tlsOpportunistic, nil
+	case "required":
+		return tlsRequired, nil
+	case "none":
+		return tlsNone, nil
+	}
+	return tlsOpportunistic, fmt.Errorf("unknown TLS policy %q", s)
+}
+
+// ConfigStruct returns the struct for reading the configuration file
+func (o *EmailOutput) ConfigStruct() interface{} {
+	return &EmailOutputConfig{SubjectTruncationMarker: "…", ImmediateSeverity: -1,
+		DeliveryLogMaxSize: 100 << 20, DeliveryLogBackups: 5, MinSeverity: 7, MXCacheTTL: "1h",
+		SubjectPayloadLen: subjectPayloadLen}
+}
+
+// Init initializes the givegn EmailOutput instance by
+// extracting from, to, sid and token value from config
+// and store it on the plugin instance.
+func (o *EmailOutput) Init(config interface{}) error {
+	conf := config.(*EmailOutputConfig)
+	if conf.VaultPath != "" {
+		if err := o.readVault(conf); err != nil {
+			return err
+		}
+	}
+	if conf.Address != "" && len(conf.Addresses) > 0 {
+		return errors.New("both address and addresses are set")
+	}
+	addresses := conf.Addresses
+	if conf.Address != "" {
+		addresses = []string{conf.Address}
+	}
+	secret, err := authSecret(conf)
+	if err != nil {
+		return err
+	}
+	if conf.Username != "" {
+		if _, err = newAuth(conf.AuthMechanism, conf.Username, secret, ""); err != nil {
+			return fmt.Errorf("bad auth_mechanism: %s", err)
+		}
+	}
+	if len(addresses) > 0 {
+		relays, err := newRelays(addresses, conf.AuthMechanism, conf.Username, secret)
+		if err != nil {
+			return err
+		}
+		o.hostport, o.opts.auth = relays[0].addr, relays[0].auth
+		o.relays, o.relayRR, o.lastGoodRelay = nil, nil, 0
+		if len(relays) > 1 {
+			if weights := conf.RelayWeights; len(weights) > 0 {
+				if len(weights) != len(relays) {
+					return fmt.Errorf("relay_weights has %d weights for %d addresses", len(weights), len(relays))
+				}
+				var err error
+				if o.relayRR, err = newWeightedRR(weights); err != nil {
+					return err
+				}
+			}
+			o.relays = relays
+		}
+	} else if len(conf.RelayWeights) > 0 {
+		return errors.New("relay_weights without addresses")
+	}
+	if len(conf.AuthByBanner) > 0 {
+		var err error
+		if o.opts.bannerAuth, err = newBannerAuth(conf.AuthByBanner, conf.Username, secret); err != nil {
+			return err
+		}
+	}
+	o.From, o.To, o.Cc, o.Bcc = conf.From, conf.To, conf.Cc, conf.Bcc
+	if len(conf.AllowedRecipientDomains) > 0 {
+		o.allowedDomains = make(map[string]bool, len(conf.AllowedRecipientDomains))
+		for _, domain := range conf.AllowedRecipientDomains {
+			o.allowedDomains[strings.ToLower(domain)] = true
+		}
+		for _, addr := range o.withCopies(o.To) {
+			if !o.allowed(addr) {
+				return fmt.Errorf("recipient %s is not in allowed_recipient_domains", addr)
+			}
+		}
+	}
+	if conf.NoCertCheck {
+		o.opts.tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	o.opts.dkim = nil
+	if conf.DKIMDomain != "" || conf.DKIMSelector != "" || conf.DKIMKeyFile != "" {
+		if conf.DKIMDomain == "" || conf.DKIMSelector == "" || conf.DKIMKeyFile == "" {
+			return errors.New("dkim_domain, dkim_selector and dkim_key_file must be set together")
+		}
+		var err error
+		if o.opts.dkim, err = newDKIMSigner(conf.DKIMDomain, conf.DKIMSelector, conf.DKIMKeyFile); err != nil {
+			return fmt.Errorf("bad dkim_key_file: %s", err)
+		}
+	}
+	o.opts.proxy = nil
+	if conf.ProxyAddress != "" {
+		var err error
+		if o.opts.proxy, err = newSOCKS5Dialer(conf.ProxyAddress, conf.ProxyUsername, conf.ProxyPassword); err != nil {
+			return fmt.Errorf("bad proxy_address %q: %s", conf.ProxyAddress, err)
+		}
+	} else if conf.ProxyUsername != "" || conf.ProxyPassword != "" {
+		return errors.New("proxy_username and proxy_password need proxy_address")
+	}
+	if o.opts.tlsConfig, err = withClientCert(o.opts.tlsConfig, conf.ClientCertFile, conf.ClientKeyFile); err != nil {
+		return err
+	}
+	o.opts.requireTLS = conf.RequireTLS || conf.RequireTLSChain
+	o.opts.requireTLSChain = conf.RequireTLSChain
+	if len(conf.TLSPolicy) > 0 {
+		o.tlsPolicy = make(map[string]tlsPolicy, len(conf.TLSPolicy))
+		for domain, s := range conf.TLSPolicy {
+			p, err := parseTLSPolicy(s)
+			if err != nil {
+				return fmt.Errorf("tls_policy of %s: %s", domain, err)
+			}
+			if p == tlsNone && conf.RequireStartTLS {
+				return fmt.Errorf("tls_policy of %s: %q contradicts require_starttls", domain, s)
+			}
+			o.tlsPolicy[strings.ToLower(domain)] = p
+		}
+	}
+	if o.requireStartTLS = conf.RequireStartTLS; o.requireStartTLS {
+		o.opts.tlsPolicy = tlsRequired
+	}
+	if conf.MTASTS {
+		o.sts = newMTASTS()
+		o.sts.logger = o.logMessage
+	}
+	if o.dane = conf.EnableDANE; o.dane {
+		if o.daneResolvers, err = parseDANEResolvers(conf.DANEResolvers); err != nil {
+			return err
+		}
+	}
+	if conf.TLSRPT {
+		o.tlsrpt = newTLSReporter()
+	}
+	o.batch = batchLimits{maxCount: conf.Batch.MaxCount, maxBytes: conf.Batch.MaxBytes,
+		separate: conf.Batch.SeparateMessages}
+	if o.batch.separate && len(addresses) > 0 {
+		return errors.New("batch separate_messages needs MX mode (no address)")
+	}
+	if conf.Batch.FlushInterval != "" {
+		d, err := time.ParseDuration(conf.Batch.FlushInterval)
+		if err != nil {
+			return fmt.Errorf("bad batch flush_interval %q: %s", conf.Batch.FlushInterval, err)
+		}
+		o.batch.flushInterval = d
+	}
+	o.batchSummary = conf.BatchSummary
+	o.immediate, o.immediateSeverity = conf.ImmediateSeverity >= 0, conf.ImmediateSeverity
+	o.severityField, o.severityMap = conf.SeverityField, conf.SeverityMap
+	if conf.DigestRateThreshold > 0 {
+		var window time.Duration
+		if conf.DigestRateWindow != "" {
+			var err error
+			if window, err = time.ParseDuration(conf.DigestRateWindow); err != nil {
+				return fmt.Errorf("bad digest_rate_window %q: %s", conf.DigestRateWindow, err)
+			}
+		}
+		o.digest = newAutoDigest(conf.DigestRateThreshold, window)
+	}
+	o.emitReceipt, o.selfAlert = conf.EmitReceipt, conf.SelfAlert
+	o.truncMarker, o.truncTag = conf.SubjectTruncationMarker, conf.SubjectTruncatedTag
+	o.contentHash = conf.ContentHash
+	o.tsLayout = conf.TimestampLayout
+	o.collapseWS = conf.CollapseWhitespace
+	if len(conf.RecipientLocales) > 0 {
+		var err error
+		if o.locales, err = parseLocales(conf.Locales); err != nil {
+			return err
+		}
+		o.recipientLocales = make(map[string]string, len(conf.RecipientLocales))
+		for addr, locale := range conf.RecipientLocales {
+			if _, ok := o.locales[locale]; !ok {
+				return fmt.Errorf("unknown locale %q of %s", locale, addr)
+			}
+			o.recipientLocales[strings.ToLower(addr)] = locale
+		}
+	}
+	if conf.StripPayloadPrefix != "" {
+		var err error
+		if o.stripPrefix, err = regexp.Compile("^(?:" + conf.StripPayloadPrefix + ")"); err != nil {
+			return fmt.Errorf("bad strip_payload_prefix %q: %s", conf.StripPayloadPrefix, err)
+		}
+	}
+	if conf.BodyFormat != "" {
+		var err error
+		if o.bodyFormatter, err = lookupBodyFormatter(conf.BodyFormat); err != nil {
+			return err
+		}
+	}
+	o.bodyTmpl, o.attachName = nil, nil
+	if conf.BodyTemplate != "" {
+		if o.bodyFormatter != nil {
+			return errors.New("both body_format and body_template are set")
+		}
+		var err error
+		if o.bodyTmpl, err = template.New("body").Option("missingkey=zero").Parse(conf.BodyTemplate); err != nil {
+			return fmt.Errorf("bad body_template: %s", err)
+		}
+	}
+	if o.attachPayload = conf.AttachPayload; o.attachPayload {
+		if o.bodyFormatter != nil {
+			return errors.New("both body_format and attach_payload are set")
+		}
+		if conf.AttachmentFilename != "" {
+			var err error
+			if o.attachName, err = template.New("attachment").Parse(conf.AttachmentFilename); err != nil {
+				return fmt.Errorf("bad attachment_filename: %s", err)
+			}
+		}
+		if o.attachType = conf.AttachmentContentType; o.attachType != "" {
+			if _, _, err := mime.ParseMediaType(o.attachType); err != nil {
+				return fmt.Errorf("bad attachment_content_type %q: %s", o.attachType, err)
+			}
+		}
+	}
+	if o.gzipThreshold = conf.GzipThreshold; o.gzipThreshold < 0 {
+		return fmt.Errorf("bad gzip_threshold %d", conf.GzipThreshold)
+	}
+	if conf.OutlookThreading {
+		o.threads = newOutlookThreads()
+	}
+	if conf.TimeoutThroughputBps < 0 {
+		return fmt.Errorf("bad timeout_throughput_bps %d", conf.TimeoutThroughputBps)
+	}
+	o.throughput = conf.TimeoutThroughputBps
+	o.fallbackRelay = conf.FallbackRelay
+	if conf.VerifyRecipients {
+		var err error
+		ttl, interval := 24*time.Hour, time.Second
+		if conf.VerifyCacheTTL != "" {
+			if ttl, err = time.ParseDuration(conf.VerifyCacheTTL); err != nil {
+				return fmt.Errorf("bad verify_cache_ttl %q: %s", conf.VerifyCacheTTL, err)
+			}
+		}
+		if conf.VerifyInterval != "" {
+			if interval, err = time.ParseDuration(conf.VerifyInterval); err != nil {
+				return fmt.Errorf("bad verify_interval %q: %s", conf.VerifyInterval, err)
+			}
+		}
+		o.verifier = newRecipientVerifier(ttl, interval, o.callout)
+		o.verifier.logger = o.logMessage
+	}
+	if len(conf.DomainThrottles) > 0 {
+		var err error
+		if o.throttles, err = newThrottles(conf.DomainThrottles); err != nil {
+			return err
+		}
+	}
+	o.partialPrepare = conf.PartialPrepare
+	o.metricsAddr, o.metricsPath = conf.MetricsAddr, conf.MetricsPath
+	o.toField, o.coalesceTo = conf.ToField, conf.CoalesceRecipients
+	if o.coalesceTo && o.batch.separate {
+		return errors.New("coalesce_recipients and batch separate_messages cannot be combined")
+	}
+	for _, cidr := range conf.StartTLSFallback {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("bad starttls_fallback network %q: %s", cidr, err)
+		}
+		o.opts.starttlsFallback = append(o.opts.starttlsFallback, network)
+	}
+	o.compressDigest = conf.CompressDigest
+	if conf.HTMLTemplate != "" {
+		var err error
+		if o.htmlTmpl, err = htmltemplate.New("html").Parse(conf.HTMLTemplate); err != nil {
+			return fmt.Errorf("bad html_template: %s", err)
+		}
+	}
+	if len(conf.Runbooks) > 0 {
+		var err error
+		if o.runbooks, err = parseRunbooks(conf.Runbooks); err != nil {
+			return err
+		}
+	}
+	if conf.Subject != "" {
+		var err error
+		if o.subjectTmpl, err = template.New("subject").Parse(conf.Subject); err != nil {
+			return fmt.Errorf("bad subject template: %s", err)
+		}
+	}
+	if (conf.AckBaseURL == "") != (conf.AckSecret == "") {
+		return errors.New("ack_base_url and ack_secret must be set together")
+	}
+	o.ackBaseURL, o.ackSecret = conf.AckBaseURL, conf.AckSecret
+	if o.coalesceTo && o.toField == "" {
+		return errors.New("coalesce_recipients without to_field")
+	}
+	if o.metricsPath == "" {
+		o.metricsPath = "/metrics"
+	}
+	if len(conf.PhaseTimeouts) > 0 {
+		var err error
+		if o.opts.phaseTimeouts, err = parsePhaseTimeouts(conf.PhaseTimeouts); err != nil {
+			return err
+		}
+	}
+	if conf.Maildir != "" {
+		var err error
+		if o.maildir, err = newMaildir(conf.Maildir); err != nil {
+			return err
+		}
+	}
+	if conf.PoolSize < 0 {
+		return fmt.Errorf("bad pool_size %d", conf.PoolSize)
+	}
+	o.pool, o.batchPool = nil, false
+	if conf.ReuseConnections {
+		o.pool = newConnPool(conf.PoolSize)
+		o.pool.idleTimeout = time.Minute
+		if conf.PoolIdleTimeout != "" {
+			d, err := time.ParseDuration(conf.PoolIdleTimeout)
+			if err == nil && d <= 0 {
+				err = errors.New("not positive")
+			}
+			if err != nil {
+				return fmt.Errorf("bad pool_idle_timeout %q: %s", conf.PoolIdleTimeout, err)
+			}
+			o.pool.idleTimeout = d
+		}
+	} else if o.batch.separate {
+		o.pool, o.batchPool = newConnPool(1), true
+		o.pool.idleTimeout = time.Minute
+	}
+	if conf.Tracing {
+		endpoint := conf.TracingEndpoint
+		if endpoint == "" {
+			endpoint = "http://localhost:4318/v1/traces"
+		}
+		exporter := newOTLPExporter(endpoint)
+		exporter.logError = o.logError
+		o.tracer = exporter
+	}
+	if len(conf.PGPKeys) > 0 {
+		switch conf.PGPMissingKey {
+		case "", "plaintext":
+		case "skip":
+			o.pgpSkip = true
+		default:
+			return fmt.Errorf("unknown pgp_missing_key %q (should be plaintext or skip)", conf.PGPMissingKey)
+		}
+		keys, err := readPGPKeys(conf.PGPKeys)
+		if err != nil {
+			return err
+		}
+		o.pgpKeys = keys
+	}
+	if conf.PendingDuration != "" {
+		d, err := time.ParseDuration(conf.PendingDuration)
+		if err == nil && d <= 0 {
+			err = errors.New("not positive")
+		}
+		if err != nil {
+			return fmt.Errorf("bad pending_duration %q: %s", conf.PendingDuration, err)
+		}
+		o.pending = newPendingAlerts(d)
+	}
+	maxPerIncident := conf.MaxEmailsPerIncident
+	if maxPerIncident < 0 {
+		return fmt.Errorf("bad max_emails_per_incident %d", maxPerIncident)
+	}
+	if conf.EscalatingDigest.Initial != "" {
+		if conf.IncidentReminderInterval != "" {
+			return errors.New("both incident_reminder_interval and escalating_digest are set")
+		}
+		if maxPerIncident == 0 {
+			maxPerIncident = 1
+		}
+	}
+	if maxPerIncident > 0 {
+		var reminder time.Duration
+		if conf.IncidentReminderInterval != "" {
+			var err error
+			if reminder, err = time.ParseDuration(conf.IncidentReminderInterval); err == nil && reminder <= 0 {
+				err = errors.New("not positive")
+			}
+			if err != nil {
+				return fmt.Errorf("bad incident_reminder_interval %q: %s", conf.IncidentReminderInterval, err)
+			}
+		}
+		o.incidents = newIncidentCap(maxPerIncident, reminder)
+		if conf.EscalatingDigest.Initial != "" {
+			var err error
+			if o.incidents.escalating, err = newEscalation(conf.EscalatingDigest); err != nil {
+				return err
+			}
+		}
+	}
+	if conf.DigestInterval != "" {
+		interval, err := time.ParseDuration(conf.DigestInterval)
+		if err == nil && interval <= 0 {
+			err = errors.New("not positive")
+		}
+		if err != nil {
+			return fmt.Errorf("bad digest_interval %q: %s", conf.DigestInterval, err)
+		}
+		o.summary = newSummary(interval, conf.DigestSendEmpty)
+	}
+	if conf.DedupWindow != "" {
+		window, err := time.ParseDuration(conf.DedupWindow)
+		if err == nil && window <= 0 {
+			err = errors.New("not positive")
+		}
+		if err != nil {
+			return fmt.Errorf("bad dedup_window %q: %s", conf.DedupWindow, err)
+		}
+		o.dedup = newDedup(window, conf.DedupKeyField)
+	}
+	if conf.RollupWindow != "" {
+		window, err := time.ParseDuration(conf.RollupWindow)
+		if err != nil {
+			return fmt.Errorf("bad rollup_window %q: %s", conf.RollupWindow, err)
+		}
+		if o.rollup, err = newRollup(window, conf.RollupBy); err != nil {
+			return err
+		}
+	}
+	if conf.RetryCount < 0 {
+		return fmt.Errorf("bad retry_count %d", conf.RetryCount)
+	}
+	o.retry = retryPolicy{count: conf.RetryCount, baseDelay: time.Second}
+	o.dropOnError = conf.DropOnError
+	if conf.MaxBatchMemory < 0 {
+		return fmt.Errorf("bad max_batch_memory %d", conf.MaxBatchMemory)
+	}
+	o.maxBatchMemory = conf.MaxBatchMemory
+	for _, param := range conf.MailParams {
+		if err := checkMailParam(param); err != nil {
+			return err
+		}
+	}
+	o.opts.mailParams = conf.MailParams
+	o.primary = conf.PrimaryRecipient
+	o.opts.implicitTLS = conf.ImplicitTLS
+	if o.opts.transferEncoding, err = parseTransferEncoding(conf.TransferEncoding); err != nil {
+		return err
+	}
+	if o.opts.transferEncoding == "" && conf.Disable8BitMIME {
+		o.opts.transferEncoding = encodingQuotedPrintable
+	}
+	o.sourceHeaders = conf.SourceHeaders
+	if o.headers, err = configHeaders(conf.ReplyTo, conf.Headers); err != nil {
+		return err
+	}
+	if err = o.initPriorities(conf); err != nil {
+		return err
+	}
+	if conf.MaxSeverity < 0 || conf.MaxSeverity > conf.MinSeverity || conf.MinSeverity > 7 {
+		return fmt.Errorf("bad min_severity %d or max_severity %d (0 <= max_severity <= min_severity <= 7)",
+			conf.MinSeverity, conf.MaxSeverity)
+	}
+	o.minSeverity, o.maxSeverity = conf.MinSeverity, conf.MaxSeverity
+	switch {
+	case conf.SubjectPayloadLen < 0:
+		return fmt.Errorf("bad subject_payload_len %d", conf.SubjectPayloadLen)
+	case conf.SubjectPayloadLen == 0:
+		o.subjectLen = -1
+	default:
+		o.subjectLen = conf.SubjectPayloadLen
+	}
+	o.filterSeverity = conf.MinSeverity < 7 || conf.MaxSeverity > 0
+	o.loggerWhitelist, o.loggerBlacklist = loggerSet(conf.LoggerWhitelist), loggerSet(conf.LoggerBlacklist)
+	if conf.FromName != "" {
+		from := mail.Address{Name: conf.FromName, Address: conf.From}
+		o.headers = append([]string{"From: " + from.String()}, o.headers...)
+	}
+	if o.opts.heloName = conf.HeloHostname; o.opts.heloName == "" {
+		// without a hostname, hello sends localhost
+		o.opts.heloName, _ = os.Hostname()
+	}
+	o.opts.logger = o.logMessage
+	if conf.DeliveryLog != "" {
+		if conf.DeliveryLogMaxSize < 0 || conf.DeliveryLogBackups < 0 {
+			return fmt.Errorf("bad delivery_log_max_size %d or delivery_log_backups %d",
+				conf.DeliveryLogMaxSize, conf.DeliveryLogBackups)
+		}
+		if o.deliveryLog != nil {
+			o.deliveryLog.Close()
+		}
+		var err error
+		if o.deliveryLog, err = openRotatingFile(conf.DeliveryLog,
+			conf.DeliveryLogMaxSize, conf.DeliveryLogBackups); err != nil {
+			return fmt.Errorf("cannot open delivery_log: %s", err)
+		}
+	}
+	if conf.MaxPerInterval < 0 {
+		return fmt.Errorf("bad max_per_interval %d", conf.MaxPerInterval)
+	}
+	if conf.MaxPerInterval > 0 {
+		interval, err := time.ParseDuration(conf.Interval)
+		if err == nil && interval <= 0 {
+			err = errors.New("not positive")
+		}
+		if err != nil {
+			return fmt.Errorf("bad interval %q: %s", conf.Interval, err)
+		}
+		if o.dropOverLimit, err = parseOnLimit(conf.OnLimit); err != nil {
+			return err
+		}
+		o.limiter = newTokenBucket(conf.MaxPerInterval, interval, time.Now())
+	}
+	if conf.RetryBaseDelay != "" {
+		d, err := time.ParseDuration(conf.RetryBaseDelay)
+		if err == nil && d <= 0 {
+			err = errors.New("not positive")
+		}
+		if err != nil {
+			return fmt.Errorf("bad retry_base_delay %q: %s", conf.RetryBaseDelay, err)
+		}
+		o.retry.baseDelay = d
+	}
+	if conf.MaxTotalConns < 0 {
+		return fmt.Errorf("bad max_total_conns %d", conf.MaxTotalConns)
+	}
+	totalConns.Limit(conf.MaxTotalConns)
+	o.mxCacheTTL = 0
+	if conf.MXCacheTTL != "" {
+		d, err := time.ParseDuration(conf.MXCacheTTL)
+		if err == nil && d <= 0 {
+			err = errors.New("not positive")
+		}
+		if err != nil {
+			return fmt.Errorf("bad mx_cache_ttl %q: %s", conf.MXCacheTTL, err)
+		}
+		o.mxCacheTTL = d
+	}
+	if conf.PrepareJitter != "" {
+		d, err := time.ParseDuration(conf.PrepareJitter)
+		if err == nil && d <= 0 {
+			err = errors.New("not positive")
+		}
+		if err != nil {
+			return fmt.Errorf("bad prepare_jitter %q: %s", conf.PrepareJitter, err)
+		}
+		o.prepareJitter = d
+	}
+	return o.Prepare()
+}
+
+// authSecret returns the secret of the auth mechanism:
+// the token of xoauth2 (read from token_file, if set), the password otherwise.
+func authSecret(conf *EmailOutputConfig) (string, error) {
+	if !strings.EqualFold(conf.AuthMechanism, "xoauth2") {
+		return conf.Password, nil
+	}
+	if conf.TokenFile == "" {
+		if conf.Token == "" && conf.Username != "" {
+			return "", errors.New("xoauth2 needs token or token_file")
+		}
+		return conf.Token, nil
+	}
+	b, err := ioutil.ReadFile(conf.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("cannot read token_file: %s", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// readVault reads the username and password from Vault into conf.
+func (o *EmailOutput) readVault(conf *EmailOutputConfig) error {
+	vc, err := newVaultClient(conf.VaultAddr, conf.VaultToken)
+	if err != nil {
+		return err
+	}
+	secret, err := vc.Read(conf.VaultPath)
+	if err != nil {
+		return fmt.Errorf("error reading credentials from vault: %s", err)
+	}
+	if conf.Username, conf.Password, err = secret.Credentials(); err != nil {
+		return fmt.Errorf("%s: %s", conf.VaultPath, err)
+	}
+	if conf.VaultRenew {
+		o.vault, o.vaultSecret = vc, secret
+	}
+	return nil
+}
+
+// prepareReport returns the consolidated report of the unreachable domains.
+func prepareReport(unreachable map[string]string) string {
+	domains := make([]string, 0, len(unreachable))
+	for domain := range unreachable {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for i, domain := range domains {
+		domains[i] = domain + ": " + unreachable[domain]
+	}
+	return strings.Join(domains, "; ")
+}
+
+// prepareRand and prepareSleep draw and wait the jitter of Prepare, replaceable for tests
+var (
+	prepareRand  = rand.Int63n
+	prepareSleep = time.Sleep
+)
+
+// Prepare prepares the sending (gets MX records if no hostport is given)
+func (o *EmailOutput) Prepare() error {
+	if o.prepareJitter > 0 {
+		prepareSleep(time.Duration(prepareRand(int64(o.prepareJitter))))
+	}
+	if o.hostport == "" {
+		var (
+			ok   bool
+			host string
+			err  error
+			tos  []string
+			mxs  []*net.MX
+		)
+		o.byHost = byDomain(o.withCopies(o.To))
+		opts := o.opts
+		opts.auth, opts.timeout = nil, 10*time.Second
+		unreachable := make(map[string]string)
+		for host, tos = range o.byHost {
+			if mxs, err = lookupMXCached(host, o.mxCacheTTL); err != nil {
+				if !o.partialPrepare {
+					return err
+				}
+				unreachable[host] = err.Error()
+				delete(o.byHost, host)
+				continue
+			}
+			ok = false
+			candidates, enforce := o.mxCandidates(host, mxs)
+			mxOpts := o.mxOptions(opts, host, tos, enforce)
+			err = fmt.Errorf("no usable MX for %s", host)
+			var errs []string
+			for _, mx := range candidates {
+				if err = testMail(mxAddr(mx.Host), o.From, tos, mxOpts); err == nil {
+					ok = true
+					break
+				}
+				errs = append(errs, mx.Host+": "+err.Error())
+			}
+			if !ok {
+				if len(errs) > 0 {
+					err = errors.New(strings.Join(errs, "; "))
+				}
+				err = fmt.Errorf("error test sending mail from %s to %s with %v: %s",
+					o.From, tos, mxs, err)
+				if !o.partialPrepare {
+					return err
+				}
+				unreachable[host] = err.Error()
+				delete(o.byHost, host)
+			}
+		}
+		if len(unreachable) > 0 {
+			report := prepareReport(unreachable)
+			if len(o.byHost) == 0 {
+				return fmt.Errorf("no reachable recipient domain: %s", report)
+			}
+			o.unreachable = unreachable // logged by Run
+		}
+		return nil
+	}
+	o.byHost = make(map[string][]string, 1)
+	to := o.withCopies(o.To)
+	opts := o.opts
+	opts.timeout = 10 * time.Second
+	opts.tlsPolicy = o.policyFor(to)
+	err := testMail(o.hostport, o.From, to, opts)
+	if err == nil {
+		o.byHost[""] = to
+	}
+	return err
+}
+
+//type Output interface {
+//       Run(or OutputRunner, h PluginHelper) (err error)
+//    }
+//
+
+// Run is the plugin's main loop
+// iterates over received messages, checking against
+// message hostname and delivering to the output if hostname is in our config.
+//
+// With batching, the messages are collected and sent in one email when
+// a batch limit is reached, the flush interval elapses, or the input is closed.
+//
+// A failed sending does not stop the plugin: it is logged via the runner, and
+// the email is dropped (drop_on_error), or queued for resending before the next one.
+func (o *EmailOutput) Run(runner pipeline.OutputRunner, helper pipeline.PluginHelper) (
+	err error) {
+
+	var (
+		body      []byte
+		batch     []*message.Message
+		size      int
+		batchMem  int // the size of the messages in batch
+		loopCount uint
+		tick      <-chan time.Time
+		rollTick  <-chan time.Time
+		sumTick   <-chan time.Time
+		idleTick  <-chan time.Time
+		due       <-chan *pendingAlert
+	)
+	o.runner, o.helper = runner, helper
+	if len(o.unreachable) > 0 {
+		runner.LogMessage("skipping the unreachable recipient domains: " + prepareReport(o.unreachable))
+	}
+	if o.pool != nil {
+		defer o.pool.Close()
+		if o.pool.idleTimeout > 0 {
+			ticker := time.NewTicker(o.pool.idleTimeout / 2)
+			defer ticker.Stop()
+			idleTick = ticker.C
+		}
+	}
+	if o.deliveryLog != nil {
+		defer o.deliveryLog.Close()
+	}
+	if o.metricsAddr != "" {
+		srv, err := o.startMetrics(o.metricsAddr, o.metricsPath)
+		if err != nil {
+			return err
+		}
+		defer srv.Close()
+	}
+	if o.vault != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go o.vault.KeepAlive(o.vaultSecret, done, runner.LogError)
+	}
+	if interval := o.batch.flushInterval; interval > 0 || o.digest != nil {
+		if interval <= 0 {
+			interval = o.digest.window
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	if o.pending != nil {
+		defer o.pending.Close()
+		due = o.pending.Due()
+	}
+	if o.rollup != nil {
+		ticker := time.NewTicker(o.rollup.window / 4)
+		defer ticker.Stop()
+		rollTick = ticker.C
+	}
+	if o.summary != nil {
+		ticker := time.NewTicker(o.summary.interval)
+		defer ticker.Stop()
+		sumTick = ticker.C
+		o.summary.start = time.Now()
+	}
+	// flushSummary sends the digest of the interval ended now
+	flushSummary := func(now time.Time, final bool) {
+		entries, start, loopCount := o.summary.Take(now)
+		if len(entries) > 0 || o.summary.sendEmpty && !final {
+			o.deliverLogged(o.formatSummary(entries, start, now), envelope{}, loopCount)
+		}
+	}
+	flushRollups := func(now time.Time, all bool) {
+		for _, g := range o.rollup.Expired(now, all) {
+			o.deliverLogged(o.formatRollup(g.msgs), o.envelopeTo(g.msgs...), g.loopCount)
+		}
+	}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		msgs := batch
+		batch, size, batchMem = nil, 0, 0
+		if o.batch.separate {
+			o.deliverSeparately(msgs, loopCount)
+			return
+		}
+		if o.coalesceTo {
+			for _, part := range o.coalesce(msgs) {
+				env := o.envelopeOf(part.msgs...)
+				env.to = part.to
+				o.deliverLogged(o.formatBatch(part.msgs), env, loopCount)
+			}
+			return
+		}
+		body = o.formatBatch(msgs)
+		o.deliverLogged(body, o.envelopeTo(msgs...), loopCount)
+	}
+	// guardMemory sends the batch and the rollups if they take too much memory
+	guardMemory := func() {
+		buffered := batchMem
+		if o.rollup != nil {
+			buffered += o.rollup.bytes
+		}
+		if o.maxBatchMemory <= 0 || buffered <= o.maxBatchMemory {
+			return
+		}
+		runner.LogMessage(fmt.Sprintf("%d bytes of messages buffered (max_batch_memory is %d), sending them",
+			buffered, o.maxBatchMemory))
+		atomic.AddInt64(&o.memoryFlushes, 1)
+		flush()
+		if o.rollup != nil {
+			flushRollups(time.Now(), true)
+		}
+	}
+
+	inChan := runner.InChan()
+	for {
+		select {
+		case pack, ok := <-inChan:
+			if !ok {
+				if o.summary != nil {
+					flushSummary(time.Now(), true)
+				}
+				if o.rollup != nil {
+					flushRollups(time.Now(), true)
+				}
+				flush()
+				o.resendFailed()
+				return nil
+			}
+			if o.filterSeverity && !o.severityInRange(pack.Message) ||
+				!o.loggerAllowed(pack.Message.GetLogger()) {
+				atomic.AddInt64(&o.dropped, 1)
+				pack.Recycle()
+				continue
+			}
+			if o.pending != nil {
+				key := conditionKey(pack.Message)
+				// a condition resolved within the grace period is not alerted
+				if isResolved(pack.Message) && o.pending.Resolve(key) ||
+					!isResolved(pack.Message) && o.pending.Hold(key, pack.Message, pack.MsgLoopCount) {
+					pack.Recycle()
+					continue
+				}
+			}
+			if o.incidents != nil {
+				key := conditionKey(pack.Message)
+				if isResolved(pack.Message) {
+					o.incidents.Reset(key)
+				} else if send, reminder, suppressed := o.incidents.Check(key, time.Now()); !send {
+					pack.Recycle()
+					continue
+				} else if reminder {
+					// loopCount is the batch's, not touched
+					body, msgLoopCount := o.formatReminder(pack.Message, suppressed), pack.MsgLoopCount
+					env := o.envelopeTo(pack.Message)
+					pack.Recycle()
+					o.deliverLogged(body, env, msgLoopCount)
+					continue
+				}
+			}
+			var suppressed int
+			if o.dedup != nil {
+				var send bool
+				if send, suppressed = o.dedup.Check(o.dedupKey(pack.Message), time.Now()); !send {
+					atomic.AddInt64(&o.duplicates, 1)
+					pack.Recycle()
+					continue
+				}
+			}
+			if o.summary != nil {
+				o.summary.Add(pack.Message, o.severity(pack.Message), o.payload(pack.Message),
+					suppressed, pack.MsgLoopCount)
+				pack.Recycle()
+				continue
+			}
+			if o.rollup != nil {
+				o.rollup.Add(o.rollupKey(pack.Message), withSuppressed(pack.Message, suppressed),
+					pack.MsgLoopCount, time.Now())
+				pack.Recycle()
+				guardMemory()
+				continue
+			}
+			digest := o.digest != nil && o.digest.Observe(time.Now())
+			immediate := o.immediate && o.severity(pack.Message) <= o.immediateSeverity
+			if !o.batch.enabled() && !digest || immediate {
+				// send the digest collected till now,
+				// but keep the batch of the less severe messages
+				if !immediate {
+					flush()
+				}
+				emails, msgLoopCount := o.messageEmails(pack.Message), pack.MsgLoopCount
+				pack.Recycle()
+				for _, e := range emails {
+					if suppressed > 0 {
+						e.body = withSubjectSuffix(e.body, duplicatesNote(suppressed))
+					}
+					o.deliverLogged(e.body, e.env, msgLoopCount)
+				}
+				continue
+			}
+			if len(batch) == 0 || pack.MsgLoopCount > loopCount {
+				loopCount = pack.MsgLoopCount
+			}
+			batch = append(batch, withSuppressed(pack.Message, suppressed))
+			size += len(pack.Message.GetPayload())
+			batchMem += messageSize(pack.Message)
+			pack.Recycle()
+			if o.batch.full(len(batch), size) {
+				flush()
+			}
+			guardMemory()
+		case <-tick:
+			flush()
+		case a := <-due:
+			if !o.pending.Fire(a) {
+				continue
+			}
+			for _, e := range o.messageEmails(a.msg) {
+				o.deliverLogged(e.body, e.env, a.loopCount)
+			}
+		case now := <-rollTick:
+			flushRollups(now, false)
+		case now := <-sumTick:
+			flushSummary(now, false)
+		case now := <-idleTick:
+			o.pool.Expire(now)
+		}
+	}
+}
+
+// maxRequeued is the maximal number of failed emails kept for resending.
+const maxRequeued = 100
+
+// failedEmail is an email whose sending failed.
+type failedEmail struct {
+	body      []byte
+	env       envelope
+	loopCount uint
+}
+
+// logMessage and logError log via the runner. There is no runner in Init:
+// Prepare returns its errors instead, and the rest is logged from Run on.
+func (o *EmailOutput) logMessage(msg string) {
+	if o.runner != nil {
+		o.runner.LogMessage(msg)
+	}
+}
+
+func (o *EmailOutput) logError(err error) {
+	if o.runner != nil {
+		o.runner.LogError(err)
+	}
+}
+
+// deliverLogged delivers the email (per max_per_interval), logging the failure via the runner.
+// The failed email is dropped with drop_on_error, and queued for resending
+// (to the recipients it failed to) before the next email otherwise.
+func (o *EmailOutput) deliverLogged(body []byte, env envelope, msgLoopCount uint) {
+	o.resendFailed()
+	if !o.rateLimit() {
+		return
+	}
+	if o.primary != "" || len(o.Cc) > 0 || len(o.Bcc) > 0 {
+		body = o.withRecipientHeaders(body, o.toRecipients(env))
+	}
+	if err := o.deliver(body, env, msgLoopCount); err != nil {
+		o.runner.LogError(fmt.Errorf("error sending email: %s", err))
+		o.requeue(failedEmail{body: body, env: o.failedPart(env, err), loopCount: msgLoopCount})
+	}
+}
+
+// requeue queues the failed email for resending (unless drop_on_error),
+// dropping the oldest one when the queue is full.
+func (o *EmailOutput) requeue(e failedEmail) {
+	if o.dropOnError {
+		atomic.AddInt64(&o.dropped, 1)
+		return
+	}
+	if len(o.requeued) >= maxRequeued {
+		o.runner.LogError(fmt.Errorf("dropping a failed email: %d emails are queued already", len(o.requeued)))
+		atomic.AddInt64(&o.dropped, 1)
+		o.requeued = o.requeued[1:]
+	}
+	o.requeued = append(o.requeued, e)
+}
+
+// resendFailed resends the queued failed emails in order (per
+// max_per_interval), till the first one failing again.
+func (o *EmailOutput) resendFailed() {
+	for len(o.requeued) > 0 {
+		if !o.rateLimitResend() {
+			return
+		}
+		e := &o.requeued[0]
+		if err := o.deliver(e.body, e.env, e.loopCount); err != nil {
+			o.runner.LogError(fmt.Errorf("error resending email: %s", err))
+			e.env = o.failedPart(e.env, err)
+			return
+		}
+		o.requeued = o.requeued[1:]
+	}
+}
+
+// deliver sends the email (encrypted to the recipients having PGP keys),
+// and does the bookkeeping of the sending.
+// msgLoopCount is the loop count of the (last) message sent.
+func (o *EmailOutput) deliver(body []byte, env envelope, msgLoopCount uint) error {
+	if o.verifier != nil {
+		to := o.recipients(env)
+		valid := addrSet(o.verifier.Filter(to))
+		if env = o.narrow(env, func(addr string) bool { return valid[strings.ToLower(addr)] }); len(o.recipients(env)) == 0 {
+			o.logMessage(fmt.Sprintf("no valid recipient among %s, email dropped", to))
+			atomic.AddInt64(&o.dropped, 1)
+			return nil
+		}
+	}
+	if len(o.pgpKeys) > 0 {
+		return o.deliverPGP(body, env, msgLoopCount)
+	}
+	return o.deliverOne(body, env, msgLoopCount)
+}
+
+// deliverOne sends the email as is, and does the bookkeeping of the sending.
+func (o *EmailOutput) deliverOne(body []byte, env envelope, msgLoopCount uint) error {
+	start := time.Now()
+	var span *Span
+	if o.tracer != nil {
+		span = startSpan(env)
+	}
+	err := o.sendMail(body, env)
+	o.metrics.Observe(time.Since(start), len(body), err)
+	if span != nil {
+		o.traceSend(span, env, err)
+	}
+	if err != nil {
+		o.failures++
+		if o.selfAlert {
+			o.injectFailure(body, env, err, msgLoopCount)
+		}
+		return err
+	}
+	o.failures = 0
+	if o.maildir != nil {
+		if err = o.maildir.Deliver(o.From, o.recipients(env), body); err != nil {
+			o.logError(fmt.Errorf("cannot write the email into maildir %s: %s", o.maildir.dir, err))
+		}
+	}
+	if o.emitReceipt {
+		o.injectReceipt(body, env, time.Since(start), msgLoopCount)
+	}
+	return nil
+}
+
+// messageHeader returns the "timestamp [severity] logger@hostname: " header of the message,
+// with the (local) timestamp formatted by layout.
+func messageHeader(msg *message.Message, severity int32, layout string) string {
+	return fmt.Sprintf("%s [%d] %s@%s: ",
+		utils.TsTime(msg.GetTimestamp()).Format(layout),
+		severity, msg.GetLogger(), msg.GetHostname())
+}
+
+// messageHeader returns the header of the message with the configured
+// timestamp layout and severity.
+func (o *EmailOutput) messageHeader(msg *message.Message) string {
+	if o.tsLayout == "" {
+		return messageHeader(msg, o.severity(msg), time.RFC3339)
+	}
+	return messageHeader(msg, o.severity(msg), o.tsLayout)
+}
+
+// severity returns the severity of the message: the one mapped from its
+// severity_field (if configured, present and mapped), or its own.
+func (o *EmailOutput) severity(msg *message.Message) int32 {
+	if o.severityField == "" {
+		return msg.GetSeverity()
+	}
+	v, ok := msg.GetFieldValue(o.severityField)
+	if !ok {
+		return msg.GetSeverity()
+	}
+	switch x := v.(type) {
+	case int64:
+		return int32(x)
+	case float64:
+		return int32(x)
+	}
+	if severity, ok := o.severityMap[fmt.Sprint(v)]; ok {
+		return severity
+	}
+	return msg.GetSeverity()
+}
+
+// severityInRange reports whether the severity of the message is between
+// max_severity and min_severity (the lower the number, the more severe).
+func (o *EmailOutput) severityInRange(msg *message.Message) bool {
+	severity := o.severity(msg)
+	return o.maxSeverity <= severity && severity <= o.minSeverity
+}
+
+// payload returns the payload of the message, without the prefix matched by
+// strip_payload_prefix.
+func (o *EmailOutput) payload(msg *message.Message) string {
+	payload := msg.GetPayload()
+	if o.stripPrefix == nil {
+		return payload
+	}
+	if loc := o.stripPrefix.FindStringIndex(payload); loc != nil {
+		return payload[loc[1]:]
+	}
+	return payload
+}
+
+// subjectPayloadLen is the default maximal length of the payload in the subject, in bytes.
+const subjectPayloadLen = 100
+
+// subjectPayload returns the beginning of the payload (at most subject_payload_len
+// bytes), for the subject. A truncated payload is cut at a rune boundary,
+// and marked as such. The runs of whitespace are collapsed to single spaces,
+// if configured.
+func (o *EmailOutput) subjectPayload(payload string) string {
+	n := o.subjectLen
+	if n == 0 {
+		n = subjectPayloadLen
+	} else if n < 0 {
+		return ""
+	}
+	if o.collapseWS {
+		payload = strings.Join(strings.Fields(payload), " ")
+	}
+	payload, truncated := cutPayload(payload, n)
+	if !truncated {
+		return payload
+	}
+	payload += o.truncMarker
+	if o.truncTag {
+		payload += " [truncated]"
+	}
+	return payload
+}
+
+// cutPayload returns at most the first n bytes of the payload, cut at a rune
+// boundary, and whether it had to be cut.
+func cutPayload(payload string, n int) (string, bool) {
+	if len(payload) <= n {
+		return payload, false
+	}
+	for n > 0 && !utf8.RuneStart(payload[n]) {
+		n--
+	}
+	return payload[:n], true
+}
+
+// formatMessage returns the email for one message: the subject is the
+// message header with the beginning of the payload, the body is the payload.
+func (o *EmailOutput) formatMessage(msg *message.Message) []byte {
+	var (
+		text    string
+		headers []string
+	)
+	file := o.payloadFile(msg)
+	if file != nil {
+		text = o.attachmentSummary(msg, file.name)
+	} else {
+		text, headers = o.formatBody(msg)
+	}
+	if rb := o.runbookText(msg.GetPayload()); rb != "" && headers == nil {
+		text += "\r\n\r\n" + rb
+	}
+	if link := o.ackLink(msg); link != "" {
+		if headers == nil { // plain text
+			text += "\r\n\r\nAcknowledge: " + link + "\r\n"
+		}
+		headers = append(headers, ackHeaders(link)...)
+	}
+	if file != nil {
+		mixed, mixedHeaders, err := withAttachments(text, *file)
+		if err != nil {
+			o.logError(fmt.Errorf("attaching the payload: %s", err))
+			mixed = text + "\r\n\r\n" + o.payload(msg)
+		}
+		text, headers = mixed, append(mixedHeaders, headers...)
+	}
+	if o.htmlTmpl != nil && headers == nil {
+		if alt, altHeaders, err := o.htmlAlternative(msg, text); err != nil {
+			o.logError(fmt.Errorf("executing the HTML template: %s", err))
+		} else {
+			text, headers = alt, altHeaders
+		}
+	}
+	headers = append(headers, o.threadHeaders(msg)...)
+	headers = append(headers, o.sourceHeadersOf(msg)...)
+	headers = append(headers, o.priorityHeaders(o.severity(msg))...)
+	headers = append(headers, o.contentHashHeader(msg)...)
+	return o.email(o.subject(msg), text, append(headers, messageDate(msg))...)
 }
 
-// EmailOutputConfig is for reading the configuration file
-type EmailOutputConfig struct {
-	Address     string   `toml:"address"`
-	Username    string   `toml:"username"`
-	Password    string   `toml:"password"`
-	From        string   `toml:"from"`
-	To          []string `toml:"to"`
-	NoCertCheck bool     `toml:"no_cert_check"`
+// contentHashHeader returns the X-Content-Hash header of the payload
+// of the message, if content_hash is on.
+func (o *EmailOutput) contentHashHeader(msg *message.Message) []string {
+	if !o.contentHash {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(o.payload(msg)))
+	return []string{"X-Content-Hash: sha256=" + hex.EncodeToString(sum[:])}
 }
 
-// ConfigStruct returns the struct for reading the configuration file
-func (o *EmailOutput) ConfigStruct() interface{} {
-	return new(EmailOutputConfig)
+// sourceHeadersOf returns the X-Heka-Pid and X-Heka-EnvVersion headers
+// of the message's set attributes, if source_headers is on.
+func (o *EmailOutput) sourceHeadersOf(msg *message.Message) []string {
+	if !o.sourceHeaders {
+		return nil
+	}
+	var headers []string
+	if pid := msg.GetPid(); pid != 0 {
+		headers = append(headers, fmt.Sprintf("X-Heka-Pid: %d", pid))
+	}
+	if v := msg.GetEnvVersion(); v != "" {
+		headers = append(headers, "X-Heka-EnvVersion: "+v)
+	}
+	return headers
 }
 
-// Init initializes the givegn EmailOutput instance by
-//extracting from, to, sid and token value from config
-//and store it on the plugin instance.
-func (o *EmailOutput) Init(config interface{}) error {
-	conf := config.(*EmailOutputConfig)
-	o.hostport = conf.Address
-	if o.hostport != "" {
-		host := o.hostport
-		if i := strings.Index(host, ":"); i >= 0 {
-			host = host[:i]
-		} else {
-			o.hostport = host + ":25"
+// configHeaders returns the Reply-To and the other configured header lines,
+// the latter sorted by name. The names have to be valid (RFC 5322 2.2),
+// and none of them may contain a line break, not to inject headers.
+func configHeaders(replyTo string, headers map[string]string) ([]string, error) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var lines []string
+	if replyTo != "" {
+		if strings.ContainsAny(replyTo, "\r\n") {
+			return nil, fmt.Errorf("bad reply_to %q: line break", replyTo)
+		}
+		lines = append(lines, "Reply-To: "+replyTo)
+	}
+	for _, name := range names {
+		if name == "" || strings.IndexFunc(name, func(r rune) bool { return r <= ' ' || r > '~' || r == ':' }) >= 0 {
+			return nil, fmt.Errorf("bad header name %q", name)
 		}
-		if conf.Username != "" {
-			o.auth = smtp.PlainAuth("", conf.Username, conf.Password, host)
+		if strings.ContainsAny(headers[name], "\r\n") {
+			return nil, fmt.Errorf("bad value of header %s %q: line break", name, headers[name])
 		}
+		lines = append(lines, name+": "+headers[name])
 	}
-	o.From, o.To = conf.From, conf.To
-	if conf.NoCertCheck {
-		o.tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	return lines, nil
+}
+
+// email returns the email with the given subject, text and extra headers,
+// adding the configured headers, a new Message-ID, and the Date of now
+// if the extra headers have none.
+func (o *EmailOutput) email(subject, text string, headers ...string) []byte {
+	body := bytes.NewBuffer(make([]byte, 0, 1024+len(text)))
+	body.WriteString("Subject: ")
+	body.WriteString(encodeSubject(subject))
+	body.WriteString("\r\n")
+	body.WriteString(newMessageID(o.opts.heloName))
+	body.WriteString("\r\n")
+	if !hasHeader(headers, "Date") {
+		body.WriteString(dateHeader(time.Now()))
+		body.WriteString("\r\n")
 	}
-	return o.Prepare()
+	for _, h := range o.headers {
+		body.WriteString(h)
+		body.WriteString("\r\n")
+	}
+	for _, h := range headers {
+		body.WriteString(h)
+		body.WriteString("\r\n")
+	}
+	body.WriteString("\r\n")
+	body.WriteString(text)
+	return body.Bytes()
 }
 
-//Prepare prepares the sending (gets MX records if no hostport is given)
-func (o *EmailOutput) Prepare() error {
+// encodeSubject returns the subject RFC 2047 encoded, folded between the
+// encoded words, if it has non-ASCII characters; as is otherwise.
+func encodeSubject(subject string) string {
+	for i := 0; i < len(subject); i++ {
+		if subject[i] >= utf8.RuneSelf {
+			return strings.Replace(mime.QEncoding.Encode("utf-8", subject), "?= =?", "?=\r\n =?", -1)
+		}
+	}
+	return subject
+}
+
+// mxAddrs caches the MX records of the domains (for the mx_cache_ttl of
+// each output, see lookupMXCached), mxLookups are the lookups in flight.
+var mxAddrs = make(map[string]cachedMX, 16)
+var mxLookups = make(map[string]*mxLookup)
+var mxAddrsLock = sync.Mutex{}
+
+// lookupMX is net.LookupMX, replaceable for tests
+var lookupMX = net.LookupMX
+
+// smtpPort is the port of the MX hosts
+var smtpPort = "25"
+
+// totalConns limits the number of concurrent SMTP conversations of the process.
+var totalConns = newConnLimiter()
+
+// connLimiter is a semaphore with an adjustable limit.
+type connLimiter struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	max, n int
+}
+
+func newConnLimiter() *connLimiter {
+	l := &connLimiter{}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// Limit sets the limit to max, if max is positive.
+func (l *connLimiter) Limit(max int) {
+	if max <= 0 {
+		return
+	}
+	l.mu.Lock()
+	l.max = max
+	l.mu.Unlock()
+	// the waiters may go on with a higher limit
+	l.cond.Broadcast()
+}
+
+// Acquire waits till a conversation can be started.
+func (l *connLimiter) Acquire() {
+	l.mu.Lock()
+	for l.max > 0 && l.n >= l.max {
+		l.cond.Wait()
+	}
+	l.n++
+	l.mu.Unlock()
+}
+
+// Release marks the end of a conversation.
+func (l *connLimiter) Release() {
+	l.mu.Lock()
+	l.n--
+	l.mu.Unlock()
+	l.cond.Signal()
+}
+
+// mxAddr returns the address of the MX host
+func mxAddr(host string) string {
+	return net.JoinHostPort(strings.TrimSuffix(host, "."), smtpPort)
+}
+
+// mxOptions returns the options for sending to the given recipients
+// through the MX hosts of their domain. If enforceSTS is true, TLS with a valid
+// certificate is required, as the MTA-STS policy dictates.
+func (o *EmailOutput) mxOptions(opts smtpOptions, domain string, to []string, enforceSTS bool) smtpOptions {
+	opts.tlsPolicy = o.policyFor(to)
+	opts.implicitTLS = false // the MX hosts listen on port 25
+	opts.dane, opts.daneDomain, opts.daneResolvers = o.dane, domain, o.daneResolvers
+	if o.tlsrpt != nil {
+		opts.onTLS = func(host string, state tls.ConnectionState, err error) {
+			o.tlsrpt.Record(domain, host, state, err)
+		}
+	}
+	if enforceSTS {
+		opts.tlsPolicy = tlsRequired
+		if opts.tlsConfig != nil {
+			opts.tlsConfig = opts.tlsConfig.Clone()
+			opts.tlsConfig.InsecureSkipVerify, opts.tlsConfig.ServerName = false, ""
+		}
+	}
+	return opts
+}
+
+// sendMail sends mail using smtp.SendMail but looks up MX records if no hostport is provided.
+// The transient failures are retried per relay and recipient domain (see retrying).
+func (o *EmailOutput) sendMail(body []byte, env envelope) error {
+	opts := o.opts
+	opts.timeout = o.sendTimeout(len(body))
+	opts.dsnNotify = env.dsnNotify
+	if len(env.mailParams) > 0 {
+		opts.mailParams = append(append([]string(nil), opts.mailParams...), env.mailParams...)
+	}
+	to, groups := o.recipients(env), o.byHost
+	if env.to != nil {
+		groups = byDomain(to)
+	}
 	if o.hostport == "" {
+		// deliver to the domains concurrently, totalConns limits the conversations
+		type result struct {
+			tos []string
+			err error
+		}
+		results := make(chan result, len(groups))
+		for host, tos := range groups {
+			go func(host string, tos []string) {
+				o.throttleDomain(host, len(tos))
+				results <- result{tos, o.retrying(func() error { return o.sendMX(host, tos, body, opts) })}
+			}(host, tos)
+		}
 		var (
-			i    int
-			ok   bool
-			host string
-			err  error
-			tos  []string
-			mxs  []*net.MX
+			err    error
+			failed []string
 		)
-		o.byHost = make(map[string][]string, len(o.To))
-		for _, tos := range o.To {
-			i = strings.Index(tos, "@")
-			host = tos[i+1:]
-			o.byHost[host] = append(o.byHost[host], tos)
-		}
-		for host, tos = range o.byHost {
-			mxAddrsLock.Lock()
-			if mxs, ok = mxAddrs[host]; !ok {
-				if mxs, err = net.LookupMX(host); err != nil {
-					return fmt.Errorf("error looking up MX record for %s: %s", host, err)
-				}
-				mxAddrs[host] = mxs
-			}
-			mxAddrsLock.Unlock()
-			ok = false
-			for _, mx := range mxs {
-				log.Printf("test sending with %s to %s", mx.Host, tos)
-				err = testMail(mx.Host+":25", nil, o.From, tos, 10*time.Second,
-					o.tlsConfig)
-				log.Printf("test send with %s to %s result: %s", mx.Host, tos, err)
+		for range groups {
+			if r := <-results; r.err != nil {
+				failed = append(failed, r.tos...)
 				if err == nil {
-					ok = true
-					break
+					err = r.err
 				}
 			}
-			if !ok {
-				return fmt.Errorf("error test sending mail from %s to %s with %s: %s",
-					o.From, tos, mxs, err)
+		}
+		if err != nil && len(failed) < len(to) {
+			return &partialError{failed: failed, err: err}
+		}
+		return err
+	}
+	for domain, tos := range byDomain(to) {
+		o.throttleDomain(domain, len(tos))
+	}
+	opts.tlsPolicy = o.policyFor(to)
+	err := o.retrying(func() error {
+		var err error
+		for _, r := range o.relayOrder() {
+			opts.auth = r.auth
+			if err = o.sendPooled(r.addr, to, body, opts); errors.Is(err, errNotPooled) {
+				err = o.send(r.addr, r.addr, to, body, opts)
 			}
+			if err == nil {
+				o.relayGood(r.addr)
+				break
+			}
+			o.logMessage(fmt.Sprintf("sending with %s to %s failed: %s", r.addr, to, err))
+		}
+		return err
+	})
+	o.updateStatus(to, err)
+	return err
+}
+
+// byDomain groups the addresses by their domains.
+func byDomain(addrs []string) map[string][]string {
+	groups := make(map[string][]string, len(addrs))
+	for _, addr := range addrs {
+		domain := addr[strings.Index(addr, "@")+1:]
+		groups[domain] = append(groups[domain], addr)
+	}
+	return groups
+}
+
+// sendMX sends the body to the recipients of the domain host,
+// over the pooled connection, or trying its MX hosts in order,
+// then the fallback relay.
+func (o *EmailOutput) sendMX(host string, tos []string, body []byte, opts smtpOptions) error {
+	if err := o.sendPooled(host, tos, body, opts); !errors.Is(err, errNotPooled) {
+		o.updateStatus(tos, err)
+		if err != nil {
+			return fmt.Errorf("error sending mail from %s to %s: %w", o.From, tos, err)
 		}
 		return nil
 	}
-	o.byHost = make(map[string][]string, 1)
-	log.Printf("test sending with %s to %s", o.hostport, o.To)
-	err := testMail(o.hostport, o.auth, o.From, o.To, 10*time.Second, o.tlsConfig)
-	log.Printf("test send with %s to %s result: %s", o.hostport, o.To, err)
-	if err == nil {
-		o.byHost[""] = o.To
+	// the domains of the recipients from to_field are not prepared
+	mxs, err := lookupMXCached(host, o.mxCacheTTL)
+	if err != nil {
+		o.updateStatus(tos, err)
+		return err
 	}
-	return err
+	candidates, enforce := o.mxCandidates(host, mxs)
+	mxOpts := o.mxOptions(opts, host, tos, enforce)
+	mxOpts.auth = nil
+	err = fmt.Errorf("no usable MX for %s", host)
+	for _, mx := range candidates {
+		if err = o.send(host, mxAddr(mx.Host), tos, body, mxOpts); err == nil {
+			break
+		}
+		o.logMessage(fmt.Sprintf("sending with %s to %s failed: %s", mx.Host, tos, err))
+	}
+	if err != nil && o.fallbackRelay != "" {
+		o.logMessage(fmt.Sprintf("sending with the fallback relay %s to %s", o.fallbackRelay, tos))
+		opts.tlsPolicy = o.policyFor(tos)
+		err = o.send(host, o.fallbackRelay, tos, body, opts)
+	}
+	o.updateStatus(tos, err)
+	if err != nil {
+		return fmt.Errorf("error sending mail from %s to %s with %v: %w",
+			o.From, tos, mxs, err)
+	}
+	return nil
 }
 
-//type Output interface {
-//       Run(or OutputRunner, h PluginHelper) (err error)
-//    }
-//
+// sendTimeout returns the timeout of sending an email of size bytes:
+// DefaultTimeout, plus size/throughput seconds if throughput is set.
+func (o *EmailOutput) sendTimeout(size int) time.Duration {
+	if o.throughput <= 0 {
+		return DefaultTimeout
+	}
+	return DefaultTimeout + time.Duration(size)*time.Second/time.Duration(o.throughput)
+}
 
-// Run is the plugin's main loop
-//iterates over received messages, checking against
-//message hostname and delivering to the output if hostname is in our config.
-func (o *EmailOutput) Run(runner pipeline.OutputRunner, helper pipeline.PluginHelper) (
-	err error) {
+// policyFor returns the strictest TLS policy of the recipients' domains:
+// required if any of them (or require_starttls) requires TLS, none if all of them forbid it.
+func (o *EmailOutput) policyFor(to []string) tlsPolicy {
+	if o.requireStartTLS {
+		return tlsRequired
+	}
+	if len(o.tlsPolicy) == 0 {
+		return tlsOpportunistic
+	}
+	policy := tlsNone
+	for _, addr := range to {
+		p := o.tlsPolicy[strings.ToLower(addr[strings.LastIndex(addr, "@")+1:])]
+		if p == tlsRequired {
+			return tlsRequired
+		}
+		if p == tlsOpportunistic {
+			policy = tlsOpportunistic
+		}
+	}
+	return policy
+}
 
-	var (
-		payload string
-	)
-	body := bytes.NewBuffer(nil)
-
-	for pack := range runner.InChan() {
-		payload = pack.Message.GetPayload()
-		if len(payload) > 100 {
-			payload = payload[:100]
-		}
-		body.WriteString(fmt.Sprintf("Subject: %s [%d] %s@%s: ",
-			utils.TsTime(pack.Message.GetTimestamp()).Format(time.RFC3339),
-			pack.Message.GetSeverity(), pack.Message.GetLogger(),
-			pack.Message.GetHostname()))
-		body.WriteString(payload)
-		body.WriteString("\r\n\r\n")
-		body.WriteString(pack.Message.GetPayload())
-		pack.Recycle()
-		err = o.sendMail(body.Bytes())
-		body.Reset()
-		if err != nil {
-			return fmt.Errorf("error sending email: %s", err)
+// updateStatus records the result of a sending attempt to the recipients.
+func (o *EmailOutput) updateStatus(to []string, err error) {
+	now := time.Now()
+	o.statusMu.Lock()
+	defer o.statusMu.Unlock()
+	if o.status == nil {
+		o.status = make(map[string]RecipientStatus, len(to))
+	}
+	for _, addr := range to {
+		st := o.status[addr]
+		st.LastAttempt, st.LastError = now, err
+		if err == nil {
+			st.ConsecutiveFailures = 0
+		} else {
+			st.ConsecutiveFailures++
 		}
+		o.status[addr] = st
+	}
+}
 
+// DeliveryStatus returns the delivery status of each recipient address
+// we tried to send to, to identify chronically failing recipients.
+func (o *EmailOutput) DeliveryStatus() map[string]RecipientStatus {
+	o.statusMu.Lock()
+	defer o.statusMu.Unlock()
+	status := make(map[string]RecipientStatus, len(o.status))
+	for addr, st := range o.status {
+		status[addr] = st
 	}
-	return
+	return status
 }
 
-var mxAddrs = make(map[string][]*net.MX, 16)
-var mxAddrsLock = sync.Mutex{}
+// smtpOptions holds the parameters of one SMTP conversation.
+type smtpOptions struct {
+	auth      smtp.Auth
+	timeout   time.Duration
+	tlsConfig *tls.Config
+	tlsPolicy tlsPolicy
+	// requireTLS issues MAIL FROM with REQUIRETLS, if the server supports it
+	requireTLS bool
+	// requireTLSChain aborts the sending if REQUIRETLS cannot be used
+	requireTLSChain bool
+	// dane verifies the certificate of the server, an MX host of daneDomain,
+	// against its TLSA records, if any
+	dane       bool
+	daneDomain string
+	// daneResolvers are the validating resolvers of the DANE lookups
+	daneResolvers []string
+	// tlsa are the usable TLSA records of the server, set by dial
+	tlsa []tlsaRecord
+	// onTLS is called with the outcome of the TLS negotiation with host
+	onTLS func(host string, state tls.ConnectionState, err error)
+	// dsnNotify is the NOTIFY parameter of the recipients, if DSN is requested
+	dsnNotify string
+	// bannerAuth overrides auth by the banner of the server, if auth is set
+	bannerAuth *bannerAuth
+	// banner returns the greeting and EHLO response of the server, set by dial
+	banner func() string
+	// phaseTimeouts are the timeouts of the phases overriding timeout
+	phaseTimeouts map[string]time.Duration
+	// starttlsFallback are the trusted networks of the servers, which are
+	// sent to in plaintext if the STARTTLS handshake with them fails
+	starttlsFallback []*net.IPNet
+	// phases sets the deadlines of the phases of one conversation
+	phases *phaseDeadlines
+	// mailParams are extra MAIL FROM parameters, sent if the server
+	// supports their extensions
+	mailParams []string
+	// implicitTLS speaks TLS from the start (SMTPS), instead of STARTTLS
+	implicitTLS bool
+	// transferEncoding is the encoding of the 8-bit text (see parseTransferEncoding)
+	transferEncoding string
+	// heloName is the name sent in EHLO, "localhost" if empty
+	heloName string
+	// logger logs the notices of the conversation (see logMessage)
+	logger func(msg string)
+	// proxy connects to the server (through a SOCKS5 proxy), if set
+	proxy Dialer
+	// dkim signs the emails, if set
+	dkim *dkimSigner
+}
 
-// sendMail sends mail using smtp.SendMail but looks up MX records if no hostport is provided
-func (o EmailOutput) sendMail(body []byte) error {
-	if o.hostport == "" {
-		var (
-			host string
-			err  error
-			tos  []string
-			mxs  []*net.MX
-		)
-		for host, tos = range o.byHost {
-			mxAddrsLock.Lock()
-			mxs = mxAddrs[host]
-			mxAddrsLock.Unlock()
-			err = nil
-			for _, mx := range mxs {
-				log.Printf("sending with %s to %s", mx.Host, tos)
-				err = sendMail(mx.Host+":25", nil, o.From, tos, body,
-					30, o.tlsConfig)
-				log.Printf("send with %s to %s result: %s", mx.Host, tos, err)
-				if err == nil {
-					break
-				}
-			}
-			if err != nil {
-				return fmt.Errorf("error sending mail from %s to %s with %s: %s",
-					o.From, tos, mxs, err)
-			}
+// logMessage logs via the logger, if any.
+func (opts smtpOptions) logMessage(msg string) {
+	if opts.logger != nil {
+		opts.logger(msg)
+	}
+}
+
+// envelope holds the parameters of the sending of one email,
+// coming from the message(s) in it.
+type envelope struct {
+	dsnNotify string   // see dsnNotify
+	to        []string // the recipients, if not all of o.To
+	// cc and bcc are the copied recipients instead of o.Cc and o.Bcc,
+	// if narrowed (to the ones the sending failed to, e.g.)
+	cc, bcc    []string
+	narrowed   bool
+	mailParams []string // see messageMailParams
+	// the trace context of the (first traced) message, if traced
+	traced       bool
+	traceID      [16]byte
+	parentSpanID [8]byte
+}
+
+// partialError is the failure of an email sent to some of its recipients only.
+type partialError struct {
+	failed []string // the recipients the email was not sent to
+	err    error    // the first failure
+}
+
+func (e *partialError) Error() string {
+	return e.err.Error()
+}
+
+// failedRecipients returns the recipients the sending of the email failed to.
+func (o *EmailOutput) failedRecipients(env envelope, err error) []string {
+	if pe, ok := err.(*partialError); ok {
+		return pe.failed
+	}
+	return o.recipients(env)
+}
+
+// failedPart returns the envelope narrowed to the recipients the sending
+// failed to, so that its resending does not duplicate the email to the others.
+func (o *EmailOutput) failedPart(env envelope, err error) envelope {
+	if _, ok := err.(*partialError); !ok {
+		return env
+	}
+	failed := addrSet(o.failedRecipients(env, err))
+	return o.narrow(env, func(addr string) bool { return failed[strings.ToLower(addr)] })
+}
+
+// envelopeOf returns the envelope parameters requested by the messages.
+func (o *EmailOutput) envelopeOf(msgs ...*message.Message) envelope {
+	var env envelope
+	for _, msg := range msgs {
+		if env.dsnNotify == "" {
+			env.dsnNotify = dsnNotify(msg)
+		}
+		env.mailParams = append(env.mailParams, o.messageMailParams(msg)...)
+		if !env.traced {
+			env.traceID, env.parentSpanID, env.traced = traceContext(msg)
 		}
-		return nil
 	}
-	log.Printf("sending with %s to %s", o.hostport, o.To)
-	err := sendMail(o.hostport, o.auth, o.From, o.To, body,
-		DefaultTimeout, o.tlsConfig)
-	log.Printf("send with %s to %s result: %s", o.hostport, o.To, err)
-	return err
+	return env
 }
 
 // testMail connects to the server at addr, switches to TLS if possible,
 // authenticates with mechanism a if possible, and then tests sending an email from
 // address from, to addresses to
-func testMail(addr string, a smtp.Auth, from string, to []string, timeout time.Duration, tlsConfig *tls.Config) error {
-	return sendMail(addr, a, from, to, nil, timeout, tlsConfig)
+func testMail(addr string, from string, to []string, opts smtpOptions) error {
+	return sendMail(addr, from, to, nil, opts)
 }
 
 // sendMail connects to the server at addr, switches to TLS if possible (using the given config),
@@ -223,58 +2358,316 @@ func testMail(addr string, a smtp.Auth, from string, to []string, timeout time.D
 // address from, to addresses to, with message msg.
 //
 // If msg is nil, then quits, this testing the recipients and the server
-func sendMail(addr string, a smtp.Auth, from string, to []string, msg []byte, timeout time.Duration, tlsConfig *tls.Config) error {
-	//c, err := Dial(addr)
-	conn, err := net.DialTimeout("tcp", addr, timeout)
+func sendMail(addr string, from string, to []string, msg []byte, opts smtpOptions) error {
+	totalConns.Acquire()
+	defer totalConns.Release()
+	opts.phases = newPhaseDeadlines(opts.phaseTimeouts)
+	c, _, err := dial(addr, opts)
 	if err != nil {
 		return err
 	}
+	defer c.Close()
+	if err = transact(c, from, to, msg, opts); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// dial connects to the server at addr, switches to TLS if possible (using the given config),
+// and authenticates with opts.auth if possible.
+// opts.timeout is set as the deadline of the returned connection.
+func dial(addr string, opts smtpOptions) (*smtp.Client, net.Conn, error) {
+	if opts.dane {
+		var err error
+		if opts.tlsa, err = daneRecords(opts.daneResolvers, opts.daneDomain, addr); err != nil {
+			return nil, nil, err
+		}
+	}
+	conn, err := dialTCP(addr, opts.timeout, opts.proxy)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the timeout applies to the whole conversation
+	if opts.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(opts.timeout))
+	}
 	host, _, _ := net.SplitHostPort(addr)
+	if opts.implicitTLS {
+		if conn, err = implicitTLS(conn, host, opts); err != nil {
+			return nil, nil, err
+		}
+	}
+	opts.phases.Start(conn, opts.timeout)
+	opts.phases.Enter("greeting")
+	if opts.auth != nil && opts.bannerAuth != nil {
+		bc := &bannerConn{Conn: conn}
+		conn, opts.banner = bc, bc.Banner
+	}
 	c, err := smtp.NewClient(conn, host)
 	if err != nil {
-		return err
+		conn.Close()
+		return nil, nil, err
+	}
+	if err = hello(c, host, opts); err != nil {
+		c.Close()
+		if _, ok := err.(*handshakeError); ok && opts.tlsPolicy == tlsOpportunistic &&
+			len(opts.tlsa) == 0 && trusted(conn.RemoteAddr(), opts.starttlsFallback) {
+			opts.logMessage(fmt.Sprintf("WARNING: STARTTLS with %s failed (%s), sending in plaintext", addr, err))
+			opts.tlsPolicy = tlsNone
+			return dial(addr, opts)
+		}
+		return nil, nil, err
+	}
+	return c, conn, nil
+}
+
+// implicitTLS does the TLS handshake (SMTPS) on the new connection,
+// verified by DANE if the server has TLSA records.
+func implicitTLS(conn net.Conn, host string, opts smtpOptions) (net.Conn, error) {
+	tlsConfig := clientTLSConfig(opts.tlsConfig, host)
+	if len(opts.tlsa) > 0 {
+		tlsConfig = daneTLSConfig(tlsConfig, host, opts.tlsa)
+	}
+	tc := tls.Client(conn, tlsConfig)
+	err := tc.Handshake()
+	if opts.onTLS != nil {
+		opts.onTLS(host, tc.ConnectionState(), err)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// handshakeError is a failed TLS handshake after STARTTLS.
+type handshakeError struct {
+	err error
+}
+
+func (e *handshakeError) Error() string { return e.err.Error() }
+
+// trusted reports whether the address is in one of the networks.
+func trusted(addr net.Addr, networks []*net.IPNet) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// hello greets the server, switches to TLS per opts.tlsPolicy (required
+// and verified by DANE if the server has TLSA records) unless it is TLS already
+// and authenticates with opts.auth (or the one chosen by the banner) if possible.
+func hello(c *smtp.Client, host string, opts smtpOptions) error {
+	opts.phases.Enter("ehlo")
+	heloName := opts.heloName
+	if heloName == "" {
+		heloName = "localhost"
 	}
-	//if err := c.hello(); err != nil {
-	//    return err
-	//}
-	if err := c.Hello("localhost"); err != nil {
+	if err := c.Hello(heloName); err != nil {
 		return err
 	}
-	if ok, _ := c.Extension("STARTTLS"); ok {
-		if err = c.StartTLS(tlsConfig); err != nil {
+	auth := opts.auth
+	if opts.banner != nil {
+		if a := opts.bannerAuth.Auth(opts.banner(), host); a != nil {
+			auth = a
+		}
+	}
+	tlsConfig := clientTLSConfig(opts.tlsConfig, host)
+	if len(opts.tlsa) > 0 {
+		tlsConfig, opts.tlsPolicy = daneTLSConfig(tlsConfig, host, opts.tlsa), tlsRequired
+	}
+	_, isTLS := c.TLSConnectionState() // with implicit TLS
+	if ok, _ := c.Extension("STARTTLS"); ok && opts.tlsPolicy != tlsNone && !isTLS {
+		opts.phases.Enter("starttls")
+		err := c.StartTLS(tlsConfig)
+		if opts.onTLS != nil {
+			state, _ := c.TLSConnectionState()
+			opts.onTLS(host, state, err)
+		}
+		if _, rejected := err.(*textproto.Error); err != nil && !rejected {
+			return &handshakeError{err}
+		}
+		if err != nil {
 			return err
 		}
+	} else if opts.tlsPolicy == tlsRequired && !isTLS {
+		if opts.onTLS != nil {
+			opts.onTLS(host, tls.ConnectionState{}, ErrStartTLSUnsupported)
+		}
+		return ErrStartTLSUnsupported
 	}
-	if a != nil {
+	if auth != nil {
 		if ok, _ := c.Extension("AUTH"); ok {
-			if err = c.Auth(a); err != nil {
+			opts.phases.Enter("auth")
+			if err := c.Auth(auth); err != nil {
 				return err
 			}
 		}
 	}
-	if err = c.Mail(from); err != nil {
-		return err
+	return nil
+}
+
+// transact sends an email from address from, to addresses to, with message msg,
+// over the established connection. If msg is nil, only the recipients are tested.
+// The 8-bit text of msg is encoded per opts.transferEncoding, by default
+// per the 8BITMIME support of the server (see transferEncode).
+// If the server requires authentication at MAIL (530) without advertising AUTH,
+// it authenticates with opts.auth, and retries MAIL once.
+func transact(c *smtp.Client, from string, to []string, msg []byte, opts smtpOptions) error {
+	var params []string
+	if opts.requireTLS {
+		_, isTLS := c.TLSConnectionState()
+		if ok, _ := c.Extension("REQUIRETLS"); ok && isTLS {
+			params = append(params, "REQUIRETLS")
+		} else if opts.requireTLSChain {
+			return ErrRequireTLSUnsupported
+		}
 	}
-	for _, addr := range to {
-		if err = c.Rcpt(addr); err != nil {
-			return err
+	var rcptParams []string
+	if opts.dsnNotify != "" {
+		if ok, _ := c.Extension("DSN"); ok {
+			params = append(params, "RET=HDRS")
+			rcptParams = append(rcptParams, "NOTIFY="+opts.dsnNotify)
 		}
 	}
-	if msg != nil {
-		w, err := c.Data()
-		if err != nil {
+	params = append(params, supportedParams(c, opts)...)
+	opts.phases.Enter("mail")
+	if err := mailFrom(c, from, params...); err != nil {
+		// some relays require AUTH only at MAIL, without advertising it
+		tpErr, ok := err.(*textproto.Error)
+		if advertised, _ := c.Extension("AUTH"); !ok || tpErr.Code != 530 || opts.auth == nil || advertised {
 			return err
 		}
-		_, err = w.Write(msg)
-		if err != nil {
+		opts.phases.Enter("auth")
+		if err = c.Auth(opts.auth); err != nil {
 			return err
 		}
-		err = w.Close()
-		if err != nil {
+		opts.phases.Enter("mail")
+		if err = mailFrom(c, from, params...); err != nil {
 			return err
 		}
 	}
-	return c.Quit()
+	for _, addr := range to {
+		opts.phases.Enter("rcpt")
+		if err := rcptTo(c, addr, rcptParams...); err != nil {
+			return err
+		}
+	}
+	if msg == nil {
+		return nil
+	}
+	switch encoding := opts.transferEncoding; encoding {
+	case "":
+		encoding = encodingQuotedPrintable
+		if eightBit, _ := c.Extension("8BITMIME"); eightBit {
+			encoding = encoding8Bit
+		}
+		msg = transferEncode(msg, encoding)
+	case encoding7Bit:
+		// a 7bit email cannot carry the 8-bit text undeclared
+		msg = transferEncode(msg, encodingQuotedPrintable)
+	default:
+		msg = transferEncode(msg, encoding)
+	}
+	var err error
+	if opts.dkim != nil {
+		if msg, err = opts.dkim.Sign(msg); err != nil {
+			return fmt.Errorf("error DKIM signing: %s", err)
+		}
+	}
+	opts.phases.Enter("data")
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// mailFrom issues the MAIL command, with the given extension parameters.
+// Without parameters, it is the same as c.Mail(from).
+func mailFrom(c *smtp.Client, from string, params ...string) error {
+	if len(params) == 0 {
+		return c.Mail(from)
+	}
+	if strings.ContainsAny(from, "\r\n") {
+		return errors.New("smtp: A line must not contain CR or LF")
+	}
+	if ok, _ := c.Extension("8BITMIME"); ok && !hasParam(params, "BODY") {
+		params = append(params, "BODY=8BITMIME")
+	}
+	id, err := c.Text.Cmd("MAIL FROM:<%s> %s", from, strings.Join(params, " "))
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(250)
+	return err
+}
+
+// rcptTo issues the RCPT command, with the given extension parameters.
+// Without parameters, it is the same as c.Rcpt(to).
+func rcptTo(c *smtp.Client, to string, params ...string) error {
+	if len(params) == 0 {
+		return c.Rcpt(to)
+	}
+	if strings.ContainsAny(to, "\r\n") {
+		return errors.New("smtp: A line must not contain CR or LF")
+	}
+	id, err := c.Text.Cmd("RCPT TO:<%s> %s", to, strings.Join(params, " "))
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(25)
+	return err
+}
+
+// withClientCert returns the TLS config (a copy, or a new one if nil) with the
+// client certificate loaded from the PEM files certFile and keyFile, if set.
+func withClientCert(tlsConfig *tls.Config, certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return tlsConfig, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("client_cert_file and client_key_file must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load the client certificate from %s and %s: %s", certFile, keyFile, err)
+	}
+	if tlsConfig == nil {
+		tlsConfig = new(tls.Config)
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	return tlsConfig, nil
+}
+
+// clientTLSConfig returns the TLS config to be used for STARTTLS with host:
+// the given config (or a new one) with the ServerName set.
+func clientTLSConfig(tlsConfig *tls.Config, host string) *tls.Config {
+	if tlsConfig == nil {
+		return &tls.Config{ServerName: host}
+	}
+	if tlsConfig.ServerName != "" || tlsConfig.InsecureSkipVerify {
+		return tlsConfig
+	}
+	cfg := tlsConfig.Clone()
+	cfg.ServerName = host
+	return cfg
 }
 
 func init() {
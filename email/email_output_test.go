@@ -0,0 +1,1095 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/tgulacsi/heka-plugins/email/testutil"
+)
+
+// testRunner is an OutputRunner feeding Run from inChan,
+// and collecting the injected packs.
+// The methods not overridden here panic if called.
+type testRunner struct {
+	pipeline.OutputRunner
+	inChan chan *pipeline.PipelinePack
+
+	mu         sync.Mutex
+	injected   []*message.Message
+	loopCounts []uint // of the injected packs
+	errors     []error
+	messages   []string
+}
+
+func newTestRunner() *testRunner {
+	return &testRunner{inChan: make(chan *pipeline.PipelinePack, 100)}
+}
+
+func (r *testRunner) Name() string                        { return "EmailOutput" }
+func (r *testRunner) InChan() chan *pipeline.PipelinePack { return r.inChan }
+
+func (r *testRunner) Inject(pack *pipeline.PipelinePack) bool {
+	r.mu.Lock()
+	r.injected = append(r.injected, pack.Message)
+	r.loopCounts = append(r.loopCounts, pack.MsgLoopCount)
+	r.mu.Unlock()
+	return true
+}
+
+func (r *testRunner) LogError(err error) {
+	r.mu.Lock()
+	r.errors = append(r.errors, err)
+	r.mu.Unlock()
+}
+
+func (r *testRunner) LogMessage(msg string) {
+	r.mu.Lock()
+	r.messages = append(r.messages, msg)
+	r.mu.Unlock()
+}
+
+// Errors returns the errors logged so far.
+func (r *testRunner) Errors() []error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]error(nil), r.errors...)
+}
+
+// Messages returns the messages logged so far.
+func (r *testRunner) Messages() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.messages...)
+}
+
+// Injected returns the messages injected so far.
+func (r *testRunner) Injected() []*message.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*message.Message(nil), r.injected...)
+}
+
+// testHelper is a PluginHelper providing new packs.
+type testHelper struct {
+	pipeline.PluginHelper
+}
+
+func (h testHelper) PipelinePack(msgLoopCount uint) *pipeline.PipelinePack {
+	pack := pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+	pack.MsgLoopCount = msgLoopCount
+	return pack
+}
+
+// newTestMessage returns a message with the given severity, hostname and payload.
+func newTestMessage(severity int32, hostname, payload string) *message.Message {
+	msg := new(message.Message)
+	msg.SetTimestamp(time.Date(2013, 11, 12, 13, 14, 15, 0, time.UTC).UnixNano())
+	msg.SetSeverity(severity)
+	msg.SetLogger("test")
+	msg.SetHostname(hostname)
+	msg.SetPayload(payload)
+	return msg
+}
+
+// send puts the message into a new pack on the input channel.
+func (r *testRunner) send(msg *message.Message) {
+	r.sendLooped(msg, 0)
+}
+
+// sendLooped puts the message into a new pack with the loop count on the input channel.
+func (r *testRunner) sendLooped(msg *message.Message, msgLoopCount uint) {
+	pack := pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+	pack.Message = msg
+	pack.MsgLoopCount = msgLoopCount
+	r.inChan <- pack
+}
+
+// startFakeSMTP starts a testutil.FakeSMTP, closed at the end of the test.
+func startFakeSMTP(t *testing.T, extensions ...string) *testutil.FakeSMTP {
+	srv := testutil.NewFakeSMTP(extensions...)
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+func findCommand(commands []string, prefix string) string {
+	for _, c := range commands {
+		if strings.HasPrefix(strings.ToUpper(c), prefix) {
+			return c
+		}
+	}
+	return ""
+}
+
+func TestRequireTLS(t *testing.T) {
+	opts := smtpOptions{
+		timeout:         time.Second,
+		tlsConfig:       &tls.Config{InsecureSkipVerify: true},
+		requireTLS:      true,
+		requireTLSChain: true,
+	}
+
+	srv := startFakeSMTP(t, "STARTTLS", "REQUIRETLS")
+	if err := sendMail(srv.Addr(), "from@example.com", []string{"to@example.com"},
+		[]byte("Subject: test\r\n\r\nbody"), opts); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := srv.Messages(); len(msgs) != 1 || strings.Join(msgs[0].FromParams, " ") != "REQUIRETLS" {
+		t.Errorf("MAIL misses REQUIRETLS: %+v", msgs)
+	}
+
+	srv = startFakeSMTP(t, "STARTTLS")
+	err := sendMail(srv.Addr(), "from@example.com", []string{"to@example.com"},
+		[]byte("Subject: test\r\n\r\nbody"), opts)
+	if err != ErrRequireTLSUnsupported {
+		t.Errorf("got %v, wanted %v", err, ErrRequireTLSUnsupported)
+	}
+	if mail := findCommand(srv.Commands(), "MAIL FROM"); mail != "" {
+		t.Errorf("MAIL issued (%q), although REQUIRETLS is unsupported", mail)
+	}
+
+	opts.requireTLSChain = false
+	if err = sendMail(srv.Addr(), "from@example.com", []string{"to@example.com"},
+		[]byte("Subject: test\r\n\r\nbody"), opts); err != nil {
+		t.Errorf("opportunistic REQUIRETLS: %v", err)
+	}
+}
+
+func TestStartTLSFallback(t *testing.T) {
+	// the certificate of the server is not trusted, so the handshake fails
+	srv := startFakeSMTP(t, "STARTTLS")
+	body := []byte("Subject: test\r\n\r\nbody")
+	opts := smtpOptions{timeout: time.Second}
+	if err := sendMail(srv.Addr(), "from@example.com", []string{"to@example.com"}, body, opts); err == nil {
+		t.Fatal("sent despite the broken STARTTLS")
+	}
+
+	_, untrusted, _ := net.ParseCIDR("10.0.0.0/8")
+	opts.starttlsFallback = []*net.IPNet{untrusted}
+	if err := sendMail(srv.Addr(), "from@example.com", []string{"to@example.com"}, body, opts); err == nil {
+		t.Fatal("fell back to plaintext with an untrusted server")
+	}
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	opts.starttlsFallback = append(opts.starttlsFallback, loopback)
+	if err := sendMail(srv.Addr(), "from@example.com", []string{"to@example.com"}, body, opts); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := srv.Messages(); len(msgs) != 1 || msgs[0].TLS {
+		t.Errorf("wanted one plaintext message, got %+v", msgs)
+	}
+
+	opts.tlsPolicy = tlsRequired
+	if err := sendMail(srv.Addr(), "from@example.com", []string{"to@example.com"}, body, opts); err == nil {
+		t.Error("fell back to plaintext although TLS is required")
+	}
+}
+
+func TestDeliveryStatus(t *testing.T) {
+	srv := startFakeSMTP(t)
+	srv.Reply("MAIL FROM", "451 try again later", "451 try again later", testutil.Pass)
+
+	o := &EmailOutput{From: "heka@example.com", To: []string{"a@example.com", "b@example.com"},
+		hostport: srv.Addr()}
+	body := []byte("Subject: test\r\n\r\nbody")
+	for i, wantFailures := range []int{1, 2, 0} {
+		start := time.Now()
+		err := o.sendMail(body, envelope{})
+		if (err != nil) != (wantFailures > 0) {
+			t.Fatalf("%d. unexpected send result %v", i, err)
+		}
+		status := o.DeliveryStatus()
+		if len(status) != 2 {
+			t.Fatalf("%d. got status for %d recipients, wanted 2", i, len(status))
+		}
+		for addr, st := range status {
+			if st.ConsecutiveFailures != wantFailures {
+				t.Errorf("%d. %s: got %d failures, wanted %d", i, addr, st.ConsecutiveFailures, wantFailures)
+			}
+			if (st.LastError != nil) != (wantFailures > 0) {
+				t.Errorf("%d. %s: bad last result %v", i, addr, st.LastError)
+			}
+			if st.LastAttempt.Before(start) {
+				t.Errorf("%d. %s: last attempt %s is before %s", i, addr, st.LastAttempt, start)
+			}
+		}
+	}
+}
+
+func TestTLSPolicy(t *testing.T) {
+	o := &EmailOutput{From: "heka@example.com"}
+	if err := o.Init(&EmailOutputConfig{TLSPolicy: map[string]string{"x.com": "sometimes"}}); err == nil {
+		t.Error("wanted error for unknown TLS policy")
+	}
+	o.tlsPolicy = map[string]tlsPolicy{"partner.com": tlsRequired, "internal.lan": tlsNone}
+	body := []byte("Subject: test\r\n\r\nbody")
+
+	plain := startFakeSMTP(t)
+	o.hostport, o.To = plain.Addr(), []string{"ops@partner.com"}
+	if err := o.sendMail(body, envelope{}); err != ErrStartTLSUnsupported {
+		t.Errorf("required TLS on a cleartext relay: got %v, wanted %v", err, ErrStartTLSUnsupported)
+	}
+	if len(plain.Messages()) != 0 {
+		t.Error("message sent in cleartext to a TLS-required domain")
+	}
+
+	withTLS := startFakeSMTP(t, "STARTTLS")
+	o.hostport, o.To = withTLS.Addr(), []string{"ops@internal.lan"}
+	if err := o.sendMail(body, envelope{}); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := withTLS.Messages(); len(msgs) != 1 || msgs[0].TLS {
+		t.Errorf("wanted one cleartext message, got %+v", msgs)
+	}
+
+	if p := o.policyFor([]string{"a@internal.lan", "b@other.org"}); p != tlsOpportunistic {
+		t.Errorf("mixed domains: got %d, wanted opportunistic", p)
+	}
+	if p := o.policyFor([]string{"a@internal.lan", "b@partner.com"}); p != tlsRequired {
+		t.Errorf("mixed domains: got %d, wanted required", p)
+	}
+}
+
+func TestRequireStartTLS(t *testing.T) {
+	plain := startFakeSMTP(t, "AUTH PLAIN")
+	plain.Users = map[string]string{"heka": "s3cret"}
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = plain.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.Username, conf.Password, conf.NoCertCheck = "heka", "s3cret", true
+	conf.RequireStartTLS = true
+	if err := o.Init(conf); err != ErrStartTLSUnsupported {
+		t.Errorf("got %v, wanted %v", err, ErrStartTLSUnsupported)
+	}
+	for _, verb := range []string{"AUTH", "MAIL"} {
+		if cmd := findCommand(plain.Commands(), verb); cmd != "" {
+			t.Errorf("%q issued in plaintext", cmd)
+		}
+	}
+
+	srv := startFakeSMTP(t, "STARTTLS", "AUTH PLAIN")
+	srv.Users = map[string]string{"heka": "s3cret"}
+	conf.Address = srv.Addr()
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := srv.Messages(); len(msgs) != 1 || !msgs[0].TLS || msgs[0].User != "heka" {
+		t.Errorf("got %+v, wanted one email over TLS", msgs)
+	}
+
+	conf.TLSPolicy = map[string]string{"example.com": "none"}
+	if err := o.Init(conf); err == nil || !strings.Contains(err.Error(), "require_starttls") {
+		t.Errorf("got %v, wanted the require_starttls error", err)
+	}
+}
+
+func TestReceipt(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := &EmailOutput{From: "heka@example.com", To: []string{"a@example.com", "b@example.com"},
+		hostport: srv.Addr(), emitReceipt: true}
+	runner := newTestRunner()
+	runner.send(newTestMessage(3, "web-01", "disk full"))
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+
+	injected := runner.Injected()
+	if len(injected) != 1 {
+		t.Fatalf("got %d injected messages, wanted 1", len(injected))
+	}
+	msg := injected[0]
+	if msg.GetType() != ReceiptType || msg.GetLogger() != "EmailOutput" {
+		t.Errorf("got type %q logger %q", msg.GetType(), msg.GetLogger())
+	}
+	want := "2013-11-12T13:14:15Z [3] test@web-01: disk full"
+	if v, _ := msg.GetFieldValue("subject"); v != want {
+		t.Errorf("got subject %q, wanted %q", v, want)
+	}
+	if v, _ := msg.GetFieldValue("recipients"); v != "a@example.com,b@example.com" {
+		t.Errorf("got recipients %q", v)
+	}
+	if v, ok := msg.GetFieldValue("latency"); !ok || v.(int64) < 0 {
+		t.Errorf("got latency %v", v)
+	}
+
+	// the bcc recipients are not told
+	o.Cc, o.Bcc = []string{"c@example.com"}, []string{"secret@example.com"}
+	runner = newTestRunner()
+	runner.send(newTestMessage(3, "web-01", "disk full"))
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+	if injected := runner.Injected(); len(injected) != 1 {
+		t.Errorf("got %d injected messages, wanted 1", len(injected))
+	} else if v, _ := injected[0].GetFieldValue("recipients"); v != "a@example.com,b@example.com,c@example.com" {
+		t.Errorf("got recipients %q", v)
+	}
+	o.Cc, o.Bcc = nil, nil
+
+	// no receipt for failed sends
+	srv.Reply("MAIL FROM", "550 denied")
+	runner = newTestRunner()
+	runner.send(newTestMessage(3, "web-01", "disk full"))
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(runner.Errors()) == 0 {
+		t.Error("wanted send error")
+	}
+	if n := len(runner.Injected()); n != 0 {
+		t.Errorf("got %d receipts for a failed send", n)
+	}
+}
+
+func TestMaxTotalConns(t *testing.T) {
+	oldConns := totalConns
+	totalConns = newConnLimiter()
+	t.Cleanup(func() { totalConns = oldConns })
+	o := &EmailOutput{From: "heka@example.com"}
+	if err := o.Init(&EmailOutputConfig{MaxTotalConns: -1}); err == nil {
+		t.Error("wanted error for negative max_total_conns")
+	}
+	totalConns.Limit(5)
+	totalConns.Limit(2) // the last one wins
+	totalConns.Limit(0) // keeps it
+
+	var gauge testutil.Gauge
+	relays := make([]*testutil.FakeSMTP, 3)
+	for i := range relays {
+		srv := testutil.NewFakeSMTP()
+		srv.Delay, srv.Gauge = 20*time.Millisecond, &gauge
+		if err := srv.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { srv.Close() })
+		relays[i] = srv
+	}
+	body := []byte("Subject: test\r\n\r\nbody")
+
+	// direct MX delivery to several domains, all served by the first relay
+	useFakeMX(t, "localhost.", relays[0].Port())
+	mx := &EmailOutput{From: "heka@example.com", byHost: make(map[string][]string)}
+	mxAddrsLock.Lock()
+	for _, domain := range []string{"a.com", "b.com", "c.com", "d.com"} {
+		mx.byHost[domain] = []string{"ops@" + domain}
+		mxAddrs[domain] = cachedMX{mxs: []*net.MX{{Host: "localhost.", Pref: 10}}, fetched: time.Now()}
+	}
+	mxAddrsLock.Unlock()
+
+	var wg sync.WaitGroup
+	outputs := []*EmailOutput{mx}
+	for i := 0; i < 6; i++ {
+		outputs = append(outputs, &EmailOutput{From: "heka@example.com",
+			To: []string{"ops@example.com"}, hostport: relays[i%len(relays)].Addr()})
+	}
+	for _, o := range outputs {
+		wg.Add(1)
+		go func(o *EmailOutput) {
+			defer wg.Done()
+			if err := o.sendMail(body, envelope{}); err != nil {
+				t.Error(err)
+			}
+		}(o)
+	}
+	wg.Wait()
+
+	var n int
+	for _, srv := range relays {
+		n += len(srv.Messages())
+	}
+	if n != 10 {
+		t.Errorf("got %d messages, wanted 10", n)
+	}
+	if m := gauge.Max(); m != 2 {
+		t.Errorf("got %d concurrent conversations, wanted 2", m)
+	}
+
+	// raising the limit (reloading the config) lets the waiting ones go on
+	totalConns.Limit(1)
+	totalConns.Acquire()
+	acquired := make(chan struct{})
+	go func() {
+		totalConns.Acquire()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	totalConns.Limit(2)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Error("still waiting after raising the limit")
+	}
+	totalConns.Release()
+	totalConns.Release()
+}
+
+func TestSubjectTruncation(t *testing.T) {
+	o := &EmailOutput{}
+	if err := o.Init(o.ConfigStruct()); err != nil {
+		t.Fatal(err)
+	}
+	short := strings.Repeat("x", subjectPayloadLen)
+	if got := o.subjectPayload(short); got != short {
+		t.Errorf("full payload got marked: %q", got)
+	}
+	// a 2-byte rune straddling the limit must not be cut in half
+	long := strings.Repeat("x", subjectPayloadLen-1) + "éz"
+	want := strings.Repeat("x", subjectPayloadLen-1) + "…"
+	if got := o.subjectPayload(long); got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+	o.truncTag = true
+	if got := o.subjectPayload(long); got != want+" [truncated]" {
+		t.Errorf("got %q, wanted the [truncated] tag", got)
+	}
+	if got := subjectOf(o.formatMessage(newTestMessage(3, "web-01", long))); !strings.HasSuffix(got, "… [truncated]") {
+		t.Errorf("subject %q misses the marker", got)
+	}
+}
+
+func TestSubjectPayloadLen(t *testing.T) {
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.SubjectPayloadLen = 12
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	msg := newTestMessage(3, "web-01", "árvíztűrő tükörfúrógép")
+	// "árvíztűrő" is 9 characters in 13 bytes: "ő" would be cut in half
+	if got, want := subjectOf(o.formatMessage(msg)), "test@web-01: árvíztűr…"; !strings.HasSuffix(got, want) {
+		t.Errorf("got %q, wanted the suffix %q", got, want)
+	}
+
+	conf.SubjectPayloadLen = 0
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	if got := subjectOf(o.formatMessage(msg)); !strings.HasSuffix(got, "[3] test@web-01") {
+		t.Errorf("got %q, wanted no payload", got)
+	}
+	conf.SubjectPayloadLen = -1
+	if err := o.Init(conf); err == nil {
+		t.Error("accepted negative subject_payload_len")
+	}
+}
+
+func TestSubjectTemplate(t *testing.T) {
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Subject = `[{{.Severity}}] {{.Hostname}}/{{.Logger}} {{.Timestamp.UTC.Format "15:04"}}:
+		{{printf "%.10s" .Payload}}`
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	msg := newTestMessage(3, "web-01", "500 on /login for 5 minutes")
+	if got, want := subjectOf(o.formatMessage(msg)), "[3] web-01/test 13:14: 500 on /lo"; got != want {
+		t.Errorf("got subject %q, wanted %q", got, want)
+	}
+	batch := o.formatBatch([]*message.Message{msg, newTestMessage(2, "db-01", "down")})
+	if got, want := subjectOf(batch), "[3] web-01/test 13:14: 500 on /lo (+1 more)"; got != want {
+		t.Errorf("got batch subject %q, wanted %q", got, want)
+	}
+
+	conf.Subject = "{{.Severity"
+	if err := new(EmailOutput).Init(conf); err == nil {
+		t.Error("wanted error for a bad subject template")
+	}
+}
+
+func TestTimestampLayout(t *testing.T) {
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.TimestampLayout = "15:04:05"
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	msg := newTestMessage(3, "web-01", "disk full")
+	want := time.Unix(0, msg.GetTimestamp()).Format("15:04:05") + " [3] test@web-01: disk full"
+	if got := subjectOf(o.formatMessage(msg)); got != want {
+		t.Errorf("got subject %q, wanted %q", got, want)
+	}
+	if got := subjectOf(new(EmailOutput).formatMessage(msg)); !strings.HasPrefix(got,
+		time.Unix(0, msg.GetTimestamp()).Format(time.RFC3339)+" ") {
+		t.Errorf("got subject %q, wanted an RFC3339 timestamp by default", got)
+	}
+}
+
+func TestCollapseWhitespace(t *testing.T) {
+	o := &EmailOutput{collapseWS: true}
+	payload := "  disk\tfull:\n\n  /var\t\t95%  \r\n"
+	email := string(o.formatMessage(newTestMessage(3, "web-01", payload)))
+	if got := subjectOf([]byte(email)); !strings.HasSuffix(got, ": disk full: /var 95%") {
+		t.Errorf("got subject %q", got)
+	}
+	if !strings.HasSuffix(email, "\r\n\r\n"+payload) {
+		t.Errorf("the body is changed:\n%q", email)
+	}
+}
+
+func TestStripPayloadPrefix(t *testing.T) {
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.StripPayloadPrefix = `\d{4}-\d\d-\d\d \d\d:\d\d:\d\d \[\d+\] `
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	email := string(o.formatMessage(newTestMessage(3, "web-01", "2013-11-12 13:14:15 [4711] disk full")))
+	if got := subjectOf([]byte(email)); !strings.HasSuffix(got, "@web-01: disk full") {
+		t.Errorf("got subject %q", got)
+	}
+	if !strings.HasSuffix(email, "\r\n\r\ndisk full") {
+		t.Errorf("the prefix is not stripped from the body:\n%s", email)
+	}
+	// only a prefix is stripped
+	payload := "disk full at 2013-11-12 13:14:15 [4711] "
+	if email = string(o.formatMessage(newTestMessage(3, "web-01", payload))); !strings.HasSuffix(email, "\r\n\r\n"+payload) {
+		t.Errorf("a non-matching payload is changed:\n%s", email)
+	}
+
+	conf.StripPayloadPrefix = "[unclosed"
+	if err := new(EmailOutput).Init(conf); err == nil {
+		t.Error("bad strip_payload_prefix accepted")
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"},
+		hostport: srv.Addr(), contentHash: true}
+	payload := "disk full\non /var"
+	runner := newTestRunner()
+	runner.send(newTestMessage(3, "web-01", payload))
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+	msgs := srv.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages, wanted 1", len(msgs))
+	}
+	sum := sha256.Sum256([]byte(payload))
+	want := "X-Content-Hash: sha256=" + hex.EncodeToString(sum[:]) + "\r\n"
+	header := string(msgs[0].Data[:bytes.Index(msgs[0].Data, []byte("\r\n\r\n"))+2])
+	if !strings.Contains(header, want) {
+		t.Errorf("header %q misses %q", header, want)
+	}
+
+	// the text added to the payload is not hashed
+	o = new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.ContentHash, conf.TimestampLayout = true, "2006-01-02"
+	conf.AckBaseURL, conf.AckSecret = "https://ack.example.com/ack", "s3cret"
+	conf.Runbooks = map[string]string{"disk": "Clean /var/log."}
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	email := string(o.formatMessage(newTestMessage(3, "web-01", payload)))
+	if !strings.Contains(email, "Runbook:") || !strings.Contains(email, "Acknowledge: ") {
+		t.Fatalf("no runbook or ack link in\n%s", email)
+	}
+	if header = email[:strings.Index(email, "\r\n\r\n")+2]; !strings.Contains(header, want) {
+		t.Errorf("header %q misses %q", header, want)
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	o := &EmailOutput{}
+	if small, large := o.sendTimeout(100), o.sendTimeout(10<<20); small != DefaultTimeout || large != DefaultTimeout {
+		t.Errorf("without throughput got %s and %s, wanted %s", small, large, DefaultTimeout)
+	}
+	o.throughput = 1 << 20 // 1MiB/s
+	small, large := o.sendTimeout(1<<10), o.sendTimeout(10<<20)
+	if large <= small {
+		t.Errorf("large body got %s, not more than the small one's %s", large, small)
+	}
+	if want := DefaultTimeout + 10*time.Second; large != want {
+		t.Errorf("10MiB got %s, wanted %s", large, want)
+	}
+
+	// the timeout bounds the whole conversation, not just the dialing
+	stall := testutil.NewFakeSMTP()
+	stall.Delay = time.Second
+	if err := stall.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stall.Close()
+	start := time.Now()
+	err := sendMail(stall.Addr(), "from@example.com", []string{"to@example.com"},
+		[]byte("Subject: test\r\n\r\nbody"), smtpOptions{timeout: 100 * time.Millisecond})
+	if err == nil || time.Since(start) > 900*time.Millisecond {
+		t.Errorf("got %v after %s, wanted a timeout", err, time.Since(start))
+	}
+}
+
+func TestSelfAlert(t *testing.T) {
+	srv := startFakeSMTP(t)
+	srv.Reply("MAIL FROM", "451 try again later")
+	runner := newTestRunner()
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"},
+		hostport: srv.Addr(), selfAlert: true, runner: runner, helper: testHelper{}}
+	body := []byte("Subject: disk full\r\n\r\nbody")
+	for i := 0; i < 3; i++ {
+		if err := o.deliver(body, envelope{}, 0); err == nil {
+			t.Fatalf("%d. wanted error", i)
+		}
+	}
+	alerts := runner.Injected()
+	if len(alerts) != 3 {
+		t.Fatalf("got %d self-alerts, wanted 3", len(alerts))
+	}
+	for i, msg := range alerts {
+		if msg.GetType() != FailureType || msg.GetSeverity() != 2 {
+			t.Errorf("%d. got type %q severity %d", i, msg.GetType(), msg.GetSeverity())
+		}
+		if n, _ := msg.GetFieldValue("consecutive_failures"); n != int64(i+1) {
+			t.Errorf("%d. got %v consecutive failures, wanted %d", i, n, i+1)
+		}
+		if v, _ := msg.GetFieldValue("subject"); v != "disk full" {
+			t.Errorf("%d. got subject %q", i, v)
+		}
+		if v, _ := msg.GetFieldValue("error"); !strings.Contains(v.(string), "451") {
+			t.Errorf("%d. got error %q", i, v)
+		}
+	}
+}
+
+func TestDropOnError(t *testing.T) {
+	for _, drop := range []bool{false, true} {
+		srv := startFakeSMTP(t)
+		o := new(EmailOutput)
+		conf := o.ConfigStruct().(*EmailOutputConfig)
+		conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+		conf.DropOnError = drop
+		if err := o.Init(conf); err != nil {
+			t.Fatal(err)
+		}
+		srv.Reply("MAIL FROM", "451 try again later", testutil.Pass)
+		runner := newTestRunner()
+		runner.send(newTestMessage(3, "web-01", "first"))
+		runner.send(newTestMessage(3, "web-01", "second"))
+		close(runner.inChan)
+		if err := o.Run(runner, testHelper{}); err != nil {
+			t.Fatalf("drop=%t: %v", drop, err)
+		}
+		if errs := runner.Errors(); len(errs) != 1 {
+			t.Errorf("drop=%t: got errors %v, wanted 1", drop, errs)
+		}
+		want := []string{"first", "second"}
+		if drop {
+			want = want[1:]
+		}
+		msgs := srv.Messages()
+		if len(msgs) != len(want) {
+			t.Fatalf("drop=%t: got %d emails, wanted %d", drop, len(msgs), len(want))
+		}
+		for i, payload := range want {
+			if !strings.Contains(string(msgs[i].Data), payload) {
+				t.Errorf("drop=%t: %d. email misses %q", drop, i+1, payload)
+			}
+		}
+	}
+}
+
+func TestRequeueFailedDomains(t *testing.T) {
+	mx := startFakeSMTP(t)
+	useFakeMX(t, "localhost.", mx.Port())
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.From, conf.To = "heka@example.com", []string{"ops@example.com", "dev@example.net"}
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	prepared := len(mx.Messages())
+	mx.Reply("RCPT TO:<dev@example.net>", "451 try again later", testutil.Pass)
+	runner := newTestRunner()
+	runner.send(newTestMessage(3, "web-01", "first"))
+	runner.send(newTestMessage(3, "web-01", "second"))
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+	// the resending goes to the failed domain only
+	var got []string
+	for _, m := range mx.Messages()[prepared:] {
+		payload := "first"
+		if strings.Contains(string(m.Data), "second") {
+			payload = "second"
+		}
+		got = append(got, payload+" "+strings.Join(m.To, ","))
+	}
+	sort.Strings(got)
+	if want := "first dev@example.net|first ops@example.com|second dev@example.net|second ops@example.com"; strings.Join(got, "|") != want {
+		t.Errorf("got %q, wanted %s", got, want)
+	}
+}
+
+func TestResendRateLimit(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.MaxPerInterval, conf.Interval, conf.OnLimit = 2, "1h", "drop"
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	srv.Reply("MAIL FROM", "451 try again later", testutil.Pass)
+	runner := newTestRunner()
+	for _, payload := range []string{"first", "second", "third"} {
+		runner.send(newTestMessage(3, "web-01", payload))
+	}
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+	// the resent first one takes the second token, the others are over the limit
+	msgs := srv.Messages()
+	if len(msgs) != 1 || !strings.Contains(string(msgs[0].Data), "first") {
+		t.Errorf("got %d emails, wanted the first one only", len(msgs))
+	}
+	if o.rateLimited != 2 {
+		t.Errorf("got %d rate limited, wanted 2", o.rateLimited)
+	}
+}
+
+func TestImplicitTLS(t *testing.T) {
+	srv := testutil.NewFakeSMTP("STARTTLS")
+	srv.ImplicitTLS = true
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.ImplicitTLS, conf.NoCertCheck = true, true
+	conf.TLSPolicy = map[string]string{"example.com": "required"}
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := srv.Messages(); len(msgs) != 1 || !msgs[0].TLS {
+		t.Errorf("got %+v, wanted one email over TLS", msgs)
+	}
+	if cmd := findCommand(srv.Commands(), "STARTTLS"); cmd != "" {
+		t.Error("STARTTLS issued over implicit TLS")
+	}
+
+	// a plaintext server fails the handshake
+	plain := startFakeSMTP(t)
+	conf.Address = plain.Addr()
+	if err := o.Init(conf); err == nil {
+		t.Error("Init succeeded with a plaintext server")
+	}
+}
+
+func TestClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "heka-email-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeClientCert(t, dir)
+
+	for _, implicit := range []bool{false, true} {
+		srv := testutil.NewFakeSMTP("STARTTLS")
+		srv.ImplicitTLS = implicit
+		var presented int
+		srv.TLSConfig.ClientAuth = tls.RequireAnyClientCert
+		srv.TLSConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			presented = len(rawCerts)
+			return nil
+		}
+		if err := srv.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+
+		o := new(EmailOutput)
+		conf := o.ConfigStruct().(*EmailOutputConfig)
+		conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+		conf.ImplicitTLS, conf.NoCertCheck = implicit, true
+		conf.TLSPolicy = map[string]string{"example.com": "required"}
+		if err := o.Init(conf); err == nil {
+			t.Errorf("implicit=%t: Init succeeded without a client certificate", implicit)
+		}
+		conf.ClientCertFile, conf.ClientKeyFile = certFile, keyFile
+		if err := o.Init(conf); err != nil {
+			t.Fatalf("implicit=%t: %v", implicit, err)
+		}
+		if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err != nil {
+			t.Fatalf("implicit=%t: %v", implicit, err)
+		}
+		if msgs := srv.Messages(); len(msgs) == 0 || !msgs[len(msgs)-1].TLS || presented != 1 {
+			t.Errorf("implicit=%t: got %d emails with %d certificates presented", implicit, len(msgs), presented)
+		}
+	}
+
+	for _, tc := range []struct {
+		cert, key, want string
+	}{
+		{certFile, "", "set together"},
+		{"", keyFile, "set together"},
+		{certFile, certFile, "cannot load"},
+		{filepath.Join(dir, "missing.pem"), keyFile, "cannot load"},
+	} {
+		conf := &EmailOutputConfig{Address: "localhost", ClientCertFile: tc.cert, ClientKeyFile: tc.key}
+		if err := new(EmailOutput).Init(conf); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q, %q: got %v, wanted %q", tc.cert, tc.key, err, tc.want)
+		}
+	}
+}
+
+// writeClientCert writes a self-signed client certificate and its key
+// into dir, returning the names of the PEM files.
+func writeClientCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "heka"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	for name, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := ioutil.WriteFile(name, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certFile, keyFile
+}
+
+func TestEncodeSubject(t *testing.T) {
+	o := new(EmailOutput)
+	if data := string(o.email("disk full on /var", "body")); !strings.HasPrefix(data, "Subject: disk full on /var\r\n") {
+		t.Errorf("the ASCII subject changed: %q", data)
+	}
+	subject := strings.Repeat("árvíztűrő tükörfúrógép ", 5) + "x"
+	data := o.email(subject, "body")
+	header := string(data[:bytes.Index(data, []byte("\r\n\r\n"))])
+	lines := strings.Split(header[:strings.Index(header, "\r\nMessage-ID:")], "\r\n")
+	if len(lines) < 2 || !strings.HasPrefix(lines[0], "Subject: =?utf-8?q?") {
+		t.Fatalf("got %q, wanted a folded encoded subject", lines)
+	}
+	for _, line := range lines {
+		if len(line) > 85 || strings.ContainsAny(line, "áéíóöőúüű") {
+			t.Errorf("bad subject line %q", line)
+		}
+	}
+	if got := subjectOf(data); got != subject {
+		t.Errorf("got %q, wanted %q", got, subject)
+	}
+	// the suffix goes after the folded lines
+	if got := subjectOf(withSubjectSuffix(data, " (2 duplicates suppressed)")); got != subject+" (2 duplicates suppressed)" {
+		t.Errorf("got %q with the suffix", got)
+	}
+}
+
+func TestSourceHeaders(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.SourceHeaders = true
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	msg := newTestMessage(2, "db-01", "the database is down")
+	msg.SetPid(4321)
+	msg.SetEnvVersion("0.8")
+	email := string(o.formatMessage(msg))
+	for _, h := range []string{"\r\nX-Heka-Pid: 4321\r\n", "\r\nX-Heka-EnvVersion: 0.8\r\n"} {
+		if !strings.Contains(email, h) {
+			t.Errorf("no %q in\n%s", strings.TrimSpace(h), email)
+		}
+	}
+
+	// the unset attributes are omitted
+	msg = newTestMessage(2, "db-01", "the database is down")
+	msg.SetPid(0)
+	if email = string(o.formatMessage(msg)); strings.Contains(email, "X-Heka-") {
+		t.Errorf("got headers of unset attributes:\n%s", email)
+	}
+	o.sourceHeaders = false
+	msg.SetPid(4321)
+	if email = string(o.formatMessage(msg)); strings.Contains(email, "X-Heka-") {
+		t.Errorf("got headers without source_headers:\n%s", email)
+	}
+}
+
+func TestHeloHostname(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.HeloHostname = "heka-01.example.com"
+	if err := o.Init(conf); err != nil { // the test sending
+		t.Fatal(err)
+	}
+	if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err != nil {
+		t.Fatal(err)
+	}
+	var helos []string
+	for _, cmd := range srv.Commands() {
+		if strings.HasPrefix(cmd, "EHLO ") {
+			helos = append(helos, cmd)
+		}
+	}
+	if got := strings.Join(helos, ","); got != "EHLO heka-01.example.com,EHLO heka-01.example.com" {
+		t.Errorf("got %s", got)
+	}
+
+	// the hostname of the machine by default
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+	conf.HeloHostname = ""
+	if err = o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	cmds := srv.Commands()
+	if got := findCommand(cmds[len(cmds)-5:], "EHLO "); got != "EHLO "+hostname {
+		t.Errorf("got %q, wanted the hostname %s", got, hostname)
+	}
+}
+
+func TestConfigHeaders(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.ReplyTo = "alerts@example.com"
+	conf.Headers = map[string]string{"X-Alert-Source": "heka", "X-Team": "ops"}
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(o.formatMessage(newTestMessage(2, "db-01", "the database is down"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"Reply-To": "alerts@example.com", "X-Alert-Source": "heka", "X-Team": "ops",
+	} {
+		if got := m.Header.Get(name); got != want {
+			t.Errorf("got %s %q, wanted %q", name, got, want)
+		}
+	}
+	if body, _ := ioutil.ReadAll(m.Body); strings.Contains(string(body), "X-Alert-Source") {
+		t.Errorf("header in the body:\n%s", body)
+	}
+
+	for _, tc := range []struct {
+		replyTo string
+		headers map[string]string
+	}{
+		{"alerts@example.com\r\nBcc: evil@example.com", nil},
+		{"", map[string]string{"X-Source\r\nBcc": "evil@example.com"}},
+		{"", map[string]string{"X Source": "heka"}},
+		{"", map[string]string{"X-Source": "heka\nBcc: evil@example.com"}},
+	} {
+		conf.ReplyTo, conf.Headers = tc.replyTo, tc.headers
+		if err := new(EmailOutput).Init(conf); err == nil {
+			t.Errorf("accepted %q %q", tc.replyTo, tc.headers)
+		}
+	}
+}
+
+func TestFromName(t *testing.T) {
+	srv := startFakeSMTP(t)
+	for _, tc := range []struct {
+		name, want string
+	}{
+		{"Heka Alerts", `"Heka Alerts" <alerts@example.com>`},
+		{"Riasztó", "=?utf-8?q?Riaszt=C3=B3?= <alerts@example.com>"},
+	} {
+		o := new(EmailOutput)
+		conf := o.ConfigStruct().(*EmailOutputConfig)
+		conf.Address, conf.From, conf.To = srv.Addr(), "alerts@example.com", []string{"ops@example.com"}
+		conf.FromName = tc.name
+		if err := o.Init(conf); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.sendMail(o.formatMessage(newTestMessage(2, "db-01", "the database is down")), envelope{}); err != nil {
+			t.Fatal(err)
+		}
+		msgs := srv.Messages()
+		last := msgs[len(msgs)-1]
+		if last.From != "alerts@example.com" {
+			t.Errorf("%s: got envelope sender %q", tc.name, last.From)
+		}
+		m, err := mail.ReadMessage(bytes.NewReader(last.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Header.Get("From"); got != tc.want {
+			t.Errorf("got From %q, wanted %q", got, tc.want)
+		}
+		if addr, err := m.Header.AddressList("From"); err != nil || addr[0].Name != tc.name {
+			t.Errorf("got %v (%v), wanted %s", addr, err, tc.name)
+		}
+	}
+}
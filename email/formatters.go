@@ -0,0 +1,222 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// BodyFormatter returns the body of the email of the message,
+// and its content type (e.g. "text/html; charset=utf-8").
+type BodyFormatter func(msg *message.Message) (body []byte, contentType string, err error)
+
+var (
+	bodyFormattersMu sync.RWMutex
+	bodyFormatters   = make(map[string]BodyFormatter)
+)
+
+// RegisterBodyFormatter registers the formatter under name,
+// to be selected with the body_format option of EmailOutput.
+func RegisterBodyFormatter(name string, formatter BodyFormatter) {
+	bodyFormattersMu.Lock()
+	bodyFormatters[name] = formatter
+	bodyFormattersMu.Unlock()
+}
+
+// lookupBodyFormatter returns the formatter registered under name.
+func lookupBodyFormatter(name string) (BodyFormatter, error) {
+	bodyFormattersMu.RLock()
+	formatter, ok := bodyFormatters[name]
+	bodyFormattersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown body_format %q", name)
+	}
+	return formatter, nil
+}
+
+func init() {
+	RegisterBodyFormatter("text", formatText)
+	RegisterBodyFormatter("json", formatJSON)
+	RegisterBodyFormatter("markdown-to-html", formatMarkdown)
+}
+
+// formatText returns the payload as is.
+func formatText(msg *message.Message) ([]byte, string, error) {
+	return []byte(msg.GetPayload()), "text/plain; charset=utf-8", nil
+}
+
+// formatJSON returns the message as a JSON object.
+func formatJSON(msg *message.Message) ([]byte, string, error) {
+	fields := make(map[string]interface{}, len(msg.GetFields()))
+	for _, f := range msg.GetFields() {
+		fields[f.GetName()] = f.GetValue()
+	}
+	b, err := json.MarshalIndent(map[string]interface{}{
+		"Timestamp": time.Unix(0, msg.GetTimestamp()).UTC().Format(time.RFC3339Nano),
+		"Type":      msg.GetType(),
+		"Logger":    msg.GetLogger(),
+		"Severity":  msg.GetSeverity(),
+		"Hostname":  msg.GetHostname(),
+		"Payload":   msg.GetPayload(),
+		"Fields":    fields,
+	}, "", "  ")
+	return b, "application/json", err
+}
+
+var (
+	mdCode   = regexp.MustCompile("`([^`]+)`")
+	mdStrong = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	mdEm     = regexp.MustCompile(`\*([^*]+)\*`)
+	mdLink   = regexp.MustCompile(`\[([^\]]+)\]\((https?://[^)\s]+)\)`)
+)
+
+// formatMarkdown renders the payload as (a basic subset of) Markdown:
+// headings, paragraphs, lists, fenced code blocks, code spans, emphasis and links.
+func formatMarkdown(msg *message.Message) ([]byte, string, error) {
+	var buf bytes.Buffer
+	buf.WriteString("<html><body>\n")
+	var para []string
+	inList, inCode := false, false
+	endPara := func() {
+		if len(para) > 0 {
+			buf.WriteString("<p>" + strings.Join(para, "\n") + "</p>\n")
+			para = para[:0]
+		}
+	}
+	endList := func() {
+		if inList {
+			buf.WriteString("</ul>\n")
+			inList = false
+		}
+	}
+	for _, line := range strings.Split(strings.Replace(msg.GetPayload(), "\r\n", "\n", -1), "\n") {
+		if strings.HasPrefix(line, "```") {
+			endPara()
+			endList()
+			if inCode {
+				buf.WriteString("</code></pre>\n")
+			} else {
+				buf.WriteString("<pre><code>")
+			}
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			buf.WriteString(html.EscapeString(line) + "\n")
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			endPara()
+			endList()
+		case strings.HasPrefix(trimmed, "#"):
+			endPara()
+			endList()
+			level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+			if level > 6 {
+				level = 6
+			}
+			fmt.Fprintf(&buf, "<h%d>%s</h%d>\n", level, mdInline(strings.TrimSpace(trimmed[level:])), level)
+		case strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* "):
+			endPara()
+			if !inList {
+				buf.WriteString("<ul>\n")
+				inList = true
+			}
+			buf.WriteString("<li>" + mdInline(trimmed[2:]) + "</li>\n")
+		default:
+			endList()
+			para = append(para, mdInline(trimmed))
+		}
+	}
+	endPara()
+	endList()
+	if inCode {
+		buf.WriteString("</code></pre>\n")
+	}
+	buf.WriteString("</body></html>\n")
+	return buf.Bytes(), "text/html; charset=utf-8", nil
+}
+
+// mdInline renders the inline Markdown of the (HTML escaped) text.
+func mdInline(text string) string {
+	text = html.EscapeString(text)
+	text = mdCode.ReplaceAllString(text, "<code>$1</code>")
+	text = mdLink.ReplaceAllString(text, `<a href="$2">$1</a>`)
+	text = mdStrong.ReplaceAllString(text, "<strong>$1</strong>")
+	return mdEm.ReplaceAllString(text, "<em>$1</em>")
+}
+
+// bodyData is the data of the body template. Its Fields shadow those of
+// localeData: as strings (with missingkey=zero), the missing ones render
+// empty, not "<no value>".
+type bodyData struct {
+	localeData
+	Type       string
+	Uuid       string
+	Pid        int32
+	EnvVersion string
+	Fields     map[string]string
+}
+
+// executeBody returns the body of the message by the body template.
+func (o *EmailOutput) executeBody(msg *message.Message) (string, error) {
+	data := bodyData{localeData: o.templateData(msg), Type: msg.GetType(), Uuid: msg.GetUuidString(),
+		Pid: msg.GetPid(), EnvVersion: msg.GetEnvVersion(), Fields: make(map[string]string, len(msg.GetFields()))}
+	data.Subject = o.subject(msg)
+	for name, v := range data.localeData.Fields {
+		data.Fields[name] = fmt.Sprint(v)
+	}
+	var buf bytes.Buffer
+	if err := o.bodyTmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// formatBody returns the text of the message's email and its extra headers,
+// by the body template or the configured body formatter (the payload,
+// without extra headers, if none).
+func (o *EmailOutput) formatBody(msg *message.Message) (string, []string) {
+	payload := o.payload(msg)
+	if o.bodyTmpl != nil {
+		text, err := o.executeBody(msg)
+		if err != nil {
+			o.logError(fmt.Errorf("executing the body template: %s", err))
+			return payload, nil
+		}
+		return text, nil
+	}
+	if o.bodyFormatter == nil {
+		return payload, nil
+	}
+	if payload != msg.GetPayload() {
+		msg = message.CopyMessage(msg)
+		msg.SetPayload(payload)
+	}
+	body, contentType, err := o.bodyFormatter(msg)
+	if err != nil {
+		o.logError(fmt.Errorf("formatting the body: %s", err))
+		return payload, nil
+	}
+	return string(body), []string{"MIME-Version: 1.0", "Content-Type: " + contentType}
+}
@@ -0,0 +1,120 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+func TestBodyFormatters(t *testing.T) {
+	RegisterBodyFormatter("shout", func(msg *message.Message) ([]byte, string, error) {
+		return []byte(strings.ToUpper(msg.GetPayload())), "text/x-shout", nil
+	})
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.BodyFormat = "shout"
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	email := string(o.formatMessage(newTestMessage(2, "db-01", "database is down")))
+	if !strings.Contains(email, "\r\nContent-Type: text/x-shout\r\n") {
+		t.Errorf("no content type in\n%s", email)
+	}
+	if !strings.HasSuffix(email, "\r\n\r\nDATABASE IS DOWN") {
+		t.Errorf("the custom formatter is not used:\n%s", email)
+	}
+
+	conf.BodyFormat = "nonexistent"
+	if err := new(EmailOutput).Init(conf); err == nil {
+		t.Error("unknown body_format accepted")
+	}
+}
+
+func TestBodyTemplate(t *testing.T) {
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.BodyTemplate = "{{.Payload}} on {{.Hostname}} ({{.Type}}, pid {{.Pid}})\n" +
+		"service: {{.Fields.service}}, owner: [{{.Fields.owner}}]{{if .Fields.runbook}}, see {{.Fields.runbook}}{{end}}"
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	msg := newTestMessage(2, "db-01", "database is down")
+	msg.SetType("alert")
+	msg.SetPid(4321)
+	addField(msg, "service", "billing", "")
+	email := string(o.formatMessage(msg))
+	if want := "\r\n\r\ndatabase is down on db-01 (alert, pid 4321)\nservice: billing, owner: []"; !strings.HasSuffix(email, want) {
+		t.Errorf("got\n%s\nwanted it to end with %q", email, want)
+	}
+	if subject := subjectOf([]byte(email)); subject != "2013-11-12T13:14:15Z [2] test@db-01: database is down" {
+		t.Errorf("got subject %q", subject)
+	}
+
+	conf.BodyTemplate = "{{.Payload"
+	if err := new(EmailOutput).Init(conf); err == nil || !strings.Contains(err.Error(), "body_template") {
+		t.Errorf("got %v, wanted the body_template error", err)
+	}
+	conf.BodyTemplate, conf.BodyFormat = "{{.Payload}}", "json"
+	if err := new(EmailOutput).Init(conf); err == nil {
+		t.Error("both body_format and body_template accepted")
+	}
+}
+
+func TestFormatJSON(t *testing.T) {
+	msg := newTestMessage(2, "db-01", "database is down")
+	f, _ := message.NewField("fingerprint", "db-down", "")
+	msg.AddField(f)
+	body, contentType, err := formatJSON(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "application/json" {
+		t.Errorf("got content type %q", contentType)
+	}
+	var m struct {
+		Hostname, Payload string
+		Fields            map[string]interface{}
+	}
+	if err = json.Unmarshal(body, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Hostname != "db-01" || m.Payload != "database is down" || m.Fields["fingerprint"] != "db-down" {
+		t.Errorf("got %+v", m)
+	}
+}
+
+func TestFormatMarkdown(t *testing.T) {
+	msg := newTestMessage(2, "db-01", "# Database down\n\nThe **primary** is <unreachable>:\n\n"+
+		"- check `pg_stat_replication`\n- see [runbook](https://wiki.example.com/db)\n\n```\nselect 1;\n```")
+	body, contentType, err := formatMarkdown(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(contentType, "text/html") {
+		t.Errorf("got content type %q", contentType)
+	}
+	for _, want := range []string{
+		"<h1>Database down</h1>",
+		"<p>The <strong>primary</strong> is &lt;unreachable&gt;:</p>",
+		"<ul>\n<li>check <code>pg_stat_replication</code></li>",
+		`<li>see <a href="https://wiki.example.com/db">runbook</a></li>`,
+		"<pre><code>select 1;\n</code></pre>",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("%q is missing from\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// GraphMailOutput sends the messages as emails with the Microsoft Graph API's
+// sendMail, authenticating with the OAuth2 client credentials flow.
+type GraphMailOutput struct {
+	Sender     string
+	To, Cc     []string
+	maxRetries int
+
+	tenantID, clientID, clientSecret string
+
+	client   *http.Client
+	loginURL string // the Microsoft identity platform endpoint
+	graphURL string // the Graph API endpoint
+
+	tokenMu     sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// GraphMailOutputConfig is for reading the configuration file
+type GraphMailOutputConfig struct {
+	TenantID     string `toml:"tenant_id"`
+	ClientID     string `toml:"client_id"`
+	ClientSecret string `toml:"client_secret"`
+	// Sender is the user (address or id) the emails are sent as;
+	// the application needs the Mail.Send permission.
+	Sender string   `toml:"sender"`
+	To     []string `toml:"to"`
+	Cc     []string `toml:"cc"`
+	// MaxRetries is the number of retries of throttled (429) requests.
+	MaxRetries int `toml:"max_retries"`
+}
+
+// ConfigStruct returns the struct for reading the configuration file
+func (o *GraphMailOutput) ConfigStruct() interface{} {
+	return &GraphMailOutputConfig{MaxRetries: 3}
+}
+
+// Init initializes the GraphMailOutput instance from the config.
+func (o *GraphMailOutput) Init(config interface{}) error {
+	conf := config.(*GraphMailOutputConfig)
+	if conf.TenantID == "" || conf.ClientID == "" || conf.ClientSecret == "" {
+		return errors.New("tenant_id, client_id and client_secret are required")
+	}
+	if conf.Sender == "" || len(conf.To) == 0 {
+		return errors.New("sender and to are required")
+	}
+	o.Sender, o.To, o.Cc, o.maxRetries = conf.Sender, conf.To, conf.Cc, conf.MaxRetries
+	o.tenantID, o.clientID, o.clientSecret = conf.TenantID, conf.ClientID, conf.ClientSecret
+	o.client = &http.Client{Timeout: DefaultTimeout}
+	o.loginURL = "https://login.microsoftonline.com"
+	o.graphURL = "https://graph.microsoft.com/v1.0"
+	return nil
+}
+
+// Run sends each message as an email.
+func (o *GraphMailOutput) Run(runner pipeline.OutputRunner, helper pipeline.PluginHelper) (
+	err error) {
+
+	var body []byte
+	for pack := range runner.InChan() {
+		body, err = o.graphMessage(pack.Message)
+		pack.Recycle()
+		if err != nil {
+			return err
+		}
+		if err = o.sendMail(body, runner.LogMessage); err != nil {
+			return fmt.Errorf("error sending email: %s", err)
+		}
+	}
+	return nil
+}
+
+type graphRecipient struct {
+	EmailAddress struct {
+		Address string `json:"address"`
+	} `json:"emailAddress"`
+}
+
+func graphRecipients(addrs []string) []graphRecipient {
+	recipients := make([]graphRecipient, len(addrs))
+	for i, addr := range addrs {
+		recipients[i].EmailAddress.Address = addr
+	}
+	return recipients
+}
+
+// graphMessage returns the sendMail request body for the message.
+func (o *GraphMailOutput) graphMessage(msg *message.Message) ([]byte, error) {
+	var req struct {
+		Message struct {
+			Subject string `json:"subject"`
+			Body    struct {
+				ContentType string `json:"contentType"`
+				Content     string `json:"content"`
+			} `json:"body"`
+			ToRecipients []graphRecipient `json:"toRecipients"`
+			CcRecipients []graphRecipient `json:"ccRecipients,omitempty"`
+		} `json:"message"`
+		SaveToSentItems bool `json:"saveToSentItems"`
+	}
+	req.Message.Subject = mailSubject(msg)
+	req.Message.Body.ContentType = "Text"
+	req.Message.Body.Content = msg.GetPayload()
+	req.Message.ToRecipients = graphRecipients(o.To)
+	if len(o.Cc) > 0 {
+		req.Message.CcRecipients = graphRecipients(o.Cc)
+	}
+	return json.Marshal(req)
+}
+
+// sendMail posts the sendMail request, retrying the throttled requests
+// after the time given in Retry-After (logged with logMessage), and the
+// unauthorized ones with a new token.
+func (o *GraphMailOutput) sendMail(body []byte, logMessage func(string)) error {
+	sendURL := o.graphURL + "/users/" + url.PathEscape(o.Sender) + "/sendMail"
+	newRequest := func() (*http.Request, error) {
+		token, err := o.accessToken()
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("POST", sendURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	}
+	status, msg, err := doRetry(o.client, o.maxRetries, newRequest, logMessage)
+	if err == nil && status == http.StatusUnauthorized {
+		o.tokenMu.Lock()
+		o.token = ""
+		o.tokenMu.Unlock()
+		status, msg, err = doRetry(o.client, o.maxRetries, newRequest, logMessage)
+	}
+	if err != nil {
+		return err
+	}
+	if status/100 != 2 {
+		return fmt.Errorf("Graph sendMail: %d %s", status, msg)
+	}
+	return nil
+}
+
+// accessToken returns the cached access token, or requests a new one
+// if it is (about to be) expired.
+func (o *GraphMailOutput) accessToken() (string, error) {
+	o.tokenMu.Lock()
+	defer o.tokenMu.Unlock()
+	if o.token != "" && time.Now().Before(o.tokenExpiry) {
+		return o.token, nil
+	}
+	resp, err := o.client.PostForm(
+		o.loginURL+"/"+url.PathEscape(o.tenantID)+"/oauth2/v2.0/token",
+		url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {o.clientID},
+			"client_secret": {o.clientSecret},
+			"scope":         {"https://graph.microsoft.com/.default"},
+		})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&token); err != nil {
+		return "", fmt.Errorf("token response (%s): %s", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return "", fmt.Errorf("token request: %s: %s %s", resp.Status, token.Error, token.Description)
+	}
+	// renew a minute before the expiry
+	o.token = token.AccessToken
+	o.tokenExpiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return o.token, nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("GraphMailOutput", func() interface{} { return new(GraphMailOutput) })
+}
@@ -0,0 +1,99 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestGraphMailOutput(t *testing.T) {
+	var (
+		mu                sync.Mutex
+		tokens, throttled int
+		bodies            []map[string]interface{}
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/tenant/oauth2/v2.0/token":
+			r.ParseForm()
+			if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("client_id") != "id" ||
+				r.Form.Get("client_secret") != "secret" || r.Form.Get("scope") != "https://graph.microsoft.com/.default" {
+				t.Errorf("bad token request %v", r.Form)
+			}
+			tokens++
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"token_type":"Bearer","expires_in":3599,"access_token":"tok"}`))
+		case "/users/heka@example.com/sendMail":
+			if auth := r.Header.Get("Authorization"); auth != "Bearer tok" {
+				t.Errorf("got Authorization %q", auth)
+			}
+			if throttled == 0 {
+				throttled++
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			b, _ := ioutil.ReadAll(r.Body)
+			var body map[string]interface{}
+			if err := json.Unmarshal(b, &body); err != nil {
+				t.Error(err)
+			}
+			bodies = append(bodies, body)
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			t.Errorf("unexpected request %s", r.URL)
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	o := new(GraphMailOutput)
+	conf := o.ConfigStruct().(*GraphMailOutputConfig)
+	conf.TenantID, conf.ClientID, conf.ClientSecret = "tenant", "id", "secret"
+	conf.Sender, conf.To, conf.Cc = "heka@example.com", []string{"ops@example.com"}, []string{"boss@example.com"}
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	o.loginURL, o.graphURL = ts.URL, ts.URL
+
+	runner := newTestRunner()
+	runner.send(newTestMessage(3, "web-01", "disk full"))
+	runner.send(newTestMessage(4, "web-02", "disk almost full"))
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if tokens != 1 {
+		t.Errorf("got %d token requests, wanted 1", tokens)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("got %d messages, wanted 2", len(bodies))
+	}
+	b, _ := json.Marshal(bodies[0])
+	want := `{"message":{"body":{"content":"disk full","contentType":"Text"},` +
+		`"ccRecipients":[{"emailAddress":{"address":"boss@example.com"}}],` +
+		`"subject":"2013-11-12T13:14:15Z [3] test@web-01: disk full",` +
+		`"toRecipients":[{"emailAddress":{"address":"ops@example.com"}}]},"saveToSentItems":false}`
+	if string(b) != want {
+		t.Errorf("got\n%s\nwanted\n%s", b, want)
+	}
+}
@@ -0,0 +1,54 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// htmlAlternative returns the multipart/alternative text of the message's
+// email with the plain text and the html_template rendered as the HTML
+// alternative, and its MIME headers. Each email gets a random boundary.
+func (o *EmailOutput) htmlAlternative(msg *message.Message, text string) (string, []string, error) {
+	data := o.templateData(msg)
+	data.Subject = o.subject(msg)
+	var html bytes.Buffer
+	if err := o.htmlTmpl.Execute(&html, data); err != nil {
+		return "", nil, err
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, alt := range []struct {
+		contentType string
+		body        []byte
+	}{
+		{"text/plain; charset=utf-8", []byte(text)},
+		{"text/html; charset=utf-8", html.Bytes()},
+	} {
+		part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {alt.contentType}})
+		if err != nil {
+			return "", nil, err
+		}
+		part.Write(alt.body)
+	}
+	if err := mw.Close(); err != nil {
+		return "", nil, err
+	}
+	return buf.String(), []string{"MIME-Version: 1.0",
+		fmt.Sprintf("Content-Type: multipart/alternative; boundary=%q", mw.Boundary())}, nil
+}
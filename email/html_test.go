@@ -0,0 +1,72 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"testing"
+)
+
+func TestHTMLTemplate(t *testing.T) {
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.HTMLTemplate = `<p><b>{{.Hostname}}</b>: {{.Payload}}</p>`
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	msg := newTestMessage(3, "web-01", "500 on <script>/login</script>")
+	var boundaries []string
+	for i := 0; i < 2; i++ {
+		email, err := mail.ReadMessage(bytes.NewReader(o.formatMessage(msg)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if email.Header.Get("MIME-Version") != "1.0" {
+			t.Errorf("got MIME-Version %q", email.Header.Get("MIME-Version"))
+		}
+		mediaType, params, err := mime.ParseMediaType(email.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/alternative" {
+			t.Fatalf("got Content-Type %q (%v)", email.Header.Get("Content-Type"), err)
+		}
+		boundaries = append(boundaries, params["boundary"])
+		mr := multipart.NewReader(email.Body, params["boundary"])
+		for _, want := range []struct{ contentType, body string }{
+			{"text/plain; charset=utf-8", "500 on <script>/login</script>"},
+			{"text/html; charset=utf-8", "<p><b>web-01</b>: 500 on &lt;script&gt;/login&lt;/script&gt;</p>"},
+		} {
+			part, err := mr.NextPart()
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(part)
+			if ct := part.Header.Get("Content-Type"); ct != want.contentType || string(body) != want.body {
+				t.Errorf("got %s part %q, wanted %s %q", ct, body, want.contentType, want.body)
+			}
+		}
+		if _, err = mr.NextPart(); err != io.EOF {
+			t.Errorf("the multipart is not terminated properly: %v", err)
+		}
+	}
+	if boundaries[0] == boundaries[1] {
+		t.Error("the boundary is not random")
+	}
+
+	conf.HTMLTemplate = "{{.Payload"
+	if err := new(EmailOutput).Init(conf); err == nil {
+		t.Error("wanted error for a bad html_template")
+	}
+}
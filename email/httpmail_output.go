@@ -0,0 +1,289 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPMailOutput sends the messages as emails with a transactional email
+// provider's HTTP API: SendGrid (v3 mail/send) or Mailgun (v3 messages).
+type HTTPMailOutput struct {
+	From          string
+	To            []string
+	provider      string
+	apiKey        string
+	apiURL        string
+	domain        string
+	attachPayload bool
+	attachName    string
+	maxRetries    int
+	client        *http.Client
+
+	// attachMinSeverity is the least severe severity getting the attachment
+	attachMinSeverity int32
+}
+
+// HTTPMailOutputConfig is for reading the configuration file
+type HTTPMailOutputConfig struct {
+	// Provider is "sendgrid" or "mailgun".
+	Provider string `toml:"provider"`
+	APIKey   string `toml:"api_key"`
+	// APIURL overrides the provider's API endpoint
+	// (e.g. "https://api.eu.mailgun.net/v3" for Mailgun's EU region).
+	APIURL string `toml:"api_url"`
+	// Domain is the sending domain, required by Mailgun.
+	Domain string   `toml:"domain"`
+	From   string   `toml:"from"`
+	To     []string `toml:"to"`
+	// AttachPayload attaches the payload as payload.txt, too.
+	AttachPayload bool `toml:"attach_payload"`
+	// AttachmentNameField is the message field holding the name of the
+	// attachment ("Logger" for the logger), instead of payload.txt.
+	// The name is sanitized: directories and illegal characters are removed.
+	AttachmentNameField string `toml:"attachment_name_field"`
+	// AttachMinSeverity attaches the payload only to the messages at least
+	// this severe (at most this severity number), regardless of their size,
+	// so the routine emails stay light. All of them get it by default (7).
+	AttachMinSeverity int32 `toml:"attach_min_severity"`
+	// MaxRetries is the number of retries of rate limited (429) requests.
+	MaxRetries int `toml:"max_retries"`
+}
+
+// ConfigStruct returns the struct for reading the configuration file
+func (o *HTTPMailOutput) ConfigStruct() interface{} {
+	return &HTTPMailOutputConfig{MaxRetries: 3, AttachMinSeverity: 7}
+}
+
+// Init initializes the HTTPMailOutput instance from the config.
+func (o *HTTPMailOutput) Init(config interface{}) error {
+	conf := config.(*HTTPMailOutputConfig)
+	o.provider, o.apiURL = strings.ToLower(conf.Provider), conf.APIURL
+	switch o.provider {
+	case "sendgrid":
+		if o.apiURL == "" {
+			o.apiURL = "https://api.sendgrid.com/v3"
+		}
+	case "mailgun":
+		if conf.Domain == "" {
+			return errors.New("domain is required for mailgun")
+		}
+		if o.apiURL == "" {
+			o.apiURL = "https://api.mailgun.net/v3"
+		}
+	default:
+		return fmt.Errorf("unknown provider %q (should be sendgrid or mailgun)", conf.Provider)
+	}
+	if conf.APIKey == "" || conf.From == "" || len(conf.To) == 0 {
+		return errors.New("api_key, from and to are required")
+	}
+	o.apiURL = strings.TrimSuffix(o.apiURL, "/")
+	o.apiKey, o.domain = conf.APIKey, conf.Domain
+	o.From, o.To = conf.From, conf.To
+	o.attachPayload, o.maxRetries = conf.AttachPayload, conf.MaxRetries
+	o.attachName, o.attachMinSeverity = conf.AttachmentNameField, conf.AttachMinSeverity
+	o.client = &http.Client{Timeout: DefaultTimeout}
+	return nil
+}
+
+// Run sends each message as an email.
+func (o *HTTPMailOutput) Run(runner pipeline.OutputRunner, helper pipeline.PluginHelper) (
+	err error) {
+
+	var newRequest func() (*http.Request, error)
+	for pack := range runner.InChan() {
+		if o.provider == "mailgun" {
+			newRequest, err = o.mailgunRequest(pack.Message)
+		} else {
+			newRequest, err = o.sendgridRequest(pack.Message)
+		}
+		pack.Recycle()
+		if err != nil {
+			return err
+		}
+		status, body, err := doRetry(o.client, o.maxRetries, newRequest, runner.LogMessage)
+		if err == nil && status/100 != 2 {
+			err = fmt.Errorf("%s: %d %s", o.provider, status, body)
+		}
+		if err != nil {
+			return fmt.Errorf("error sending email: %s", err)
+		}
+	}
+	return nil
+}
+
+// mailSubject returns the subject of the email of the message.
+func mailSubject(msg *message.Message) string {
+	snippet, truncated := cutPayload(msg.GetPayload(), subjectPayloadLen)
+	if truncated {
+		snippet += "…"
+	}
+	return messageHeader(msg, msg.GetSeverity(), time.RFC3339) + snippet
+}
+
+type sendgridAddress struct {
+	Email string `json:"email"`
+}
+
+type sendgridPersonalization struct {
+	To []sendgridAddress `json:"to"`
+}
+
+type sendgridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendgridAttachment struct {
+	Content  string `json:"content"`
+	Type     string `json:"type"`
+	Filename string `json:"filename"`
+}
+
+// sendgridRequest returns the mail/send request maker for the message.
+func (o *HTTPMailOutput) sendgridRequest(msg *message.Message) (func() (*http.Request, error), error) {
+	var mail struct {
+		Personalizations []sendgridPersonalization `json:"personalizations"`
+		From             sendgridAddress           `json:"from"`
+		Subject          string                    `json:"subject"`
+		Content          []sendgridContent         `json:"content"`
+		Attachments      []sendgridAttachment      `json:"attachments,omitempty"`
+	}
+	var to []sendgridAddress
+	for _, addr := range o.To {
+		to = append(to, sendgridAddress{addr})
+	}
+	mail.Personalizations = []sendgridPersonalization{{To: to}}
+	mail.From.Email = o.From
+	mail.Subject = mailSubject(msg)
+	mail.Content = []sendgridContent{{Type: "text/plain", Value: msg.GetPayload()}}
+	if o.attach(msg) {
+		mail.Attachments = []sendgridAttachment{{
+			Content:  base64.StdEncoding.EncodeToString([]byte(msg.GetPayload())),
+			Type:     "text/plain",
+			Filename: attachmentName(msg, o.attachName),
+		}}
+	}
+	body, err := json.Marshal(mail)
+	if err != nil {
+		return nil, err
+	}
+	return func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", o.apiURL+"/mail/send", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+o.apiKey)
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	}, nil
+}
+
+// attach reports whether the payload of the message should be attached.
+func (o *HTTPMailOutput) attach(msg *message.Message) bool {
+	return o.attachPayload && msg.GetSeverity() <= o.attachMinSeverity
+}
+
+// mailgunRequest returns the messages request maker for the message.
+func (o *HTTPMailOutput) mailgunRequest(msg *message.Message) (func() (*http.Request, error), error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	w.WriteField("from", o.From)
+	for _, to := range o.To {
+		w.WriteField("to", to)
+	}
+	w.WriteField("subject", mailSubject(msg))
+	w.WriteField("text", msg.GetPayload())
+	if o.attach(msg) {
+		fw, err := w.CreateFormFile("attachment", attachmentName(msg, o.attachName))
+		if err != nil {
+			return nil, err
+		}
+		io.WriteString(fw, msg.GetPayload())
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	body, contentType := buf.Bytes(), w.FormDataContentType()
+	return func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", o.apiURL+"/"+o.domain+"/messages", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth("api", o.apiKey)
+		req.Header.Set("Content-Type", contentType)
+		return req, nil
+	}, nil
+}
+
+// maxRetryWait caps the wait before retrying a rate limited request.
+var maxRetryWait = time.Minute
+
+// doRetry does the request made by newRequest, retrying it at most maxRetries times
+// if it is rate limited (429), and returns the status code and the (beginning of the)
+// response body. The retries are logged with logMessage.
+func doRetry(client *http.Client, maxRetries int, newRequest func() (*http.Request, error),
+	logMessage func(string)) (int, []byte, error) {
+	for retries := 0; ; retries++ {
+		req, err := newRequest()
+		if err != nil {
+			return 0, nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, nil, err
+		}
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusTooManyRequests || retries >= maxRetries {
+			return resp.StatusCode, body, nil
+		}
+		wait := retryAfter(resp.Header)
+		logMessage(fmt.Sprintf("%s %s rate limited, retrying in %s", req.Method, req.URL, wait))
+		time.Sleep(wait)
+	}
+}
+
+// retryAfter returns the wait before retrying, from the Retry-After (seconds)
+// or the X-RateLimit-Reset (Unix time, used by SendGrid) header, defaulting to one second.
+func retryAfter(header http.Header) time.Duration {
+	wait := time.Second
+	if secs, err := strconv.Atoi(strings.TrimSpace(header.Get("Retry-After"))); err == nil && secs >= 0 {
+		wait = time.Duration(secs) * time.Second
+	} else if reset, err := strconv.ParseInt(strings.TrimSpace(header.Get("X-RateLimit-Reset")), 10, 64); err == nil {
+		if wait = time.Until(time.Unix(reset, 0)); wait < 0 {
+			wait = 0
+		}
+	}
+	if wait > maxRetryWait {
+		wait = maxRetryWait
+	}
+	return wait
+}
+
+func init() {
+	pipeline.RegisterPlugin("HTTPMailOutput", func() interface{} { return new(HTTPMailOutput) })
+}
@@ -0,0 +1,130 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// runHTTPMail sends one message with a HTTPMailOutput of the provider,
+// and returns the requests received by the mock API (the first one is rate limited).
+func runHTTPMail(t *testing.T, provider string) []*http.Request {
+	var requests []*http.Request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// keep the body for checking it after the handler returned
+		b, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		requests = append(requests, r)
+		if len(requests) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	o := new(HTTPMailOutput)
+	conf := o.ConfigStruct().(*HTTPMailOutputConfig)
+	conf.Provider, conf.APIKey, conf.APIURL, conf.Domain = provider, "key", ts.URL, "mg.example.com"
+	conf.From, conf.To, conf.AttachPayload = "heka@example.com", []string{"a@example.com", "b@example.com"}, true
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	runner := newTestRunner()
+	runner.send(newTestMessage(3, "web-01", "disk full"))
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests, wanted 2 (one retried)", len(requests))
+	}
+	return requests
+}
+
+func TestHTTPMailSendGrid(t *testing.T) {
+	r := runHTTPMail(t, "sendgrid")[1]
+	if r.URL.Path != "/mail/send" || r.Header.Get("Authorization") != "Bearer key" {
+		t.Errorf("got %s with Authorization %q", r.URL.Path, r.Header.Get("Authorization"))
+	}
+	b, _ := ioutil.ReadAll(r.Body)
+	want := `{"personalizations":[{"to":[{"email":"a@example.com"},{"email":"b@example.com"}]}],` +
+		`"from":{"email":"heka@example.com"},"subject":"2013-11-12T13:14:15Z [3] test@web-01: disk full",` +
+		`"content":[{"type":"text/plain","value":"disk full"}],` +
+		`"attachments":[{"content":"ZGlzayBmdWxs","type":"text/plain","filename":"payload.txt"}]}`
+	if string(b) != want {
+		t.Errorf("got\n%s\nwanted\n%s", b, want)
+	}
+}
+
+func TestHTTPMailMailgun(t *testing.T) {
+	r := runHTTPMail(t, "mailgun")[1]
+	if r.URL.Path != "/mg.example.com/messages" {
+		t.Errorf("got path %s", r.URL.Path)
+	}
+	if user, pass, ok := r.BasicAuth(); !ok || user != "api" || pass != "key" {
+		t.Errorf("got basic auth %q:%q", user, pass)
+	}
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	form := r.MultipartForm
+	for k, want := range map[string]string{
+		"from":    "heka@example.com",
+		"to":      "a@example.com,b@example.com",
+		"subject": "2013-11-12T13:14:15Z [3] test@web-01: disk full",
+		"text":    "disk full",
+	} {
+		if got := strings.Join(form.Value[k], ","); got != want {
+			t.Errorf("%s: got %q, wanted %q", k, got, want)
+		}
+	}
+	if files := form.File["attachment"]; len(files) != 1 || files[0].Filename != "payload.txt" {
+		t.Errorf("got attachments %v", files)
+	}
+}
+
+func TestHTTPMailAttachMinSeverity(t *testing.T) {
+	var attachments []int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Error(err)
+		}
+		attachments = append(attachments, len(r.MultipartForm.File["attachment"]))
+	}))
+	defer ts.Close()
+
+	o := new(HTTPMailOutput)
+	conf := o.ConfigStruct().(*HTTPMailOutputConfig)
+	conf.Provider, conf.APIKey, conf.APIURL, conf.Domain = "mailgun", "key", ts.URL, "mg.example.com"
+	conf.From, conf.To, conf.AttachPayload = "heka@example.com", []string{"a@example.com"}, true
+	conf.AttachMinSeverity = 2
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	runner := newTestRunner()
+	runner.send(newTestMessage(4, "web-01", "disk almost full")) // warning
+	runner.send(newTestMessage(2, "web-01", "disk almost full")) // crit
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != 2 || attachments[0] != 0 || attachments[1] != 1 {
+		t.Errorf("got attachments %v, wanted none for the warning and one for the crit", attachments)
+	}
+}
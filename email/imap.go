@@ -0,0 +1,277 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imapClient is a minimal IMAP4rev1 (RFC 3501) client, knowing just enough
+// for polling a folder: LOGIN, SELECT, UID SEARCH, UID FETCH, UID STORE
+// and EXPUNGE.
+type imapClient struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	host    string
+	tag     int
+	timeout time.Duration
+	isTLS   bool
+}
+
+// imapResponse is an untagged response line, with its literals cut out
+// (the line keeps their {size} markers).
+type imapResponse struct {
+	line     string
+	literals [][]byte
+}
+
+// imapError is a NO or BAD completion of a command.
+type imapError struct {
+	cmd, status string
+}
+
+func (e *imapError) Error() string {
+	return fmt.Sprintf("IMAP %s: %s", e.cmd, e.status)
+}
+
+// dialIMAP connects to the IMAP server at addr (with TLS from the start
+// if implicitTLS), reading its greeting. Each command has timeout to complete.
+func dialIMAP(addr string, tlsConfig *tls.Config, implicitTLS bool, timeout time.Duration) (*imapClient, error) {
+	conn, err := dialTCP(addr, timeout, nil)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if implicitTLS {
+		tc := tls.Client(conn, clientTLSConfig(tlsConfig, host))
+		tc.SetDeadline(time.Now().Add(timeout))
+		if err = tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	c := &imapClient{conn: conn, r: bufio.NewReader(conn), host: host, timeout: timeout, isTLS: implicitTLS}
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	greeting, err := c.r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting, "* OK") && !strings.HasPrefix(greeting, "* PREAUTH") {
+		conn.Close()
+		return nil, fmt.Errorf("IMAP greeting: %s", strings.TrimSpace(greeting))
+	}
+	return c, nil
+}
+
+// Close closes the connection.
+func (c *imapClient) Close() error {
+	return c.conn.Close()
+}
+
+// Cmd sends the command, returning its untagged responses.
+func (c *imapClient) Cmd(format string, args ...interface{}) ([]imapResponse, error) {
+	c.tag++
+	tag := "h" + strconv.Itoa(c.tag)
+	cmd := fmt.Sprintf(format, args...)
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := io.WriteString(c.conn, tag+" "+cmd+"\r\n"); err != nil {
+		return nil, err
+	}
+	name := cmd
+	if i := strings.IndexByte(cmd, ' '); i > 0 {
+		name = cmd[:i]
+		if name == "UID" {
+			if j := strings.IndexByte(cmd[i+1:], ' '); j > 0 {
+				name = cmd[:i+1+j]
+			}
+		}
+	}
+	var resps []imapResponse
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(resp.line, tag+" ") {
+			resps = append(resps, resp)
+			continue
+		}
+		status := strings.TrimSpace(resp.line[len(tag)+1:])
+		if !strings.HasPrefix(strings.ToUpper(status), "OK") {
+			return resps, &imapError{cmd: name, status: status}
+		}
+		return resps, nil
+	}
+}
+
+// readResponse reads a response line, with its literals.
+func (c *imapClient) readResponse() (imapResponse, error) {
+	var resp imapResponse
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return resp, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		resp.line += line
+		if !strings.HasSuffix(line, "}") {
+			return resp, nil
+		}
+		i := strings.LastIndexByte(line, '{')
+		if i < 0 {
+			return resp, nil
+		}
+		size, err := strconv.Atoi(line[i+1 : len(line)-1])
+		if err != nil || size < 0 {
+			return resp, nil
+		}
+		literal := make([]byte, size)
+		if _, err = io.ReadFull(c.r, literal); err != nil {
+			return resp, err
+		}
+		resp.literals = append(resp.literals, literal)
+	}
+}
+
+// StartTLS upgrades the connection to TLS.
+func (c *imapClient) StartTLS(tlsConfig *tls.Config) error {
+	if _, err := c.Cmd("STARTTLS"); err != nil {
+		return err
+	}
+	tc := tls.Client(c.conn, clientTLSConfig(tlsConfig, c.host))
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	c.conn, c.r, c.isTLS = tc, bufio.NewReader(tc), true
+	return nil
+}
+
+// Capabilities returns the capabilities of the server, in upper case.
+func (c *imapClient) Capabilities() (map[string]bool, error) {
+	resps, err := c.Cmd("CAPABILITY")
+	if err != nil {
+		return nil, err
+	}
+	caps := make(map[string]bool)
+	for _, resp := range resps {
+		if fields := strings.Fields(resp.line); len(fields) > 1 && strings.EqualFold(fields[1], "CAPABILITY") {
+			for _, f := range fields[2:] {
+				caps[strings.ToUpper(f)] = true
+			}
+		}
+	}
+	return caps, nil
+}
+
+// Login authenticates with the username and password.
+func (c *imapClient) Login(username, password string) error {
+	u, err := imapQuote(username)
+	if err != nil {
+		return err
+	}
+	p, err := imapQuote(password)
+	if err != nil {
+		return err
+	}
+	_, err = c.Cmd("LOGIN %s %s", u, p)
+	return err
+}
+
+// Select selects the folder.
+func (c *imapClient) Select(folder string) error {
+	f, err := imapQuote(folder)
+	if err != nil {
+		return err
+	}
+	_, err = c.Cmd("SELECT %s", f)
+	return err
+}
+
+// Search returns the UIDs of the messages matching the criteria.
+func (c *imapClient) Search(criteria string) ([]uint32, error) {
+	resps, err := c.Cmd("UID SEARCH %s", criteria)
+	if err != nil {
+		return nil, err
+	}
+	var uids []uint32
+	for _, resp := range resps {
+		fields := strings.Fields(resp.line)
+		if len(fields) < 2 || !strings.EqualFold(fields[1], "SEARCH") {
+			continue
+		}
+		for _, f := range fields[2:] {
+			uid, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("bad UID %q in %q", f, resp.line)
+			}
+			uids = append(uids, uint32(uid))
+		}
+	}
+	return uids, nil
+}
+
+// Fetch returns the whole message with the uid, without setting its \Seen flag.
+func (c *imapClient) Fetch(uid uint32) ([]byte, error) {
+	resps, err := c.Cmd("UID FETCH %d (UID BODY.PEEK[])", uid)
+	if err != nil {
+		return nil, err
+	}
+	for _, resp := range resps {
+		if len(resp.literals) == 1 && strings.Contains(strings.ToUpper(resp.line), " FETCH ") &&
+			strings.Contains(strings.ToUpper(resp.line), "BODY[]") {
+			return resp.literals[0], nil
+		}
+	}
+	return nil, fmt.Errorf("IMAP UID FETCH: no body of UID %d", uid)
+}
+
+// AddFlag adds the flag (e.g. \Seen) to the message with the uid.
+func (c *imapClient) AddFlag(uid uint32, flag string) error {
+	_, err := c.Cmd("UID STORE %d +FLAGS.SILENT (%s)", uid, flag)
+	return err
+}
+
+// Expunge removes the messages flagged \Deleted from the selected folder.
+func (c *imapClient) Expunge() error {
+	_, err := c.Cmd("EXPUNGE")
+	return err
+}
+
+// Logout logs out and closes the connection.
+func (c *imapClient) Logout() error {
+	_, err := c.Cmd("LOGOUT")
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// imapQuote returns s as an IMAP quoted string.
+func imapQuote(s string) (string, error) {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '\r' || c == '\n' || c == 0 || c >= 0x80 {
+			return "", errors.New("IMAP: cannot quote CR, LF, NUL and non-ASCII characters")
+		}
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`, nil
+}
@@ -0,0 +1,101 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgulacsi/heka-plugins/email/testutil"
+)
+
+func TestIMAPClient(t *testing.T) {
+	srv := testutil.NewFakeIMAP()
+	srv.Users = map[string]string{"heka": `se"cr\et`}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	// the literal holds lines looking like responses
+	data := "Subject: x\r\n\r\nh1 OK fake\r\n* 1 FETCH {3}\r\n"
+	uid := srv.Add("INBOX", []byte(data))
+
+	c, err := dialIMAP(srv.Addr(), nil, false, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Login("heka", "wrong"); err == nil || !strings.Contains(err.Error(), "IMAP LOGIN: NO") {
+		t.Errorf("got %v, wanted the LOGIN failure", err)
+	}
+	if err = c.Login("heka", `se"cr\et`); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Select("Missing"); err == nil {
+		t.Error("selected a missing folder")
+	}
+	if err = c.Select("INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	uids, err := c.Search("UNSEEN")
+	if err != nil || len(uids) != 1 || uids[0] != uid {
+		t.Fatalf("got %v, %v, wanted [%d]", uids, err, uid)
+	}
+	got, err := c.Fetch(uid)
+	if err != nil || string(got) != data {
+		t.Fatalf("got %q, %v, wanted %q", got, err, data)
+	}
+	if _, err = c.Fetch(uid + 1); err == nil {
+		t.Error("fetched a missing UID")
+	}
+	if err = c.AddFlag(uid, `\Seen`); err != nil {
+		t.Fatal(err)
+	}
+	if uids, err = c.Search("UNSEEN"); err != nil || len(uids) != 0 {
+		t.Errorf("got %v, %v after marking seen", uids, err)
+	}
+	if err = c.Logout(); err != nil {
+		t.Error(err)
+	}
+	if cmds := srv.Commands(); cmds[len(cmds)-1] != "LOGOUT" {
+		t.Errorf("got commands %q", cmds)
+	}
+}
+
+func TestIMAPResponse(t *testing.T) {
+	c := &imapClient{r: bufio.NewReader(strings.NewReader(
+		"* 2 FETCH (UID 7 BODY[] {5}\r\nab\r\nc FLAGS {0}\r\n)\r\n* OK {no literal}\r\n"))}
+	resp, err := c.readResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.line != "* 2 FETCH (UID 7 BODY[] {5} FLAGS {0})" || len(resp.literals) != 2 ||
+		string(resp.literals[0]) != "ab\r\nc" || len(resp.literals[1]) != 0 {
+		t.Errorf("got %q with %q", resp.line, resp.literals)
+	}
+	if resp, err = c.readResponse(); err != nil || resp.line != "* OK {no literal}" {
+		t.Errorf("got %q, %v", resp.line, err)
+	}
+
+	for in, want := range map[string]string{
+		"INBOX":     `"INBOX"`,
+		`a "b" \c`:  `"a \"b\" \\c"`,
+		"with\r\nX": "",
+		"árvíz":     "",
+	} {
+		if got, err := imapQuote(in); got != want || (err == nil) != (want != "") {
+			t.Errorf("%q: got %q, %v, wanted %q", in, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// incidentCap caps the number of emails per incident (condition):
+// after max emails, the messages of the incident are suppressed
+// till it is resolved, but a reminder is sent every reminder (if set),
+// or at the escalating intervals (if set).
+type incidentCap struct {
+	max        int
+	reminder   time.Duration
+	escalating *escalation
+	incidents  map[string]*incident
+}
+
+// incident is the state of an ongoing incident.
+type incident struct {
+	sent       int       // number of the emails sent
+	suppressed int       // number of the messages suppressed since the last email
+	reminders  int       // number of the reminders sent
+	next       time.Time // the earliest time of the next reminder
+}
+
+func newIncidentCap(max int, reminder time.Duration) *incidentCap {
+	return &incidentCap{max: max, reminder: reminder, incidents: make(map[string]*incident)}
+}
+
+// EscalatingDigestConfig makes the reminders of the capped incidents
+// ever rarer the longer the incident persists: the first one is sent
+// after initial, each further one after factor times the previous interval,
+// but at most max_interval.
+type EscalatingDigestConfig struct {
+	// Initial is the first interval, e.g. "1m"; escalation is off if empty.
+	Initial string `toml:"initial"`
+	// Factor is the growth of the intervals, 3 by default.
+	Factor float64 `toml:"factor"`
+	// MaxInterval caps the intervals, "4h" by default.
+	MaxInterval string `toml:"max_interval"`
+}
+
+// escalation is the parsed EscalatingDigestConfig.
+type escalation struct {
+	initial, max time.Duration
+	factor       float64
+}
+
+func newEscalation(conf EscalatingDigestConfig) (*escalation, error) {
+	e := &escalation{factor: conf.Factor, max: 4 * time.Hour}
+	var err error
+	if e.initial, err = time.ParseDuration(conf.Initial); err == nil && e.initial <= 0 {
+		err = errors.New("not positive")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bad escalating_digest initial %q: %s", conf.Initial, err)
+	}
+	if conf.MaxInterval != "" {
+		if e.max, err = time.ParseDuration(conf.MaxInterval); err != nil {
+			return nil, fmt.Errorf("bad escalating_digest max_interval %q: %s", conf.MaxInterval, err)
+		}
+	}
+	if e.factor == 0 {
+		e.factor = 3
+	} else if e.factor < 1 {
+		return nil, fmt.Errorf("bad escalating_digest factor %g", e.factor)
+	}
+	return e, nil
+}
+
+// Interval returns the interval before the reminder following n reminders.
+func (e *escalation) Interval(n int) time.Duration {
+	d := float64(e.initial)
+	for i := 0; i < n && d < float64(e.max); i++ {
+		d *= e.factor
+	}
+	if d > float64(e.max) {
+		return e.max
+	}
+	return time.Duration(d)
+}
+
+// interval returns the interval before the next reminder of the incident,
+// 0 if there are no reminders.
+func (c *incidentCap) interval(inc *incident) time.Duration {
+	if c.escalating != nil {
+		return c.escalating.Interval(inc.reminders)
+	}
+	return c.reminder
+}
+
+// Check reports whether the message of the incident arriving at now is to be sent,
+// and whether as a reminder, with the number of messages suppressed before it.
+func (c *incidentCap) Check(key string, now time.Time) (send, reminder bool, suppressed int) {
+	inc := c.incidents[key]
+	if inc == nil {
+		inc = new(incident)
+		c.incidents[key] = inc
+	}
+	if inc.sent < c.max {
+		inc.sent++
+		inc.next = now.Add(c.interval(inc))
+		return true, false, 0
+	}
+	if interval := c.interval(inc); interval > 0 && !now.Before(inc.next) {
+		suppressed = inc.suppressed
+		inc.suppressed = 0
+		inc.reminders++
+		inc.next = now.Add(c.interval(inc))
+		return true, true, suppressed
+	}
+	inc.suppressed++
+	return false, false, 0
+}
+
+// Reset forgets the (resolved) incident.
+func (c *incidentCap) Reset(key string) {
+	delete(c.incidents, key)
+}
+
+// formatReminder returns the "still ongoing" reminder email of the message,
+// with the number of the messages suppressed since the previous email.
+func (o *EmailOutput) formatReminder(msg *message.Message, suppressed int) []byte {
+	subject := fmt.Sprintf("Still ongoing (%d suppressed): %s", suppressed, o.subject(msg))
+	headers := append(o.threadHeaders(msg), o.priorityHeaders(o.severity(msg))...)
+	return o.email(subject, o.payload(msg), append(headers, o.contentHashHeader(msg)...)...)
+}
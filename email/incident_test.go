@@ -0,0 +1,150 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+func TestIncidentCap(t *testing.T) {
+	c := newIncidentCap(2, time.Hour)
+	start := time.Date(2013, 11, 12, 13, 14, 15, 0, time.UTC)
+	for i, tc := range []struct {
+		after          time.Duration
+		send, reminder bool
+		suppressed     int
+	}{
+		{0, true, false, 0},
+		{time.Minute, true, false, 0},
+		{2 * time.Minute, false, false, 0},
+		{30 * time.Minute, false, false, 0},
+		{61 * time.Minute, true, true, 2},   // an hour after the last email
+		{90 * time.Minute, false, false, 0}, // within the hour of the reminder
+		{122 * time.Minute, true, true, 1},
+	} {
+		send, reminder, suppressed := c.Check("db-down", start.Add(tc.after))
+		if send != tc.send || reminder != tc.reminder || suppressed != tc.suppressed {
+			t.Errorf("%d. got %t, %t, %d, wanted %t, %t, %d", i,
+				send, reminder, suppressed, tc.send, tc.reminder, tc.suppressed)
+		}
+	}
+	if send, _, _ := c.Check("disk-full", start); !send {
+		t.Error("another incident is capped")
+	}
+	c.Reset("db-down")
+	if send, reminder, _ := c.Check("db-down", start.Add(123*time.Minute)); !send || reminder {
+		t.Error("the resolved incident is still capped")
+	}
+}
+
+func TestRunIncidentCap(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"},
+		hostport: srv.Addr(), incidents: newIncidentCap(2, 0)}
+	runner := newTestRunner()
+	for i := 0; i < 5; i++ {
+		runner.send(newTestMessage(2, "db-01", "database is down"))
+	}
+	resolved := newTestMessage(6, "db-01", "database is up")
+	f, _ := message.NewField("resolved", true, "")
+	resolved.AddField(f)
+	runner.send(resolved)
+	runner.send(newTestMessage(2, "db-01", "database is down again"))
+	close(runner.inChan)
+	if err := o.Run(runner, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var subjects []string
+	for _, m := range srv.Messages() {
+		subjects = append(subjects, subjectOf(m.Data))
+	}
+	if len(subjects) != 4 {
+		t.Fatalf("got %d emails, wanted 4 (2 capped, the recovery and the new one):\n%s",
+			len(subjects), strings.Join(subjects, "\n"))
+	}
+	if !strings.HasSuffix(subjects[2], "database is up") || !strings.HasSuffix(subjects[3], "database is down again") {
+		t.Errorf("got subjects\n%s", strings.Join(subjects, "\n"))
+	}
+
+	for _, d := range []string{"0s", "-4h", "later"} {
+		conf := &EmailOutputConfig{Address: srv.Addr(), MaxEmailsPerIncident: 2, IncidentReminderInterval: d}
+		if err := new(EmailOutput).Init(conf); err == nil || !strings.Contains(err.Error(), "incident_reminder_interval") {
+			t.Errorf("%s: got %v, wanted the incident_reminder_interval error", d, err)
+		}
+	}
+}
+
+func TestEscalatingDigest(t *testing.T) {
+	e, err := newEscalation(EscalatingDigestConfig{Initial: "1m", MaxInterval: "30m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newIncidentCap(1, 0)
+	c.escalating = e
+	start := time.Date(2013, 11, 12, 13, 14, 15, 0, time.UTC)
+	var reminders []time.Duration
+	// the messages of the incident keep arriving every 30s for 2 hours
+	for after := time.Duration(0); after <= 2*time.Hour; after += 30 * time.Second {
+		if send, reminder, _ := c.Check("db-down", start.Add(after)); send && reminder {
+			reminders = append(reminders, after)
+		} else if send && after > 0 {
+			t.Errorf("not a reminder sent after %s", after)
+		}
+	}
+	// after 1m, 3m, 9m, 27m, then capped at 30m
+	want := []time.Duration{1 * time.Minute, 4 * time.Minute, 13 * time.Minute, 40 * time.Minute,
+		70 * time.Minute, 100 * time.Minute}
+	if len(reminders) != len(want) {
+		t.Fatalf("got reminders after %v, wanted %v", reminders, want)
+	}
+	for i := range want {
+		if reminders[i] != want[i] {
+			t.Errorf("got reminders after %v, wanted %v", reminders, want)
+			break
+		}
+	}
+
+	// the incident clears, and the escalation starts over
+	c.Reset("db-down")
+	now := start.Add(3 * time.Hour)
+	if send, reminder, _ := c.Check("db-down", now); !send || reminder {
+		t.Error("the new incident is not sent")
+	}
+	if send, _, _ := c.Check("db-down", now.Add(59*time.Second)); send {
+		t.Error("reminder within the initial interval")
+	}
+	if send, reminder, suppressed := c.Check("db-down", now.Add(time.Minute)); !send || !reminder || suppressed != 1 {
+		t.Errorf("got %t, %t, %d after the initial interval, wanted a reminder", send, reminder, suppressed)
+	}
+
+	for _, conf := range []EscalatingDigestConfig{{Initial: "0s"}, {Initial: "1m", Factor: 0.5},
+		{Initial: "1m", MaxInterval: "soon"}} {
+		if _, err := newEscalation(conf); err == nil {
+			t.Errorf("wanted error for %+v", conf)
+		}
+	}
+	// escalating_digest caps the incidents at one email, leaving the config as is
+	srv := startFakeSMTP(t)
+	conf := &EmailOutputConfig{Address: srv.Addr(), EscalatingDigest: EscalatingDigestConfig{Initial: "1m"}}
+	o := new(EmailOutput)
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	if o.incidents == nil || o.incidents.max != 1 || conf.MaxEmailsPerIncident != 0 {
+		t.Errorf("got incidents %+v, max_emails_per_incident %d", o.incidents, conf.MaxEmailsPerIncident)
+	}
+}
@@ -0,0 +1,165 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/tgulacsi/heka-plugins/utils"
+)
+
+// LocaleConfig holds the templates (text/template) of a locale's emails.
+// They are executed with the message's Timestamp, Severity, Logger, Hostname,
+// Payload, Fields (by name) and the default Subject.
+// An empty template renders the default subject or the payload.
+type LocaleConfig struct {
+	Subject string `toml:"subject"`
+	Body    string `toml:"body"`
+}
+
+// localeTemplates are the parsed templates of a locale.
+type localeTemplates struct {
+	subject, body *template.Template
+}
+
+// localeData is the data of the locale templates.
+type localeData struct {
+	Timestamp time.Time
+	Severity  int32
+	Logger    string
+	Hostname  string
+	Payload   string
+	Subject   string
+	Fields    map[string]interface{}
+}
+
+// templateData returns the template data of the message, without the Subject.
+func (o *EmailOutput) templateData(msg *message.Message) localeData {
+	data := localeData{
+		Timestamp: utils.TsTime(msg.GetTimestamp()),
+		Severity:  o.severity(msg),
+		Logger:    msg.GetLogger(),
+		Hostname:  msg.GetHostname(),
+		Payload:   o.payload(msg),
+		Fields:    make(map[string]interface{}, len(msg.GetFields())),
+	}
+	for _, f := range msg.GetFields() {
+		data.Fields[f.GetName()] = f.GetValue()
+	}
+	return data
+}
+
+// subject returns the subject of the message's email: the subject template
+// executed with the message, or the message header with the beginning of the payload.
+func (o *EmailOutput) subject(msg *message.Message) string {
+	if o.subjectTmpl != nil {
+		var buf bytes.Buffer
+		err := o.subjectTmpl.Execute(&buf, o.templateData(msg))
+		if err == nil {
+			return strings.Join(strings.Fields(buf.String()), " ")
+		}
+		o.logError(fmt.Errorf("executing the subject template: %s", err))
+	}
+	if payload := o.subjectPayload(o.payload(msg)); payload != "" {
+		return o.messageHeader(msg) + payload
+	}
+	return strings.TrimSuffix(o.messageHeader(msg), ": ")
+}
+
+// parseLocales parses the templates of the locales.
+func parseLocales(locales map[string]LocaleConfig) (map[string]*localeTemplates, error) {
+	parsed := make(map[string]*localeTemplates, len(locales))
+	for locale, conf := range locales {
+		var lt localeTemplates
+		var err error
+		if conf.Subject != "" {
+			if lt.subject, err = template.New(locale + ".subject").Parse(conf.Subject); err != nil {
+				return nil, fmt.Errorf("subject template of locale %s: %s", locale, err)
+			}
+		}
+		if conf.Body != "" {
+			if lt.body, err = template.New(locale + ".body").Parse(conf.Body); err != nil {
+				return nil, fmt.Errorf("body template of locale %s: %s", locale, err)
+			}
+		}
+		parsed[locale] = &lt
+	}
+	return parsed, nil
+}
+
+// localizedEmail is an email to some of the recipients.
+type localizedEmail struct {
+	body []byte
+	env  envelope
+}
+
+// messageEmails returns the emails of the message: one per locale of the
+// recipients (by recipient_locales), or one to all of them.
+func (o *EmailOutput) messageEmails(msg *message.Message) []localizedEmail {
+	env := o.envelopeTo(msg)
+	if len(o.recipientLocales) == 0 {
+		return []localizedEmail{{body: o.formatMessage(msg), env: env}}
+	}
+	groups := make(map[string][]string)
+	for _, addr := range o.recipients(env) {
+		locale := o.recipientLocales[strings.ToLower(addr)]
+		groups[locale] = append(groups[locale], addr)
+	}
+	locales := make([]string, 0, len(groups))
+	for locale := range groups {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	emails := make([]localizedEmail, 0, len(groups))
+	for _, locale := range locales {
+		e := env
+		e.to = groups[locale]
+		emails = append(emails, localizedEmail{body: o.formatLocalized(msg, o.locales[locale]), env: e})
+	}
+	return emails
+}
+
+// formatLocalized returns the email of the message rendered by the
+// templates of the locale (the default email without templates).
+func (o *EmailOutput) formatLocalized(msg *message.Message, lt *localeTemplates) []byte {
+	if lt == nil {
+		return o.formatMessage(msg)
+	}
+	data := o.templateData(msg)
+	data.Subject = o.subject(msg)
+	subject, text := data.Subject, data.Payload
+	var buf bytes.Buffer
+	if lt.subject != nil {
+		if err := lt.subject.Execute(&buf, data); err != nil {
+			o.logError(fmt.Errorf("executing %s: %s", lt.subject.Name(), err))
+		} else {
+			subject = strings.Join(strings.Fields(buf.String()), " ")
+		}
+	}
+	if lt.body != nil {
+		buf.Reset()
+		if err := lt.body.Execute(&buf, data); err != nil {
+			o.logError(fmt.Errorf("executing %s: %s", lt.body.Name(), err))
+		} else {
+			text = buf.String()
+		}
+	}
+	headers := append(o.threadHeaders(msg), o.priorityHeaders(o.severity(msg))...)
+	headers = append(headers, o.contentHashHeader(msg)...)
+	return o.email(subject, text, append(headers, messageDate(msg))...)
+}
@@ -0,0 +1,66 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRecipientLocales(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From = srv.Addr(), "heka@example.com"
+	conf.To = []string{"ops@example.com", "betrieb@example.de", "uzemeltetes@example.hu", "dev@example.com"}
+	conf.Locales = map[string]LocaleConfig{
+		"de": {Subject: "Warnung von {{.Hostname}}: {{.Payload}}", Body: "Nachricht:\n{{.Payload}}"},
+		"hu": {Subject: "Figyelmeztetés ({{.Hostname}}): {{.Payload}}"},
+	}
+	conf.RecipientLocales = map[string]string{"Betrieb@example.de": "de", "uzemeltetes@example.hu": "hu"}
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	prepared := len(srv.Messages())
+	runner := newTestRunner()
+	runner.send(newTestMessage(3, "db-01", "disk full"))
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := srv.Messages()[prepared:]
+	if len(msgs) != 3 {
+		t.Fatalf("got %d emails, wanted 3 (default, de, hu)", len(msgs))
+	}
+	got := make(map[string]string, len(msgs))
+	for _, m := range msgs {
+		got[strings.Join(m.To, ",")] = string(m.Data)
+	}
+	if data := got["ops@example.com,dev@example.com"]; !strings.Contains(data, "[3] test@db-01: disk full\r\n") {
+		t.Errorf("default email:\n%s", data)
+	}
+	if data := got["betrieb@example.de"]; !strings.HasPrefix(data, "Subject: Warnung von db-01: disk full\r\n") ||
+		!strings.Contains(data, "\r\n\r\nNachricht:\r\ndisk full") {
+		t.Errorf("de email:\n%s", data)
+	}
+	if data := got["uzemeltetes@example.hu"]; !strings.HasPrefix(data, "Subject: =?utf-8?q?") ||
+		subjectOf([]byte(data)) != "Figyelmeztetés (db-01): disk full" ||
+		!strings.Contains(data, "\r\n\r\ndisk full") {
+		t.Errorf("hu email:\n%s", data)
+	}
+
+	conf.RecipientLocales = map[string]string{"ops@example.com": "fr"}
+	if err := new(EmailOutput).Init(conf); err == nil {
+		t.Error("unknown locale accepted")
+	}
+}
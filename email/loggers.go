@@ -0,0 +1,34 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+// loggerSet returns the set of the loggers, nil if none.
+func loggerSet(loggers []string) map[string]bool {
+	if len(loggers) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(loggers))
+	for _, logger := range loggers {
+		set[logger] = true
+	}
+	return set
+}
+
+// loggerAllowed reports whether the messages of the logger are sent:
+// only the whitelisted ones if logger_whitelist is set,
+// the not blacklisted ones otherwise.
+func (o *EmailOutput) loggerAllowed(logger string) bool {
+	if o.loggerWhitelist != nil {
+		return o.loggerWhitelist[logger]
+	}
+	return !o.loggerBlacklist[logger]
+}
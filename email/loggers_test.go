@@ -0,0 +1,62 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoggerFilter(t *testing.T) {
+	srv := startFakeSMTP(t)
+	for _, tc := range []struct {
+		whitelist, blacklist []string
+		want                 string
+	}{
+		{nil, nil, "a,b,c"},
+		{[]string{"a", "b"}, nil, "a,b"},
+		{nil, []string{"b"}, "a,c"},
+		{[]string{"a"}, []string{"a", "c"}, "a"}, // the whitelist wins
+	} {
+		o := new(EmailOutput)
+		conf := o.ConfigStruct().(*EmailOutputConfig)
+		conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+		conf.LoggerWhitelist, conf.LoggerBlacklist = tc.whitelist, tc.blacklist
+		if err := o.Init(conf); err != nil {
+			t.Fatal(err)
+		}
+		sent := len(srv.Messages())
+		runner := newTestRunner()
+		for _, logger := range []string{"a", "b", "c"} {
+			msg := newTestMessage(3, "db-01", "logger "+logger)
+			msg.SetLogger(logger)
+			runner.send(msg)
+		}
+		close(runner.inChan)
+		if err := o.Run(runner, testHelper{}); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, m := range srv.Messages()[sent:] {
+			subject := subjectOf(m.Data)
+			got = append(got, subject[len(subject)-1:])
+		}
+		if s := strings.Join(got, ","); s != tc.want {
+			t.Errorf("whitelist %q, blacklist %q: sent the loggers %s, wanted %s",
+				tc.whitelist, tc.blacklist, s, tc.want)
+		}
+		if n := 3 - len(got); o.dropped != int64(n) {
+			t.Errorf("whitelist %q, blacklist %q: %d dropped, wanted %d",
+				tc.whitelist, tc.blacklist, o.dropped, n)
+		}
+	}
+}
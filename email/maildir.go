@@ -0,0 +1,79 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maildir writes the emails into a maildir, for local inspection.
+type maildir struct {
+	dir      string
+	hostname string // with "/" and ":" escaped
+	seq      uint64 // of the deliveries of the process
+}
+
+// newMaildir returns the maildir at dir, creating its subdirectories if needed.
+func newMaildir(dir string) (*maildir, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, fmt.Errorf("cannot create maildir %s: %s", dir, err)
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	return &maildir{dir: dir, hostname: hostname}, nil
+}
+
+// uniqueName returns a new unique file name, per the maildir conventions.
+func (md *maildir) uniqueName() string {
+	now := time.Now()
+	return fmt.Sprintf("%d.M%06dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000,
+		os.Getpid(), atomic.AddUint64(&md.seq, 1), md.hostname)
+}
+
+// Deliver writes the email into tmp, and then moves it into new,
+// so readers of the maildir never see partial files.
+func (md *maildir) Deliver(from string, to []string, body []byte) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Return-Path: <%s>\nDelivered-To: %s\n", from, strings.Join(to, ", "))
+	buf.Write(bytes.Replace(body, []byte("\r\n"), []byte("\n"), -1))
+
+	name := md.uniqueName()
+	tmp := filepath.Join(md.dir, "tmp", name)
+	fh, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = fh.Write(buf.Bytes()); err == nil {
+		err = fh.Sync()
+	}
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(md.dir, "new", name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaildir(t *testing.T) {
+	srv := startFakeSMTP(t)
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From = srv.Addr(), "heka@example.com"
+	conf.To = []string{"ops@example.com", "dev@example.com"}
+	conf.Maildir = dir
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	runner := newTestRunner()
+	runner.send(newTestMessage(2, "db-01", "the database is down"))
+	runner.send(newTestMessage(2, "db-02", "the database is down, too"))
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if tmp, _ := ioutil.ReadDir(filepath.Join(dir, "tmp")); len(tmp) != 0 {
+		t.Errorf("%d files left in tmp", len(tmp))
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("got %d files in new, wanted 2", len(files))
+	}
+	if files[0].Name() == files[1].Name() {
+		t.Errorf("the file names are not unique: %s", files[0].Name())
+	}
+	payloads := make(map[string]bool)
+	for _, fi := range files {
+		fh, err := os.Open(filepath.Join(dir, "new", fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		email, err := mail.ReadMessage(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(email.Body)
+		fh.Close()
+		if got := email.Header.Get("Delivered-To"); got != "ops@example.com, dev@example.com" {
+			t.Errorf("got Delivered-To %q", got)
+		}
+		if got := email.Header.Get("Return-Path"); got != "<heka@example.com>" {
+			t.Errorf("got Return-Path %q", got)
+		}
+		if strings.Contains(string(body), "\r") {
+			t.Errorf("CRLF line endings in %q", body)
+		}
+		payloads[strings.TrimSpace(string(body))] = true
+	}
+	if !payloads["the database is down"] || !payloads["the database is down, too"] {
+		t.Errorf("got bodies %v", payloads)
+	}
+	if len(srv.Messages()) != 2 {
+		t.Errorf("got %d emails sent, wanted 2", len(srv.Messages()))
+	}
+}
@@ -0,0 +1,107 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"fmt"
+	"net/smtp"
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// paramExtensions are the extensions defining the well-known MAIL FROM
+// parameters. The other parameters need the extension of their own name.
+var paramExtensions = map[string]string{
+	"AUTH":        "AUTH",
+	"BODY":        "8BITMIME",
+	"BY":          "DELIVERBY",
+	"ENVID":       "DSN",
+	"HOLDFOR":     "FUTURERELEASE",
+	"HOLDUNTIL":   "FUTURERELEASE",
+	"MT-PRIORITY": "MT-PRIORITY",
+	"REQUIRETLS":  "REQUIRETLS",
+	"RET":         "DSN",
+	"SIZE":        "SIZE",
+	"SMTPUTF8":    "SMTPUTF8",
+}
+
+// checkMailParam checks the syntax of the MAIL FROM parameter
+// (RFC 5321 esmtp-param: keyword[=value]).
+func checkMailParam(param string) error {
+	keyword, value, hasValue := strings.Cut(param, "=")
+	if keyword == "" || hasValue && value == "" {
+		return fmt.Errorf("bad MAIL FROM parameter %q", param)
+	}
+	for i, r := range keyword {
+		if !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' && i > 0) {
+			return fmt.Errorf("bad MAIL FROM parameter keyword %q", keyword)
+		}
+	}
+	for _, r := range value {
+		if r <= ' ' || r == '=' || r > '~' {
+			return fmt.Errorf("bad MAIL FROM parameter value %q", value)
+		}
+	}
+	return nil
+}
+
+// messageMailParams returns the valid MAIL FROM parameters of the message's
+// mail_params field (space-separated, or repeated).
+func (o *EmailOutput) messageMailParams(msg *message.Message) []string {
+	var params []string
+	for _, f := range msg.GetFields() {
+		if f.GetName() != "mail_params" {
+			continue
+		}
+		for _, v := range f.GetValueString() {
+			for _, param := range strings.Fields(v) {
+				if err := checkMailParam(param); err != nil {
+					o.logMessage(fmt.Sprintf("skipping the parameter of message %s: %s", msg.GetUuidString(), err))
+					continue
+				}
+				params = append(params, param)
+			}
+		}
+	}
+	return params
+}
+
+// supportedParams returns the parameters of opts.mailParams whose
+// extensions the server advertises.
+func supportedParams(c *smtp.Client, opts smtpOptions) []string {
+	var supported []string
+	for _, param := range opts.mailParams {
+		keyword, _, _ := strings.Cut(param, "=")
+		keyword = strings.ToUpper(keyword)
+		ext, ok := paramExtensions[keyword]
+		if !ok {
+			ext = keyword
+		}
+		if ok, _ := c.Extension(ext); !ok {
+			opts.logMessage(fmt.Sprintf("skipping MAIL FROM parameter %s: the server does not support %s", param, ext))
+			continue
+		}
+		supported = append(supported, param)
+	}
+	return supported
+}
+
+// hasParam reports whether the parameters include one with the keyword.
+func hasParam(params []string, keyword string) bool {
+	for _, param := range params {
+		if k, _, _ := strings.Cut(param, "="); strings.EqualFold(k, keyword) {
+			return true
+		}
+	}
+	return false
+}
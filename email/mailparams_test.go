@@ -0,0 +1,60 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+func TestMailParams(t *testing.T) {
+	for _, tc := range []struct {
+		exts []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"DSN"}, "ENVID=alert-1"},
+		{[]string{"DSN", "XPRIO", "AUTH PLAIN"}, "ENVID=alert-1 AUTH=<> XPRIO=5"},
+	} {
+		srv := startFakeSMTP(t, tc.exts...)
+		o := new(EmailOutput)
+		conf := o.ConfigStruct().(*EmailOutputConfig)
+		conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+		conf.MailParams = []string{"ENVID=alert-1", "AUTH=<>"}
+		if err := o.Init(conf); err != nil {
+			t.Fatal(err)
+		}
+		msg := newTestMessage(3, "db-01", "db down")
+		f, _ := message.NewField("mail_params", "XPRIO=5 bad=a=b", "")
+		msg.AddField(f)
+		runner := newTestRunner()
+		runner.send(msg)
+		close(runner.inChan)
+		if err := o.Run(runner, testHelper{}); err != nil {
+			t.Fatal(err)
+		}
+		msgs := srv.Messages()
+		if len(msgs) != 1 {
+			t.Fatalf("%s: got %d emails, wanted 1", tc.exts, len(msgs))
+		}
+		if got := strings.Join(msgs[0].FromParams, " "); got != tc.want {
+			t.Errorf("%s: got MAIL FROM parameters %q, wanted %q", tc.exts, got, tc.want)
+		}
+	}
+
+	conf := &EmailOutputConfig{Address: "localhost", MailParams: []string{"ENVID=a b"}}
+	if err := new(EmailOutput).Init(conf); err == nil {
+		t.Error("wanted error for a bad parameter")
+	}
+}
@@ -0,0 +1,239 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// latencyBuckets are the upper bounds of the send latency histogram, in seconds.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// sendMetrics counts the sendings, the bytes sent, and their latencies.
+type sendMetrics struct {
+	mu      sync.Mutex
+	sent    int64
+	failed  int64
+	bytes   int64   // of the emails sent
+	buckets []int64 // per latencyBuckets, not cumulated
+	sum     float64 // of the latencies, in seconds
+}
+
+// Observe records a sending of an email of size bytes.
+func (m *sendMetrics) Observe(latency time.Duration, size int, err error) {
+	secs := latency.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.failed++
+	} else {
+		m.sent++
+		m.bytes += int64(size)
+	}
+	if m.buckets == nil {
+		m.buckets = make([]int64, len(latencyBuckets))
+	}
+	if i := sort.SearchFloat64s(latencyBuckets, secs); i < len(latencyBuckets) {
+		m.buckets[i]++
+	}
+	m.sum += secs
+}
+
+// snapshot returns a consistent copy of the metrics.
+func (m *sendMetrics) snapshot() (sent, failed int64, buckets []int64, sum float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sent, m.failed, append([]int64(nil), m.buckets...), m.sum
+}
+
+// Bytes returns the bytes of the emails sent.
+func (m *sendMetrics) Bytes() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bytes
+}
+
+// promWriter writes metrics in the Prometheus text exposition format.
+type promWriter struct {
+	buf  bytes.Buffer
+	seen map[string]bool
+}
+
+// metric writes a sample, preceded by the HELP and TYPE of its family on its first sample.
+// labels are name, value pairs.
+func (w *promWriter) metric(family, typ, help, suffix string, value float64, labels ...string) {
+	if !w.seen[family] {
+		if w.seen == nil {
+			w.seen = make(map[string]bool)
+		}
+		w.seen[family] = true
+		fmt.Fprintf(&w.buf, "# HELP %s %s\n# TYPE %s %s\n", family, help, family, typ)
+	}
+	w.buf.WriteString(family + suffix)
+	if len(labels) > 0 {
+		w.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			fmt.Fprintf(&w.buf, "%s=\"%s\"", labels[i], promEscaper.Replace(labels[i+1]))
+		}
+		w.buf.WriteByte('}')
+	}
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	w.buf.WriteByte('\n')
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetrics writes the statistics of ReportMsg, and the sending metrics.
+func (o *EmailOutput) writeMetrics(w *promWriter) {
+	sent, failed, buckets, sum := o.metrics.snapshot()
+	w.metric("heka_email_sent_total", "counter", "Emails sent successfully.", "", float64(sent))
+	w.metric("heka_email_failed_total", "counter", "Failed sendings of emails.", "", float64(failed))
+	w.metric("heka_email_sent_bytes_total", "counter", "Bytes of the emails sent.", "", float64(o.metrics.Bytes()))
+	w.metric("heka_email_retries_total", "counter", "Retries of the failed sendings.", "",
+		float64(atomic.LoadInt64(&o.retries)))
+	w.metric("heka_email_dropped_total", "counter", "Messages and emails dropped unsent.", "",
+		float64(atomic.LoadInt64(&o.dropped)))
+	const latency = "heka_email_send_duration_seconds"
+	var cum int64
+	for i, le := range latencyBuckets {
+		if buckets != nil {
+			cum += buckets[i]
+		}
+		w.metric(latency, "histogram", "Latency of the sendings.", "_bucket", float64(cum),
+			"le", strconv.FormatFloat(le, 'g', -1, 64))
+	}
+	w.metric(latency, "histogram", "", "_bucket", float64(sent+failed), "le", "+Inf")
+	w.metric(latency, "histogram", "", "_sum", sum)
+	w.metric(latency, "histogram", "", "_count", float64(sent+failed))
+
+	if o.pool != nil {
+		stats := o.pool.Stats()
+		const conns = "heka_email_pool_connections"
+		w.metric(conns, "gauge", "Pooled SMTP connections.", "", float64(stats.Active), "state", "active")
+		w.metric(conns, "gauge", "", "", float64(stats.Idle), "state", "idle")
+		w.metric("heka_email_pool_created_total", "counter", "SMTP connections opened by the pool.",
+			"", float64(stats.Created))
+		w.metric("heka_email_pool_evicted_total", "counter", "SMTP connections evicted from the full pool.",
+			"", float64(stats.Evicted))
+		w.metric("heka_email_pool_expired_total", "counter", "SMTP connections closed after pool_idle_timeout.",
+			"", float64(stats.Expired))
+	}
+	for _, domain := range sortedKeys(o.unreachable) {
+		w.metric("heka_email_prepare_unreachable", "gauge", "Recipient domains found unreachable by Prepare.",
+			"", 1, "domain", domain)
+	}
+	reports := o.TLSReports()
+	domains := make([]string, 0, len(reports))
+	for domain := range reports {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	const sessions = "heka_email_tls_sessions_total"
+	for _, domain := range domains {
+		rep := reports[domain]
+		w.metric(sessions, "counter", "TLS sessions per recipient domain and result.",
+			"", float64(rep.Successes), "domain", domain, "result", "success")
+		results := make([]string, 0, len(rep.Results))
+		for result := range rep.Results {
+			results = append(results, result)
+		}
+		sort.Strings(results)
+		for _, result := range results {
+			w.metric(sessions, "counter", "", "", float64(rep.Results[result]), "domain", domain, "result", result)
+		}
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// serveMetrics serves the metrics in the Prometheus text exposition format.
+func (o *EmailOutput) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var pw promWriter
+	o.writeMetrics(&pw)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(pw.buf.Bytes())
+}
+
+// startMetrics starts serving the metrics at addr, path.
+// The returned server should be closed when the plugin stops.
+func (o *EmailOutput) startMetrics(addr, path string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on metrics_addr %s: %s", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, o.serveMetrics)
+	srv := &http.Server{Handler: mux, ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+	go srv.Serve(ln)
+	return srv, nil
+}
+
+// ReportMsg adds the plugin's statistics to the Heka report message.
+func (o *EmailOutput) ReportMsg(msg *message.Message) error {
+	sent, failed, _, _ := o.metrics.snapshot()
+	addField(msg, "Sent", sent, "count")
+	addField(msg, "Failed", failed, "count")
+	addField(msg, "Dropped", atomic.LoadInt64(&o.dropped), "count")
+	addField(msg, "Retries", atomic.LoadInt64(&o.retries), "count")
+	addField(msg, "BytesSent", o.metrics.Bytes(), "B")
+	if o.pool != nil {
+		stats := o.pool.Stats()
+		addField(msg, "Pool.Active", stats.Active, "count")
+		addField(msg, "Pool.Idle", stats.Idle, "count")
+		addField(msg, "Pool.Created", stats.Created, "count")
+		addField(msg, "Pool.Evicted", stats.Evicted, "count")
+		addField(msg, "Pool.Expired", stats.Expired, "count")
+	}
+	if o.maxBatchMemory > 0 {
+		addField(msg, "Batch.MemoryFlushes", atomic.LoadInt64(&o.memoryFlushes), "count")
+	}
+	if o.limiter != nil {
+		addField(msg, "RateLimit.Dropped", atomic.LoadInt64(&o.rateLimited), "count")
+	}
+	if o.dedup != nil {
+		addField(msg, "Dedup.Suppressed", atomic.LoadInt64(&o.duplicates), "count")
+	}
+	for domain, err := range o.unreachable {
+		addField(msg, "Prepare.Unreachable."+domain, err, "")
+	}
+	o.reportTLS(msg)
+	return nil
+}
+
+// addField adds a new field to the message, ignoring unsupported values.
+func addField(msg *message.Message, name string, value interface{}, representation string) {
+	if f, err := message.NewField(name, value, representation); err == nil {
+		msg.AddField(f)
+	}
+}
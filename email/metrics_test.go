@@ -0,0 +1,147 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/tgulacsi/heka-plugins/email/testutil"
+)
+
+// promSample matches a sample line of the Prometheus text format.
+var promSample = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*"(?:,[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*")*\})? (\S+)$`)
+
+func TestMetricsEndpoint(t *testing.T) {
+	srv := startFakeSMTP(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.MetricsAddr, conf.ReuseConnections = addr, true
+	if err = o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	runner := newTestRunner()
+	done := make(chan error, 1)
+	go func() { done <- o.Run(runner, testHelper{}) }()
+	runner.send(newTestMessage(2, "db-01", "the database is down"))
+
+	url := "http://" + addr + "/metrics"
+	var body string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get(url)
+		if err != nil {
+			continue
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if body = string(b); strings.Contains(body, "heka_email_sent_total 1\n") {
+			break
+		}
+	}
+	typed := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			typed[fields[2]] = fields[3]
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		m := promSample.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("bad sample line %q", line)
+			continue
+		}
+		family := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(m[1], "_bucket"), "_sum"), "_count")
+		if typed[family] == "" {
+			t.Errorf("sample %q precedes its TYPE", line)
+		}
+	}
+	for _, want := range []string{
+		"heka_email_sent_total 1\n",
+		"heka_email_failed_total 0\n",
+		`heka_email_send_duration_seconds_bucket{le="+Inf"} 1` + "\n",
+		"heka_email_send_duration_seconds_count 1\n",
+		`heka_email_pool_connections{state="idle"} 1` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q from\n%s", want, body)
+		}
+	}
+	if typed["heka_email_send_duration_seconds"] != "histogram" {
+		t.Errorf("got types %v", typed)
+	}
+
+	close(runner.inChan)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := http.Get(url); err == nil {
+		resp.Body.Close()
+		t.Error("the metrics are still served after Run returned")
+	}
+}
+
+func TestReportCounters(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.RetryCount, conf.RetryBaseDelay, conf.DropOnError = 1, "1ms", true
+	conf.MinSeverity = 6
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	srv.Reply("MAIL FROM", "451 try again later", testutil.Pass, "550 rejected", testutil.Pass)
+	runner := newTestRunner()
+	runner.send(newTestMessage(2, "db-01", "retried, then sent"))
+	runner.send(newTestMessage(2, "db-01", "rejected"))
+	runner.send(newTestMessage(7, "db-01", "debug, out of range"))
+	runner.send(newTestMessage(2, "db-01", "sent"))
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := new(message.Message)
+	if err := o.ReportMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]int64{"Sent": 2, "Failed": 1, "Dropped": 2, "Retries": 1} {
+		if v, _ := msg.GetFieldValue(name); v != want {
+			t.Errorf("%s is %v, wanted %d", name, v, want)
+		}
+	}
+	var size int64
+	for _, m := range srv.Messages() {
+		size += int64(len(m.Data))
+	}
+	// the sent bodies, before the dot-stuffing and the transfer encoding
+	if v, _ := msg.GetFieldValue("BytesSent"); v.(int64) < size/2 || v.(int64) > size {
+		t.Errorf("BytesSent is %v, wanted about %d", v, size)
+	}
+}
@@ -0,0 +1,57 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/tgulacsi/heka-plugins/utils"
+)
+
+// newMessageID returns a new, unique Message-ID header with the host
+// (the EHLO name) as its domain part.
+func newMessageID(host string) string {
+	if host == "" {
+		host = "localhost"
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	return "Message-ID: <" + hex.EncodeToString(b[:]) + "@" + host + ">"
+}
+
+// dateHeader returns the Date header of t.
+func dateHeader(t time.Time) string {
+	return "Date: " + t.Format(time.RFC1123Z)
+}
+
+// messageDate returns the Date header of the message's timestamp,
+// of now if it has none.
+func messageDate(msg *message.Message) string {
+	if ts := msg.GetTimestamp(); ts != 0 {
+		return dateHeader(utils.TsTime(ts))
+	}
+	return dateHeader(time.Now())
+}
+
+// hasHeader reports whether the header lines include the named one.
+func hasHeader(headers []string, name string) bool {
+	for _, h := range headers {
+		if i := strings.IndexByte(h, ':'); i >= 0 && strings.EqualFold(h[:i], name) {
+			return true
+		}
+	}
+	return false
+}
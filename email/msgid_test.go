@@ -0,0 +1,61 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+func TestMessageIDAndDate(t *testing.T) {
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.HeloHostname = "heka-01.example.com"
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	msg := newTestMessage(2, "db-01", "the database is down")
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		m, err := mail.ReadMessage(bytes.NewReader(o.formatMessage(msg)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := m.Header.Get("Message-ID")
+		if !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@heka-01.example.com>") || seen[id] {
+			t.Errorf("got Message-ID %q, wanted a new one of heka-01.example.com", id)
+		}
+		seen[id] = true
+		date, err := m.Header.Date()
+		if err != nil || !date.Equal(time.Date(2013, 11, 12, 13, 14, 15, 0, time.UTC)) {
+			t.Errorf("got Date %v (%v), wanted the timestamp of the message", date, err)
+		}
+	}
+
+	// the emails of several messages are dated now
+	o.batch = batchLimits{maxCount: 10}
+	m, err := mail.ReadMessage(bytes.NewReader(o.formatBatch([]*message.Message{msg, msg})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if date, err := m.Header.Date(); err != nil || time.Since(date) > time.Minute {
+		t.Errorf("got Date %v (%v), wanted now", date, err)
+	}
+	if id := m.Header.Get("Message-ID"); id == "" || seen[id] {
+		t.Errorf("got Message-ID %q, wanted a new one", id)
+	}
+}
@@ -0,0 +1,226 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stsNegativeTTL is how long the absence of a policy (or a failed fetch) is cached.
+var stsNegativeTTL = 5 * time.Minute
+
+// MTA-STS (RFC 8461) policy modes
+const (
+	stsEnforce = "enforce"
+	stsTesting = "testing"
+	stsNone    = "none"
+)
+
+// stsPolicy is an MTA-STS policy.
+type stsPolicy struct {
+	Mode   string
+	MX     []string
+	MaxAge time.Duration
+}
+
+// Matches reports whether the MX host matches one of the policy's mx patterns.
+func (p stsPolicy) Matches(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.MX {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if i := strings.IndexByte(host, '.'); i > 0 && host[i+1:] == pattern[2:] {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSTSPolicy parses the mta-sts.txt policy file.
+func parseSTSPolicy(r io.Reader) (stsPolicy, error) {
+	var p stsPolicy
+	version := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "version":
+			version = value
+		case "mode":
+			p.Mode = value
+		case "mx":
+			p.MX = append(p.MX, value)
+		case "max_age":
+			secs, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return p, fmt.Errorf("bad max_age %q: %s", value, err)
+			}
+			p.MaxAge = time.Duration(secs) * time.Second
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return p, err
+	}
+	if version != "STSv1" {
+		return p, fmt.Errorf("unknown policy version %q", version)
+	}
+	switch p.Mode {
+	case stsEnforce, stsTesting:
+		if len(p.MX) == 0 {
+			return p, errors.New("no mx in policy")
+		}
+	case stsNone:
+	default:
+		return p, fmt.Errorf("unknown policy mode %q", p.Mode)
+	}
+	return p, nil
+}
+
+type cachedSTSPolicy struct {
+	policy  *stsPolicy // nil if the domain has no (valid) policy
+	expires time.Time
+}
+
+// mtaSTS fetches and caches the MTA-STS policies of the recipient domains.
+type mtaSTS struct {
+	client    *http.Client
+	lookupTXT func(name string) ([]string, error)
+	// policyURL returns the URL of the policy of the domain
+	policyURL func(domain string) string
+	// logger logs the fetch failures, if set
+	logger func(msg string)
+
+	mu       sync.Mutex
+	policies map[string]cachedSTSPolicy
+}
+
+func newMTASTS() *mtaSTS {
+	return &mtaSTS{
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			// RFC 8461 3.3: HTTP 3xx redirects MUST NOT be followed
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		lookupTXT: net.LookupTXT,
+		policyURL: func(domain string) string {
+			return "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+		},
+		policies: make(map[string]cachedSTSPolicy),
+	}
+}
+
+// Policy returns the policy of the domain, or nil if it has none.
+// Fetch failures are logged and treated as if there were no policy.
+func (m *mtaSTS) Policy(domain string) *stsPolicy {
+	domain = strings.ToLower(domain)
+	m.mu.Lock()
+	cached, ok := m.policies[domain]
+	m.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.policy
+	}
+	policy, err := m.fetch(domain)
+	entry := cachedSTSPolicy{policy: policy, expires: time.Now().Add(stsNegativeTTL)}
+	if err != nil {
+		if m.logger != nil {
+			m.logger(fmt.Sprintf("MTA-STS policy of %s: %s", domain, err))
+		}
+		if ok {
+			// keep using the previous policy till the next try
+			entry.policy = cached.policy
+		}
+	} else if policy != nil && policy.MaxAge > 0 {
+		entry.expires = time.Now().Add(policy.MaxAge)
+	}
+	m.mu.Lock()
+	m.policies[domain] = entry
+	m.mu.Unlock()
+	return entry.policy
+}
+
+// fetch looks up the _mta-sts TXT record and fetches the policy.
+func (m *mtaSTS) fetch(domain string) (*stsPolicy, error) {
+	txts, err := m.lookupTXT("_mta-sts." + domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	found := false
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=STSv1") {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	resp, err := m.client.Get(m.policyURL(domain))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching policy: %s", resp.Status)
+	}
+	policy, err := parseSTSPolicy(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// mxCandidates returns the MX hosts usable for the domain, and whether
+// the domain's MTA-STS policy must be enforced on them.
+func (o *EmailOutput) mxCandidates(domain string, mxs []*net.MX) ([]*net.MX, bool) {
+	if o.sts == nil {
+		return mxs, false
+	}
+	policy := o.sts.Policy(domain)
+	if policy == nil || policy.Mode == stsNone {
+		return mxs, false
+	}
+	matching := make([]*net.MX, 0, len(mxs))
+	for _, mx := range mxs {
+		if policy.Matches(mx.Host) {
+			matching = append(matching, mx)
+		} else {
+			o.logMessage(fmt.Sprintf("MTA-STS: MX %s of %s does not match the policy %v", mx.Host, domain, policy.MX))
+		}
+	}
+	if policy.Mode == stsTesting {
+		return mxs, false
+	}
+	return matching, true
+}
@@ -0,0 +1,134 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// useFakeMX makes the MX lookups return host for every domain,
+// with the SMTP port of the given server.
+func useFakeMX(t *testing.T, host, port string) {
+	oldLookup, oldPort := lookupMX, smtpPort
+	lookupMX = func(string) ([]*net.MX, error) { return []*net.MX{{Host: host, Pref: 10}}, nil }
+	smtpPort = port
+	mxAddrsLock.Lock()
+	mxAddrs = make(map[string]cachedMX)
+	mxAddrsLock.Unlock()
+	t.Cleanup(func() {
+		lookupMX, smtpPort = oldLookup, oldPort
+		mxAddrsLock.Lock()
+		mxAddrs = make(map[string]cachedMX)
+		mxAddrsLock.Unlock()
+	})
+}
+
+func TestMTASTSEnforce(t *testing.T) {
+	policyMX := "localhost"
+	var fetches int32
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		fmt.Fprintf(w, "version: STSv1\r\nmode: enforce\r\nmx: %s\r\nmax_age: 86400\r\n", policyMX)
+	}))
+	defer ts.Close()
+	newSTS := func() *mtaSTS {
+		sts := newMTASTS()
+		sts.client = ts.Client()
+		sts.lookupTXT = func(string) ([]string, error) { return []string{"v=STSv1; id=20240101"}, nil }
+		sts.policyURL = func(string) string { return ts.URL + "/.well-known/mta-sts.txt" }
+		return sts
+	}
+
+	srv := startFakeSMTP(t, "STARTTLS")
+	useFakeMX(t, "localhost.", srv.Port())
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"}, sts: newSTS()}
+	o.opts.tlsConfig = &tls.Config{RootCAs: srv.CertPool()}
+	if err := o.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := srv.Messages(); len(msgs) != 1 || !msgs[0].TLS {
+		t.Errorf("wanted one message over TLS, got %+v", msgs)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("policy fetched %d times, wanted 1 (cached)", n)
+	}
+
+	// certificate names are validated, even with no_cert_check
+	o.opts.tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err == nil {
+		t.Error("wanted certificate validation error")
+	}
+
+	// TLS is required
+	plain := startFakeSMTP(t)
+	useFakeMX(t, "localhost.", plain.Port())
+	o.opts.tlsConfig = &tls.Config{RootCAs: srv.CertPool()}
+	if err := o.Prepare(); err == nil {
+		t.Error("wanted error for MX without STARTTLS")
+	}
+
+	// the MX must match the policy
+	policyMX = "*.mail.example.com"
+	o.sts = newSTS()
+	useFakeMX(t, "localhost.", srv.Port())
+	if err := o.Prepare(); err == nil {
+		t.Error("wanted error for MX not matching the policy")
+	}
+}
+
+func TestMTASTSFetchFailure(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	sts := newMTASTS()
+	sts.client = ts.Client()
+	sts.lookupTXT = func(string) ([]string, error) { return []string{"v=STSv1; id=1"}, nil }
+	sts.policyURL = func(string) string { return ts.URL }
+	if p := sts.Policy("example.com"); p != nil {
+		t.Errorf("got policy %+v for a failed fetch", p)
+	}
+
+	srv := startFakeSMTP(t)
+	useFakeMX(t, "localhost.", srv.Port())
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"}, sts: sts}
+	if err := o.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err != nil {
+		t.Errorf("sending without policy: %v", err)
+	}
+}
+
+func TestSTSPolicyMatches(t *testing.T) {
+	p := stsPolicy{Mode: stsEnforce, MX: []string{"mx1.example.com", "*.mail.example.com"}}
+	for host, want := range map[string]bool{
+		"mx1.example.com.":        true,
+		"MX1.example.com":         true,
+		"a.mail.example.com.":     true,
+		"a.b.mail.example.com":    false,
+		"mail.example.com":        false,
+		"mx2.example.com":         false,
+		"mx1.example.com.evil.io": false,
+	} {
+		if got := p.Matches(host); got != want {
+			t.Errorf("%s: got %t, wanted %t", host, got, want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// pendingAlerts holds back the first message of a condition (per logger or
+// fingerprint) for the grace period: the alert is sent only if the condition
+// is not resolved till then, like the "for" of the Prometheus alerting rules.
+// Once sent, the alert is firing, and its messages are sent till resolved.
+//
+// The methods must be called from the Run goroutine only: the timers
+// just send the alerts due on the channel returned by Due.
+type pendingAlerts struct {
+	duration time.Duration
+	alerts   map[string]*pendingAlert
+	firing   map[string]bool
+	due      chan *pendingAlert
+	done     chan struct{}
+}
+
+// pendingAlert is the first message of a pending condition.
+type pendingAlert struct {
+	key       string
+	msg       *message.Message
+	loopCount uint
+	timer     *time.Timer
+}
+
+func newPendingAlerts(duration time.Duration) *pendingAlerts {
+	return &pendingAlerts{
+		duration: duration,
+		alerts:   make(map[string]*pendingAlert),
+		firing:   make(map[string]bool),
+		due:      make(chan *pendingAlert),
+		done:     make(chan struct{}),
+	}
+}
+
+// Hold holds back the message if its condition is not firing yet,
+// and reports whether it did so.
+func (p *pendingAlerts) Hold(key string, msg *message.Message, loopCount uint) bool {
+	if p.firing[key] {
+		return false
+	}
+	if _, ok := p.alerts[key]; ok {
+		return true
+	}
+	a := &pendingAlert{key: key, msg: message.CopyMessage(msg), loopCount: loopCount}
+	a.timer = time.AfterFunc(p.duration, func() {
+		select {
+		case p.due <- a:
+		case <-p.done:
+		}
+	})
+	p.alerts[key] = a
+	return true
+}
+
+// Resolve cancels the pending alert of the condition,
+// and reports whether there was one.
+func (p *pendingAlerts) Resolve(key string) bool {
+	delete(p.firing, key)
+	a, ok := p.alerts[key]
+	if ok {
+		a.timer.Stop()
+		delete(p.alerts, key)
+	}
+	return ok
+}
+
+// Due returns the channel of the alerts whose grace period elapsed.
+func (p *pendingAlerts) Due() <-chan *pendingAlert {
+	return p.due
+}
+
+// Fire marks the condition of the due alert as firing, and reports
+// whether it is still pending (it was not resolved in the meantime).
+func (p *pendingAlerts) Fire(a *pendingAlert) bool {
+	if p.alerts[a.key] != a {
+		return false
+	}
+	delete(p.alerts, a.key)
+	p.firing[a.key] = true
+	return true
+}
+
+// Close drops the pending alerts.
+func (p *pendingAlerts) Close() {
+	close(p.done)
+	for key, a := range p.alerts {
+		a.timer.Stop()
+		delete(p.alerts, key)
+	}
+}
+
+// conditionKey returns the key of the message's condition:
+// the fingerprint field, or the logger.
+func conditionKey(msg *message.Message) string {
+	if fp, ok := msg.GetFieldValue("fingerprint"); ok {
+		return fmt.Sprintf("fp:%v", fp)
+	}
+	return "logger:" + msg.GetLogger()
+}
+
+// isResolved reports whether the message resolves its condition
+// (it has a true "resolved" field).
+func isResolved(msg *message.Message) bool {
+	v, ok := msg.GetFieldValue("resolved")
+	if !ok {
+		return false
+	}
+	resolved, _ := v.(bool)
+	return resolved
+}
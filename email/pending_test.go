@@ -0,0 +1,118 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+func TestPendingDuration(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"},
+		hostport: srv.Addr(), pending: newPendingAlerts(100 * time.Millisecond)}
+	condition := func(fp, payload string, resolved bool) *message.Message {
+		msg := newTestMessage(2, "db-01", payload)
+		f, _ := message.NewField("fingerprint", fp, "")
+		msg.AddField(f)
+		if resolved {
+			f, _ = message.NewField("resolved", true, "")
+			msg.AddField(f)
+		}
+		return msg
+	}
+	runner := newTestRunner()
+	done := make(chan error, 1)
+	go func() { done <- o.Run(runner, nil) }()
+
+	// a flap: resolved within the grace period
+	runner.send(condition("flap", "replication lag", false))
+	runner.send(condition("flap", "replication lag ok", true))
+	// a sustained condition
+	runner.send(condition("down", "database is down", false))
+	runner.send(condition("down", "database is still down", false))
+	time.Sleep(50 * time.Millisecond)
+	if n := len(srv.Messages()); n != 0 {
+		t.Fatalf("got %d emails within the grace period", n)
+	}
+	time.Sleep(150 * time.Millisecond)
+	// firing: sent at once
+	runner.send(condition("down", "database is down again", false))
+	// and its resolution is sent, too
+	runner.send(condition("down", "database is up", true))
+	close(runner.inChan)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := srv.Messages()
+	var got []string
+	for _, m := range msgs {
+		got = append(got, string(m.Data))
+	}
+	all := strings.Join(got, "\n----\n")
+	if len(msgs) != 3 {
+		t.Fatalf("got %d emails, wanted 3:\n%s", len(msgs), all)
+	}
+	if strings.Contains(all, "replication lag") {
+		t.Errorf("the flap was alerted:\n%s", all)
+	}
+	for i, want := range []string{"database is down", "database is down again", "database is up"} {
+		if !strings.Contains(got[i], "\r\n\r\n"+want+"\r\n") {
+			t.Errorf("%d. email is\n%s\nwanted %q", i, got[i], want)
+		}
+	}
+}
+
+func TestPendingLocales(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From = srv.Addr(), "heka@example.com"
+	conf.To = []string{"ops@example.com", "betrieb@example.de"}
+	conf.Locales = map[string]LocaleConfig{"de": {Subject: "Warnung von {{.Hostname}}: {{.Payload}}"}}
+	conf.RecipientLocales = map[string]string{"betrieb@example.de": "de"}
+	conf.PendingDuration = "50ms"
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	prepared := len(srv.Messages())
+	runner := newTestRunner()
+	done := make(chan error, 1)
+	go func() { done <- o.Run(runner, testHelper{}) }()
+	runner.send(newTestMessage(2, "db-01", "database is down"))
+	time.Sleep(200 * time.Millisecond)
+	close(runner.inChan)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// the held back alert goes in the recipients' languages, too
+	got := make(map[string]string)
+	for _, m := range srv.Messages()[prepared:] {
+		got[strings.Join(m.To, ",")] = subjectOf(m.Data)
+	}
+	if len(got) != 2 || !strings.HasPrefix(got["betrieb@example.de"], "Warnung von db-01") ||
+		strings.HasPrefix(got["ops@example.com"], "Warnung") {
+		t.Errorf("got subjects %q", got)
+	}
+
+	for _, d := range []string{"0s", "-1m", "soon"} {
+		conf.PendingDuration = d
+		if err := new(EmailOutput).Init(conf); err == nil || !strings.Contains(err.Error(), "pending_duration") {
+			t.Errorf("%s: got %v, wanted the pending_duration error", d, err)
+		}
+	}
+}
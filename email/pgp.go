@@ -0,0 +1,139 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	// RIPEMD160 is the hash used with the keys without hash preferences
+	_ "golang.org/x/crypto/ripemd160"
+)
+
+// readPGPKeys reads the armored public key files of the addresses.
+func readPGPKeys(files map[string]string) (map[string]*openpgp.Entity, error) {
+	keys := make(map[string]*openpgp.Entity, len(files))
+	for addr, file := range files {
+		fh, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("error opening PGP key of %s: %s", addr, err)
+		}
+		entities, err := openpgp.ReadArmoredKeyRing(fh)
+		fh.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading PGP key of %s from %s: %s", addr, file, err)
+		}
+		keys[strings.ToLower(addr)] = entities[0]
+	}
+	return keys, nil
+}
+
+// deliverPGP sends the email encrypted to the recipients having a key,
+// and in plaintext to the others, unless they are to be skipped.
+func (o *EmailOutput) deliverPGP(body []byte, env envelope, msgLoopCount uint) error {
+	hasKey := func(addr string) bool { return o.pgpKeys[strings.ToLower(addr)] != nil }
+	var keys openpgp.EntityList
+	for _, addr := range o.recipients(env) {
+		if key := o.pgpKeys[strings.ToLower(addr)]; key != nil {
+			keys = append(keys, key)
+		}
+	}
+	var (
+		err    error
+		failed []string
+	)
+	if len(keys) > 0 {
+		encrypted, e := encryptBody(body, keys)
+		if e != nil {
+			return fmt.Errorf("error encrypting: %s", e)
+		}
+		encEnv := o.narrow(env, hasKey)
+		if err = o.deliverOne(encrypted, encEnv, msgLoopCount); err != nil {
+			failed = o.failedRecipients(encEnv, err)
+		}
+	}
+	if !o.pgpSkip {
+		plainEnv := o.narrow(env, func(addr string) bool { return !hasKey(addr) })
+		if len(o.recipients(plainEnv)) > 0 {
+			if e := o.deliverOne(body, plainEnv, msgLoopCount); e != nil {
+				failed = append(failed, o.failedRecipients(plainEnv, e)...)
+				if err == nil {
+					err = e
+				}
+			}
+		}
+	}
+	if err != nil && len(failed) < len(o.recipients(env)) {
+		return &partialError{failed: failed, err: err}
+	}
+	return err
+}
+
+// encryptBody returns the PGP/MIME (RFC 3156) encrypted email: the headers
+// of the body are kept, the text is encrypted as a text/plain MIME part.
+func encryptBody(body []byte, to openpgp.EntityList) ([]byte, error) {
+	header, text := body, []byte(nil)
+	if i := bytes.Index(body, []byte("\r\n\r\n")); i >= 0 {
+		header, text = body[:i+2], body[i+4:]
+	}
+
+	var armored bytes.Buffer
+	aw, err := armor.Encode(&armored, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := openpgp.Encrypt(aw, to, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	pw.Write([]byte("Content-Type: text/plain; charset=utf-8\r\n\r\n"))
+	pw.Write(text)
+	if err = pw.Close(); err != nil {
+		return nil, err
+	}
+	if err = aw.Close(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(header)
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n"+
+		"Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=%q\r\n\r\n",
+		mw.Boundary())
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"application/pgp-encrypted"},
+		"Content-Description": {"PGP/MIME version identification"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	part.Write([]byte("Version: 1\r\n"))
+	if part, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {`application/octet-stream; name="encrypted.asc"`},
+		"Content-Description": {"OpenPGP encrypted message"},
+		"Content-Disposition": {`inline; filename="encrypted.asc"`},
+	}); err != nil {
+		return nil, err
+	}
+	part.Write(bytes.Replace(armored.Bytes(), []byte("\n"), []byte("\r\n"), -1))
+	if err = mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
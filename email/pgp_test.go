@@ -0,0 +1,114 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+func TestPGP(t *testing.T) {
+	entity, err := openpgp.NewEntity("Ops", "", "ops@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "ops.asc")
+	fh, err := os.Create(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw, _ := armor.Encode(fh, openpgp.PublicKeyType, nil)
+	if err = entity.Serialize(aw); err != nil {
+		t.Fatal(err)
+	}
+	aw.Close()
+	fh.Close()
+
+	srv := startFakeSMTP(t)
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From = srv.Addr(), "heka@example.com"
+	conf.To = []string{"ops@example.com", "dev@example.com"}
+	conf.PGPKeys = map[string]string{"ops@example.com": keyFile}
+	if err = o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	runner := newTestRunner()
+	runner.send(newTestMessage(2, "db-01", "secret: the database is down"))
+	close(runner.inChan)
+	if err = o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := srv.Messages()
+	if len(msgs) != 2 {
+		t.Fatalf("got %d emails, wanted 2 (encrypted and plaintext)", len(msgs))
+	}
+	var encrypted []byte
+	for _, m := range msgs {
+		switch strings.Join(m.To, ",") {
+		case "ops@example.com":
+			encrypted = m.Data
+		case "dev@example.com":
+			if !bytes.Contains(m.Data, []byte("secret: the database is down")) {
+				t.Errorf("plaintext email misses the payload: %q", m.Data)
+			}
+		default:
+			t.Errorf("unexpected recipients %v", m.To)
+		}
+	}
+
+	email, err := mail.ReadMessage(bytes.NewReader(encrypted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(email.Header.Get("Subject"), "secret: the database is down") {
+		t.Errorf("got subject %q", email.Header.Get("Subject"))
+	}
+	mediaType, params, err := mime.ParseMediaType(email.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/encrypted" || params["protocol"] != "application/pgp-encrypted" {
+		t.Fatalf("got Content-Type %q (%v)", email.Header.Get("Content-Type"), err)
+	}
+	mr := multipart.NewReader(email.Body, params["boundary"])
+	if part, err := mr.NextPart(); err != nil || part.Header.Get("Content-Type") != "application/pgp-encrypted" {
+		t.Fatalf("bad version part: %v", err)
+	}
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := armor.Decode(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{entity}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Content-Type: text/plain; charset=utf-8\r\n\r\nsecret: the database is down"; string(plain) != want {
+		t.Errorf("decrypted %q, wanted %q", plain, want)
+	}
+}
@@ -0,0 +1,89 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// smtpPhases are the phases of the SMTP conversation with their own timeouts.
+var smtpPhases = []string{"greeting", "ehlo", "starttls", "auth", "mail", "rcpt", "data"}
+
+// parsePhaseTimeouts parses the phase -> duration map of phase_timeouts.
+func parsePhaseTimeouts(conf map[string]string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration, len(conf))
+	for phase, s := range conf {
+		phase = strings.ToLower(phase)
+		known := false
+		for _, p := range smtpPhases {
+			known = known || p == phase
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown SMTP phase %q in phase_timeouts (should be one of %s)",
+				phase, strings.Join(smtpPhases, ", "))
+		}
+		d, err := time.ParseDuration(s)
+		if err == nil && d <= 0 {
+			err = errors.New("not positive")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad phase_timeouts %s %q: %s", phase, s, err)
+		}
+		timeouts[phase] = d
+	}
+	return timeouts, nil
+}
+
+// phaseDeadlines sets the deadline of the connection per phase: the phase's
+// timeout if it has one, the deadline of the whole conversation otherwise.
+// A nil *phaseDeadlines does nothing.
+type phaseDeadlines struct {
+	timeouts map[string]time.Duration
+	conn     net.Conn
+	deadline time.Time // of the whole conversation, zero if none
+}
+
+// newPhaseDeadlines returns a new phaseDeadlines for one conversation,
+// nil if there are no phase timeouts.
+func newPhaseDeadlines(timeouts map[string]time.Duration) *phaseDeadlines {
+	if len(timeouts) == 0 {
+		return nil
+	}
+	return &phaseDeadlines{timeouts: timeouts}
+}
+
+// Start starts the conversation over conn, which should end in timeout.
+func (pd *phaseDeadlines) Start(conn net.Conn, timeout time.Duration) {
+	if pd == nil {
+		return
+	}
+	pd.conn = conn
+	if timeout > 0 {
+		pd.deadline = time.Now().Add(timeout)
+	}
+}
+
+// Enter sets the deadline of the phase.
+func (pd *phaseDeadlines) Enter(phase string) {
+	if pd == nil || pd.conn == nil {
+		return
+	}
+	if d, ok := pd.timeouts[phase]; ok {
+		pd.conn.SetDeadline(time.Now().Add(d))
+	} else {
+		pd.conn.SetDeadline(pd.deadline)
+	}
+}
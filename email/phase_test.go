@@ -0,0 +1,51 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPhaseTimeouts(t *testing.T) {
+	srv := startFakeSMTP(t)
+	srv.Delay = 300 * time.Millisecond // of accepting the DATA
+
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.PhaseTimeouts = map[string]string{"rcpt": "1s", "data": "50ms"}
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	body := []byte("Subject: test\r\n\r\nbody")
+	err := o.sendMail(body, envelope{})
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("got %v, wanted a timeout of DATA", err)
+	}
+
+	conf.PhaseTimeouts["data"] = "1s"
+	if err = o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.sendMail(body, envelope{}); err != nil {
+		t.Errorf("the longer DATA timeout did not help: %v", err)
+	}
+
+	for _, bad := range []map[string]string{{"quit": "1s"}, {"data": "soon"}, {"data": "-1s"}} {
+		conf.PhaseTimeouts = bad
+		if err = new(EmailOutput).Init(conf); err == nil {
+			t.Errorf("wanted error for phase_timeouts %v", bad)
+		}
+	}
+}
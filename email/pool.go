@@ -0,0 +1,248 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+// errNotPooled is returned by sendPooled if there is no usable pooled
+// connection: none, or a stale one (failing RSET, closed by the server meanwhile).
+// Only then may the email be sent over a new connection: any other failure
+// is the server's answer to the email, or may come after it was accepted.
+var errNotPooled = errors.New("no pooled connection")
+
+// pooledConn is an open SMTP connection, idle after a successful transaction.
+type pooledConn struct {
+	c    *smtp.Client
+	conn net.Conn
+	addr string    // the address of the server
+	idle time.Time // the time it was put back into the pool
+}
+
+// connPool holds the idle connections per host group: recipient domain in
+// MX mode, relay address otherwise, at most size per group. The connections
+// are kept regardless of the way (MX, fallback relay) they were established.
+// When a group is full, its least recently used connection is evicted.
+// The connections idle for more than idleTimeout (if set) are closed.
+type connPool struct {
+	size        int
+	idleTimeout time.Duration
+
+	mu    sync.Mutex
+	conns map[string][]*pooledConn // the idle connections, the most recently used last
+	stats poolStats
+}
+
+// poolStats are the counters of the pool.
+type poolStats struct {
+	Active  int64 // connections in use
+	Idle    int64 // connections in the pool
+	Created int64 // connections created for pooling
+	Evicted int64 // connections quit because the pool was full
+	Expired int64 // connections quit because they were idle for too long
+}
+
+// newConnPool returns a pool of size idle connections per group (at least one).
+func newConnPool(size int) *connPool {
+	if size < 1 {
+		size = 1
+	}
+	return &connPool{size: size, conns: make(map[string][]*pooledConn)}
+}
+
+// Get removes and returns the most recently used connection of the group,
+// nil if there is none. The connection must be Put back or Discarded.
+func (p *connPool) Get(group string) *pooledConn {
+	p.Expire(time.Now())
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	idle := p.conns[group]
+	if len(idle) == 0 {
+		return nil
+	}
+	pc := idle[len(idle)-1]
+	if len(idle) == 1 {
+		delete(p.conns, group)
+	} else {
+		p.conns[group] = idle[:len(idle)-1]
+	}
+	p.stats.Idle--
+	p.stats.Active++
+	return pc
+}
+
+// Expire quits the connections idle for more than idleTimeout till now.
+func (p *connPool) Expire(now time.Time) {
+	if p.idleTimeout <= 0 {
+		return
+	}
+	var expired []*pooledConn
+	p.mu.Lock()
+	for group, idle := range p.conns {
+		// the least recently used ones are the first
+		n := 0
+		for n < len(idle) && now.Sub(idle[n].idle) > p.idleTimeout {
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+		expired = append(expired, idle[:n]...)
+		if n == len(idle) {
+			delete(p.conns, group)
+		} else {
+			p.conns[group] = idle[n:]
+		}
+		p.stats.Idle -= int64(n)
+		p.stats.Expired += int64(n)
+	}
+	p.mu.Unlock()
+	for _, pc := range expired {
+		pc.Quit()
+	}
+}
+
+// New counts a new connection in use.
+func (p *connPool) New() {
+	p.mu.Lock()
+	p.stats.Created++
+	p.stats.Active++
+	p.mu.Unlock()
+}
+
+// Put stores the connection in use for the group, evicting the least
+// recently used one if the group is full.
+func (p *connPool) Put(group string, pc *pooledConn) {
+	var evicted *pooledConn
+	pc.idle = time.Now()
+	p.mu.Lock()
+	idle := append(p.conns[group], pc)
+	if len(idle) > p.size {
+		evicted, idle = idle[0], idle[1:]
+		p.stats.Evicted++
+	} else {
+		p.stats.Idle++
+	}
+	p.conns[group] = idle
+	p.stats.Active--
+	p.mu.Unlock()
+	if evicted != nil {
+		evicted.Quit()
+	}
+}
+
+// Discard counts the (closed) connection in use as gone.
+func (p *connPool) Discard() {
+	p.mu.Lock()
+	p.stats.Active--
+	p.mu.Unlock()
+}
+
+// Stats returns the counters of the pool.
+func (p *connPool) Stats() poolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// Close quits all the pooled connections.
+func (p *connPool) Close() {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = make(map[string][]*pooledConn)
+	p.stats.Idle = 0
+	p.mu.Unlock()
+	for _, idle := range conns {
+		for _, pc := range idle {
+			pc.Quit()
+		}
+	}
+}
+
+// Quit says goodbye to the server, and closes the connection.
+func (pc *pooledConn) Quit() {
+	pc.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := pc.c.Quit(); err != nil {
+		pc.c.Close()
+	}
+}
+
+// send sends the email to the recipients of the host group via the server
+// at addr, keeping the connection in the pool (if pooling is on).
+func (o *EmailOutput) send(group, addr string, to []string, body []byte, opts smtpOptions) error {
+	start := time.Now()
+	if o.pool == nil {
+		err := sendMail(addr, o.From, to, body, opts)
+		o.logDelivery(addr, to, body, start, err)
+		return err
+	}
+	totalConns.Acquire()
+	defer totalConns.Release()
+	opts.phases = newPhaseDeadlines(opts.phaseTimeouts)
+	c, conn, err := dial(addr, opts)
+	if err != nil {
+		o.logDelivery(addr, to, body, start, err)
+		return err
+	}
+	o.pool.New()
+	err = transact(c, o.From, to, body, opts)
+	o.logDelivery(addr, to, body, start, err)
+	if err != nil {
+		c.Close()
+		o.pool.Discard()
+		return err
+	}
+	o.pool.Put(group, &pooledConn{c: c, conn: conn, addr: addr})
+	return nil
+}
+
+// sendPooled sends the email over the pooled connection of the host group,
+// returning errNotPooled (wrapped, if stale) if there is no usable one.
+// The connection is put back to the pool after a successful sending,
+// and closed on failure.
+func (o *EmailOutput) sendPooled(group string, to []string, body []byte, opts smtpOptions) error {
+	if o.pool == nil {
+		return errNotPooled
+	}
+	pc := o.pool.Get(group)
+	if pc == nil {
+		return errNotPooled
+	}
+	start := time.Now()
+	totalConns.Acquire()
+	defer totalConns.Release()
+	if opts.timeout > 0 {
+		pc.conn.SetDeadline(time.Now().Add(opts.timeout))
+	}
+	opts.phases = newPhaseDeadlines(opts.phaseTimeouts)
+	opts.phases.Start(pc.conn, opts.timeout)
+	if err := pc.c.Reset(); err != nil {
+		pc.c.Close()
+		o.pool.Discard()
+		return fmt.Errorf("%w: %s: %s", errNotPooled, pc.addr, err)
+	}
+	err := transact(pc.c, o.From, to, body, opts)
+	o.logDelivery(pc.addr, to, body, start, err)
+	if err != nil {
+		pc.c.Close()
+		o.pool.Discard()
+		return err
+	}
+	o.pool.Put(group, pc)
+	return nil
+}
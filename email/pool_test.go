@@ -0,0 +1,164 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/tgulacsi/heka-plugins/email/testutil"
+)
+
+func TestReuseFallbackConnection(t *testing.T) {
+	mx := startFakeSMTP(t)
+	mx.Reply("MAIL FROM", "451 try again later")
+	relay := startFakeSMTP(t)
+	useFakeMX(t, "localhost.", mx.Port())
+	mxAddrsLock.Lock()
+	mxAddrs["example.com"] = cachedMX{mxs: []*net.MX{{Host: "localhost.", Pref: 10}}, fetched: time.Now()}
+	mxAddrsLock.Unlock()
+
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"},
+		byHost:        map[string][]string{"example.com": {"ops@example.com"}},
+		fallbackRelay: relay.Addr(), pool: newConnPool(1)}
+	for i := 0; i < 2; i++ {
+		if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err != nil {
+			t.Fatalf("%d. %v", i, err)
+		}
+	}
+	if n := len(relay.Messages()); n != 2 {
+		t.Errorf("fallback relay got %d messages, wanted 2", n)
+	}
+	if n := relay.Connections(); n != 1 {
+		t.Errorf("fallback relay got %d connections, wanted 1", n)
+	}
+	if rset := findCommand(relay.Commands(), "RSET"); rset == "" {
+		t.Error("no RSET before reusing the connection")
+	}
+	if n := mx.Connections(); n != 1 {
+		t.Errorf("MX got %d connections, wanted 1 (the pooled connection should be used)", n)
+	}
+
+	o.pool.Close()
+	if quit := findCommand(relay.Commands(), "QUIT"); quit == "" {
+		t.Error("pooled connection closed without QUIT")
+	}
+}
+
+func TestPoolSize(t *testing.T) {
+	var relays []*testutil.FakeSMTP
+	for i := 0; i < 3; i++ {
+		relays = append(relays, startFakeSMTP(t))
+	}
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"}, pool: newConnPool(2)}
+	body := []byte("Subject: test\r\n\r\nbody")
+	// three connections in the same group: the least recently used is evicted
+	for _, relay := range relays {
+		if err := o.send("relay", relay.Addr(), o.To, body, o.opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := o.pool.Stats(); stats != (poolStats{Idle: 2, Created: 3, Evicted: 1}) {
+		t.Errorf("got %+v", stats)
+	}
+	if quit := findCommand(relays[0].Commands(), "QUIT"); quit == "" {
+		t.Error("the least recently used connection is not evicted")
+	}
+	// the most recently used connection is reused
+	if err := o.sendPooled("relay", o.To, body, o.opts); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(relays[2].Messages()); n != 2 {
+		t.Errorf("the last relay got %d messages, wanted 2", n)
+	}
+
+	msg := new(message.Message)
+	if err := o.ReportMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]int64{"Pool.Active": 0, "Pool.Idle": 2, "Pool.Created": 3, "Pool.Evicted": 1} {
+		if v, ok := msg.GetFieldValue(name); !ok || v != want {
+			t.Errorf("%s: got %v, wanted %d", name, v, want)
+		}
+	}
+
+	o.pool.Close()
+	if stats := o.pool.Stats(); stats.Idle != 0 {
+		t.Errorf("got %+v after Close", stats)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	relay := startFakeSMTP(t)
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"}, pool: newConnPool(1)}
+	o.pool.idleTimeout = 50 * time.Millisecond
+	body := []byte("Subject: test\r\n\r\nbody")
+	if err := o.send("relay", relay.Addr(), o.To, body, o.opts); err != nil {
+		t.Fatal(err)
+	}
+	o.pool.Expire(time.Now())
+	if stats := o.pool.Stats(); stats.Idle != 1 {
+		t.Fatalf("got %+v, wanted the fresh connection kept", stats)
+	}
+
+	o.pool.Expire(time.Now().Add(100 * time.Millisecond))
+	if stats := o.pool.Stats(); stats != (poolStats{Created: 1, Expired: 1}) {
+		t.Errorf("got %+v", stats)
+	}
+	if quit := findCommand(relay.Commands(), "QUIT"); quit == "" {
+		t.Error("the stale connection is closed without QUIT")
+	}
+	if err := o.sendPooled("relay", o.To, body, o.opts); err != errNotPooled {
+		t.Errorf("got %v, wanted errNotPooled", err)
+	}
+}
+
+func TestPooledFailureNotResent(t *testing.T) {
+	relay := startFakeSMTP(t)
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = relay.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.ReuseConnections, conf.PoolSize = true, 1
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer o.pool.Close()
+	body := []byte("Subject: test\r\n\r\nbody")
+	if err := o.sendMail(body, envelope{}); err != nil {
+		t.Fatal(err)
+	}
+	conns := relay.Connections()
+
+	// the answer over the pooled connection is final
+	relay.Reply("RCPT TO", "550 no such user", testutil.Pass)
+	if err := o.sendMail(body, envelope{}); err == nil || !strings.Contains(err.Error(), "550") {
+		t.Errorf("got %v, wanted the 550", err)
+	}
+	if n := relay.Connections(); n != conns {
+		t.Errorf("got %d new connections after the rejection, wanted none", n-conns)
+	}
+	if err := o.sendMail(body, envelope{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a stale connection is replaced
+	relay.Reply("RSET", testutil.Drop, testutil.Pass)
+	if err := o.sendMail(body, envelope{}); err != nil {
+		t.Fatalf("got %v over a stale connection", err)
+	}
+	if n := len(relay.Messages()); n != 3 {
+		t.Errorf("got %d messages, wanted 3", n)
+	}
+}
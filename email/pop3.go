@@ -0,0 +1,231 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pop3Client is a minimal POP3 (RFC 1939) client, knowing just enough
+// for polling a mailbox: CAPA, STLS, USER/PASS, UIDL, RETR, DELE and QUIT.
+type pop3Client struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	host    string
+	timeout time.Duration
+	isTLS   bool
+}
+
+// pop3Error is an -ERR response.
+type pop3Error struct {
+	cmd, status string
+}
+
+func (e *pop3Error) Error() string {
+	return fmt.Sprintf("POP3 %s: %s", e.cmd, e.status)
+}
+
+// pop3Message is a message of the mailbox, with its number in the session.
+type pop3Message struct {
+	num  int
+	uidl string
+}
+
+// dialPOP3 connects to the POP3 server at addr (with TLS from the start
+// if implicitTLS), reading its greeting. Each command has timeout to complete.
+func dialPOP3(addr string, tlsConfig *tls.Config, implicitTLS bool, timeout time.Duration) (*pop3Client, error) {
+	conn, err := dialTCP(addr, timeout, nil)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if implicitTLS {
+		tc := tls.Client(conn, clientTLSConfig(tlsConfig, host))
+		tc.SetDeadline(time.Now().Add(timeout))
+		if err = tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	c := &pop3Client{conn: conn, r: bufio.NewReader(conn), host: host, timeout: timeout, isTLS: implicitTLS}
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	if _, err = c.response("greeting"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the connection.
+func (c *pop3Client) Close() error {
+	return c.conn.Close()
+}
+
+// Cmd sends the command, returning the text of its +OK response.
+func (c *pop3Client) Cmd(format string, args ...interface{}) (string, error) {
+	cmd := fmt.Sprintf(format, args...)
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := io.WriteString(c.conn, cmd+"\r\n"); err != nil {
+		return "", err
+	}
+	name := cmd
+	if i := strings.IndexByte(cmd, ' '); i > 0 {
+		name = cmd[:i]
+	}
+	return c.response(name)
+}
+
+// response reads a response line, returning its text after +OK.
+func (c *pop3Client) response(cmd string) (string, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.HasPrefix(line, "+OK"):
+		return strings.TrimSpace(line[3:]), nil
+	case strings.HasPrefix(line, "-ERR"):
+		return "", &pop3Error{cmd: cmd, status: strings.TrimSpace(line[4:])}
+	}
+	return "", fmt.Errorf("POP3 %s: bad response %q", cmd, line)
+}
+
+func (c *pop3Client) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// multiline reads the dot-encoded lines following a +OK response,
+// returning them decoded, with CRLF line endings.
+func (c *pop3Client) multiline() ([]byte, error) {
+	var b bytes.Buffer
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "." {
+			return b.Bytes(), nil
+		}
+		b.WriteString(strings.TrimPrefix(line, "."))
+		b.WriteString("\r\n")
+	}
+}
+
+// Capabilities returns the capabilities of the server (the first words
+// of the CAPA lines, in upper case), empty if it does not support CAPA.
+func (c *pop3Client) Capabilities() (map[string]bool, error) {
+	caps := make(map[string]bool)
+	if _, err := c.Cmd("CAPA"); err != nil {
+		if _, ok := err.(*pop3Error); ok {
+			return caps, nil
+		}
+		return nil, err
+	}
+	lines, err := c.multiline()
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(lines), "\r\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			caps[strings.ToUpper(fields[0])] = true
+		}
+	}
+	return caps, nil
+}
+
+// StartTLS upgrades the connection to TLS (STLS, RFC 2595).
+func (c *pop3Client) StartTLS(tlsConfig *tls.Config) error {
+	if _, err := c.Cmd("STLS"); err != nil {
+		return err
+	}
+	tc := tls.Client(c.conn, clientTLSConfig(tlsConfig, c.host))
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	c.conn, c.r, c.isTLS = tc, bufio.NewReader(tc), true
+	return nil
+}
+
+// Login authenticates with USER and PASS.
+func (c *pop3Client) Login(username, password string) error {
+	if strings.ContainsAny(username+password, "\r\n") {
+		return errors.New("POP3: line break in the username or password")
+	}
+	if _, err := c.Cmd("USER %s", username); err != nil {
+		return err
+	}
+	_, err := c.Cmd("PASS %s", password)
+	return err
+}
+
+// List returns the messages of the mailbox, in their order, with their UIDL.
+func (c *pop3Client) List() ([]pop3Message, error) {
+	if _, err := c.Cmd("UIDL"); err != nil {
+		return nil, err
+	}
+	lines, err := c.multiline()
+	if err != nil {
+		return nil, err
+	}
+	var msgs []pop3Message
+	for _, line := range strings.Split(string(lines), "\r\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		num, err := strconv.Atoi(fields[0])
+		if err != nil || len(fields) != 2 {
+			return nil, fmt.Errorf("POP3 UIDL: bad line %q", line)
+		}
+		msgs = append(msgs, pop3Message{num: num, uidl: fields[1]})
+	}
+	return msgs, nil
+}
+
+// Retr returns the message with the number.
+func (c *pop3Client) Retr(num int) ([]byte, error) {
+	if _, err := c.Cmd("RETR %d", num); err != nil {
+		return nil, err
+	}
+	return c.multiline()
+}
+
+// Dele marks the message with the number deleted, to be removed at Quit.
+func (c *pop3Client) Dele(num int) error {
+	_, err := c.Cmd("DELE %d", num)
+	return err
+}
+
+// Quit ends the session (removing the messages marked deleted),
+// and closes the connection.
+func (c *pop3Client) Quit() error {
+	_, err := c.Cmd("QUIT")
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgulacsi/heka-plugins/email/testutil"
+)
+
+func TestPOP3Client(t *testing.T) {
+	srv := testutil.NewFakePOP3()
+	srv.StartTLS = true
+	srv.Users = map[string]string{"heka": "secret"}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	// the lines starting with a dot are dot-stuffed on the wire
+	data := "Subject: x\r\n\r\n.\r\n..two dots\r\n"
+	first := srv.Add([]byte(data))
+	second := srv.Add([]byte("Subject: y\r\n\r\ny\r\n"))
+
+	c, err := dialPOP3(srv.Addr(), nil, false, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	caps, err := c.Capabilities()
+	if err != nil || !caps["STLS"] || !caps["UIDL"] {
+		t.Fatalf("got %v, %v", caps, err)
+	}
+	if err = c.StartTLS(&tls.Config{RootCAs: srv.CertPool()}); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Login("heka", "wrong"); err == nil || !strings.Contains(err.Error(), "POP3 PASS: [AUTH]") {
+		t.Errorf("got %v, wanted the PASS failure", err)
+	}
+	if err = c.Login("heka", "se\r\ncret"); err == nil {
+		t.Error("sent a line break")
+	}
+	if err = c.Login("heka", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := c.List()
+	if err != nil || len(msgs) != 2 || msgs[0] != (pop3Message{1, first}) || msgs[1] != (pop3Message{2, second}) {
+		t.Fatalf("got %v, %v", msgs, err)
+	}
+	got, err := c.Retr(1)
+	if err != nil || string(got) != data {
+		t.Fatalf("got %q, %v, wanted %q", got, err, data)
+	}
+	if _, err = c.Retr(3); err == nil {
+		t.Error("retrieved a missing message")
+	}
+	if err = c.Dele(1); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Quit(); err != nil {
+		t.Error(err)
+	}
+	if msgs := srv.Mailbox(); len(msgs) != 1 || string(msgs[0].Data) != "Subject: y\r\n\r\ny\r\n" {
+		t.Errorf("got %+v, wanted the second message only", msgs)
+	}
+}
@@ -0,0 +1,117 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+func TestPartialPrepare(t *testing.T) {
+	mx := startFakeSMTP(t)
+	useFakeMX(t, "localhost.", mx.Port())
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		if domain == "bad.example.com" {
+			return nil, errors.New("no such host")
+		}
+		return []*net.MX{{Host: "localhost.", Pref: 10}}, nil
+	}
+
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.From = "heka@example.com"
+	conf.To = []string{"ops@good.example.com", "ops@bad.example.com"}
+	if err := o.Init(conf); err == nil {
+		t.Fatal("Init succeeded with an unreachable domain")
+	}
+
+	conf.PartialPrepare = true
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	prepared := len(mx.Commands())
+	runner := newTestRunner()
+	runner.send(newTestMessage(2, "db-01", "database is down"))
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+	msgs := mx.Messages()
+	if len(msgs) != 1 || strings.Join(msgs[0].To, ",") != "ops@good.example.com" {
+		t.Fatalf("got %d emails (%v), wanted one to the good domain", len(msgs), msgs)
+	}
+	if len(mx.Commands()) == prepared {
+		t.Error("nothing sent after Prepare")
+	}
+	// Init has no runner: the skipped domains are logged by Run
+	if logged := runner.Messages(); len(logged) == 0 ||
+		!strings.HasPrefix(logged[0], "skipping the unreachable recipient domains: bad.example.com: ") {
+		t.Errorf("got log messages %q", logged)
+	}
+
+	msg := new(message.Message)
+	o.ReportMsg(msg)
+	if v, ok := msg.GetFieldValue("Prepare.Unreachable.bad.example.com"); !ok ||
+		!strings.Contains(v.(string), "no such host") {
+		t.Errorf("got report %v", v)
+	}
+
+	conf.To = []string{"ops@bad.example.com"}
+	if err := new(EmailOutput).Init(conf); err == nil {
+		t.Error("Init succeeded without any reachable domain")
+	}
+}
+
+func TestPrepareJitter(t *testing.T) {
+	srv := startFakeSMTP(t)
+	var slept []time.Duration
+	defer func(r func(int64) int64, s func(time.Duration)) { prepareRand, prepareSleep = r, s }(prepareRand, prepareSleep)
+	prepareRand = func(n int64) int64 { return n - 1 }
+	prepareSleep = func(d time.Duration) {
+		if len(srv.Commands()) != 0 {
+			t.Error("the jitter is not applied before the test sending")
+		}
+		slept = append(slept, d)
+	}
+
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.PrepareJitter = "30s"
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	if len(slept) != 1 || slept[0] < 0 || slept[0] >= 30*time.Second {
+		t.Errorf("slept %v, wanted once, less than 30s", slept)
+	}
+	if findCommand(srv.Commands(), "QUIT") == "" {
+		t.Errorf("Prepare has not completed: %q", srv.Commands())
+	}
+
+	slept = slept[:0]
+	conf.PrepareJitter = ""
+	if err := new(EmailOutput).Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	if len(slept) != 0 {
+		t.Errorf("slept %v without prepare_jitter", slept)
+	}
+	conf.PrepareJitter = "-1s"
+	if err := new(EmailOutput).Init(conf); err == nil || !strings.Contains(err.Error(), "prepare_jitter") {
+		t.Errorf("got %v, wanted the prepare_jitter error", err)
+	}
+}
@@ -0,0 +1,98 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// priorityHeaderLines are the header lines of the email priorities,
+// for the mail clients honouring either of them.
+var priorityHeaderLines = map[string][]string{
+	"high":   {"X-Priority: 1 (Highest)", "X-MSMail-Priority: High", "Importance: High"},
+	"normal": {"X-Priority: 3 (Normal)", "X-MSMail-Priority: Normal", "Importance: Normal"},
+	"low":    {"X-Priority: 5 (Lowest)", "X-MSMail-Priority: Low", "Importance: Low"},
+}
+
+// parsePriorityMap returns the priorities of the severities 0-7: high for
+// crit and the more severe ones, normal for warn, low for the others,
+// unless m maps the severity (as "4") to another.
+func parsePriorityMap(m map[string]string) ([]string, error) {
+	priorities := make([]string, len(severityNames))
+	for i := range priorities {
+		switch {
+		case i <= 3:
+			priorities[i] = "high"
+		case i == 4:
+			priorities[i] = "normal"
+		default:
+			priorities[i] = "low"
+		}
+	}
+	for k, v := range m {
+		severity, err := strconv.Atoi(k)
+		if err != nil || severity < 0 || severity >= len(priorities) {
+			return nil, fmt.Errorf("bad severity %q (should be 0-7)", k)
+		}
+		v = strings.ToLower(v)
+		if priorityHeaderLines[v] == nil {
+			return nil, fmt.Errorf("bad priority %q of severity %s (should be high, normal or low)", m[k], k)
+		}
+		priorities[severity] = v
+	}
+	return priorities, nil
+}
+
+// initPriorities sets the priorities of the severities, if add_priority_header.
+func (o *EmailOutput) initPriorities(conf *EmailOutputConfig) (err error) {
+	o.priorities = nil
+	if !conf.AddPriorityHeader {
+		if len(conf.PriorityMap) != 0 {
+			return errors.New("priority_map needs add_priority_header")
+		}
+		return nil
+	}
+	if o.priorities, err = parsePriorityMap(conf.PriorityMap); err != nil {
+		return fmt.Errorf("bad priority_map: %s", err)
+	}
+	return nil
+}
+
+// priorityHeaders returns the priority header lines of the severity
+// (clamped to 0-7), none without add_priority_header.
+func (o *EmailOutput) priorityHeaders(severity int32) []string {
+	if o.priorities == nil {
+		return nil
+	}
+	if severity < 0 {
+		severity = 0
+	} else if int(severity) >= len(o.priorities) {
+		severity = int32(len(o.priorities) - 1)
+	}
+	return priorityHeaderLines[o.priorities[severity]]
+}
+
+// mostSevere returns the severity of the most severe message.
+func (o *EmailOutput) mostSevere(msgs []*message.Message) int32 {
+	severity := o.severity(msgs[0])
+	for _, msg := range msgs[1:] {
+		if s := o.severity(msg); s < severity {
+			severity = s
+		}
+	}
+	return severity
+}
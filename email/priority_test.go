@@ -0,0 +1,70 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+func TestPriorityHeaders(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.AddPriorityHeader = true
+	conf.PriorityMap = map[string]string{"5": "Normal"}
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	for severity, want := range map[int32]string{
+		-1: "X-Priority: 1 (Highest)\r\nX-MSMail-Priority: High\r\nImportance: High\r\n",
+		2:  "X-Priority: 1 (Highest)\r\nX-MSMail-Priority: High\r\nImportance: High\r\n",
+		4:  "X-Priority: 3 (Normal)\r\nX-MSMail-Priority: Normal\r\nImportance: Normal\r\n",
+		5:  "X-Priority: 3 (Normal)\r\n", // mapped
+		6:  "X-Priority: 5 (Lowest)\r\nX-MSMail-Priority: Low\r\nImportance: Low\r\n",
+		9:  "X-Priority: 5 (Lowest)\r\n",
+	} {
+		email := string(o.formatMessage(newTestMessage(severity, "db-01", "the database is down")))
+		if !strings.Contains(email, "\r\n"+want) {
+			t.Errorf("%d: no %q in\n%s", severity, want, email)
+		}
+	}
+
+	// a batch gets the priority of its most severe message
+	email := string(o.formatBatch([]*message.Message{
+		newTestMessage(6, "web-01", "slow"), newTestMessage(3, "db-01", "down")}))
+	if !strings.Contains(email, "\r\nX-Priority: 1 (Highest)\r\n") {
+		t.Errorf("no high priority in\n%s", email)
+	}
+
+	conf.AddPriorityHeader, conf.PriorityMap = false, nil
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	if email := string(o.formatMessage(newTestMessage(2, "db-01", "down"))); strings.Contains(email, "Priority") {
+		t.Errorf("got priority headers without add_priority_header:\n%s", email)
+	}
+
+	for _, m := range []map[string]string{{"8": "high"}, {"crit": "high"}, {"2": "urgent"}} {
+		conf.AddPriorityHeader, conf.PriorityMap = true, m
+		if err := o.Init(conf); err == nil {
+			t.Errorf("priority_map %v accepted", m)
+		}
+	}
+	conf.AddPriorityHeader, conf.PriorityMap = false, map[string]string{"2": "high"}
+	if err := o.Init(conf); err == nil {
+		t.Error("priority_map accepted without add_priority_header")
+	}
+}
@@ -0,0 +1,104 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket is a token bucket rate limiter of capacity tokens,
+// refilled continuously at capacity per interval.
+type tokenBucket struct {
+	capacity float64
+	perToken time.Duration // the refill time of one token
+	tokens   float64
+	last     time.Time // the time of the last refill
+}
+
+// newTokenBucket returns a full bucket of n tokens per interval.
+func newTokenBucket(n int, interval time.Duration, now time.Time) *tokenBucket {
+	return &tokenBucket{capacity: float64(n), perToken: interval / time.Duration(n),
+		tokens: float64(n), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += float64(elapsed) / float64(b.perToken)
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+		b.last = now
+	}
+}
+
+// TryTake takes a token, reporting whether there was one.
+func (b *tokenBucket) TryTake(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Reserve takes a token, and returns how long to wait till it is available.
+func (b *tokenBucket) Reserve(now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens * float64(b.perToken))
+}
+
+// parseOnLimit parses on_limit: whether to drop the emails over the limit.
+func parseOnLimit(s string) (bool, error) {
+	switch s {
+	case "", "block":
+		return false, nil
+	case "drop":
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown on_limit %q (should be block or drop)", s)
+}
+
+// rateLimitResend reports whether the next queued failed email may be
+// resent, like rateLimit, but with on_limit drop the ones over the limit
+// are kept queued for a later resending, not dropped.
+func (o *EmailOutput) rateLimitResend() bool {
+	if o.limiter != nil && o.dropOverLimit {
+		return o.limiter.TryTake(time.Now())
+	}
+	return o.rateLimit()
+}
+
+// rateLimit reports whether the next email may be sent, waiting
+// for the rate limit (if any), or counting it as dropped with on_limit drop.
+func (o *EmailOutput) rateLimit() bool {
+	if o.limiter == nil {
+		return true
+	}
+	if o.dropOverLimit {
+		if o.limiter.TryTake(time.Now()) {
+			return true
+		}
+		atomic.AddInt64(&o.rateLimited, 1)
+		atomic.AddInt64(&o.dropped, 1)
+		return false
+	}
+	if wait := o.limiter.Reserve(time.Now()); wait > 0 {
+		time.Sleep(wait)
+	}
+	return true
+}
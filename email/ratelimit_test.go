@@ -0,0 +1,81 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, time.Second, now)
+	if !b.TryTake(now) || !b.TryTake(now) || b.TryTake(now) {
+		t.Fatal("wanted a burst of 2")
+	}
+	if !b.TryTake(now.Add(500 * time.Millisecond)) {
+		t.Error("no token after refilling one")
+	}
+	if wait := b.Reserve(now.Add(500 * time.Millisecond)); wait != 500*time.Millisecond {
+		t.Errorf("got wait %s, wanted 500ms", wait)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	for _, onLimit := range []string{"drop", "block"} {
+		srv := startFakeSMTP(t)
+		o := new(EmailOutput)
+		conf := o.ConfigStruct().(*EmailOutputConfig)
+		conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+		conf.MaxPerInterval, conf.Interval, conf.OnLimit = 2, "100ms", onLimit
+		if onLimit == "drop" {
+			conf.Interval = "1h"
+		}
+		if err := o.Init(conf); err != nil {
+			t.Fatal(err)
+		}
+		runner := newTestRunner()
+		for i := 1; i <= 5; i++ {
+			runner.send(newTestMessage(3, "db-01", fmt.Sprintf("db down %d", i)))
+		}
+		close(runner.inChan)
+		start := time.Now()
+		if err := o.Run(runner, testHelper{}); err != nil {
+			t.Fatal(err)
+		}
+		elapsed := time.Since(start)
+
+		report := new(message.Message)
+		o.ReportMsg(report)
+		dropped, _ := report.GetFieldValue("RateLimit.Dropped")
+		switch n := len(srv.Messages()); onLimit {
+		case "drop":
+			if n != 2 || dropped != int64(3) {
+				t.Errorf("drop: got %d emails and %v dropped, wanted 2 and 3", n, dropped)
+			}
+		case "block":
+			// the 3 emails after the burst wait 50ms each
+			if n != 5 || dropped != int64(0) || elapsed < 140*time.Millisecond {
+				t.Errorf("block: got %d emails and %v dropped in %s, wanted 5 and 0 in 150ms",
+					n, dropped, elapsed)
+			}
+		}
+	}
+
+	conf := &EmailOutputConfig{Address: "localhost", MaxPerInterval: 1, Interval: "1m", OnLimit: "queue"}
+	if err := new(EmailOutput).Init(conf); err == nil {
+		t.Error("wanted error for an unknown on_limit")
+	}
+}
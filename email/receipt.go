@@ -0,0 +1,147 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"os"
+	"strings"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// ReceiptType is the type of the messages injected after successful sends.
+const ReceiptType = "email_sent"
+
+// FailureType is the type of the self-alerts injected after failed sends.
+const FailureType = "email_delivery_failure"
+
+// injector is implemented by the runners able to inject messages
+// back into the pipeline (Heka's output runners are such).
+type injector interface {
+	Inject(pack *pipeline.PipelinePack) bool
+}
+
+// newEvent returns a new message of the given type and severity,
+// originating from this plugin.
+func (o *EmailOutput) newEvent(typ string, severity int32) *message.Message {
+	msg := new(message.Message)
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetTimestamp(time.Now().UnixNano())
+	msg.SetType(typ)
+	msg.SetSeverity(severity)
+	msg.SetPid(int32(os.Getpid()))
+	if hostname, err := os.Hostname(); err == nil {
+		msg.SetHostname(hostname)
+	}
+	if o.runner != nil {
+		msg.SetLogger(o.runner.Name())
+	}
+	return msg
+}
+
+// inject injects the message into the pipeline, logging the failures.
+func (o *EmailOutput) inject(msg *message.Message, msgLoopCount uint) {
+	inj, ok := o.runner.(injector)
+	if !ok || o.helper == nil {
+		o.logError(fmt.Errorf("cannot inject %s message: the runner does not support injection", msg.GetType()))
+		return
+	}
+	pack := o.helper.PipelinePack(msgLoopCount)
+	if pack == nil {
+		o.logError(fmt.Errorf("cannot inject %s message: no output pack - infinite loop?", msg.GetType()))
+		return
+	}
+	pack.Message = msg
+	pack.Decoded = true
+	if !inj.Inject(pack) {
+		o.logError(fmt.Errorf("cannot inject %s message %v", msg.GetType(), msg))
+	}
+}
+
+// injectReceipt injects an email_sent message with the recipients,
+// the subject and the latency of the sending.
+func (o *EmailOutput) injectReceipt(body []byte, env envelope, latency time.Duration, msgLoopCount uint) {
+	msg := o.newEvent(ReceiptType, 6)
+	subject := subjectOf(body)
+	msg.SetPayload(subject)
+	addField(msg, "recipients", strings.Join(o.visibleRecipients(env), ","), "")
+	addField(msg, "subject", subject, "")
+	addField(msg, "latency", int64(latency/time.Millisecond), "ms")
+	addField(msg, "bytes", int64(len(body)), "B")
+	o.inject(msg, msgLoopCount)
+}
+
+// injectFailure injects an email_delivery_failure message with the error,
+// the recipients, the subject and the number of consecutive failures.
+func (o *EmailOutput) injectFailure(body []byte, env envelope, err error, msgLoopCount uint) {
+	msg := o.newEvent(FailureType, 2)
+	to := strings.Join(o.visibleRecipients(env), ",")
+	msg.SetPayload(fmt.Sprintf("email delivery failing (%d times in a row) to %s: %s", o.failures, to, err))
+	addField(msg, "error", err.Error(), "")
+	addField(msg, "recipients", to, "")
+	addField(msg, "subject", subjectOf(body), "")
+	addField(msg, "consecutive_failures", int64(o.failures), "count")
+	o.inject(msg, msgLoopCount)
+}
+
+// recipients returns the recipients of the email, with the cc and bcc ones.
+func (o *EmailOutput) recipients(env envelope) []string {
+	cc, bcc := o.copies(env)
+	return mergeAddrs(o.toRecipients(env), cc, bcc)
+}
+
+// visibleRecipients returns the To and Cc recipients of the email:
+// the bcc ones are never told, not even to the pipeline.
+func (o *EmailOutput) visibleRecipients(env envelope) []string {
+	cc, _ := o.copies(env)
+	return mergeAddrs(o.toRecipients(env), cc)
+}
+
+// copies returns the cc and bcc recipients of the email.
+func (o *EmailOutput) copies(env envelope) (cc, bcc []string) {
+	if env.narrowed {
+		return env.cc, env.bcc
+	}
+	return o.Cc, o.Bcc
+}
+
+// toRecipients returns the (To) recipients of the email.
+func (o *EmailOutput) toRecipients(env envelope) []string {
+	if env.to != nil {
+		return env.to
+	}
+	return o.To
+}
+
+// subjectOf returns the (unfolded, decoded) Subject header of the email.
+func subjectOf(body []byte) string {
+	if i := bytes.Index(body, []byte("\r\n\r\n")); i >= 0 {
+		body = body[:i]
+	}
+	header := strings.Replace(strings.Replace(string(body), "\r\n ", " ", -1), "\r\n\t", "\t", -1)
+	for _, line := range strings.Split(header, "\r\n") {
+		if len(line) > 8 && strings.EqualFold(line[:8], "Subject:") {
+			subject := strings.TrimSpace(line[8:])
+			if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+				return decoded
+			}
+			return subject
+		}
+	}
+	return ""
+}
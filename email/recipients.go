@@ -0,0 +1,223 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// messageRecipients returns the recipients in the (comma-separated or
+// repeated) values of the message's field, nil if there are none.
+func messageRecipients(msg *message.Message, field string) []string {
+	var to []string
+	seen := make(map[string]bool)
+	for _, f := range msg.GetFields() {
+		if f.GetName() != field {
+			continue
+		}
+		for _, v := range f.GetValueString() {
+			for _, addr := range strings.Split(v, ",") {
+				addr = strings.TrimSpace(addr)
+				if key := strings.ToLower(addr); addr != "" && !seen[key] {
+					seen[key] = true
+					to = append(to, addr)
+				}
+			}
+		}
+	}
+	return to
+}
+
+// msgRecipients returns the recipients of the message: those in to_field
+// (in the allowed domains), or the configured ones.
+func (o *EmailOutput) msgRecipients(msg *message.Message) []string {
+	if o.toField != "" {
+		if to := o.filterAllowed(messageRecipients(msg, o.toField)); len(to) > 0 {
+			return to
+		}
+	}
+	return o.To
+}
+
+// allowed reports whether the address is in an allowed_recipient_domains domain.
+func (o *EmailOutput) allowed(addr string) bool {
+	if o.allowedDomains == nil {
+		return true
+	}
+	return o.allowedDomains[strings.ToLower(addr[strings.LastIndex(addr, "@")+1:])]
+}
+
+// filterAllowed returns the addresses in the allowed domains, logging the dropped ones.
+func (o *EmailOutput) filterAllowed(addrs []string) []string {
+	if o.allowedDomains == nil {
+		return addrs
+	}
+	allowed := addrs[:0:0]
+	for _, addr := range addrs {
+		if o.allowed(addr) {
+			allowed = append(allowed, addr)
+		} else {
+			o.logMessage(fmt.Sprintf("dropping recipient %s: its domain is not in allowed_recipient_domains", addr))
+		}
+	}
+	return allowed
+}
+
+// envelopeTo returns the envelope of the messages, with the union of their
+// recipients if they come from to_field.
+func (o *EmailOutput) envelopeTo(msgs ...*message.Message) envelope {
+	env := o.envelopeOf(msgs...)
+	if o.toField == "" {
+		return env
+	}
+	seen := make(map[string]bool)
+	for _, msg := range msgs {
+		for _, addr := range o.msgRecipients(msg) {
+			if key := strings.ToLower(addr); !seen[key] {
+				seen[key] = true
+				env.to = append(env.to, addr)
+			}
+		}
+	}
+	return env
+}
+
+// coalescedBatch is the part of a batch going to the same recipients.
+type coalescedBatch struct {
+	msgs []*message.Message
+	to   []string
+}
+
+// coalesce splits the batch per recipients: each recipient gets the messages
+// addressed to it only, in one email shared with the recipients getting
+// the very same messages. The recipients are kept in their order of appearance.
+func (o *EmailOutput) coalesce(batch []*message.Message) []coalescedBatch {
+	var order []string                 // of the recipients
+	indices := make(map[string][]int)  // the messages of the recipients
+	display := make(map[string]string) // the first seen form of the addresses
+	for i, msg := range batch {
+		for _, addr := range o.msgRecipients(msg) {
+			key := strings.ToLower(addr)
+			idx, ok := indices[key]
+			if !ok {
+				order = append(order, key)
+				display[key] = addr
+			} else if idx[len(idx)-1] == i {
+				continue
+			}
+			indices[key] = append(idx, i)
+		}
+	}
+	var parts []coalescedBatch
+	bySet := make(map[string]int) // message set -> index in parts
+	for _, key := range order {
+		set := fmt.Sprint(indices[key])
+		j, ok := bySet[set]
+		if !ok {
+			j = len(parts)
+			bySet[set] = j
+			msgs := make([]*message.Message, len(indices[key]))
+			for k, i := range indices[key] {
+				msgs[k] = batch[i]
+			}
+			parts = append(parts, coalescedBatch{msgs: msgs})
+		}
+		parts[j].to = append(parts[j].to, display[key])
+	}
+	return parts
+}
+
+// primaryFirst returns the recipients with primary_recipient first (if among them),
+// the others in their order.
+func (o *EmailOutput) primaryFirst(to []string) []string {
+	for i, addr := range to {
+		if strings.EqualFold(addr, o.primary) {
+			ordered := make([]string, 0, len(to))
+			ordered = append(ordered, addr)
+			ordered = append(ordered, to[:i]...)
+			return append(ordered, to[i+1:]...)
+		}
+	}
+	return to
+}
+
+// withRecipientHeaders prepends the To header of the recipients,
+// primary_recipient first, and the Cc header to the email.
+// The bcc recipients are in no header.
+func (o *EmailOutput) withRecipientHeaders(body []byte, to []string) []byte {
+	header := "To: " + strings.Join(o.primaryFirst(to), ", ") + "\r\n"
+	if len(o.Cc) > 0 {
+		header += "Cc: " + strings.Join(o.Cc, ", ") + "\r\n"
+	}
+	return append([]byte(header), body...)
+}
+
+// withCopies returns the recipients with the cc and bcc ones, without repetitions.
+func (o *EmailOutput) withCopies(to []string) []string {
+	return mergeAddrs(to, o.Cc, o.Bcc)
+}
+
+// mergeAddrs returns the addresses of to and the copies, without
+// (case-insensitive) repetitions; to itself if there are no copies.
+func mergeAddrs(to []string, copies ...[]string) []string {
+	n := len(to)
+	for _, addrs := range copies {
+		n += len(addrs)
+	}
+	if n == len(to) {
+		return to
+	}
+	all := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for _, addrs := range append([][]string{to}, copies...) {
+		for _, addr := range addrs {
+			if key := strings.ToLower(addr); !seen[key] {
+				seen[key] = true
+				all = append(all, addr)
+			}
+		}
+	}
+	return all
+}
+
+// addrSet returns the set of the (lower case) addresses.
+func addrSet(addrs []string) map[string]bool {
+	set := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		set[strings.ToLower(addr)] = true
+	}
+	return set
+}
+
+// narrow returns the envelope with its recipients (to, cc and bcc
+// separately) limited to the ones keep accepts.
+func (o *EmailOutput) narrow(env envelope, keep func(addr string) bool) envelope {
+	cc, bcc := o.copies(env)
+	env.to, env.cc, env.bcc = filterAddrs(o.toRecipients(env), keep), filterAddrs(cc, keep), filterAddrs(bcc, keep)
+	env.narrowed = true
+	return env
+}
+
+// filterAddrs returns the addresses keep accepts, never nil
+// (an empty env.to means no recipients, not the default ones).
+func filterAddrs(addrs []string, keep func(addr string) bool) []string {
+	kept := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if keep(addr) {
+			kept = append(kept, addr)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,205 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"net"
+	"net/mail"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+func TestAllowedRecipientDomains(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From = srv.Addr(), "heka@example.com"
+	conf.To = []string{"ops@example.com", "someone@gmail.com"}
+	conf.AllowedRecipientDomains = []string{"Example.com", "corp.example.com"}
+	if err := o.Init(conf); err == nil || !strings.Contains(err.Error(), "someone@gmail.com") {
+		t.Fatalf("got %v, wanted error for the recipient outside the allowlist", err)
+	}
+
+	conf.To, conf.ToField = []string{"ops@example.com"}, "to"
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	msg := newTestMessage(2, "db-01", "the database is down")
+	f, _ := message.NewField("to", "dba@corp.example.com, someone@gmail.com", "")
+	msg.AddField(f)
+	external := newTestMessage(2, "db-02", "the database is down, too")
+	f, _ = message.NewField("to", "someone@gmail.com", "")
+	external.AddField(f)
+	runner := newTestRunner()
+	runner.send(msg)
+	runner.send(external)
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := srv.Messages()
+	if len(msgs) != 2 {
+		t.Fatalf("got %d emails, wanted 2", len(msgs))
+	}
+	// the external recipient is dropped, and the message without
+	// allowed recipients goes to the configured ones
+	for i, want := range []string{"dba@corp.example.com", "ops@example.com"} {
+		if got := strings.Join(msgs[i].To, ","); got != want {
+			t.Errorf("%d. email went to %s, wanted %s", i+1, got, want)
+		}
+	}
+}
+
+func TestPrimaryRecipient(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From = srv.Addr(), "heka@example.com"
+	conf.To = []string{"dev@example.com", "ops@example.com", "oncall@example.com"}
+	conf.PrimaryRecipient = "OnCall@example.com"
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	runner := newTestRunner()
+	runner.send(newTestMessage(2, "db-01", "the database is down"))
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := srv.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d emails, wanted 1", len(msgs))
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(msgs[0].Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "oncall@example.com, dev@example.com, ops@example.com"
+	if got := m.Header.Get("To"); got != want {
+		t.Errorf("got To %q, wanted %q", got, want)
+	}
+	if got := strings.Join(msgs[0].To, ", "); got != strings.Join(conf.To, ", ") {
+		t.Errorf("got envelope recipients %s, wanted %s", got, conf.To)
+	}
+}
+
+func TestToFieldMX(t *testing.T) {
+	mx := startFakeSMTP(t)
+	useFakeMX(t, "localhost.", mx.Port())
+	var (
+		mu      sync.Mutex
+		lookups []string
+	)
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		lookups = append(lookups, domain)
+		return []*net.MX{{Host: "localhost.", Pref: 10}}, nil
+	}
+
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.From, conf.To, conf.ToField = "heka@example.com", []string{"ops@example.com"}, "team"
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	prepared := len(mx.Messages())
+	msg := newTestMessage(2, "db-01", "the database is down")
+	f, _ := message.NewField("team", "dba@db.example.org, dev@example.net", "")
+	msg.AddField(f)
+	f, _ = message.NewField("team", "lead@db.example.org", "")
+	msg.AddField(f)
+	runner := newTestRunner()
+	runner.send(msg)
+	runner.send(newTestMessage(2, "web-01", "the web server is down")) // without the field
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// one transaction per recipient domain, each with the MX of its domain
+	var got []string
+	for _, m := range mx.Messages()[prepared:] {
+		got = append(got, strings.Join(m.To, ","))
+	}
+	sort.Strings(got)
+	if want := "dba@db.example.org,lead@db.example.org|dev@example.net|ops@example.com"; strings.Join(got, "|") != want {
+		t.Errorf("got %q, wanted %s", got, want)
+	}
+	sort.Strings(lookups)
+	if want := "db.example.org,example.com,example.net"; strings.Join(distinct(lookups), ",") != want {
+		t.Errorf("looked up the MX of %q, wanted %s", lookups, want)
+	}
+}
+
+// distinct returns the sorted strings without the repetitions.
+func distinct(sorted []string) []string {
+	var uniq []string
+	for i, s := range sorted {
+		if i == 0 || s != sorted[i-1] {
+			uniq = append(uniq, s)
+		}
+	}
+	return uniq
+}
+
+func TestCcBcc(t *testing.T) {
+	mx := startFakeSMTP(t)
+	useFakeMX(t, "localhost.", mx.Port())
+
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.From, conf.To = "heka@example.com", []string{"ops@example.com"}
+	conf.Cc = []string{"manager@corp.example.org"}
+	conf.Bcc = []string{"audit@archive.example.net", "OPS@example.com"}
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	// the copied domains are prepared, too
+	if got := len(o.byHost); got != 3 {
+		t.Errorf("prepared %d domains (%v), wanted 3", got, o.byHost)
+	}
+	prepared := len(mx.Messages())
+	runner := newTestRunner()
+	runner.send(newTestMessage(2, "db-01", "the database is down"))
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := mx.Messages()[prepared:]
+	var rcpts []string
+	for _, m := range msgs {
+		rcpts = append(rcpts, m.To...)
+		if bytes.Contains(m.Data, []byte("audit@")) {
+			t.Errorf("the bcc recipient is in the email:\n%s", m.Data)
+		}
+		h, err := mail.ReadMessage(bytes.NewReader(m.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if to, cc := h.Header.Get("To"), h.Header.Get("Cc"); to != "ops@example.com" || cc != "manager@corp.example.org" {
+			t.Errorf("got To %q and Cc %q", to, cc)
+		}
+	}
+	sort.Strings(rcpts)
+	if got, want := strings.Join(rcpts, ","), "audit@archive.example.net,manager@corp.example.org,ops@example.com"; got != want {
+		t.Errorf("sent to %s, wanted %s", got, want)
+	}
+}
@@ -0,0 +1,120 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"fmt"
+	"net/smtp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// relay is a configured relay server.
+type relay struct {
+	addr string // host:port
+	auth smtp.Auth
+}
+
+// relayAddr returns the address with the default port added if it has none,
+// and the host part of it.
+func relayAddr(address string) (hostport, host string) {
+	if i := strings.Index(address, ":"); i >= 0 {
+		return address, address[:i]
+	}
+	return address + ":25", address
+}
+
+// newRelays returns the relays of the addresses, authenticating with
+// the mechanism (see newAuth) and credentials (if given) to each.
+func newRelays(addresses []string, mechanism, username, password string) ([]relay, error) {
+	relays := make([]relay, len(addresses))
+	for i, address := range addresses {
+		var host string
+		relays[i].addr, host = relayAddr(address)
+		if username != "" {
+			var err error
+			if relays[i].auth, err = newAuth(mechanism, username, password, host); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return relays, nil
+}
+
+// weightedRR selects the relays by smooth weighted round-robin,
+// so each relay gets its share of the sends, evenly interleaved.
+type weightedRR struct {
+	mu      sync.Mutex
+	weights []int
+	current []int
+	total   int
+}
+
+// newWeightedRR returns a selector with the given weights, which must be positive.
+func newWeightedRR(weights []int) (*weightedRR, error) {
+	w := &weightedRR{weights: weights, current: make([]int, len(weights))}
+	for i, weight := range weights {
+		if weight <= 0 {
+			return nil, fmt.Errorf("bad relay weight %d of %d. relay", weight, i+1)
+		}
+		w.total += weight
+	}
+	return w, nil
+}
+
+// Next returns the index of the next relay.
+func (w *weightedRR) Next() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	best := 0
+	for i, weight := range w.weights {
+		w.current[i] += weight
+		if w.current[i] > w.current[best] {
+			best = i
+		}
+	}
+	w.current[best] -= w.total
+	return best
+}
+
+// relayOrder returns the relays to try: the selected one (by relay_weights,
+// or the last good one) first, then the others in the configured order.
+func (o *EmailOutput) relayOrder() []relay {
+	if len(o.relays) == 0 {
+		return []relay{{addr: o.hostport, auth: o.opts.auth}}
+	}
+	var first int
+	if o.relayRR != nil {
+		first = o.relayRR.Next()
+	} else {
+		first = int(atomic.LoadInt32(&o.lastGoodRelay))
+	}
+	order := make([]relay, 0, len(o.relays))
+	order = append(order, o.relays[first])
+	order = append(order, o.relays[:first]...)
+	return append(order, o.relays[first+1:]...)
+}
+
+// relayGood remembers the relay which accepted an email, to be tried
+// first next time (without relay_weights).
+func (o *EmailOutput) relayGood(addr string) {
+	if o.relayRR != nil {
+		return
+	}
+	for i, r := range o.relays {
+		if r.addr == addr {
+			atomic.StoreInt32(&o.lastGoodRelay, int32(i))
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"testing"
+
+	"github.com/tgulacsi/heka-plugins/email/testutil"
+)
+
+func TestRelayWeights(t *testing.T) {
+	weights := []int{1, 2, 3}
+	var (
+		relays    []*testutil.FakeSMTP
+		addresses []string
+	)
+	for range weights {
+		srv := startFakeSMTP(t)
+		relays = append(relays, srv)
+		addresses = append(addresses, srv.Addr())
+	}
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.From, conf.To = "heka@example.com", []string{"ops@example.com"}
+	conf.Addresses, conf.RelayWeights = addresses, weights
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	// discount the test mail of Prepare
+	prepared := len(relays[0].Messages())
+
+	const n = 60
+	for i := 0; i < n; i++ {
+		if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err != nil {
+			t.Fatalf("%d. %v", i, err)
+		}
+	}
+	for i, srv := range relays {
+		got := len(srv.Messages())
+		if i == 0 {
+			got -= prepared
+		}
+		if want := n * weights[i] / 6; got != want {
+			t.Errorf("relay %d (weight %d) got %d emails, wanted %d", i, weights[i], got, want)
+		}
+	}
+
+	// the others take over the load of a failing relay
+	relays[2].Reply("MAIL FROM", "451 try again later")
+	before := len(relays[0].Messages()) + len(relays[1].Messages())
+	for i := 0; i < 6; i++ {
+		if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err != nil {
+			t.Fatalf("%d. %v", i, err)
+		}
+	}
+	if got := len(relays[0].Messages()) + len(relays[1].Messages()) - before; got != 6 {
+		t.Errorf("the working relays got %d emails, wanted 6", got)
+	}
+
+	conf.RelayWeights = []int{1, 2}
+	if err := new(EmailOutput).Init(conf); err == nil {
+		t.Error("mismatched relay_weights accepted")
+	}
+	conf.RelayWeights = []int{1, 0, 1}
+	if err := new(EmailOutput).Init(conf); err == nil {
+		t.Error("zero relay weight accepted")
+	}
+}
+
+func TestRelayFailover(t *testing.T) {
+	var (
+		relays    []*testutil.FakeSMTP
+		addresses []string
+	)
+	for i := 0; i < 3; i++ {
+		srv := startFakeSMTP(t)
+		relays = append(relays, srv)
+		addresses = append(addresses, srv.Addr())
+	}
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.From, conf.To = "heka@example.com", []string{"ops@example.com"}
+	conf.Addresses = addresses
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	counts := func() []int {
+		n := make([]int, len(relays))
+		for i, srv := range relays {
+			n[i] = len(srv.Messages())
+		}
+		return n
+	}
+	send := func(k int) {
+		for i := 0; i < k; i++ {
+			if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err != nil {
+				t.Fatalf("%d. %v", i, err)
+			}
+		}
+	}
+	check := func(before []int, want ...int) {
+		t.Helper()
+		for i, n := range counts() {
+			if got := n - before[i]; got != want[i] {
+				t.Errorf("relay %d got %d emails, wanted %d", i, got, want[i])
+			}
+		}
+	}
+
+	// without relay_weights, all the emails go to the first relay
+	before := counts()
+	send(3)
+	check(before, 3, 0, 0)
+
+	// after a failure, the next relay is kept even when the first recovers
+	relays[0].Reply("MAIL FROM", "451 try again later", testutil.Pass)
+	before = counts()
+	send(3)
+	check(before, 0, 3, 0)
+
+	// the failing last good relay is passed over, wrapping around in order
+	relays[1].Reply("MAIL FROM", "451 try again later")
+	relays[2].Reply("MAIL FROM", "451 try again later")
+	before = counts()
+	send(2)
+	check(before, 2, 0, 0)
+}
@@ -0,0 +1,61 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/textproto"
+	"sync/atomic"
+	"time"
+)
+
+// retryPolicy says how many times and how the failed sendings are retried.
+type retryPolicy struct {
+	count     int
+	baseDelay time.Duration
+}
+
+// Delay returns the backoff before the attempt-th retry (from 1):
+// baseDelay doubled per attempt, plus up to 50% random jitter.
+func (p retryPolicy) Delay(attempt int) time.Duration {
+	d := p.baseDelay << uint(attempt-1)
+	if d <= 0 { // overflow
+		d = p.baseDelay
+	}
+	if half := int64(d / 2); half > 0 {
+		d += time.Duration(rand.Int63n(half))
+	}
+	return d
+}
+
+// permanentError reports whether the error is a permanent (5xx) SMTP reply.
+// The other errors (connection refused, timeout, 4xx...) are transient.
+func permanentError(err error) bool {
+	var tpErr *textproto.Error
+	return errors.As(err, &tpErr) && tpErr.Code >= 500
+}
+
+// retrying calls send, retrying its transient failures
+// per retry_count and retry_base_delay.
+func (o *EmailOutput) retrying(send func() error) error {
+	err := send()
+	for attempt := 1; err != nil && attempt <= o.retry.count && !permanentError(err); attempt++ {
+		delay := o.retry.Delay(attempt)
+		o.logMessage(fmt.Sprintf("sending failed: %s; retry %d/%d in %s", err, attempt, o.retry.count, delay))
+		atomic.AddInt64(&o.retries, 1)
+		time.Sleep(delay)
+		err = send()
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgulacsi/heka-plugins/email/testutil"
+)
+
+func TestRetry(t *testing.T) {
+	p := retryPolicy{count: 3, baseDelay: 100 * time.Millisecond}
+	for attempt, base := range []time.Duration{100, 200, 400} {
+		base *= time.Millisecond
+		if d := p.Delay(attempt + 1); d < base || d >= base*3/2 {
+			t.Errorf("delay of retry %d is %s, wanted [%s, %s)", attempt+1, d, base, base*3/2)
+		}
+	}
+
+	srv := startFakeSMTP(t)
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+	conf.RetryCount, conf.RetryBaseDelay = 3, "1ms"
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	countMails := func() int {
+		var n int
+		for _, cmd := range srv.Commands() {
+			if strings.HasPrefix(strings.ToUpper(cmd), "MAIL FROM") {
+				n++
+			}
+		}
+		return n
+	}
+	body := []byte("Subject: test\r\n\r\nbody")
+
+	// transient failures are retried
+	before := countMails()
+	srv.Reply("MAIL FROM", "451 try again later", "421 too busy", testutil.Pass)
+	if err := o.sendMail(body, envelope{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := countMails() - before; n != 3 {
+		t.Errorf("got %d attempts, wanted 3", n)
+	}
+	if len(srv.Messages()) != 1 {
+		t.Errorf("got %d emails, wanted 1", len(srv.Messages()))
+	}
+
+	// permanent failures are not
+	before = countMails()
+	srv.Reply("RCPT TO", "550 no such user")
+	if err := o.sendMail(body, envelope{}); err == nil {
+		t.Fatal("sending succeeded with a rejected recipient")
+	}
+	if n := countMails() - before; n != 1 {
+		t.Errorf("got %d attempts of a permanent failure, wanted 1", n)
+	}
+}
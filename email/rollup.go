@@ -0,0 +1,125 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/tgulacsi/heka-plugins/utils"
+)
+
+// rollup collects the identical messages arriving within the window,
+// to be sent as one email.
+type rollup struct {
+	window        time.Duration
+	byFingerprint bool // the messages are identical if their fingerprint fields are
+	groups        map[string]*rollupGroup
+	bytes         int // the size of the messages of the groups
+}
+
+// rollupGroup is a group of identical messages.
+type rollupGroup struct {
+	start     time.Time // arrival of the first message
+	msgs      []*message.Message
+	loopCount uint // the maximal loop count of the messages
+	bytes     int  // the size of the messages
+}
+
+func newRollup(window time.Duration, by string) (*rollup, error) {
+	r := &rollup{window: window, groups: make(map[string]*rollupGroup)}
+	switch by {
+	case "", "subject":
+	case "fingerprint":
+		r.byFingerprint = true
+	default:
+		return nil, fmt.Errorf("unknown rollup_by %q (should be subject or fingerprint)", by)
+	}
+	return r, nil
+}
+
+// Add adds the message to the group of the identical ones.
+func (r *rollup) Add(key string, msg *message.Message, loopCount uint, now time.Time) {
+	g := r.groups[key]
+	if g == nil {
+		g = &rollupGroup{start: now}
+		r.groups[key] = g
+	}
+	g.msgs = append(g.msgs, msg)
+	n := messageSize(msg)
+	g.bytes += n
+	r.bytes += n
+	if loopCount > g.loopCount {
+		g.loopCount = loopCount
+	}
+}
+
+// Expired removes and returns the groups whose window elapsed till now
+// (or all of them, if all is true), in the order of their start.
+func (r *rollup) Expired(now time.Time, all bool) []*rollupGroup {
+	var expired []*rollupGroup
+	for key, g := range r.groups {
+		if all || now.Sub(g.start) >= r.window {
+			expired = append(expired, g)
+			delete(r.groups, key)
+			r.bytes -= g.bytes
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].start.Before(expired[j].start) })
+	return expired
+}
+
+// rollupKey returns the key of the message: the messages with the same key
+// are identical. The key is the fingerprint field, or (without one) the
+// subject, without the timestamp and the hostname.
+func (o *EmailOutput) rollupKey(msg *message.Message) string {
+	if o.rollup.byFingerprint {
+		if fp, ok := msg.GetFieldValue("fingerprint"); ok {
+			return fmt.Sprintf("fp:%v", fp)
+		}
+	}
+	return fmt.Sprintf("%d %s %s", o.severity(msg), msg.GetLogger(), o.subjectPayload(o.payload(msg)))
+}
+
+// formatRollup returns the email for the identical messages: the subject is
+// that of the first message with the count, the body is the first payload
+// with the distinct timestamps and hosts of the occurrences.
+func (o *EmailOutput) formatRollup(msgs []*message.Message) []byte {
+	suppressed := suppressedBefore(msgs...)
+	if len(msgs) == 1 {
+		if suppressed > 0 {
+			return withSubjectSuffix(o.formatMessage(msgs[0]), duplicatesNote(suppressed))
+		}
+		return o.formatMessage(msgs[0])
+	}
+	first := msgs[0]
+	subject := fmt.Sprintf("%s (x%d)%s", o.subject(first), len(msgs), duplicatesNote(suppressed))
+	payload := o.payload(first)
+	text := bytes.NewBuffer(make([]byte, 0, len(payload)+64*len(msgs)))
+	text.WriteString(payload)
+	fmt.Fprintf(text, "\r\n\r\nOccurrences (%d):\r\n", len(msgs))
+	seen := make(map[string]bool, len(msgs))
+	for _, msg := range msgs {
+		line := utils.TsTime(msg.GetTimestamp()).Format(time.RFC3339) + " " + msg.GetHostname()
+		if seen[line] {
+			continue
+		}
+		seen[line] = true
+		text.WriteString(line)
+		text.WriteString("\r\n")
+	}
+	headers := append(o.threadHeaders(first), o.priorityHeaders(o.mostSevere(msgs))...)
+	return o.email(subject, text.String(), headers...)
+}
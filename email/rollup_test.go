@@ -0,0 +1,84 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRollup(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"}, hostport: srv.Addr()}
+	var err error
+	if o.rollup, err = newRollup(time.Hour, "subject"); err != nil {
+		t.Fatal(err)
+	}
+	runner := newTestRunner()
+	runner.send(newTestMessage(3, "web-01", "disk full"))
+	runner.send(newTestMessage(3, "web-01", "disk full"))
+	runner.send(newTestMessage(3, "web-02", "disk full"))
+	runner.send(newTestMessage(4, "web-02", "disk almost full"))
+	close(runner.inChan)
+	if err = o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+	msgs := srv.Messages()
+	if len(msgs) != 2 {
+		t.Fatalf("got %d emails, wanted 2", len(msgs))
+	}
+	data := string(msgs[0].Data)
+	if subject := subjectOf(msgs[0].Data); subject != "2013-11-12T13:14:15Z [3] test@web-01: disk full (x3)" {
+		t.Errorf("got subject %q", subject)
+	}
+	want := "\r\n\r\ndisk full\r\n\r\nOccurrences (3):\r\n" +
+		"2013-11-12T13:14:15Z web-01\r\n2013-11-12T13:14:15Z web-02\r\n"
+	if !strings.HasSuffix(data, want) {
+		t.Errorf("got %q, wanted it to end with %q", data, want)
+	}
+	if subject := subjectOf(msgs[1].Data); strings.Contains(subject, "(x") {
+		t.Errorf("single message got a count: %q", subject)
+	}
+}
+
+func TestRollupWindow(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"}, hostport: srv.Addr()}
+	var err error
+	if o.rollup, err = newRollup(50*time.Millisecond, "fingerprint"); err != nil {
+		t.Fatal(err)
+	}
+	runner := newTestRunner()
+	done := make(chan error, 1)
+	go func() { done <- o.Run(runner, testHelper{}) }()
+	for _, payload := range []string{"disk full on /", "disk full on /var"} {
+		msg := newTestMessage(3, "web-01", payload)
+		addField(msg, "fingerprint", "disk-full", "")
+		runner.send(msg)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(srv.Messages()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(runner.inChan)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	msgs := srv.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d emails, wanted 1", len(msgs))
+	}
+	if subject := subjectOf(msgs[0].Data); !strings.HasSuffix(subject, "disk full on / (x2)") {
+		t.Errorf("got subject %q", subject)
+	}
+}
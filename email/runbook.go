@@ -0,0 +1,66 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// runbook is a remediation snippet (or URL) of the payloads matching re.
+type runbook struct {
+	re      *regexp.Regexp
+	snippet string
+}
+
+// parseRunbooks compiles the pattern -> snippet map, ordering the runbooks
+// by their patterns.
+func parseRunbooks(conf map[string]string) ([]runbook, error) {
+	patterns := make([]string, 0, len(conf))
+	for pattern := range conf {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	runbooks := make([]runbook, len(patterns))
+	for i, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad runbooks pattern %q: %s", pattern, err)
+		}
+		runbooks[i] = runbook{re: re, snippet: conf[pattern]}
+	}
+	return runbooks, nil
+}
+
+// runbookText returns the "Runbook:" section of the payload,
+// listing the snippets of the matching runbooks; "" if none matches.
+func (o *EmailOutput) runbookText(payload string) string {
+	var snippets []string
+	for _, rb := range o.runbooks {
+		if !rb.re.MatchString(payload) {
+			continue
+		}
+		dup := false
+		for _, s := range snippets {
+			dup = dup || s == rb.snippet
+		}
+		if !dup {
+			snippets = append(snippets, rb.snippet)
+		}
+	}
+	if len(snippets) == 0 {
+		return ""
+	}
+	return "Runbook:\r\n" + strings.Join(snippets, "\r\n") + "\r\n"
+}
@@ -0,0 +1,56 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+func TestRunbooks(t *testing.T) {
+	o := new(EmailOutput)
+	conf := o.ConfigStruct().(*EmailOutputConfig)
+	conf.Runbooks = map[string]string{
+		`(?i)disk (full|space)`: "Clean /var/log: https://wiki.example.com/runbooks/disk",
+		`ORA-\d+`:               "Page the DBA on call.",
+	}
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		payload, want string
+	}{
+		{"Disk full on /var", "\r\n\r\nRunbook:\r\nClean /var/log: https://wiki.example.com/runbooks/disk\r\n"},
+		{"ORA-00600 internal error", "\r\n\r\nRunbook:\r\nPage the DBA on call.\r\n"},
+		{"500 on /login", ""},
+	} {
+		email := string(o.formatMessage(newTestMessage(3, "web-01", tc.payload)))
+		if body := email[strings.Index(email, "\r\n\r\n")+4:]; body != tc.payload+tc.want {
+			t.Errorf("%s: got body %q, wanted %q", tc.payload, body, tc.payload+tc.want)
+		}
+	}
+
+	batch := string(o.formatBatch([]*message.Message{
+		newTestMessage(3, "db-01", "ORA-01555 snapshot too old"),
+		newTestMessage(3, "web-01", "500 on /login"),
+	}))
+	if strings.Count(batch, "Runbook:") != 1 || !strings.Contains(batch, "too old\r\nRunbook:\r\nPage the DBA on call.\r\n") {
+		t.Errorf("got batch %q", batch)
+	}
+
+	conf.Runbooks = map[string]string{"(": "never"}
+	if err := new(EmailOutput).Init(conf); err == nil {
+		t.Error("wanted error for a bad pattern")
+	}
+}
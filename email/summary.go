@@ -0,0 +1,148 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/tgulacsi/heka-plugins/utils"
+)
+
+const (
+	// summarySamples is the maximal number of sample payloads per entry
+	summarySamples = 3
+	// summarySampleLen is the maximal length of a sample payload, in bytes
+	summarySampleLen = 200
+)
+
+// summary collects the messages of the digest interval by their logger and
+// severity, to be sent as one summarized email.
+type summary struct {
+	interval  time.Duration
+	sendEmpty bool // send the digest of an interval without messages, too
+	start     time.Time
+	entries   map[summaryKey]*summaryEntry
+	loopCount uint // the maximal loop count of the messages
+}
+
+type summaryKey struct {
+	logger   string
+	severity int32
+}
+
+// summaryEntry counts the messages of a logger with a severity.
+type summaryEntry struct {
+	summaryKey
+	count       int
+	suppressed  int       // the duplicates suppressed before the messages
+	first, last time.Time // the timestamps of the messages
+	samples     []string  // the first distinct payloads
+}
+
+func newSummary(interval time.Duration, sendEmpty bool) *summary {
+	return &summary{interval: interval, sendEmpty: sendEmpty, start: time.Now(),
+		entries: make(map[summaryKey]*summaryEntry)}
+}
+
+// Add counts the message with the severity (and its duplicates suppressed
+// before it), sampling its payload.
+func (s *summary) Add(msg *message.Message, severity int32, payload string, suppressed int, loopCount uint) {
+	key := summaryKey{logger: msg.GetLogger(), severity: severity}
+	ts := utils.TsTime(msg.GetTimestamp())
+	e := s.entries[key]
+	if e == nil {
+		e = &summaryEntry{summaryKey: key, first: ts, last: ts}
+		s.entries[key] = e
+	}
+	e.count++
+	e.suppressed += suppressed
+	if ts.Before(e.first) {
+		e.first = ts
+	}
+	if ts.After(e.last) {
+		e.last = ts
+	}
+	if len(e.samples) < summarySamples {
+		payload = strings.Join(strings.Fields(payload), " ")
+		if cut, truncated := cutPayload(payload, summarySampleLen); truncated {
+			payload = cut + "…"
+		}
+		seen := false
+		for _, sample := range e.samples {
+			if seen = sample == payload; seen {
+				break
+			}
+		}
+		if !seen {
+			e.samples = append(e.samples, payload)
+		}
+	}
+	if loopCount > s.loopCount {
+		s.loopCount = loopCount
+	}
+}
+
+// Take returns the entries (the most severe first) collected since the
+// start of the interval, and clears the summary for the next interval, which
+// starts now.
+func (s *summary) Take(now time.Time) (entries []*summaryEntry, start time.Time, loopCount uint) {
+	entries = make([]*summaryEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].severity != entries[j].severity {
+			return entries[i].severity < entries[j].severity
+		}
+		return entries[i].logger < entries[j].logger
+	})
+	start, loopCount = s.start, s.loopCount
+	s.start, s.loopCount = now, 0
+	s.entries = make(map[summaryKey]*summaryEntry, len(entries))
+	return entries, start, loopCount
+}
+
+// formatSummary returns the digest email of the entries collected
+// from start till end.
+func (o *EmailOutput) formatSummary(entries []*summaryEntry, start, end time.Time) []byte {
+	var total int
+	for _, e := range entries {
+		total += e.count
+	}
+	noun := "messages"
+	if total == 1 {
+		noun = "message"
+	}
+	period := start.UTC().Format(time.RFC3339) + " - " + end.UTC().Format(time.RFC3339)
+	subject := fmt.Sprintf("Digest: %d %s, %s", total, noun, period)
+	if total == 0 {
+		subject = "Digest: no messages, " + period
+	}
+	text := bytes.NewBuffer(make([]byte, 0, 256*len(entries)+64))
+	fmt.Fprintf(text, "%d %s from %s\r\n", total, noun, period)
+	for _, e := range entries {
+		fmt.Fprintf(text, "\r\n%d %s from %s (first %s, last %s)%s\r\n", e.count, severityName(e.severity),
+			e.logger, e.first.UTC().Format(time.RFC3339), e.last.UTC().Format(time.RFC3339),
+			duplicatesNote(e.suppressed))
+		for _, sample := range e.samples {
+			text.WriteString("    ")
+			text.WriteString(sample)
+			text.WriteString("\r\n")
+		}
+	}
+	return o.email(subject, text.String())
+}
@@ -0,0 +1,77 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDigestInterval(t *testing.T) {
+	srv := startFakeSMTP(t)
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"}, hostport: srv.Addr(),
+		summary: newSummary(time.Hour, true)}
+	runner := newTestRunner()
+	late := newTestMessage(2, "db-02", "database is down")
+	late.SetTimestamp(late.GetTimestamp() + int64(time.Minute))
+	runner.send(newTestMessage(4, "web-01", "disk almost full"))
+	runner.send(newTestMessage(2, "db-01", "database is down"))
+	runner.send(late)
+	runner.send(newTestMessage(2, "db-01", "replication   lag"))
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{}); err != nil {
+		t.Fatal(err)
+	}
+	msgs := srv.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d emails, wanted one digest", len(msgs))
+	}
+	if subject := subjectOf(msgs[0].Data); !strings.HasPrefix(subject, "Digest: 4 messages, ") {
+		t.Errorf("got subject %q", subject)
+	}
+	want := "\r\n\r\n3 crit from test (first 2013-11-12T13:14:15Z, last 2013-11-12T13:15:15Z)\r\n" +
+		"    database is down\r\n    replication lag\r\n" +
+		"\r\n1 warn from test (first 2013-11-12T13:14:15Z, last 2013-11-12T13:14:15Z)\r\n" +
+		"    disk almost full\r\n"
+	if data := string(msgs[0].Data); !strings.HasSuffix(data, want) {
+		t.Errorf("got %q, wanted it to end with %q", data, want)
+	}
+}
+
+func TestDigestSendEmpty(t *testing.T) {
+	for _, sendEmpty := range []bool{false, true} {
+		srv := startFakeSMTP(t)
+		o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com"}, hostport: srv.Addr(),
+			summary: newSummary(20*time.Millisecond, sendEmpty)}
+		runner := newTestRunner()
+		done := make(chan error, 1)
+		go func() { done <- o.Run(runner, testHelper{}) }()
+		time.Sleep(100 * time.Millisecond)
+		close(runner.inChan)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		msgs := srv.Messages()
+		if !sendEmpty && len(msgs) != 0 {
+			t.Errorf("got %d empty digests", len(msgs))
+		}
+		if sendEmpty && (len(msgs) == 0 || !strings.HasPrefix(subjectOf(msgs[0].Data), "Digest: no messages, ")) {
+			t.Errorf("got %d emails, wanted empty digests", len(msgs))
+		}
+	}
+
+	conf := &EmailOutputConfig{Address: "localhost", DigestInterval: "-1m"}
+	if err := new(EmailOutput).Init(conf); err == nil || !strings.Contains(err.Error(), "digest_interval") {
+		t.Errorf("got %v, wanted the digest_interval error", err)
+	}
+}
@@ -0,0 +1,422 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package testutil
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MailboxMessage is a message stored in a mailbox of FakeIMAP or FakePOP3.
+type MailboxMessage struct {
+	UID     uint32
+	Data    []byte
+	Seen    bool
+	Deleted bool
+}
+
+// FakeIMAP is an IMAP4rev1 server listening on the loopback interface,
+// serving in-memory mailboxes. It knows only the commands needed for
+// polling a folder: CAPABILITY, NOOP, LOGOUT, STARTTLS, LOGIN, SELECT,
+// EXPUNGE and the UID variants of SEARCH (ALL, UNSEEN, UNDELETED),
+// FETCH (BODY[] and BODY.PEEK[]) and STORE (the \Seen and \Deleted flags).
+//
+// The exported fields must be set before Start.
+type FakeIMAP struct {
+	// Users are the accepted username -> password pairs for LOGIN.
+	// Any credentials are accepted if empty.
+	Users map[string]string
+	// StartTLS advertises and allows STARTTLS; LOGIN is disabled before it.
+	StartTLS bool
+	// TLSConfig is used by STARTTLS. NewFakeIMAP sets it to use a
+	// self-signed certificate for localhost and 127.0.0.1, see CertPool.
+	TLSConfig *tls.Config
+	// ImplicitTLS makes the server speak TLS from the start (IMAPS),
+	// with TLSConfig.
+	ImplicitTLS bool
+
+	ln       net.Listener
+	certPool *x509.CertPool
+
+	mu        sync.Mutex
+	commands  []string
+	mailboxes map[string][]*MailboxMessage
+	nextUID   uint32
+}
+
+// NewFakeIMAP returns a new, not yet started FakeIMAP with an empty INBOX.
+func NewFakeIMAP() *FakeIMAP {
+	s := &FakeIMAP{mailboxes: map[string][]*MailboxMessage{"INBOX": nil}, nextUID: 1}
+	s.TLSConfig, s.certPool = selfSigned()
+	return s
+}
+
+// Add appends the message to the mailbox (creating it if needed),
+// returning its UID.
+func (s *FakeIMAP) Add(mailbox string, data []byte) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uid := s.nextUID
+	s.nextUID++
+	s.mailboxes[mailbox] = append(s.mailboxes[mailbox], &MailboxMessage{UID: uid, Data: data})
+	return uid
+}
+
+// Mailbox returns the messages of the mailbox, with their current flags.
+func (s *FakeIMAP) Mailbox(mailbox string) []MailboxMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := make([]MailboxMessage, 0, len(s.mailboxes[mailbox]))
+	for _, m := range s.mailboxes[mailbox] {
+		msgs = append(msgs, *m)
+	}
+	return msgs
+}
+
+// Start starts listening on a random loopback port.
+func (s *FakeIMAP) Start() error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// Close stops the server.
+func (s *FakeIMAP) Close() error {
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Close()
+}
+
+// Addr returns the host:port the server listens on.
+func (s *FakeIMAP) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// CertPool returns a pool containing the certificate of the default TLSConfig.
+func (s *FakeIMAP) CertPool() *x509.CertPool {
+	return s.certPool
+}
+
+// Commands returns all the command lines received so far (in all sessions),
+// without their tags.
+func (s *FakeIMAP) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+type imapSession struct {
+	*FakeIMAP
+	conn     net.Conn
+	rw       *bufio.ReadWriter
+	tls      bool
+	user     string
+	selected string
+}
+
+func (s *FakeIMAP) serve(conn net.Conn) {
+	ss := &imapSession{FakeIMAP: s, conn: conn}
+	defer func() { ss.conn.Close() }()
+	if s.ImplicitTLS {
+		tc := tls.Server(conn, s.TLSConfig)
+		if err := tc.Handshake(); err != nil {
+			return
+		}
+		ss.conn, ss.tls = tc, true
+	}
+	ss.rw = bufio.NewReadWriter(bufio.NewReader(ss.conn), bufio.NewWriter(ss.conn))
+	ss.reply("* OK fake IMAP ready")
+	for {
+		line, err := ss.rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		tag, cmd := line, ""
+		if i := strings.IndexByte(line, ' '); i > 0 {
+			tag, cmd = line[:i], line[i+1:]
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		s.mu.Unlock()
+		if !ss.handle(tag, cmd) {
+			return
+		}
+	}
+}
+
+func (ss *imapSession) reply(lines ...string) {
+	for _, line := range lines {
+		ss.rw.WriteString(line)
+		ss.rw.WriteString("\r\n")
+	}
+	ss.rw.Flush()
+}
+
+// handle handles the command, reporting whether the session goes on.
+func (ss *imapSession) handle(tag, cmd string) bool {
+	args := imapArgs(cmd)
+	if len(args) == 0 {
+		ss.reply(tag + " BAD empty command")
+		return true
+	}
+	name := strings.ToUpper(args[0])
+	if name == "UID" && len(args) > 1 {
+		name += " " + strings.ToUpper(args[1])
+		args = args[1:]
+	}
+	switch name {
+	case "CAPABILITY":
+		caps := "* CAPABILITY IMAP4rev1"
+		if ss.StartTLS && !ss.tls {
+			caps += " STARTTLS LOGINDISABLED"
+		}
+		ss.reply(caps, tag+" OK CAPABILITY completed")
+	case "NOOP":
+		ss.reply(tag + " OK NOOP completed")
+	case "LOGOUT":
+		ss.reply("* BYE logging out", tag+" OK LOGOUT completed")
+		return false
+	case "STARTTLS":
+		if !ss.StartTLS || ss.tls {
+			ss.reply(tag + " BAD STARTTLS not available")
+			return true
+		}
+		ss.reply(tag + " OK begin TLS negotiation")
+		tc := tls.Server(ss.conn, ss.TLSConfig)
+		if err := tc.Handshake(); err != nil {
+			return false
+		}
+		ss.conn, ss.tls = tc, true
+		ss.rw = bufio.NewReadWriter(bufio.NewReader(tc), bufio.NewWriter(tc))
+	case "LOGIN":
+		switch {
+		case ss.StartTLS && !ss.tls:
+			ss.reply(tag + " NO LOGIN disabled before STARTTLS")
+		case len(args) != 3:
+			ss.reply(tag + " BAD LOGIN needs a username and a password")
+		case len(ss.Users) > 0 && ss.Users[args[1]] != args[2]:
+			ss.reply(tag + " NO [AUTHENTICATIONFAILED] invalid credentials")
+		default:
+			ss.user = args[1]
+			ss.reply(tag + " OK LOGIN completed")
+		}
+	case "SELECT":
+		if !ss.authenticated(tag) {
+			return true
+		}
+		if len(args) != 2 {
+			ss.reply(tag + " BAD SELECT needs a mailbox")
+			return true
+		}
+		ss.mu.Lock()
+		msgs, ok := ss.mailboxes[args[1]]
+		ss.mu.Unlock()
+		if !ok {
+			ss.reply(tag + " NO no such mailbox")
+			return true
+		}
+		ss.selected = args[1]
+		ss.reply(fmt.Sprintf("* %d EXISTS", len(msgs)), "* FLAGS (\\Seen \\Deleted)",
+			tag+" OK [READ-WRITE] SELECT completed")
+	case "UID SEARCH":
+		if !ss.isSelected(tag) {
+			return true
+		}
+		var uids []string
+		ss.mu.Lock()
+		for _, m := range ss.mailboxes[ss.selected] {
+			if imapMatches(m, args[1:]) {
+				uids = append(uids, strconv.FormatUint(uint64(m.UID), 10))
+			}
+		}
+		ss.mu.Unlock()
+		ss.reply(strings.TrimSpace("* SEARCH "+strings.Join(uids, " ")), tag+" OK SEARCH completed")
+	case "UID FETCH":
+		if !ss.isSelected(tag) {
+			return true
+		}
+		if len(args) < 3 {
+			ss.reply(tag + " BAD FETCH needs a UID set and items")
+			return true
+		}
+		peek := strings.Contains(strings.ToUpper(strings.Join(args[2:], " ")), "BODY.PEEK[]")
+		ss.mu.Lock()
+		for i, m := range ss.mailboxes[ss.selected] {
+			if !inUIDSet(m.UID, args[1]) {
+				continue
+			}
+			if !peek {
+				m.Seen = true
+			}
+			fmt.Fprintf(ss.rw, "* %d FETCH (UID %d BODY[] {%d}\r\n", i+1, m.UID, len(m.Data))
+			ss.rw.Write(m.Data)
+			ss.rw.WriteString(")\r\n")
+		}
+		ss.mu.Unlock()
+		ss.reply(tag + " OK FETCH completed")
+	case "UID STORE":
+		if !ss.isSelected(tag) {
+			return true
+		}
+		if len(args) < 4 {
+			ss.reply(tag + " BAD STORE needs a UID set, an item and flags")
+			return true
+		}
+		add := strings.HasPrefix(args[2], "+")
+		flags := strings.ToUpper(strings.Join(args[3:], " "))
+		ss.mu.Lock()
+		for _, m := range ss.mailboxes[ss.selected] {
+			if !inUIDSet(m.UID, args[1]) {
+				continue
+			}
+			if strings.Contains(flags, `\SEEN`) {
+				m.Seen = add
+			}
+			if strings.Contains(flags, `\DELETED`) {
+				m.Deleted = add
+			}
+		}
+		ss.mu.Unlock()
+		ss.reply(tag + " OK STORE completed")
+	case "EXPUNGE":
+		if !ss.isSelected(tag) {
+			return true
+		}
+		var expunged []string
+		ss.mu.Lock()
+		var kept []*MailboxMessage
+		for i, m := range ss.mailboxes[ss.selected] {
+			if m.Deleted {
+				expunged = append(expunged, fmt.Sprintf("* %d EXPUNGE", i+1-len(expunged)))
+			} else {
+				kept = append(kept, m)
+			}
+		}
+		ss.mailboxes[ss.selected] = kept
+		ss.mu.Unlock()
+		ss.reply(append(expunged, tag+" OK EXPUNGE completed")...)
+	default:
+		ss.reply(tag + " BAD unknown command")
+	}
+	return true
+}
+
+func (ss *imapSession) authenticated(tag string) bool {
+	if ss.user == "" {
+		ss.reply(tag + " NO not authenticated")
+		return false
+	}
+	return true
+}
+
+func (ss *imapSession) isSelected(tag string) bool {
+	if !ss.authenticated(tag) {
+		return false
+	}
+	if ss.selected == "" {
+		ss.reply(tag + " NO no mailbox selected")
+		return false
+	}
+	return true
+}
+
+// imapArgs splits the command into its atoms and (unquoted) quoted strings.
+func imapArgs(cmd string) []string {
+	var args []string
+	for cmd = strings.TrimSpace(cmd); cmd != ""; cmd = strings.TrimSpace(cmd) {
+		if cmd[0] != '"' {
+			i := strings.IndexByte(cmd, ' ')
+			if i < 0 {
+				i = len(cmd)
+			}
+			args = append(args, cmd[:i])
+			cmd = cmd[i:]
+			continue
+		}
+		var b strings.Builder
+		i := 1
+		for ; i < len(cmd) && cmd[i] != '"'; i++ {
+			if cmd[i] == '\\' && i+1 < len(cmd) {
+				i++
+			}
+			b.WriteByte(cmd[i])
+		}
+		args = append(args, b.String())
+		cmd = cmd[min(i+1, len(cmd)):]
+	}
+	return args
+}
+
+// imapMatches reports whether the message matches the search keys.
+func imapMatches(m *MailboxMessage, keys []string) bool {
+	for _, key := range keys {
+		switch strings.ToUpper(key) {
+		case "UNSEEN":
+			if m.Seen {
+				return false
+			}
+		case "UNDELETED":
+			if m.Deleted {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// inUIDSet reports whether the uid is in the set (e.g. "1,3:5,7:*").
+func inUIDSet(uid uint32, set string) bool {
+	for _, part := range strings.Split(set, ",") {
+		lo, hi := part, part
+		if i := strings.IndexByte(part, ':'); i >= 0 {
+			lo, hi = part[:i], part[i+1:]
+		}
+		bounds := make([]uint64, 0, 2)
+		for _, s := range []string{lo, hi} {
+			if s == "*" {
+				bounds = append(bounds, 1<<32-1)
+				continue
+			}
+			n, err := strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				return false
+			}
+			bounds = append(bounds, n)
+		}
+		sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+		if uint64(uid) >= bounds[0] && uint64(uid) <= bounds[1] {
+			return true
+		}
+	}
+	return false
+}
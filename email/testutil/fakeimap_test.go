@@ -0,0 +1,102 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package testutil
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestFakeIMAP(t *testing.T) {
+	srv := NewFakeIMAP()
+	srv.Users = map[string]string{"user": `pa"ss`}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Add("INBOX", []byte("Subject: one\r\n\r\nfirst\r\n"))
+	srv.Add("INBOX", []byte("Subject: two\r\n\r\nsecond\r\n"))
+
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	// cmd sends the command, returning the responses till the tagged one
+	cmd := func(line string) string {
+		if _, err := io.WriteString(conn, "t "+line+"\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		var resp []string
+		for {
+			l, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp = append(resp, l)
+			if strings.HasPrefix(l, "t ") {
+				return strings.Join(resp, "")
+			}
+		}
+	}
+	if greeting, _ := r.ReadString('\n'); !strings.HasPrefix(greeting, "* OK") {
+		t.Fatalf("got greeting %q", greeting)
+	}
+	for _, tc := range []struct{ cmd, want string }{
+		{"SELECT INBOX", "t NO not authenticated"},
+		{`LOGIN user "pass"`, "t NO [AUTHENTICATIONFAILED]"},
+		{`LOGIN user "pa\"ss"`, "t OK"},
+		{"SELECT INBOX", "* 2 EXISTS"},
+		{"UID SEARCH UNSEEN", "* SEARCH 1 2\r\n"},
+		{"UID FETCH 2 (UID BODY.PEEK[])", "* 2 FETCH (UID 2 BODY[] {24}\r\nSubject: two\r\n\r\nsecond\r\n)\r\n"},
+		{"UID SEARCH UNSEEN", "* SEARCH 1 2\r\n"},
+		{"UID FETCH 1:1 (UID BODY[])", "* 1 FETCH (UID 1 BODY[] {23}\r\n"},
+		{"UID SEARCH UNSEEN", "* SEARCH 2\r\n"},
+		{`UID STORE 2 +FLAGS.SILENT (\Deleted)`, "t OK"},
+		{"EXPUNGE", "* 2 EXPUNGE\r\n"},
+		{"UID SEARCH ALL", "* SEARCH 1\r\n"},
+	} {
+		if got := cmd(tc.cmd); !strings.Contains(got, tc.want) {
+			t.Errorf("%s: got %q, wanted %q", tc.cmd, got, tc.want)
+		}
+	}
+	if msgs := srv.Mailbox("INBOX"); len(msgs) != 1 || !msgs[0].Seen {
+		t.Errorf("got %+v, wanted the first message, seen", msgs)
+	}
+}
+
+func TestFakeIMAPStartTLS(t *testing.T) {
+	srv := NewFakeIMAP()
+	srv.StartTLS = true
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	r.ReadString('\n')
+	io.WriteString(conn, "a LOGIN user pass\r\n")
+	if resp, _ := r.ReadString('\n'); !strings.HasPrefix(resp, "a NO") {
+		t.Errorf("LOGIN before STARTTLS got %q", resp)
+	}
+	if cmds := srv.Commands(); len(cmds) != 1 || cmds[0] != "LOGIN user pass" {
+		t.Errorf("got commands %q", cmds)
+	}
+}
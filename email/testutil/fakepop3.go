@@ -0,0 +1,330 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package testutil
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FakePOP3 is a POP3 (RFC 1939) server listening on the loopback interface,
+// serving an in-memory mailbox. It knows CAPA, STLS, USER, PASS, STAT,
+// UIDL, RETR, DELE, RSET, NOOP and QUIT; the messages marked deleted
+// are removed at QUIT.
+//
+// The exported fields must be set before Start.
+type FakePOP3 struct {
+	// Users are the accepted username -> password pairs for USER and PASS.
+	// Any credentials are accepted if empty.
+	Users map[string]string
+	// StartTLS advertises and allows STLS; USER is refused before it.
+	StartTLS bool
+	// TLSConfig is used by STLS. NewFakePOP3 sets it to use a
+	// self-signed certificate for localhost and 127.0.0.1, see CertPool.
+	TLSConfig *tls.Config
+	// ImplicitTLS makes the server speak TLS from the start (POP3S),
+	// with TLSConfig.
+	ImplicitTLS bool
+
+	ln       net.Listener
+	certPool *x509.CertPool
+
+	mu       sync.Mutex
+	commands []string
+	messages []*MailboxMessage
+	nextUID  uint32
+}
+
+// NewFakePOP3 returns a new, not yet started FakePOP3 with an empty mailbox.
+func NewFakePOP3() *FakePOP3 {
+	s := &FakePOP3{nextUID: 1}
+	s.TLSConfig, s.certPool = selfSigned()
+	return s
+}
+
+// Add appends the message to the mailbox, returning its UIDL.
+func (s *FakePOP3) Add(data []byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uid := s.nextUID
+	s.nextUID++
+	s.messages = append(s.messages, &MailboxMessage{UID: uid, Data: data})
+	return pop3UIDL(uid)
+}
+
+// Remove removes the message with the UIDL from the mailbox
+// (as another client would do).
+func (s *FakePOP3) Remove(uidl string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, m := range s.messages {
+		if pop3UIDL(m.UID) == uidl {
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+			return
+		}
+	}
+}
+
+// Mailbox returns the messages of the mailbox.
+func (s *FakePOP3) Mailbox() []MailboxMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := make([]MailboxMessage, 0, len(s.messages))
+	for _, m := range s.messages {
+		msgs = append(msgs, *m)
+	}
+	return msgs
+}
+
+func pop3UIDL(uid uint32) string {
+	return "uidl-" + strconv.FormatUint(uint64(uid), 10)
+}
+
+// Start starts listening on a random loopback port.
+func (s *FakePOP3) Start() error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// Close stops the server.
+func (s *FakePOP3) Close() error {
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Close()
+}
+
+// Addr returns the host:port the server listens on.
+func (s *FakePOP3) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// CertPool returns a pool containing the certificate of the default TLSConfig.
+func (s *FakePOP3) CertPool() *x509.CertPool {
+	return s.certPool
+}
+
+// Commands returns all the command lines received so far (in all sessions),
+// with the password of PASS masked.
+func (s *FakePOP3) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+type pop3Session struct {
+	*FakePOP3
+	conn    net.Conn
+	rw      *bufio.ReadWriter
+	tls     bool
+	user    string
+	authed  bool
+	deleted map[uint32]bool
+	// the messages of the session, numbered from 1
+	msgs []*MailboxMessage
+}
+
+func (s *FakePOP3) serve(conn net.Conn) {
+	ss := &pop3Session{FakePOP3: s, conn: conn, deleted: make(map[uint32]bool)}
+	defer func() { ss.conn.Close() }()
+	if s.ImplicitTLS {
+		tc := tls.Server(conn, s.TLSConfig)
+		if err := tc.Handshake(); err != nil {
+			return
+		}
+		ss.conn, ss.tls = tc, true
+	}
+	ss.rw = bufio.NewReadWriter(bufio.NewReader(ss.conn), bufio.NewWriter(ss.conn))
+	ss.reply("+OK fake POP3 ready")
+	for {
+		line, err := ss.rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		logged := line
+		if strings.HasPrefix(strings.ToUpper(line), "PASS ") {
+			logged = "PASS ***"
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, logged)
+		s.mu.Unlock()
+		if !ss.handle(line) {
+			return
+		}
+	}
+}
+
+func (ss *pop3Session) reply(lines ...string) {
+	for _, line := range lines {
+		ss.rw.WriteString(line)
+		ss.rw.WriteString("\r\n")
+	}
+	ss.rw.Flush()
+}
+
+// handle handles the command line, reporting whether the session goes on.
+func (ss *pop3Session) handle(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		ss.reply("-ERR empty command")
+		return true
+	}
+	cmd, args := strings.ToUpper(fields[0]), fields[1:]
+	switch cmd {
+	case "CAPA":
+		caps := []string{"+OK capabilities follow", "USER", "UIDL"}
+		if ss.StartTLS && !ss.tls {
+			caps = append(caps, "STLS")
+		}
+		ss.reply(append(caps, ".")...)
+		return true
+	case "NOOP":
+		ss.reply("+OK")
+		return true
+	case "QUIT":
+		if ss.authed {
+			ss.mu.Lock()
+			var kept []*MailboxMessage
+			for _, m := range ss.messages {
+				if !ss.deleted[m.UID] {
+					kept = append(kept, m)
+				}
+			}
+			ss.messages = kept
+			ss.mu.Unlock()
+		}
+		ss.reply("+OK bye")
+		return false
+	}
+	if !ss.authed {
+		switch cmd {
+		case "STLS":
+			if !ss.StartTLS || ss.tls {
+				ss.reply("-ERR STLS not available")
+				return true
+			}
+			ss.reply("+OK begin TLS negotiation")
+			tc := tls.Server(ss.conn, ss.TLSConfig)
+			if err := tc.Handshake(); err != nil {
+				return false
+			}
+			ss.conn, ss.tls = tc, true
+			ss.rw = bufio.NewReadWriter(bufio.NewReader(tc), bufio.NewWriter(tc))
+		case "USER":
+			if ss.StartTLS && !ss.tls {
+				ss.reply("-ERR USER disabled before STLS")
+			} else if len(args) != 1 {
+				ss.reply("-ERR USER needs a name")
+			} else {
+				ss.user = args[0]
+				ss.reply("+OK")
+			}
+		case "PASS":
+			pass := strings.TrimPrefix(line[4:], " ")
+			if ss.user == "" {
+				ss.reply("-ERR USER first")
+			} else if len(ss.Users) > 0 && ss.Users[ss.user] != pass {
+				ss.reply("-ERR [AUTH] invalid credentials")
+			} else {
+				ss.authed = true
+				ss.mu.Lock()
+				ss.msgs = append([]*MailboxMessage(nil), ss.messages...)
+				ss.mu.Unlock()
+				ss.reply("+OK logged in")
+			}
+		default:
+			ss.reply("-ERR not authenticated")
+		}
+		return true
+	}
+	var m *MailboxMessage
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 || n > len(ss.msgs) || ss.deleted[ss.msgs[n-1].UID] {
+			ss.reply("-ERR no such message")
+			return true
+		}
+		m = ss.msgs[n-1]
+	}
+	switch cmd {
+	case "STAT":
+		var count, size int
+		for _, m := range ss.msgs {
+			if !ss.deleted[m.UID] {
+				count++
+				size += len(m.Data)
+			}
+		}
+		ss.reply(fmt.Sprintf("+OK %d %d", count, size))
+	case "UIDL":
+		if m != nil {
+			ss.reply(fmt.Sprintf("+OK %s %s", args[0], pop3UIDL(m.UID)))
+			return true
+		}
+		lines := []string{"+OK"}
+		for i, m := range ss.msgs {
+			if !ss.deleted[m.UID] {
+				lines = append(lines, fmt.Sprintf("%d %s", i+1, pop3UIDL(m.UID)))
+			}
+		}
+		ss.reply(append(lines, ".")...)
+	case "RETR":
+		if m == nil {
+			ss.reply("-ERR RETR needs a message number")
+			return true
+		}
+		ss.reply(fmt.Sprintf("+OK %d octets", len(m.Data)))
+		data := bytes.TrimSuffix(m.Data, []byte("\r\n"))
+		for _, l := range bytes.Split(data, []byte("\r\n")) {
+			if bytes.HasPrefix(l, []byte(".")) {
+				ss.rw.WriteByte('.')
+			}
+			ss.rw.Write(l)
+			ss.rw.WriteString("\r\n")
+		}
+		ss.reply(".")
+	case "DELE":
+		if m == nil {
+			ss.reply("-ERR DELE needs a message number")
+			return true
+		}
+		ss.deleted[m.UID] = true
+		ss.reply("+OK marked deleted")
+	case "RSET":
+		ss.deleted = make(map[uint32]bool)
+		ss.reply("+OK")
+	default:
+		ss.reply("-ERR unknown command")
+	}
+	return true
+}
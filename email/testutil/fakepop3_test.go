@@ -0,0 +1,86 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package testutil
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestFakePOP3(t *testing.T) {
+	srv := NewFakePOP3()
+	srv.Users = map[string]string{"user": "pass word"}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	first := srv.Add([]byte("Subject: one\r\n\r\n.dotted\r\n"))
+	srv.Add([]byte("Subject: two\r\n\r\nsecond\r\n"))
+
+	c, err := textproto.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// cmd sends the command, returning the response (with the dot-encoded
+	// lines following it, if multiline)
+	cmd := func(line string, multiline bool) string {
+		if err := c.PrintfLine("%s", line); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if multiline && strings.HasPrefix(resp, "+OK") {
+			lines, err := c.ReadDotLines()
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp += "\n" + strings.Join(lines, "\n")
+		}
+		return resp
+	}
+	if greeting, _ := c.ReadLine(); !strings.HasPrefix(greeting, "+OK") {
+		t.Fatalf("got greeting %q", greeting)
+	}
+	for _, tc := range []struct {
+		cmd       string
+		multiline bool
+		want      string
+	}{
+		{"STAT", false, "-ERR not authenticated"},
+		{"USER user", false, "+OK"},
+		{"PASS pass", false, "-ERR [AUTH]"},
+		{"PASS pass word", false, "+OK"},
+		{"STAT", false, "+OK 2 49"},
+		{"UIDL", true, "+OK\n1 " + first + "\n2 uidl-2"},
+		{"RETR 1", true, "Subject: one\n\n.dotted"},
+		{"DELE 1", false, "+OK"},
+		{"RETR 1", false, "-ERR no such message"},
+		{"UIDL", true, "+OK\n2 uidl-2"},
+		{"RSET", false, "+OK"},
+		{"DELE 2", false, "+OK"},
+		{"QUIT", false, "+OK"},
+	} {
+		if got := cmd(tc.cmd, tc.multiline); !strings.Contains(got, tc.want) {
+			t.Errorf("%s: got %q, wanted %q", tc.cmd, got, tc.want)
+		}
+	}
+	if msgs := srv.Mailbox(); len(msgs) != 1 || msgs[0].UID != 1 {
+		t.Errorf("got %+v, wanted the first message only", msgs)
+	}
+	if cmds := srv.Commands(); cmds[3] != "PASS ***" {
+		t.Errorf("the password is logged: %q", cmds)
+	}
+}
@@ -0,0 +1,571 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+// Package testutil contains helpers for testing the email plugins,
+// and custom code (e.g. smtp.Auth implementations) used with them.
+//
+// FakeSMTP is a scriptable, in-memory SMTP server:
+//
+//	srv := testutil.NewFakeSMTP("STARTTLS", "AUTH PLAIN")
+//	srv.Reply("RCPT TO:<bad@", "550 no such user")
+//	if err := srv.Start(); err != nil { ... }
+//	defer srv.Close()
+//	... send mail to srv.Addr() ...
+//	msgs := srv.Messages()
+//
+// FakeIMAP and FakePOP3 serve in-memory mailboxes over IMAP and POP3,
+// for testing the input.
+package testutil
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is an email received by FakeSMTP.
+type Message struct {
+	From       string   // envelope sender
+	FromParams []string // MAIL FROM extension parameters
+	To         []string // envelope recipients (accepted ones only)
+	Data       []byte   // the DATA, without the terminating dot, dot-unstuffed
+	TLS        bool     // whether the session was encrypted
+	User       string   // the authenticated user, if any
+}
+
+// FakeSMTP is a scriptable SMTP server listening on the loopback interface.
+//
+// The exported fields must be set before Start.
+type FakeSMTP struct {
+	// Greeting is the 220 greeting line, without the code.
+	Greeting string
+	// Extensions are advertised in the EHLO response, e.g. "STARTTLS", "AUTH PLAIN LOGIN".
+	// STARTTLS is not advertised anymore after it succeeded.
+	Extensions []string
+	// Users are the accepted username -> password pairs for AUTH PLAIN, LOGIN and CRAM-MD5
+	// (username -> token for XOAUTH2).
+	// Any credentials are accepted if empty.
+	Users map[string]string
+	// TLSConfig is used by STARTTLS. NewFakeSMTP sets it to use a
+	// self-signed certificate for localhost and 127.0.0.1, see CertPool.
+	TLSConfig *tls.Config
+	// ImplicitTLS makes the server speak TLS from the start (SMTPS),
+	// with TLSConfig.
+	ImplicitTLS bool
+	// DropInData makes the server close the connection in the middle of DATA.
+	DropInData bool
+	// Delay delays the reply to the end of DATA, keeping the connections open for a while.
+	Delay time.Duration
+	// Gauge, if set, counts the open connections together with the other
+	// servers sharing it.
+	Gauge *Gauge
+
+	ln       net.Listener
+	certPool *x509.CertPool
+
+	mu       sync.Mutex
+	replies  []scriptedReply
+	commands []string
+	messages []Message
+	conns    int
+	active   Gauge
+}
+
+// Gauge counts the simultaneously open connections.
+// A connection counts as open from its acceptance till QUIT or its closing.
+type Gauge struct {
+	mu     sync.Mutex
+	n, max int
+}
+
+func (g *Gauge) inc() {
+	g.mu.Lock()
+	g.n++
+	if g.n > g.max {
+		g.max = g.n
+	}
+	g.mu.Unlock()
+}
+
+func (g *Gauge) dec() {
+	g.mu.Lock()
+	g.n--
+	g.mu.Unlock()
+}
+
+// Max returns the maximal number of simultaneously open connections.
+func (g *Gauge) Max() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.max
+}
+
+type scriptedReply struct {
+	prefix  string
+	replies []string
+}
+
+// Special scripted replies.
+const (
+	// Drop makes the server close the connection instead of answering.
+	Drop = "<drop>"
+	// Pass makes the server handle the command the default way.
+	Pass = "<pass>"
+)
+
+// NewFakeSMTP returns a new, not yet started FakeSMTP advertising the given extensions.
+func NewFakeSMTP(extensions ...string) *FakeSMTP {
+	s := &FakeSMTP{Greeting: "fake ESMTP", Extensions: extensions}
+	s.TLSConfig, s.certPool = selfSigned()
+	return s
+}
+
+// Reply scripts the replies for the commands beginning with prefix
+// (compared case-insensitively): the first matching command gets the first
+// reply, the second gets the second, and so on; the last reply is repeated.
+// A reply is a full response line (e.g. "550 no such user"), Drop or Pass.
+// A scripted reply replaces the default handling of the command, so
+// e.g. a rejected RCPT does not add the recipient to the message.
+//
+// The scripts are checked in the order of registration.
+func (s *FakeSMTP) Reply(prefix string, replies ...string) {
+	s.mu.Lock()
+	s.replies = append(s.replies, scriptedReply{prefix: strings.ToUpper(prefix), replies: replies})
+	s.mu.Unlock()
+}
+
+// Start starts listening on a random loopback port.
+func (s *FakeSMTP) Start() error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// Close stops the server.
+func (s *FakeSMTP) Close() error {
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Close()
+}
+
+// Addr returns the host:port the server listens on.
+func (s *FakeSMTP) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Port returns the port the server listens on.
+func (s *FakeSMTP) Port() string {
+	_, port, _ := net.SplitHostPort(s.Addr())
+	return port
+}
+
+// CertPool returns a pool containing the certificate of the default TLSConfig.
+func (s *FakeSMTP) CertPool() *x509.CertPool {
+	return s.certPool
+}
+
+// Commands returns all the command lines received so far (in all sessions).
+func (s *FakeSMTP) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// Messages returns the messages received so far.
+func (s *FakeSMTP) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+// Connections returns the number of accepted connections so far.
+func (s *FakeSMTP) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+// MaxConcurrent returns the maximal number of simultaneously open connections.
+func (s *FakeSMTP) MaxConcurrent() int {
+	return s.active.Max()
+}
+
+// scripted returns the scripted reply for the command line, if any.
+func (s *FakeSMTP) scripted(line string) (string, bool) {
+	upper := strings.ToUpper(line)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sr := range s.replies {
+		if !strings.HasPrefix(upper, sr.prefix) {
+			continue
+		}
+		reply := sr.replies[0]
+		if len(sr.replies) > 1 {
+			s.replies[i].replies = sr.replies[1:]
+		}
+		return reply, true
+	}
+	return "", false
+}
+
+type session struct {
+	*FakeSMTP
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	tls  bool
+	user string
+	msg  *Message
+	quit bool
+}
+
+func (s *FakeSMTP) serve(conn net.Conn) {
+	s.mu.Lock()
+	s.conns++
+	s.mu.Unlock()
+	s.active.inc()
+	if s.Gauge != nil {
+		s.Gauge.inc()
+	}
+
+	ss := &session{FakeSMTP: s}
+	ss.setConn(conn)
+	defer func() {
+		ss.conn.Close()
+		ss.close()
+	}()
+	if s.ImplicitTLS {
+		tc := tls.Server(conn, s.TLSConfig)
+		if err := tc.Handshake(); err != nil {
+			return
+		}
+		ss.setConn(tc)
+		ss.tls = true
+	}
+	ss.reply("220 " + s.Greeting)
+	for {
+		line, err := ss.rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		s.mu.Lock()
+		s.commands = append(s.commands, line)
+		s.mu.Unlock()
+		if reply, ok := s.scripted(line); ok && reply != Pass {
+			if reply == Drop {
+				return
+			}
+			if strings.HasPrefix(reply, "221") {
+				ss.close()
+				ss.reply(reply)
+				return
+			}
+			ss.reply(reply)
+			continue
+		}
+		if !ss.handle(line) {
+			return
+		}
+	}
+}
+
+// close stops counting the connection as open. It is called before
+// answering QUIT, so that the client cannot open a new connection
+// while this one is still counted.
+func (ss *session) close() {
+	if ss.quit {
+		return
+	}
+	ss.quit = true
+	ss.active.dec()
+	if ss.Gauge != nil {
+		ss.Gauge.dec()
+	}
+}
+
+func (ss *session) setConn(conn net.Conn) {
+	ss.conn = conn
+	ss.rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+}
+
+func (ss *session) reply(lines ...string) {
+	for _, line := range lines {
+		ss.rw.WriteString(line + "\r\n")
+	}
+	ss.rw.Flush()
+}
+
+// handle handles the command line with the default behaviour,
+// and returns false if the session should be closed.
+func (ss *session) handle(line string) bool {
+	verb, arg := line, ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		verb, arg = line[:i], line[i+1:]
+	}
+	switch strings.ToUpper(verb) {
+	case "EHLO", "HELO":
+		lines := []string{"fake"}
+		for _, ext := range ss.Extensions {
+			if ss.tls && strings.EqualFold(ext, "STARTTLS") {
+				continue
+			}
+			lines = append(lines, ext)
+		}
+		for i := range lines {
+			if i < len(lines)-1 {
+				lines[i] = "250-" + lines[i]
+			} else {
+				lines[i] = "250 " + lines[i]
+			}
+		}
+		ss.reply(lines...)
+	case "STARTTLS":
+		ss.reply("220 go ahead")
+		tc := tls.Server(ss.conn, ss.TLSConfig)
+		if err := tc.Handshake(); err != nil {
+			return false
+		}
+		ss.setConn(tc)
+		ss.tls = true
+	case "AUTH":
+		return ss.auth(arg)
+	case "MAIL":
+		from, params := parsePath(arg)
+		ss.msg = &Message{From: from, FromParams: params, TLS: ss.tls, User: ss.user}
+		ss.reply("250 ok")
+	case "RCPT":
+		if ss.msg == nil {
+			ss.reply("503 need MAIL first")
+			break
+		}
+		to, _ := parsePath(arg)
+		ss.msg.To = append(ss.msg.To, to)
+		ss.reply("250 ok")
+	case "DATA":
+		if ss.msg == nil || len(ss.msg.To) == 0 {
+			ss.reply("503 need RCPT first")
+			break
+		}
+		ss.reply("354 go ahead")
+		var buf bytes.Buffer
+		for {
+			line, err := ss.rw.ReadString('\n')
+			if err != nil {
+				return false
+			}
+			if ss.DropInData {
+				return false
+			}
+			if line == ".\r\n" {
+				break
+			}
+			if strings.HasPrefix(line, ".") {
+				line = line[1:]
+			}
+			buf.WriteString(line)
+		}
+		ss.msg.Data = buf.Bytes()
+		ss.mu.Lock()
+		ss.messages = append(ss.messages, *ss.msg)
+		ss.mu.Unlock()
+		ss.msg = nil
+		time.Sleep(ss.Delay)
+		ss.reply("250 queued")
+	case "RSET":
+		ss.msg = nil
+		ss.reply("250 ok")
+	case "NOOP":
+		ss.reply("250 ok")
+	case "QUIT":
+		ss.close()
+		ss.reply("221 bye")
+		return false
+	default:
+		ss.reply("502 command not implemented")
+	}
+	return true
+}
+
+// auth handles AUTH PLAIN, LOGIN, CRAM-MD5 and XOAUTH2.
+func (ss *session) auth(arg string) bool {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		ss.reply("501 syntax error")
+		return true
+	}
+	var user, pass string
+	switch strings.ToUpper(fields[0]) {
+	case "PLAIN":
+		resp := ""
+		if len(fields) > 1 {
+			resp = fields[1]
+		} else {
+			ss.reply("334 ")
+			line, err := ss.rw.ReadString('\n')
+			if err != nil {
+				return false
+			}
+			resp = strings.TrimSpace(line)
+		}
+		b, err := base64.StdEncoding.DecodeString(resp)
+		parts := strings.Split(string(b), "\x00")
+		if err != nil || len(parts) != 3 {
+			ss.reply("501 malformed PLAIN response")
+			return true
+		}
+		user, pass = parts[1], parts[2]
+	case "LOGIN":
+		var creds [2]string
+		for i, prompt := range []string{"Username:", "Password:"} {
+			if i == 0 && len(fields) > 1 {
+				b, _ := base64.StdEncoding.DecodeString(fields[1])
+				creds[0] = string(b)
+				continue
+			}
+			ss.reply("334 " + base64.StdEncoding.EncodeToString([]byte(prompt)))
+			line, err := ss.rw.ReadString('\n')
+			if err != nil {
+				return false
+			}
+			b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+			if err != nil {
+				ss.reply("501 malformed LOGIN response")
+				return true
+			}
+			creds[i] = string(b)
+		}
+		user, pass = creds[0], creds[1]
+	case "CRAM-MD5":
+		challenge := "<" + time.Now().Format("20060102150405.000000000") + "@fakesmtp>"
+		ss.reply("334 " + base64.StdEncoding.EncodeToString([]byte(challenge)))
+		line, err := ss.rw.ReadString('\n')
+		if err != nil {
+			return false
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+		i := bytes.LastIndexByte(b, ' ')
+		if err != nil || i < 0 {
+			ss.reply("501 malformed CRAM-MD5 response")
+			return true
+		}
+		user = string(b[:i])
+		// the password is never sent: it passes if the digest matches
+		mac := hmac.New(md5.New, []byte(ss.Users[user]))
+		mac.Write([]byte(challenge))
+		if hex.EncodeToString(mac.Sum(nil)) == string(b[i+1:]) {
+			pass = ss.Users[user]
+		}
+	case "XOAUTH2":
+		var resp []byte
+		if len(fields) > 1 {
+			resp, _ = base64.StdEncoding.DecodeString(fields[1])
+		}
+		for _, kv := range strings.Split(string(resp), "\x01") {
+			if strings.HasPrefix(kv, "user=") {
+				user = kv[len("user="):]
+			} else if strings.HasPrefix(kv, "auth=Bearer ") {
+				pass = kv[len("auth=Bearer "):]
+			}
+		}
+		if len(ss.Users) != 0 && (ss.Users[user] != pass || pass == "") {
+			// the error challenge, to be answered with an empty line (or "*")
+			ss.reply("334 " + base64.StdEncoding.EncodeToString([]byte(`{"status":"401","schemes":"bearer"}`)))
+			if _, err := ss.rw.ReadString('\n'); err != nil {
+				return false
+			}
+			ss.reply("535 authentication failed")
+			return true
+		}
+	default:
+		ss.reply("504 unrecognized authentication type")
+		return true
+	}
+	if len(ss.Users) != 0 && (ss.Users[user] != pass || pass == "") {
+		ss.reply("535 authentication failed")
+		return true
+	}
+	ss.user = user
+	ss.reply("235 authenticated")
+	return true
+}
+
+// parsePath splits "FROM:<addr> PARAM=1 PARAM2" into addr and params.
+func parsePath(arg string) (string, []string) {
+	if i := strings.IndexByte(arg, ':'); i >= 0 {
+		arg = arg[i+1:]
+	}
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return strings.Trim(fields[0], "<>"), fields[1:]
+}
+
+// selfSigned returns a TLS config with a self-signed certificate
+// for localhost and 127.0.0.1, and a pool containing that certificate.
+func selfSigned() (*tls.Config, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}},
+	}, pool
+}
@@ -0,0 +1,170 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package testutil
+
+import (
+	"crypto/tls"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func startFake(t *testing.T, srv *FakeSMTP) *FakeSMTP {
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+func TestFakeSMTPSend(t *testing.T) {
+	srv := NewFakeSMTP("STARTTLS", "AUTH PLAIN LOGIN")
+	srv.Users = map[string]string{"user": "pass"}
+	startFake(t, srv)
+
+	c, err := smtp.Dial(srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		t.Fatal("STARTTLS is not advertised")
+	}
+	if err = c.StartTLS(&tls.Config{ServerName: "localhost", RootCAs: srv.CertPool()}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		t.Error("STARTTLS is advertised after STARTTLS")
+	}
+	if err = c.Auth(smtp.PlainAuth("", "user", "pass", "127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Mail("from@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Rcpt("to@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("Subject: test\r\n\r\n.dotted\r\n"))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := srv.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages, wanted 1", len(msgs))
+	}
+	m := msgs[0]
+	if m.From != "from@example.com" || len(m.To) != 1 || m.To[0] != "to@example.com" {
+		t.Errorf("bad envelope: %+v", m)
+	}
+	if !m.TLS || m.User != "user" {
+		t.Errorf("wanted TLS and user, got %+v", m)
+	}
+	if want := "Subject: test\r\n\r\n.dotted\r\n"; string(m.Data) != want {
+		t.Errorf("got data %q, wanted %q", m.Data, want)
+	}
+}
+
+func TestFakeSMTPAuthFailure(t *testing.T) {
+	srv := NewFakeSMTP("AUTH LOGIN")
+	srv.Users = map[string]string{"user": "pass"}
+	startFake(t, srv)
+	c, err := smtp.Dial(srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Hello("localhost")
+	id, _ := c.Text.Cmd("AUTH LOGIN")
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(334)
+	c.Text.EndResponse(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []struct {
+		resp string
+		code int
+	}{{"dXNlcg==", 334}, {"YmFk", 235}} { // "user", "bad"
+		id, _ = c.Text.Cmd("%s", step.resp)
+		c.Text.StartResponse(id)
+		_, _, err = c.Text.ReadResponse(step.code)
+		c.Text.EndResponse(id)
+	}
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 535 {
+		t.Errorf("got %v, wanted 535", err)
+	}
+}
+
+func TestFakeSMTPScripted(t *testing.T) {
+	srv := startFake(t, NewFakeSMTP("PIPELINING"))
+	srv.Reply("RCPT TO:<bad@", "550 no such user")
+	srv.Reply("NOOP", "421 busy", Pass)
+
+	c, err := smtp.Dial(srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i, want := range []int{421, 250, 250} {
+		err = c.Noop()
+		if e, ok := err.(*textproto.Error); want != 250 && (!ok || e.Code != want) {
+			t.Errorf("%d. NOOP: got %v, wanted %d", i, err, want)
+		} else if want == 250 && err != nil {
+			t.Errorf("%d. NOOP: %v", i, err)
+		}
+	}
+	if err = c.Mail("from@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	err = c.Rcpt("bad@example.com")
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 550 {
+		t.Errorf("got %v, wanted 550", err)
+	}
+	if err = c.Rcpt("good@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	w, _ := c.Data()
+	w.Write([]byte("\r\n"))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := srv.Messages(); len(msgs) != 1 || strings.Join(msgs[0].To, ",") != "good@example.com" {
+		t.Errorf("got %+v, wanted only good@", msgs)
+	}
+}
+
+func TestFakeSMTPDropInData(t *testing.T) {
+	srv := NewFakeSMTP()
+	srv.DropInData = true
+	startFake(t, srv)
+	err := smtp.SendMail(srv.Addr(), nil, "from@example.com", []string{"to@example.com"},
+		[]byte("Subject: test\r\n\r\nbody\r\n"))
+	if err == nil {
+		t.Error("wanted error for dropped connection")
+	}
+	if len(srv.Messages()) != 0 {
+		t.Error("message received despite of the drop")
+	}
+	if srv.Connections() != 1 || srv.MaxConcurrent() != 1 {
+		t.Errorf("got %d connections (max. %d concurrent), wanted 1", srv.Connections(), srv.MaxConcurrent())
+	}
+}
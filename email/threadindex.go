@@ -0,0 +1,95 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// maxThreadChildren caps the number of child blocks of a Thread-Index,
+// to keep the header short: the later follow-ups get the same index.
+const maxThreadChildren = 50
+
+// filetimeEpoch is the Unix epoch in Windows FILETIME (100ns since 1601).
+const filetimeEpoch = 116444736000000000
+
+// outlookThreads computes the Outlook conversation indexes (Thread-Index,
+// MS-OXOMSG 2.2.1.3) of the incidents: the first email of an incident gets
+// the 22 bytes header block (its time and a GUID from the incident key),
+// each follow-up appends a 5 bytes child block.
+type outlookThreads struct {
+	mu      sync.Mutex
+	indexes map[string][]byte
+}
+
+func newOutlookThreads() *outlookThreads {
+	return &outlookThreads{indexes: make(map[string][]byte)}
+}
+
+// Index returns the base64 encoded Thread-Index of the incident's email sent at t.
+func (ot *outlookThreads) Index(key string, t time.Time) string {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	ft := uint64(t.UnixNano()/100 + filetimeEpoch)
+	index := ot.indexes[key]
+	if index == nil {
+		index = make([]byte, 22)
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], ft)
+		copy(index, b[:6])
+		guid := md5.Sum([]byte(key))
+		copy(index[6:], guid[:])
+	} else if n := (len(index) - 22) / 5; n < maxThreadChildren {
+		var b [8]byte
+		copy(b[:6], index[:6])
+		var delta uint64
+		if start := binary.BigEndian.Uint64(b[:]); ft > start {
+			delta = ft - start
+		}
+		var v uint32
+		if delta>>49 == 0 {
+			v = uint32(delta>>18) & 0x7fffffff
+		} else {
+			v = 1<<31 | uint32(delta>>23)&0x7fffffff
+		}
+		index = append(index, 0, 0, 0, 0, byte(rand.Intn(16))<<4|byte((n+1)&0xf))
+		binary.BigEndian.PutUint32(index[len(index)-5:], v)
+	}
+	ot.indexes[key] = index
+	return base64.StdEncoding.EncodeToString(index)
+}
+
+// incidentKey returns the key of the message's incident: the fingerprint
+// field, or (without one) the subject without the timestamp and the hostname.
+func (o *EmailOutput) incidentKey(msg *message.Message) string {
+	if fp, ok := msg.GetFieldValue("fingerprint"); ok {
+		return fmt.Sprintf("fp:%v", fp)
+	}
+	return fmt.Sprintf("%d %s %s", o.severity(msg), msg.GetLogger(), o.subjectPayload(o.payload(msg)))
+}
+
+// threadHeaders returns the Thread-Index header of the message's email,
+// if Outlook threading is on.
+func (o *EmailOutput) threadHeaders(msg *message.Message) []string {
+	if o.threads == nil {
+		return nil
+	}
+	return []string{"Thread-Index: " + o.threads.Index(o.incidentKey(msg), time.Unix(0, msg.GetTimestamp()))}
+}
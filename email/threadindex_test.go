@@ -0,0 +1,74 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+var threadIndexRe = regexp.MustCompile("\r\nThread-Index: ([^\r]+)\r\n")
+
+func TestThreadIndex(t *testing.T) {
+	o := &EmailOutput{threads: newOutlookThreads()}
+	index := func(msg *message.Message) []byte {
+		m := threadIndexRe.FindSubmatch(o.formatMessage(msg))
+		if m == nil {
+			t.Fatalf("no Thread-Index in the email of %q", msg.GetPayload())
+		}
+		b, err := base64.StdEncoding.DecodeString(string(m[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	incident := func(ts time.Time, fp, payload string) *message.Message {
+		msg := newTestMessage(2, "db-01", payload)
+		msg.SetTimestamp(ts.UnixNano())
+		f, _ := message.NewField("fingerprint", fp, "")
+		msg.AddField(f)
+		return msg
+	}
+
+	start := time.Date(2013, 11, 12, 13, 14, 15, 0, time.UTC)
+	first := index(incident(start, "db-down", "database is down"))
+	if len(first) != 22 {
+		t.Fatalf("header block is %d bytes, wanted 22", len(first))
+	}
+	prev := first
+	for i := 1; i <= 3; i++ {
+		next := index(incident(start.Add(time.Duration(i)*time.Minute), "db-down", "database is still down"))
+		if len(next) != 22+5*i {
+			t.Errorf("%d. follow-up index is %d bytes, wanted %d", i, len(next), 22+5*i)
+		}
+		if !bytes.HasPrefix(next, prev) {
+			t.Errorf("%d. follow-up index %x does not extend %x", i, next, prev)
+		}
+		if seq := int(next[len(next)-1] & 0xf); seq != i {
+			t.Errorf("%d. got sequence %d", i, seq)
+		}
+		prev = next
+	}
+
+	other := index(incident(start, "disk-full", "disk is full"))
+	if len(other) != 22 || bytes.Equal(other[6:22], first[6:22]) {
+		t.Errorf("another incident got index %x, the first %x", other, first)
+	}
+	if got := (&EmailOutput{}).formatMessage(newTestMessage(2, "db-01", "down")); threadIndexRe.Match(got) {
+		t.Error("Thread-Index without outlook_threading")
+	}
+}
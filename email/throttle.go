@@ -0,0 +1,66 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttle paces the deliveries to a domain, one recipient per interval.
+type throttle struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time // the time of the next free slot
+}
+
+// newThrottles returns the throttles of the domains, from their maximal
+// number of recipients per minute.
+func newThrottles(perMinute map[string]int) (map[string]*throttle, error) {
+	throttles := make(map[string]*throttle, len(perMinute))
+	for domain, n := range perMinute {
+		if n <= 0 {
+			return nil, fmt.Errorf("bad domain_throttles of %s: %d", domain, n)
+		}
+		throttles[strings.ToLower(domain)] = &throttle{interval: time.Minute / time.Duration(n)}
+	}
+	return throttles, nil
+}
+
+// Reserve reserves the slots of n recipients, and returns how long
+// to wait before sending to them.
+func (t *throttle) Reserve(n int) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	wait := t.next.Sub(now)
+	t.next = t.next.Add(time.Duration(n) * t.interval)
+	return wait
+}
+
+// throttleDomain waits till the domain's throttle (if any) lets
+// the n recipients through.
+func (o *EmailOutput) throttleDomain(domain string, n int) {
+	t := o.throttles[strings.ToLower(domain)]
+	if t == nil {
+		return
+	}
+	if wait := t.Reserve(n); wait > 0 {
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,51 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDomainThrottles(t *testing.T) {
+	srv := startFakeSMTP(t)
+	throttles, err := newThrottles(map[string]int{"Gmail.com": 600}) // one per 100ms
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &EmailOutput{From: "heka@example.com", hostport: srv.Addr(), throttles: throttles}
+	body := []byte("Subject: test\r\n\r\nbody")
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := o.sendMail(body, envelope{to: []string{"ops@example.com"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("the unthrottled domain took %s", d)
+	}
+
+	start = time.Now()
+	for i := 0; i < 4; i++ {
+		if err := o.sendMail(body, envelope{to: []string{"ops@gmail.com"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("the throttled domain took only %s, wanted at least 300ms", d)
+	}
+
+	if _, err := newThrottles(map[string]int{"gmail.com": 0}); err == nil {
+		t.Error("zero throttle accepted")
+	}
+}
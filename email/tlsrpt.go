@@ -0,0 +1,174 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// tlsrptTTL is how long a domain's TLSRPT record is cached.
+var tlsrptTTL = time.Hour
+
+// TLSReport is the summary of the TLS outcomes of the deliveries to a recipient domain,
+// to be submitted to (or inspected instead of) its TLSRPT (RFC 8460) report URIs.
+type TLSReport struct {
+	RUA       []string       // the report URIs from the domain's TLSRPT record
+	Successes int64          // number of successful TLS sessions
+	Failures  int64          // number of failed TLS sessions
+	Version   string         // the last negotiated TLS version
+	Cipher    string         // the last negotiated cipher suite
+	MXHost    string         // the MX host of the last session
+	Results   map[string]int // failure counts per RFC 8460 result type
+	LastError string         // the last failure
+}
+
+type tlsrptEntry struct {
+	report  TLSReport
+	checked time.Time // when the TLSRPT record was looked up
+}
+
+// tlsReporter accumulates the TLS outcomes per recipient domain,
+// for the domains publishing TLSRPT.
+type tlsReporter struct {
+	lookupTXT func(name string) ([]string, error)
+
+	mu      sync.Mutex
+	domains map[string]*tlsrptEntry
+}
+
+func newTLSReporter() *tlsReporter {
+	return &tlsReporter{lookupTXT: net.LookupTXT, domains: make(map[string]*tlsrptEntry)}
+}
+
+// rua returns the report URIs of the domain's TLSRPT record, caching them.
+func (r *tlsReporter) rua(domain string) []string {
+	r.mu.Lock()
+	e := r.domains[domain]
+	r.mu.Unlock()
+	if e != nil && time.Since(e.checked) < tlsrptTTL {
+		return e.report.RUA
+	}
+	txts, _ := r.lookupTXT("_smtp._tls." + domain)
+	var rua []string
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=TLSRPTv1") {
+			continue
+		}
+		for _, part := range strings.Split(txt, ";") {
+			if k, v, ok := strings.Cut(strings.TrimSpace(part), "="); ok && k == "rua" {
+				for _, uri := range strings.Split(v, ",") {
+					rua = append(rua, strings.TrimSpace(uri))
+				}
+			}
+		}
+	}
+	r.mu.Lock()
+	if e = r.domains[domain]; e == nil {
+		e = &tlsrptEntry{report: TLSReport{Results: make(map[string]int)}}
+		r.domains[domain] = e
+	}
+	e.report.RUA, e.checked = rua, time.Now()
+	r.mu.Unlock()
+	return rua
+}
+
+// Record records the outcome of a TLS negotiation with mxHost for domain.
+func (r *tlsReporter) Record(domain, mxHost string, state tls.ConnectionState, err error) {
+	domain = strings.ToLower(domain)
+	if len(r.rua(domain)) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rep := &r.domains[domain].report
+	rep.MXHost = mxHost
+	if err != nil {
+		rep.Failures++
+		rep.Results[tlsrptResultType(err)]++
+		rep.LastError = err.Error()
+		return
+	}
+	rep.Successes++
+	rep.Version = tls.VersionName(state.Version)
+	rep.Cipher = tls.CipherSuiteName(state.CipherSuite)
+}
+
+// Reports returns a copy of the accumulated reports.
+func (r *tlsReporter) Reports() map[string]TLSReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reports := make(map[string]TLSReport, len(r.domains))
+	for domain, e := range r.domains {
+		if len(e.report.RUA) == 0 {
+			continue
+		}
+		rep := e.report
+		rep.RUA = append([]string(nil), rep.RUA...)
+		rep.Results = make(map[string]int, len(e.report.Results))
+		for k, v := range e.report.Results {
+			rep.Results[k] = v
+		}
+		reports[domain] = rep
+	}
+	return reports
+}
+
+// tlsrptResultType maps the error to an RFC 8460 result type.
+func tlsrptResultType(err error) string {
+	var (
+		hostErr      x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+		authorityErr x509.UnknownAuthorityError
+	)
+	switch {
+	case errors.Is(err, ErrStartTLSUnsupported):
+		return "starttls-not-supported"
+	case errors.As(err, &hostErr):
+		return "certificate-host-mismatch"
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return "certificate-expired"
+	case errors.As(err, &authorityErr):
+		return "certificate-not-trusted"
+	}
+	return "validation-failure"
+}
+
+// TLSReports returns the TLS outcomes per recipient domain publishing TLSRPT.
+func (o *EmailOutput) TLSReports() map[string]TLSReport {
+	if o.tlsrpt == nil {
+		return nil
+	}
+	return o.tlsrpt.Reports()
+}
+
+// reportTLS adds the TLS outcomes per domain to the Heka report message.
+func (o *EmailOutput) reportTLS(msg *message.Message) {
+	for domain, rep := range o.TLSReports() {
+		prefix := "TLS." + domain + "."
+		addField(msg, prefix+"SuccessCount", rep.Successes, "count")
+		addField(msg, prefix+"FailureCount", rep.Failures, "count")
+		addField(msg, prefix+"Version", rep.Version, "")
+		addField(msg, prefix+"Cipher", rep.Cipher, "")
+		addField(msg, prefix+"RUA", strings.Join(rep.RUA, ","), "")
+		for result, n := range rep.Results {
+			addField(msg, prefix+"Result."+result, int64(n), "count")
+		}
+	}
+}
@@ -0,0 +1,72 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+func TestTLSReports(t *testing.T) {
+	srv := startFakeSMTP(t, "STARTTLS")
+	useFakeMX(t, "localhost.", srv.Port())
+	rep := newTLSReporter()
+	rep.lookupTXT = func(name string) ([]string, error) {
+		if name == "_smtp._tls.reporting.com" {
+			return []string{"v=TLSRPTv1; rua=mailto:tlsrpt@reporting.com"}, nil
+		}
+		return nil, nil
+	}
+	o := &EmailOutput{From: "heka@example.com", tlsrpt: rep,
+		To: []string{"a@reporting.com", "b@silent.com"}}
+	o.opts.tlsConfig = &tls.Config{RootCAs: srv.CertPool()}
+	if err := o.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err != nil {
+		t.Fatal(err)
+	}
+	// the failure is tested with the reporting domain only
+	o.byHost = map[string][]string{"reporting.com": {"a@reporting.com"}}
+	o.opts.tlsConfig = &tls.Config{RootCAs: srv.CertPool(), ServerName: "mx.example.com"}
+	if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err == nil {
+		t.Fatal("wanted certificate name mismatch")
+	}
+
+	reports := o.TLSReports()
+	if len(reports) != 1 {
+		t.Fatalf("got reports for %d domains, wanted only reporting.com: %+v", len(reports), reports)
+	}
+	r := reports["reporting.com"]
+	if r.Successes != 2 || r.Failures != 1 { // Prepare, sendMail, failed sendMail
+		t.Errorf("got %d successes and %d failures, wanted 2 and 1", r.Successes, r.Failures)
+	}
+	if r.Results["certificate-host-mismatch"] != 1 {
+		t.Errorf("got results %v, wanted a certificate-host-mismatch", r.Results)
+	}
+	if r.Version == "" || r.Cipher == "" || r.MXHost != "localhost" {
+		t.Errorf("missing TLS details: %+v", r)
+	}
+	if len(r.RUA) != 1 || r.RUA[0] != "mailto:tlsrpt@reporting.com" {
+		t.Errorf("got RUA %v", r.RUA)
+	}
+
+	msg := new(message.Message)
+	if err := o.ReportMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := msg.GetFieldValue("TLS.reporting.com.SuccessCount"); !ok || v.(int64) != 2 {
+		t.Errorf("got SuccessCount %v in the report message", v)
+	}
+}
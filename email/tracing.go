@@ -0,0 +1,220 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Span is a finished OpenTelemetry span.
+type Span struct {
+	TraceID      [16]byte
+	SpanID       [8]byte
+	ParentSpanID [8]byte // zero if the span is a root span
+	Name         string
+	Start, End   time.Time
+	Attributes   map[string]interface{} // string, int64 or bool values
+	Err          error                  // the error status of the span, if any
+}
+
+// SpanExporter exports the finished spans.
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+}
+
+// traceContext returns the trace and parent span IDs of the W3C traceparent
+// ("00-<trace id>-<parent id>-<flags>") of the message's "traceparent" field.
+func traceContext(msg *message.Message) (traceID [16]byte, parentID [8]byte, ok bool) {
+	v, found := msg.GetFieldValue("traceparent")
+	s, isString := v.(string)
+	if !found || !isString {
+		return traceID, parentID, false
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return traceID, parentID, false
+	}
+	return traceID, parentID, traceID != [16]byte{}
+}
+
+// startSpan returns a new "email.send" span, in the trace of the envelope
+// (or a new trace).
+func startSpan(env envelope) *Span {
+	span := &Span{Name: "email.send", Start: time.Now(), Attributes: make(map[string]interface{}, 4)}
+	if env.traced {
+		span.TraceID, span.ParentSpanID = env.traceID, env.parentSpanID
+	} else {
+		rand.Read(span.TraceID[:])
+	}
+	rand.Read(span.SpanID[:])
+	return span
+}
+
+// traceSend exports the span of the sending of the email.
+func (o *EmailOutput) traceSend(span *Span, env envelope, err error) {
+	span.End = time.Now()
+	relay := o.hostport
+	if relay == "" {
+		relay = "mx"
+	}
+	span.Attributes["email.relay"] = relay
+	span.Attributes["email.recipients"] = int64(len(o.recipients(env)))
+	span.Attributes["email.latency_ms"] = int64(span.End.Sub(span.Start) / time.Millisecond)
+	span.Err = err
+	if err != nil {
+		span.Attributes["email.result"] = "error"
+	} else {
+		span.Attributes["email.result"] = "ok"
+	}
+	if err := o.tracer.ExportSpans([]*Span{span}); err != nil {
+		o.logError(fmt.Errorf("exporting span: %s", err))
+	}
+}
+
+// otlpExporter exports the spans to an OTLP/HTTP (JSON) endpoint,
+// in the background.
+type otlpExporter struct {
+	endpoint string
+	client   *http.Client
+	// logError logs the failed exports, if set
+	logError func(error)
+}
+
+func newOTLPExporter(endpoint string) *otlpExporter {
+	return &otlpExporter{endpoint: endpoint, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// ExportSpans posts the spans in the background, logging the errors.
+func (e *otlpExporter) ExportSpans(spans []*Span) error {
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	go func() {
+		resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = errors.New(resp.Status)
+			}
+		}
+		if err != nil && e.logError != nil {
+			e.logError(fmt.Errorf("exporting spans to %s: %s", e.endpoint, err))
+		}
+	}()
+	return nil
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+// otlpRequest returns the OTLP ExportTraceServiceRequest of the spans.
+func otlpRequest(spans []*Span) interface{} {
+	converted := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		s := otlpSpan{
+			TraceID:           hex.EncodeToString(span.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.SpanID[:]),
+			Name:              span.Name,
+			Kind:              3, // SPAN_KIND_CLIENT
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+			Status:            otlpStatus{Code: 1}, // STATUS_CODE_OK
+		}
+		if span.ParentSpanID != [8]byte{} {
+			s.ParentSpanID = hex.EncodeToString(span.ParentSpanID[:])
+		}
+		if span.Err != nil {
+			s.Status = otlpStatus{Code: 2, Message: span.Err.Error()} // STATUS_CODE_ERROR
+		}
+		converted = append(converted, s)
+	}
+	service := "heka"
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: &service}}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/tgulacsi/heka-plugins/email"},
+				"spans": converted,
+			}},
+		}},
+	}
+}
+
+// otlpAttributes converts the attributes, sorted by key.
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+	converted := make([]otlpAttribute, 0, len(attrs))
+	for k, v := range attrs {
+		var value otlpValue
+		switch x := v.(type) {
+		case string:
+			value.StringValue = &x
+		case int64:
+			s := strconv.FormatInt(x, 10)
+			value.IntValue = &s
+		case bool:
+			value.BoolValue = &x
+		default:
+			s := fmt.Sprint(x)
+			value.StringValue = &s
+		}
+		converted = append(converted, otlpAttribute{Key: k, Value: value})
+	}
+	sort.Slice(converted, func(i, j int) bool { return converted[i].Key < converted[j].Key })
+	return converted
+}
@@ -0,0 +1,129 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// memExporter collects the exported spans.
+type memExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (e *memExporter) ExportSpans(spans []*Span) error {
+	e.mu.Lock()
+	e.spans = append(e.spans, spans...)
+	e.mu.Unlock()
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	srv := startFakeSMTP(t)
+	exporter := new(memExporter)
+	o := &EmailOutput{From: "heka@example.com", To: []string{"ops@example.com", "dev@example.com"},
+		hostport: srv.Addr(), tracer: exporter}
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	traced := newTestMessage(2, "db-01", "database is down")
+	f, _ := message.NewField("traceparent", "00-"+traceID+"-"+parentID+"-01", "")
+	traced.AddField(f)
+	runner := newTestRunner()
+	runner.send(traced)
+	runner.send(newTestMessage(2, "db-01", "database is still down"))
+	close(runner.inChan)
+	if err := o.Run(runner, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(exporter.spans) != 2 {
+		t.Fatalf("got %d spans, wanted 2", len(exporter.spans))
+	}
+	span := exporter.spans[0]
+	if span.Name != "email.send" {
+		t.Errorf("got span %q", span.Name)
+	}
+	if got := hex.EncodeToString(span.TraceID[:]); got != traceID {
+		t.Errorf("got trace %s, wanted %s", got, traceID)
+	}
+	if got := hex.EncodeToString(span.ParentSpanID[:]); got != parentID {
+		t.Errorf("got parent %s, wanted %s", got, parentID)
+	}
+	for k, want := range map[string]interface{}{
+		"email.relay":      srv.Addr(),
+		"email.recipients": int64(2),
+		"email.result":     "ok",
+	} {
+		if got := span.Attributes[k]; got != want {
+			t.Errorf("%s: got %v, wanted %v", k, got, want)
+		}
+	}
+	if _, ok := span.Attributes["email.latency_ms"].(int64); !ok || span.End.Before(span.Start) {
+		t.Errorf("no latency in %+v", span)
+	}
+	if untraced := exporter.spans[1]; untraced.TraceID == span.TraceID || untraced.ParentSpanID != [8]byte{} {
+		t.Errorf("the untraced message's span is in the trace: %+v", untraced)
+	}
+
+	srv.Reply("MAIL FROM", "550 no")
+	exporter.spans = nil
+	if err := o.deliver([]byte("Subject: test\r\n\r\nbody"), envelope{}, 0); err == nil {
+		t.Fatal("sending succeeded")
+	}
+	if len(exporter.spans) != 1 || exporter.spans[0].Attributes["email.result"] != "error" ||
+		exporter.spans[0].Err == nil {
+		t.Errorf("got spans %+v for a failure", exporter.spans)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	bodies := make(chan string, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- r.URL.Path + " " + r.Header.Get("Content-Type") + " " + string(b)
+	}))
+	defer collector.Close()
+
+	span := &Span{Name: "email.send", Start: time.Unix(1, 0), End: time.Unix(2, 0),
+		Attributes: map[string]interface{}{"email.recipients": int64(2), "email.result": "ok"}}
+	span.TraceID[0], span.SpanID[0] = 1, 2
+	if err := newOTLPExporter(collector.URL + "/v1/traces").ExportSpans([]*Span{span}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-bodies:
+		for _, want := range []string{
+			"/v1/traces application/json ",
+			`"traceId":"01000000000000000000000000000000"`,
+			`"spanId":"0200000000000000"`,
+			`"name":"email.send"`,
+			`"startTimeUnixNano":"1000000000"`,
+			`{"key":"email.recipients","value":{"intValue":"2"}}`,
+			`"status":{"code":1}`,
+		} {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s is missing from %s", want, got)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no export")
+	}
+}
@@ -0,0 +1,179 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// has8Bit reports whether p has bytes outside of 7-bit ASCII.
+func has8Bit(p []byte) bool {
+	for _, b := range p {
+		if b >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// The transfer encodings of transfer_encoding.
+const (
+	encoding7Bit            = "7bit"
+	encoding8Bit            = "8bit"
+	encodingQuotedPrintable = "quoted-printable"
+	encodingBase64          = "base64"
+)
+
+// parseTransferEncoding checks the transfer_encoding, "" (the default) being
+// 8bit to the servers supporting 8BITMIME, quoted-printable to the others.
+func parseTransferEncoding(s string) (string, error) {
+	switch s = strings.ToLower(s); s {
+	case "", encoding7Bit, encodingQuotedPrintable, encodingBase64:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown transfer_encoding %q (should be 7bit, quoted-printable or base64)", s)
+}
+
+// transferEncode returns the email with its 8-bit text declared as such
+// ("Content-Transfer-Encoding: 8bit") or encoded as quoted-printable or base64,
+// per the encoding. The parts of multipart emails are encoded one by one,
+// and the entities having a Content-Transfer-Encoding already are kept as they are.
+func transferEncode(msg []byte, encoding string) []byte {
+	if !has8Bit(msg) {
+		return msg
+	}
+	i := bytes.Index(msg, []byte("\r\n\r\n"))
+	if i < 0 {
+		return msg
+	}
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(msg[:i+4]))).ReadMIMEHeader()
+	if err != nil {
+		return msg
+	}
+	extra, body := encodeEntity(header, msg[i+4:], encoding)
+	if extra == nil {
+		return msg
+	}
+	if len(extra) > 0 && header.Get("Mime-Version") == "" {
+		extra = append([]string{"MIME-Version: 1.0"}, extra...)
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(msg) + len(body) - i + 128)
+	buf.Write(msg[:i+2])
+	for _, h := range extra {
+		buf.WriteString(h + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// encodeEntity returns the headers to be added to the MIME entity
+// with the header, and its encoded body (see transferEncode).
+// It returns nil headers if the entity is to be kept as is.
+func encodeEntity(header textproto.MIMEHeader, body []byte, encoding string) ([]string, []byte) {
+	if header.Get("Content-Transfer-Encoding") != "" || !has8Bit(body) {
+		return nil, body
+	}
+	contentType := header.Get("Content-Type")
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if strings.HasPrefix(mediaType, "multipart/") {
+		encoded, err := encodeMultipart(body, params["boundary"], encoding)
+		if err != nil {
+			return nil, body
+		}
+		// a multipart entity may only be 7bit, 8bit or binary itself
+		if encoding == encoding8Bit {
+			return []string{"Content-Transfer-Encoding: 8bit"}, encoded
+		}
+		return []string{}, encoded
+	}
+	var extra []string
+	if contentType == "" {
+		extra = append(extra, "Content-Type: text/plain; charset=utf-8")
+	}
+	extra = append(extra, "Content-Transfer-Encoding: "+encoding)
+	var buf bytes.Buffer
+	switch encoding {
+	case encodingQuotedPrintable:
+		qw := quotedprintable.NewWriter(&buf)
+		qw.Write(body)
+		qw.Close()
+	case encodingBase64:
+		buf.WriteString(base64Lines(body))
+	default:
+		return extra, body
+	}
+	return extra, buf.Bytes()
+}
+
+// base64Lines returns the data base64 encoded, in lines of 76 characters
+// (RFC 2045 6.8) separated by CRLF.
+func base64Lines(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var buf strings.Builder
+	buf.Grow(len(encoded) + len(encoded)/38 + 2)
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded)
+	return buf.String()
+}
+
+// encodeMultipart returns the multipart body with its parts encoded by encodeEntity.
+func encodeMultipart(body []byte, boundary string, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	mw := multipart.NewWriter(&buf)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(p)
+		if err != nil {
+			return nil, err
+		}
+		extra, data := encodeEntity(p.Header, data, encoding)
+		for _, h := range extra {
+			if i := strings.IndexByte(h, ':'); i >= 0 {
+				p.Header.Set(h[:i], strings.TrimSpace(h[i+1:]))
+			}
+		}
+		w, err := mw.CreatePart(p.Header)
+		if err != nil {
+			return nil, err
+		}
+		w.Write(data)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
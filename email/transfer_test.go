@@ -0,0 +1,125 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func Test8BitMIME(t *testing.T) {
+	const payload = "Árvíztűrő tükörfúrógép leállt"
+	for _, tc := range []struct {
+		exts     []string
+		disable  bool
+		encoding string
+		cte      string
+	}{
+		{[]string{"8BITMIME"}, false, "", "8bit"},
+		{nil, false, "", "quoted-printable"},
+		{[]string{"8BITMIME"}, true, "", "quoted-printable"},
+		{[]string{"8BITMIME"}, false, "base64", "base64"},
+		{nil, false, "Quoted-Printable", "quoted-printable"},
+		{nil, false, "7bit", "quoted-printable"},
+		{[]string{"8BITMIME"}, false, "7bit", "quoted-printable"}, // not 8bit, even if supported
+	} {
+		srv := startFakeSMTP(t, tc.exts...)
+		o := new(EmailOutput)
+		conf := o.ConfigStruct().(*EmailOutputConfig)
+		conf.Address, conf.From, conf.To = srv.Addr(), "heka@example.com", []string{"ops@example.com"}
+		conf.Disable8BitMIME, conf.TransferEncoding = tc.disable, tc.encoding
+		if err := o.Init(conf); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.sendMail(o.formatMessage(newTestMessage(3, "db-01", payload)), envelope{}); err != nil {
+			t.Fatal(err)
+		}
+		msgs := srv.Messages()
+		if len(msgs) != 1 {
+			t.Fatalf("%s: got %d emails", tc.exts, len(msgs))
+		}
+		m, err := mail.ReadMessage(bytes.NewReader(msgs[0].Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the body only: the subject is sent as is
+		body, _ := ioutil.ReadAll(m.Body)
+		if has8Bit(body) != (tc.cte == "8bit" || tc.cte == "") {
+			t.Errorf("%s: 8-bit body %t with %q", tc.exts, has8Bit(body), tc.cte)
+		}
+		switch tc.cte {
+		case "quoted-printable":
+			body, _ = ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		case "base64":
+			body, _ = ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(body)))
+		}
+		if !strings.Contains(string(body), payload) {
+			t.Errorf("%s: the payload is lost from\n%s", tc.exts, msgs[0].Data)
+		}
+		if cte := m.Header.Get("Content-Transfer-Encoding"); cte != tc.cte {
+			t.Errorf("%s: got Content-Transfer-Encoding %q, wanted %q", tc.exts, cte, tc.cte)
+		}
+		if ct := m.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" && tc.cte != "" {
+			t.Errorf("%s: got Content-Type %q", tc.exts, ct)
+		}
+		// the Go client declares BODY=8BITMIME whenever the server supports it
+		if body := strings.Join(msgs[0].FromParams, " "); (body == "BODY=8BITMIME") != (len(tc.exts) > 0) {
+			t.Errorf("%s: got MAIL FROM parameters %q", tc.exts, body)
+		}
+	}
+}
+
+func TestTransferEncodeMultipart(t *testing.T) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, ct := range []string{"text/plain; charset=utf-8", "text/html; charset=utf-8"} {
+		w, _ := mw.CreatePart(map[string][]string{"Content-Type": {ct}})
+		w.Write([]byte("naïve café"))
+	}
+	mw.Close()
+	msg := []byte("Subject: test\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"" + mw.Boundary() + "\"\r\n\r\n" + buf.String())
+
+	encoded := transferEncode(msg, encodingQuotedPrintable)
+	if has8Bit(encoded) {
+		t.Fatalf("8-bit data left:\n%s", encoded)
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, _ := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	for i := 0; i < 2; i++ {
+		p, err := mr.NextPart() // decodes the quoted-printable
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := ioutil.ReadAll(p); string(b) != "naïve café" {
+			t.Errorf("%d. part is %q", i+1, b)
+		}
+	}
+	conf := &EmailOutputConfig{Address: "localhost", TransferEncoding: "binary"}
+	if err := new(EmailOutput).Init(conf); err == nil || !strings.Contains(err.Error(), "transfer_encoding") {
+		t.Errorf("got %v, wanted the transfer_encoding error", err)
+	}
+	if ascii := []byte("Subject: test\r\n\r\nbody"); !bytes.Equal(transferEncode(ascii, encodingBase64), ascii) {
+		t.Error("ASCII email changed")
+	}
+}
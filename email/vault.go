@@ -0,0 +1,150 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// vaultClient reads secrets through HashiCorp Vault's HTTP API.
+type vaultClient struct {
+	addr, token string
+	client      *http.Client
+}
+
+// vaultSecret is the response of Vault for a secret read or renewal.
+type vaultSecret struct {
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+	Auth          *struct {
+		LeaseDuration int  `json:"lease_duration"`
+		Renewable     bool `json:"renewable"`
+	} `json:"auth"`
+}
+
+// newVaultClient returns a client for the Vault at addr, authenticating with token.
+// The VAULT_ADDR and VAULT_TOKEN environment variables are used for the empty ones.
+func newVaultClient(addr, token string) (*vaultClient, error) {
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if addr == "" || token == "" {
+		return nil, errors.New("vault address or token is missing")
+	}
+	return &vaultClient{addr: strings.TrimSuffix(addr, "/"), token: token,
+		client: &http.Client{Timeout: DefaultTimeout}}, nil
+}
+
+// do calls the API at path, and decodes the response into a secret.
+func (vc *vaultClient) do(method, path string, body interface{}) (*vaultSecret, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, vc.addr+"/v1/"+strings.TrimPrefix(path, "/"), r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", vc.token)
+	resp, err := vc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("vault %s %s: %s %s", method, path, resp.Status, msg)
+	}
+	var secret vaultSecret
+	if err = json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("vault %s %s: %s", method, path, err)
+	}
+	return &secret, nil
+}
+
+// Read reads the secret at path.
+func (vc *vaultClient) Read(path string) (*vaultSecret, error) {
+	return vc.do("GET", path, nil)
+}
+
+// Credentials returns the username and password from the secret,
+// supporting both the KV version 1 and 2 secret engines.
+func (s *vaultSecret) Credentials() (username, password string, err error) {
+	data := s.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, hasMeta := data["metadata"]; hasMeta { // KV v2
+			data = inner
+		}
+	}
+	username, _ = data["username"].(string)
+	password, _ = data["password"].(string)
+	if username == "" {
+		return "", "", errors.New("no username in the vault secret")
+	}
+	return username, password, nil
+}
+
+// renewInterval returns when to renew a lease of the given seconds.
+func renewInterval(seconds int) time.Duration {
+	if seconds <= 0 {
+		return time.Hour
+	}
+	return time.Duration(seconds) * time.Second / 2
+}
+
+// KeepAlive renews the secret's lease (if renewable) and the token,
+// at the half of their durations, until done is closed, logging the failures with logError.
+func (vc *vaultClient) KeepAlive(secret *vaultSecret, done <-chan struct{}, logError func(error)) {
+	wait := renewInterval(secret.LeaseDuration)
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(wait):
+		}
+		wait = time.Hour
+		if secret.Renewable && secret.LeaseID != "" {
+			s, err := vc.do("PUT", "sys/leases/renew",
+				map[string]interface{}{"lease_id": secret.LeaseID})
+			if err != nil {
+				logError(fmt.Errorf("error renewing the vault lease %s: %s", secret.LeaseID, err))
+			} else if d := renewInterval(s.LeaseDuration); d < wait {
+				wait = d
+			}
+		}
+		s, err := vc.do("PUT", "auth/token/renew-self", nil)
+		if err != nil {
+			logError(fmt.Errorf("error renewing the vault token: %s", err))
+		} else if s.Auth != nil && s.Auth.Renewable {
+			if d := renewInterval(s.Auth.LeaseDuration); d < wait {
+				wait = d
+			}
+		}
+	}
+}
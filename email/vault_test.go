@@ -0,0 +1,91 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tgulacsi/heka-plugins/email/testutil"
+)
+
+func newMockVault(t *testing.T, renewals *int32) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/heka/smtp":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"lease_duration": 1,
+				"lease_id":       "secret/data/heka/smtp/abc",
+				"renewable":      true,
+				"data": map[string]interface{}{
+					"data":     map[string]interface{}{"username": "heka", "password": "s3cret"},
+					"metadata": map[string]interface{}{"version": 2},
+				},
+			})
+		case "/v1/sys/leases/renew", "/v1/auth/token/renew-self":
+			atomic.AddInt32(renewals, 1)
+			w.Write([]byte(`{"lease_duration":1,"auth":{"lease_duration":1,"renewable":true}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestVaultCredentials(t *testing.T) {
+	var renewals int32
+	vault := newMockVault(t, &renewals)
+	srv := testutil.NewFakeSMTP("AUTH PLAIN")
+	srv.Users = map[string]string{"heka": "s3cret"}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	conf := &EmailOutputConfig{Address: srv.Addr(), From: "heka@example.com", To: []string{"ops@example.com"},
+		VaultAddr: vault.URL, VaultToken: "s.token", VaultPath: "secret/data/heka/smtp", VaultRenew: true}
+	o := new(EmailOutput)
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Username != "heka" || conf.Password != "s3cret" {
+		t.Errorf("got credentials %q/%q", conf.Username, conf.Password)
+	}
+	if err := o.sendMail([]byte("Subject: test\r\n\r\nbody"), envelope{}); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := srv.Messages(); len(msgs) != 1 || msgs[0].User != "heka" {
+		t.Errorf("wanted a message sent by heka, got %+v", msgs)
+	}
+
+	done := make(chan struct{})
+	go o.vault.KeepAlive(o.vaultSecret, done, func(err error) { t.Error(err) })
+	time.Sleep(700 * time.Millisecond)
+	close(done)
+	if n := atomic.LoadInt32(&renewals); n != 2 { // the lease and the token
+		t.Errorf("got %d renewals, wanted 2", n)
+	}
+
+	conf.VaultToken = "bad"
+	if err := new(EmailOutput).Init(conf); err == nil {
+		t.Error("wanted error for a bad vault token")
+	}
+}
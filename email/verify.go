@@ -0,0 +1,187 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recipientVerifier verifies the recipient addresses with SMTP callouts
+// (RCPT to their MX hosts), caching the results.
+type recipientVerifier struct {
+	ttl      time.Duration // of the cached results
+	interval time.Duration // the minimal time between two callouts
+	// callout returns whether the address is accepted by its MX,
+	// err is set if it cannot be decided.
+	callout func(addr string) (bool, error)
+	// logger logs the failed callouts, if set
+	logger func(msg string)
+
+	mu     sync.Mutex
+	cache  map[string]verifiedAddr
+	nextAt time.Time // the earliest time of the next callout
+}
+
+type verifiedAddr struct {
+	valid   bool
+	expires time.Time
+}
+
+func newRecipientVerifier(ttl, interval time.Duration, callout func(string) (bool, error)) *recipientVerifier {
+	return &recipientVerifier{ttl: ttl, interval: interval, callout: callout,
+		cache: make(map[string]verifiedAddr)}
+}
+
+// Valid reports whether the address is not known to be invalid.
+// Addresses which cannot be verified are deemed valid, but not cached.
+func (v *recipientVerifier) Valid(addr string) bool {
+	key := strings.ToLower(addr)
+	v.mu.Lock()
+	if e, ok := v.cache[key]; ok && time.Now().Before(e.expires) {
+		v.mu.Unlock()
+		return e.valid
+	}
+	// rate limit the callouts, not to trip anti-abuse measures
+	wait := time.Until(v.nextAt)
+	if wait < 0 {
+		wait = 0
+	}
+	v.nextAt = time.Now().Add(wait + v.interval)
+	v.mu.Unlock()
+	time.Sleep(wait)
+
+	valid, err := v.callout(addr)
+	if err != nil {
+		v.logMessage(fmt.Sprintf("cannot verify %s: %s", addr, err))
+		return true
+	}
+	v.mu.Lock()
+	v.cache[key] = verifiedAddr{valid: valid, expires: time.Now().Add(v.ttl)}
+	v.mu.Unlock()
+	return valid
+}
+
+// Filter returns the addresses not known to be invalid.
+func (v *recipientVerifier) Filter(addrs []string) []string {
+	valid := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if v.Valid(addr) {
+			valid = append(valid, addr)
+		} else {
+			v.logMessage("skipping invalid recipient " + addr)
+		}
+	}
+	return valid
+}
+
+// logMessage logs via the logger, if any.
+func (v *recipientVerifier) logMessage(msg string) {
+	if v.logger != nil {
+		v.logger(msg)
+	}
+}
+
+// cachedMX are the MX records of a domain, looked up at fetched.
+type cachedMX struct {
+	mxs     []*net.MX
+	fetched time.Time
+}
+
+// mxLookup is a lookup in flight, done when done is closed.
+type mxLookup struct {
+	done chan struct{}
+	mxs  []*net.MX
+	err  error
+}
+
+// lookupMXCached returns the MX records of the domain, from the cache if
+// possible: the cache is shared, but the records older than the caller's ttl
+// (if positive) are expired for it. The expired records are looked up again,
+// the concurrent callers waiting for the same lookup; if it fails,
+// the expired records are used.
+func lookupMXCached(domain string, ttl time.Duration) ([]*net.MX, error) {
+	mxAddrsLock.Lock()
+	cached, ok := mxAddrs[domain]
+	if ok && (ttl <= 0 || time.Since(cached.fetched) < ttl) {
+		mxAddrsLock.Unlock()
+		return cached.mxs, nil
+	}
+	l := mxLookups[domain]
+	if l == nil {
+		l = &mxLookup{done: make(chan struct{})}
+		mxLookups[domain] = l
+		mxAddrsLock.Unlock()
+		l.mxs, l.err = lookupMX(domain)
+		mxAddrsLock.Lock()
+		delete(mxLookups, domain)
+		if l.err == nil {
+			mxAddrs[domain] = cachedMX{mxs: l.mxs, fetched: time.Now()}
+		}
+		close(l.done)
+	}
+	mxAddrsLock.Unlock()
+	<-l.done
+	if l.err != nil {
+		if ok {
+			return cached.mxs, nil
+		}
+		return nil, fmt.Errorf("error looking up MX record for %s: %s", domain, l.err)
+	}
+	return l.mxs, nil
+}
+
+// callout asks the MX hosts of the address' domain whether they accept it.
+// Permanent (5xx) rejections of RCPT make the address invalid.
+func (o *EmailOutput) callout(addr string) (bool, error) {
+	mxs, err := lookupMXCached(addr[strings.LastIndex(addr, "@")+1:], o.mxCacheTTL)
+	if err != nil {
+		return false, err
+	}
+	opts := smtpOptions{timeout: 10 * time.Second, tlsConfig: o.opts.tlsConfig, heloName: o.opts.heloName,
+		tlsPolicy: o.policyFor([]string{addr}), proxy: o.opts.proxy}
+	err = fmt.Errorf("no MX for %s", addr)
+	for _, mx := range mxs {
+		var valid bool
+		if valid, err = o.calloutMX(mxAddr(mx.Host), addr, opts); err == nil {
+			return valid, nil
+		}
+	}
+	return false, err
+}
+
+// calloutMX asks the server at mxAddr whether it accepts the address.
+func (o *EmailOutput) calloutMX(mxAddr, addr string, opts smtpOptions) (bool, error) {
+	totalConns.Acquire()
+	defer totalConns.Release()
+	c, _, err := dial(mxAddr, opts)
+	if err != nil {
+		return false, err
+	}
+	if err = mailFrom(c, o.From); err == nil {
+		err = rcptTo(c, addr)
+	}
+	if c.Quit() != nil {
+		c.Close()
+	}
+	if err == nil {
+		return true, nil
+	}
+	if tpErr, ok := err.(*textproto.Error); ok && tpErr.Code >= 500 {
+		return false, nil
+	}
+	return false, err
+}
@@ -0,0 +1,163 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package email
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVerifyRecipients(t *testing.T) {
+	mx := startFakeSMTP(t)
+	mx.Reply("RCPT TO:<BAD@", "550 no such user")
+	mx.Reply("RCPT TO:<BAD.", "550 no such user")
+	useFakeMX(t, "localhost.", mx.Port())
+	mxAddrsLock.Lock()
+	mxAddrs["example.com"] = cachedMX{mxs: []*net.MX{{Host: "localhost.", Pref: 10}}, fetched: time.Now()}
+	mxAddrsLock.Unlock()
+	relay := startFakeSMTP(t)
+
+	o := &EmailOutput{From: "heka@example.com", To: []string{"good@example.com", "bad@example.com"},
+		hostport: relay.Addr()}
+	o.verifier = newRecipientVerifier(time.Hour, time.Millisecond, o.callout)
+	for i := 0; i < 2; i++ {
+		if err := o.deliver([]byte("Subject: test\r\n\r\nbody"), envelope{}, 0); err != nil {
+			t.Fatalf("%d. %v", i, err)
+		}
+	}
+	msgs := relay.Messages()
+	if len(msgs) != 2 {
+		t.Fatalf("got %d emails, wanted 2", len(msgs))
+	}
+	for i, m := range msgs {
+		if strings.Join(m.To, ",") != "good@example.com" {
+			t.Errorf("%d. got recipients %v, wanted only the good one", i, m.To)
+		}
+	}
+	// the results are cached: one callout per address
+	var callouts int
+	for _, cmd := range mx.Commands() {
+		if strings.HasPrefix(cmd, "RCPT TO:") {
+			callouts++
+		}
+	}
+	if callouts != 2 {
+		t.Errorf("got %d callouts, wanted 2", callouts)
+	}
+	if len(mx.Messages()) != 0 {
+		t.Error("callout sent DATA")
+	}
+
+	// the rejected cc and bcc recipients get no RCPT either
+	o.Cc, o.Bcc = []string{"bad.cc@example.com"}, []string{"bad.bcc@example.com", "audit@example.com"}
+	if err := o.deliver([]byte("Subject: test\r\n\r\nbody"), envelope{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := relay.Messages(); len(msgs) != 3 || strings.Join(msgs[2].To, ",") != "good@example.com,audit@example.com" {
+		t.Errorf("got recipients %v, wanted the good and the audit ones", msgs[len(msgs)-1].To)
+	}
+}
+
+func TestVerifyRateLimit(t *testing.T) {
+	var calls int
+	v := newRecipientVerifier(time.Hour, 50*time.Millisecond, func(string) (bool, error) {
+		calls++
+		return true, nil
+	})
+	start := time.Now()
+	v.Filter([]string{"a@example.com", "b@example.com", "c@example.com", "a@example.com"})
+	if calls != 3 {
+		t.Errorf("got %d callouts, wanted 3", calls)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("3 callouts in %s, wanted them 50ms apart", elapsed)
+	}
+}
+
+func TestMXCacheTTL(t *testing.T) {
+	useFakeMX(t, "localhost.", "25")
+	var (
+		lookups int32
+		host    atomic.Value
+		fail    atomic.Value
+	)
+	host.Store("mx1.example.com.")
+	fail.Store(false)
+	release := make(chan struct{})
+	lookupMX = func(string) ([]*net.MX, error) {
+		atomic.AddInt32(&lookups, 1)
+		<-release
+		if fail.Load().(bool) {
+			return nil, errors.New("SERVFAIL")
+		}
+		return []*net.MX{{Host: host.Load().(string), Pref: 10}}, nil
+	}
+
+	// the concurrent callers share one lookup
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if mxs, err := lookupMXCached("example.com", time.Hour); err != nil || mxs[0].Host != "mx1.example.com." {
+				t.Errorf("got %v, %v", mxs, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&lookups); n != 1 {
+		t.Errorf("looked up %d times, wanted once", n)
+	}
+
+	// the expired records are looked up again
+	expire := func() {
+		mxAddrsLock.Lock()
+		c := mxAddrs["example.com"]
+		c.fetched = c.fetched.Add(-2 * time.Hour)
+		mxAddrs["example.com"] = c
+		mxAddrsLock.Unlock()
+	}
+	host.Store("mx2.example.com.")
+	if mxs, _ := lookupMXCached("example.com", time.Hour); mxs[0].Host != "mx1.example.com." {
+		t.Errorf("got %s before the expiry", mxs[0].Host)
+	}
+	// the records are expired for the output with a shorter TTL only
+	time.Sleep(2 * time.Millisecond)
+	if mxs, _ := lookupMXCached("example.com", time.Millisecond); mxs[0].Host != "mx2.example.com." {
+		t.Errorf("got %s after the shorter TTL, wanted the new MX", mxs[0].Host)
+	}
+	host.Store("mx3.example.com.")
+	if mxs, _ := lookupMXCached("example.com", time.Hour); mxs[0].Host != "mx2.example.com." {
+		t.Errorf("got %s, wanted the records refreshed for the shorter TTL", mxs[0].Host)
+	}
+	expire()
+	if mxs, _ := lookupMXCached("example.com", time.Hour); mxs[0].Host != "mx3.example.com." {
+		t.Errorf("got %s after the expiry, wanted the new MX", mxs[0].Host)
+	}
+
+	// the expired records are used if the lookup fails
+	expire()
+	fail.Store(true)
+	if mxs, err := lookupMXCached("example.com", time.Hour); err != nil || mxs[0].Host != "mx3.example.com." {
+		t.Errorf("got %v, %v, wanted the expired records", mxs, err)
+	}
+	if _, err := lookupMXCached("example.org", time.Hour); err == nil {
+		t.Error("wanted the lookup error without cached records")
+	}
+}
@@ -15,5 +15,6 @@ import (
 	_ "github.com/tgulacsi/heka-plugins/email"
 	_ "github.com/tgulacsi/heka-plugins/http"
 	_ "github.com/tgulacsi/heka-plugins/mantis"
+	_ "github.com/tgulacsi/heka-plugins/notify"
 	_ "github.com/tgulacsi/heka-plugins/twilio"
 )
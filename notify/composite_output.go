@@ -0,0 +1,244 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+// Package notify contains the CompositeNotifyOutput, routing the messages
+// to the other (email, SMS, ticket...) outputs.
+package notify
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CompositeNotifyOutput dispatches the messages by rules to other outputs
+// (the backends, e.g. an EmailOutput and a TwilioOutput), configured with a
+// message_matcher catching nothing ("FALSE"), so they get the routed messages only.
+// A backend not taking the messages (e.g. stopped) does not hold up the others.
+type CompositeNotifyOutput struct {
+	rules       []rule
+	defaults    []string
+	sendTimeout time.Duration
+
+	mu       sync.Mutex
+	stats    map[string]*backendStats
+	unrouted int64
+}
+
+// rule routes the messages with the field matching re to the backends.
+type rule struct {
+	field    string
+	re       *regexp.Regexp
+	backends []string
+}
+
+// backendStats are the counts of the messages given to and failed
+// to be given to a backend.
+type backendStats struct {
+	Sent, Failed int64
+}
+
+// CompositeNotifyOutputConfig is for reading the configuration file
+type CompositeNotifyOutputConfig struct {
+	// Rules are tried in order: the message goes to the backends
+	// of the first rule matching it.
+	Rules []RuleConfig `toml:"rules"`
+	// Default are the backends of the messages matching no rule.
+	// Those are dropped if empty.
+	Default []string `toml:"default"`
+	// SendTimeout is the time a backend has to take a message,
+	// before it is counted as failed for that backend, "5s" by default.
+	SendTimeout string `toml:"send_timeout"`
+}
+
+// RuleConfig is a routing rule.
+type RuleConfig struct {
+	// Field is the message attribute ("Type", "Logger", "Hostname",
+	// "Severity" or "Payload") or field the rule matches.
+	Field string `toml:"field"`
+	// Match is the regexp the value of the field has to match.
+	Match string `toml:"match"`
+	// Backends are the names of the outputs getting the matching messages.
+	Backends []string `toml:"backends"`
+}
+
+// ConfigStruct returns the struct for reading the configuration file
+func (o *CompositeNotifyOutput) ConfigStruct() interface{} {
+	return &CompositeNotifyOutputConfig{SendTimeout: "5s"}
+}
+
+// Init initializes the CompositeNotifyOutput instance from the config.
+func (o *CompositeNotifyOutput) Init(config interface{}) error {
+	conf := config.(*CompositeNotifyOutputConfig)
+	if len(conf.Rules) == 0 && len(conf.Default) == 0 {
+		return errors.New("rules or default is required")
+	}
+	o.rules = make([]rule, len(conf.Rules))
+	for i, rc := range conf.Rules {
+		if rc.Field == "" || len(rc.Backends) == 0 {
+			return fmt.Errorf("rule %d: field and backends are required", i+1)
+		}
+		re, err := regexp.Compile(rc.Match)
+		if err != nil {
+			return fmt.Errorf("rule %d: bad match %q: %s", i+1, rc.Match, err)
+		}
+		o.rules[i] = rule{field: rc.Field, re: re, backends: rc.Backends}
+	}
+	o.defaults = conf.Default
+	d, err := time.ParseDuration(conf.SendTimeout)
+	if err == nil && d <= 0 {
+		err = errors.New("not positive")
+	}
+	if err != nil {
+		return fmt.Errorf("bad send_timeout %q: %s", conf.SendTimeout, err)
+	}
+	o.sendTimeout = d
+	o.stats = make(map[string]*backendStats)
+	for _, name := range o.backendNames() {
+		o.stats[name] = new(backendStats)
+	}
+	return nil
+}
+
+// backendNames returns the names of all the backends, sorted.
+func (o *CompositeNotifyOutput) backendNames() []string {
+	seen := make(map[string]bool)
+	for _, r := range o.rules {
+		for _, name := range r.backends {
+			seen[name] = true
+		}
+	}
+	for _, name := range o.defaults {
+		seen[name] = true
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run dispatches each message to the backends of its route.
+func (o *CompositeNotifyOutput) Run(runner pipeline.OutputRunner, helper pipeline.PluginHelper) error {
+	backends := make(map[string]pipeline.OutputRunner, len(o.stats))
+	for name := range o.stats {
+		out, ok := helper.Output(name)
+		if !ok {
+			return fmt.Errorf("unknown backend %q", name)
+		}
+		backends[name] = out
+	}
+	for pack := range runner.InChan() {
+		names := o.route(pack.Message)
+		if len(names) == 0 {
+			atomic.AddInt64(&o.unrouted, 1)
+		}
+		for _, name := range names {
+			if err := o.dispatch(backends[name], pack); err != nil {
+				runner.LogError(fmt.Errorf("%s: %s", name, err))
+				o.count(name, false)
+				continue
+			}
+			o.count(name, true)
+		}
+		pack.Recycle()
+	}
+	return nil
+}
+
+// route returns the backends of the message.
+func (o *CompositeNotifyOutput) route(msg *message.Message) []string {
+	for _, r := range o.rules {
+		if v, ok := fieldValue(msg, r.field); ok && r.re.MatchString(v) {
+			return r.backends
+		}
+	}
+	return o.defaults
+}
+
+// dispatch gives the pack to the backend, with an extra reference recycled
+// by it, or returns an error if it does not take the pack in send_timeout.
+func (o *CompositeNotifyOutput) dispatch(out pipeline.OutputRunner, pack *pipeline.PipelinePack) error {
+	atomic.AddInt32(&pack.RefCount, 1)
+	timer := time.NewTimer(o.sendTimeout)
+	defer timer.Stop()
+	select {
+	case out.InChan() <- pack:
+		return nil
+	case <-timer.C:
+		pack.Recycle()
+		return fmt.Errorf("message not taken in %s", o.sendTimeout)
+	}
+}
+
+func (o *CompositeNotifyOutput) count(name string, sent bool) {
+	o.mu.Lock()
+	if sent {
+		o.stats[name].Sent++
+	} else {
+		o.stats[name].Failed++
+	}
+	o.mu.Unlock()
+}
+
+// fieldValue returns the value of the message attribute or field.
+func fieldValue(msg *message.Message, field string) (string, bool) {
+	switch field {
+	case "Type":
+		return msg.GetType(), true
+	case "Logger":
+		return msg.GetLogger(), true
+	case "Hostname":
+		return msg.GetHostname(), true
+	case "Severity":
+		return strconv.Itoa(int(msg.GetSeverity())), true
+	case "Payload":
+		return msg.GetPayload(), true
+	}
+	v, ok := msg.GetFieldValue(field)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprint(v), true
+}
+
+// ReportMsg adds the counts of the messages sent to and failed per backend,
+// and of those matching no route to the report.
+func (o *CompositeNotifyOutput) ReportMsg(msg *message.Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for name, stats := range o.stats {
+		addField(msg, "Backend."+name+".Sent", stats.Sent, "count")
+		addField(msg, "Backend."+name+".Failed", stats.Failed, "count")
+	}
+	addField(msg, "Unrouted", atomic.LoadInt64(&o.unrouted), "count")
+	return nil
+}
+
+// addField adds the field to the message, if it is valid.
+func addField(msg *message.Message, name string, value interface{}, representation string) {
+	if f, err := message.NewField(name, value, representation); err == nil {
+		msg.AddField(f)
+	}
+}
+
+func init() {
+	pipeline.RegisterPlugin("CompositeNotifyOutput", func() interface{} { return new(CompositeNotifyOutput) })
+}
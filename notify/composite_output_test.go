@@ -0,0 +1,141 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is Tamás Gulácsi.
+# Portions created by the Initial Developer are Copyright (C) 2013
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package notify
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// testRunner is the runner of the composite and of its backends.
+type testRunner struct {
+	pipeline.OutputRunner
+	inChan chan *pipeline.PipelinePack
+
+	mu     sync.Mutex
+	errors []error
+}
+
+func (r *testRunner) InChan() chan *pipeline.PipelinePack { return r.inChan }
+
+func (r *testRunner) LogError(err error) {
+	r.mu.Lock()
+	r.errors = append(r.errors, err)
+	r.mu.Unlock()
+}
+
+// testHelper returns the backends by name.
+type testHelper struct {
+	pipeline.PluginHelper
+	outputs map[string]*testRunner
+}
+
+func (h testHelper) Output(name string) (pipeline.OutputRunner, bool) {
+	out, ok := h.outputs[name]
+	return out, ok
+}
+
+func newTestMessage(severity int32, logger, payload string) *message.Message {
+	msg := new(message.Message)
+	msg.SetSeverity(severity)
+	msg.SetLogger(logger)
+	msg.SetPayload(payload)
+	return msg
+}
+
+func TestCompositeNotifyOutput(t *testing.T) {
+	o := new(CompositeNotifyOutput)
+	conf := o.ConfigStruct().(*CompositeNotifyOutputConfig)
+	conf.Rules = []RuleConfig{
+		{Field: "Severity", Match: "^[0-2]$", Backends: []string{"email", "sms"}},
+		{Field: "team", Match: "^dba$", Backends: []string{"ticket"}},
+	}
+	conf.Default = []string{"email"}
+	conf.SendTimeout = "50ms"
+	if err := o.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	// sms is stuck: it does not take any message
+	outputs := map[string]*testRunner{
+		"email":  {inChan: make(chan *pipeline.PipelinePack, 10)},
+		"sms":    {inChan: make(chan *pipeline.PipelinePack)},
+		"ticket": {inChan: make(chan *pipeline.PipelinePack, 10)},
+	}
+	runner := &testRunner{inChan: make(chan *pipeline.PipelinePack, 10)}
+	recycled := make(chan *pipeline.PipelinePack, 10)
+	for _, msg := range []*message.Message{
+		newTestMessage(2, "db", "the database is down"),
+		newTestMessage(4, "db", "slow queries"),
+		newTestMessage(6, "web", "deployed"),
+	} {
+		if msg.GetPayload() == "slow queries" {
+			f, _ := message.NewField("team", "dba", "")
+			msg.AddField(f)
+		}
+		pack := pipeline.NewPipelinePack(recycled)
+		pack.Message = msg
+		runner.inChan <- pack
+	}
+	close(runner.inChan)
+	if err := o.Run(runner, testHelper{outputs: outputs}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string][]string)
+	for name, out := range outputs {
+		close(out.inChan)
+		for pack := range out.inChan {
+			got[name] = append(got[name], pack.Message.GetPayload())
+			pack.Recycle()
+		}
+	}
+	for name, want := range map[string]string{
+		"email":  "the database is down,deployed",
+		"sms":    "",
+		"ticket": "slow queries",
+	} {
+		if s := strings.Join(got[name], ","); s != want {
+			t.Errorf("%s got %q, wanted %q", name, s, want)
+		}
+	}
+	if len(runner.errors) != 1 || !strings.HasPrefix(runner.errors[0].Error(), "sms: ") {
+		t.Errorf("got errors %v, wanted the one of sms", runner.errors)
+	}
+	if len(recycled) != 3 {
+		t.Errorf("%d packs recycled, wanted all 3", len(recycled))
+	}
+
+	msg := new(message.Message)
+	o.ReportMsg(msg)
+	for field, want := range map[string]int64{
+		"Backend.email.Sent": 2, "Backend.sms.Failed": 1, "Backend.ticket.Sent": 1, "Unrouted": 0,
+	} {
+		if v, _ := msg.GetFieldValue(field); v != want {
+			t.Errorf("%s is %v, wanted %d", field, v, want)
+		}
+	}
+
+	runner = &testRunner{inChan: make(chan *pipeline.PipelinePack)}
+	delete(outputs, "ticket")
+	if err := o.Run(runner, testHelper{outputs: outputs}); err == nil || !strings.Contains(err.Error(), "ticket") {
+		t.Errorf("got %v, wanted error for the unknown backend", err)
+	}
+	conf.Rules[0].Match = "("
+	if err := o.Init(conf); err == nil {
+		t.Error("wanted error for the bad regexp")
+	}
+}